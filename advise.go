@@ -0,0 +1,93 @@
+package logdb
+
+// An AccessPattern describes how the entries of a database are going to be read, so that the operating system
+// can manage its page cache to suit.
+type AccessPattern int
+
+const (
+	// AccessNormal means there is no particular pattern. This is the default.
+	AccessNormal AccessPattern = iota
+
+	// AccessSequential means entries will be read in order, so the operating system may read ahead
+	// aggressively and drop pages soon after they are read.
+	AccessSequential
+
+	// AccessRandom means entries will be read in no particular order, so reading ahead is wasteful.
+	AccessRandom
+)
+
+// Advise tells the operating system how the database is going to be read. See the 'LockFreeChunkDB' method for
+// details.
+func (db *ChunkDB) Advise(pattern AccessPattern) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.Advise(pattern)
+}
+
+// Advise tells the operating system how the database is going to be read, with 'madvise'. The advice applies to
+// every chunk, including chunks created or mapped again later, until it is changed. 'Scan', and the other ways of
+// visiting every entry, and 'Iterator' advise each chunk to be read sequentially while they read it, and then give
+// it this access pattern again.
+//
+// This is only a hint, and only has an effect for an 'OSFileSystem' on platforms which have 'madvise'.
+// Elsewhere it does nothing.
+func (db *LockFreeChunkDB) Advise(pattern AccessPattern) error {
+	if db.closed {
+		return ErrClosed
+	}
+
+	if db.maxMappedChunks > 0 {
+		db.mapLock.Lock()
+		defer db.mapLock.Unlock()
+	}
+
+	db.accessPattern = pattern
+	for _, c := range db.chunks {
+		if err := db.advise(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Advise that the memory-mapped bytes of a chunk, as given by 'withChunkBytes', are about to be read in order, and
+// return a function which gives them the access pattern of the database again. This is only a hint, so errors
+// are ignored. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) adviseSequential(bytes []byte) func() {
+	if db.backend == BackendFile || db.accessPattern == AccessSequential || bytes == nil || !isOSFileSystem(db.fs) {
+		return func() {}
+	}
+	_ = madvise(bytes, AccessSequential)
+	return func() { _ = madvise(bytes, db.accessPattern) }
+}
+
+// Give a chunk the given access pattern advice, if it is still part of the database and is mapped. This is only
+// a hint, so errors are ignored. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) adviseChunk(c *chunk, pattern AccessPattern) {
+	if db.closed || db.backend == BackendFile || db.accessPattern == AccessSequential || len(c.ends) == 0 || !isOSFileSystem(db.fs) {
+		return
+	}
+	if cur, err := db.chunkFor(c.next() - 1); err != nil || cur != c {
+		return
+	}
+	if db.maxMappedChunks > 0 {
+		db.mapLock.Lock()
+		defer db.mapLock.Unlock()
+	}
+	if c.bytes != nil {
+		_ = madvise(c.bytes, pattern)
+	}
+}
+
+// Give the current access pattern advice for a chunk, if it is mapped. Assumes 'mapLock' is held if the number
+// of mapped chunks is limited.
+func (db *LockFreeChunkDB) advise(c *chunk) error {
+	if !isOSFileSystem(db.fs) || c.bytes == nil {
+		return nil
+	}
+	if err := madvise(c.bytes, db.accessPattern); err != nil {
+		return &ReadError{err}
+	}
+	return nil
+}
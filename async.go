@@ -0,0 +1,117 @@
+package logdb
+
+import "sync"
+
+// AsyncAppender starts a goroutine which appends the entries sent on the returned entry channel, which can hold
+// 'buffer' entries before sends block. Whatever entries are waiting when the goroutine takes the write lock are
+// appended together with 'AppendEntries', so under load the cost of locking is shared between many entries.
+//
+// Entries are appended in the order they are sent. The database owns an entry once it has been sent, so the
+// slice must not be changed afterwards.
+//
+// Errors are sent on the returned error channel, which can hold 'buffer' errors (or one, if 'buffer' is less
+// than one). If it is full, further errors are dropped rather than blocking appends. If appending a group of
+// entries fails, every entry of the group is lost, as with 'AppendEntries', except that an entry larger than
+// the 'MaxEntrySize' of the database is left out of its group, with an 'ErrTooBig' error.
+//
+// The returned stop function appends every entry sent before it was called, syncs the database, and then closes
+// the error channel. It returns the first error of the goroutine, or of the sync. Nothing may be sent on the
+// entry channel once stop has been called. Calling stop again does nothing but return the same error.
+func (db *ChunkDB) AsyncAppender(buffer int) (chan<- []byte, <-chan error, func() error) {
+	if buffer < 0 {
+		buffer = 0
+	}
+	errBuffer := buffer
+	if errBuffer < 1 {
+		errBuffer = 1
+	}
+
+	a := &asyncAppender{
+		db:      db,
+		entries: make(chan []byte, buffer),
+		errs:    make(chan error, errBuffer),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+
+	return a.entries, a.errs, a.stop
+}
+
+// The state of an 'AsyncAppender' goroutine.
+type asyncAppender struct {
+	db *ChunkDB
+
+	entries chan []byte
+	errs    chan error
+	done    chan struct{}
+
+	// The first error, which is returned by 'stop'. Only written by the goroutine.
+	err error
+
+	stopOnce sync.Once
+}
+
+// Append entries until the entry channel is closed.
+func (a *asyncAppender) run() {
+	defer close(a.done)
+
+	for entry := range a.entries {
+		group := a.add(nil, entry)
+
+		// Take every entry which is already waiting, up to the batch limit.
+		size := uint64(len(entry))
+	coalesce:
+		for size < maxBatchBytes {
+			select {
+			case entry, ok := <-a.entries:
+				if !ok {
+					break coalesce
+				}
+				group = a.add(group, entry)
+				size += uint64(len(entry))
+			default:
+				break coalesce
+			}
+		}
+
+		if len(group) > 0 {
+			if _, err := a.db.AppendEntries(group); err != nil {
+				a.report(err)
+			}
+		}
+	}
+}
+
+// Add an entry to a group, or report it as too big.
+func (a *asyncAppender) add(group [][]byte, entry []byte) [][]byte {
+	if uint64(len(entry)) > a.db.MaxEntrySize() {
+		a.report(ErrTooBig)
+		return group
+	}
+	return append(group, entry)
+}
+
+// Send an error on the error channel, if there is room, and remember it if it is the first.
+func (a *asyncAppender) report(err error) {
+	if a.err == nil {
+		a.err = err
+	}
+	select {
+	case a.errs <- err:
+	default:
+	}
+}
+
+// Stop the goroutine, once every entry has been appended, and sync.
+func (a *asyncAppender) stop() error {
+	a.stopOnce.Do(func() {
+		close(a.entries)
+		<-a.done
+
+		if err := a.db.Sync(); err != nil {
+			a.report(err)
+		}
+		close(a.errs)
+	})
+	return a.err
+}
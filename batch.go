@@ -0,0 +1,71 @@
+package logdb
+
+// The maximum number of bytes a 'Batch' will buffer before it must be committed.
+const maxBatchBytes = 64 * 1024 * 1024
+
+// A Batch accumulates entries to be appended to a database atomically, with 'Commit', or abandoned, with
+// 'Discard'. Batches are created with 'NewBatch'.
+//
+// A batch is not safe for concurrent use, even if the database it was created from is.
+type Batch struct {
+	db BoundedDB
+
+	entries [][]byte
+	size    uint64
+}
+
+// NewBatch creates a new, empty, batch of entries to append to the database. Committing the batch takes the
+// write lock.
+func (db *ChunkDB) NewBatch() *Batch {
+	return &Batch{db: db}
+}
+
+// NewBatch creates a new, empty, batch of entries to append to the database.
+func (db *LockFreeChunkDB) NewBatch() *Batch {
+	return &Batch{db: db}
+}
+
+// Append adds an entry to the batch. The entry is copied, so the slice may be reused after this returns.
+//
+// Returns 'ErrTooBig' if the entry is larger than the 'MaxEntrySize' of the database, and 'ErrBatchFull' if the
+// batch cannot buffer any more bytes. In either case the batch is unchanged.
+func (b *Batch) Append(entry []byte) error {
+	if uint64(len(entry)) > b.db.MaxEntrySize() {
+		return ErrTooBig
+	}
+	if b.size+uint64(len(entry)) > maxBatchBytes {
+		return ErrBatchFull
+	}
+
+	b.entries = append(b.entries, append([]byte(nil), entry...))
+	b.size += uint64(len(entry))
+	return nil
+}
+
+// Len returns the number of entries in the batch.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Commit atomically appends all the entries in the batch to the database, with 'AppendEntries', and returns
+// the ID of the first. The batch is then empty, and can be reused.
+//
+// Returns the same errors as 'AppendEntries'. If the entries were not appended, 0 is returned with the error and
+// the batch is unchanged, so the commit can be retried. If they were appended but something afterwards failed,
+// such as a periodic sync, the ID of the first is returned with the error and the batch is emptied, as
+// committing it again would append the entries twice.
+func (b *Batch) Commit() (uint64, error) {
+	id, err := b.db.AppendEntries(b.entries)
+	if err != nil && id == 0 {
+		return 0, err
+	}
+
+	b.Discard()
+	return id, err
+}
+
+// Discard drops all the entries in the batch without appending them. The batch can then be reused.
+func (b *Batch) Discard() {
+	b.entries = nil
+	b.size = 0
+}
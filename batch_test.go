@@ -0,0 +1,154 @@
+package logdb
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch_Commit(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "batch_commit", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, 10)
+
+	b := db.NewBatch()
+	entry := make([]byte, 8)
+	for i := 0; i < numEntries; i++ {
+		// Reuse the same slice: the batch must copy it.
+		entry[0] = byte(i)
+		if err := b.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+		vs = append(vs, append([]byte(nil), entry...))
+	}
+	assert.Equal(t, numEntries, b.Len())
+	assert.Equal(t, uint64(10), db.NewestID(), "expected batch not to be appended before commit")
+
+	id, err := b.Commit()
+	assert.Nil(t, err, "failed to commit batch: %s", err)
+	assert.Equal(t, uint64(11), id)
+	assert.Equal(t, 0, b.Len(), "expected batch to be empty after commit")
+
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+}
+
+func TestBatch_Discard(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "batch_discard", chunkSize).(*LockFreeChunkDB)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, 10)
+
+	b := db.NewBatch()
+	for i := 0; i < 5; i++ {
+		if err := b.Append([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Discard()
+	assert.Equal(t, 0, b.Len())
+
+	// The batch is reusable after a discard.
+	if err := b.Append([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	id, err := b.Commit()
+	assert.Nil(t, err, "failed to commit batch: %s", err)
+	assert.Equal(t, uint64(len(vs)+1), id)
+	assert.Equal(t, uint64(len(vs)+1), db.NewestID())
+	assert.Equal(t, []byte("hello"), assertGet(t, db, id))
+}
+
+func TestBatch_NoAppendTooBig(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "batch_too_big", chunkSize).(*LockFreeChunkDB)
+	defer assertClose(t, db)
+
+	b := db.NewBatch()
+	assert.Equal(t, ErrTooBig, b.Append(make([]byte, chunkSize+1)))
+	assert.Equal(t, 0, b.Len())
+
+	entry := make([]byte, chunkSize)
+	for i := 0; i < maxBatchBytes/chunkSize; i++ {
+		if err := b.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full := b.Len()
+	assert.Equal(t, ErrBatchFull, b.Append(entry))
+	assert.Equal(t, full, b.Len())
+}
+
+func TestBatch_CommitFaultRollsBack(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := assertOpenOptions(t, true, "batch_commit_fault", chunkSize, WithFileSystem(fs))
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, 10)
+
+	b := db.NewBatch()
+	for i := 0; i < 20; i++ {
+		if err := b.Append(make([]byte, chunkSize/4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fail the creation of the next chunk file: the batch will need a new chunk part way through.
+	fs.failCreate = func(name string) error {
+		if isBasenameChunkDataFile(filepath.Base(name)) {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+
+	_, err := b.Commit()
+	assert.True(t, errwrap.ContainsType(err, new(WriteError)), "expected write error, got: %s", err)
+	assert.Equal(t, uint64(len(vs)), db.NewestID(), "expected commit to be rolled back")
+	assert.Equal(t, 20, b.Len(), "expected batch to be unchanged after failed commit")
+
+	// Once the fault clears, the same batch commits.
+	fs.failCreate = nil
+	id, err := b.Commit()
+	assert.Nil(t, err, "failed to commit batch: %s", err)
+	assert.Equal(t, uint64(len(vs)+1), id)
+	assert.Equal(t, uint64(len(vs)+20), db.NewestID())
+}
+
+func TestBatch_CommitSyncFault(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := assertOpenOptions(t, true, "batch_commit_sync_fault", chunkSize, WithFileSystem(fs))
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, 10)
+	assertSetSync(t, db, 0)
+
+	b := db.NewBatch()
+	for i := 0; i < 2; i++ {
+		if err := b.Append([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fail the sync after the append: the entries are in the log, so the batch must not be committed again.
+	fs.failRename = func(oldpath, newpath string) error {
+		if filepath.Base(oldpath) == syncMetaFile {
+			return syscall.EIO
+		}
+		return nil
+	}
+
+	id, err := b.Commit()
+	assert.True(t, errwrap.ContainsType(err, new(SyncError)), "expected sync error, got: %s", err)
+	assert.Equal(t, uint64(len(vs)+1), id)
+	assert.Equal(t, 0, b.Len(), "expected batch to be emptied after the entries were appended")
+
+	fs.failRename = nil
+	_, err = b.Commit()
+	assert.Nil(t, err, "failed to commit empty batch: %s", err)
+	assert.Equal(t, uint64(len(vs)+2), db.NewestID())
+}
@@ -0,0 +1,123 @@
+package logdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A cache of recently-read entries, with the least recently used entry evicted when it is full. A nil cache
+// holds nothing, so every method can be called whether or not the 'WithReadCache' option was given.
+//
+// Readers share the database lock, so the cache has a lock of its own.
+type readCache struct {
+	lock sync.Mutex
+
+	// The maximum number of entries.
+	max int
+
+	// The cached entries, most recently used first, and the element of each by ID.
+	order   *list.List
+	entries map[uint64]*list.Element
+
+	// The number of lookups which found the entry, and which didn't.
+	hits   uint64
+	misses uint64
+}
+
+// An entry in the cache.
+type cachedEntry struct {
+	id    uint64
+	entry []byte
+}
+
+// Make a cache which holds up to 'max' entries, or nil if 'max' is not positive.
+func newReadCache(max int) *readCache {
+	if max <= 0 {
+		return nil
+	}
+	return &readCache{
+		max:     max,
+		order:   list.New(),
+		entries: make(map[uint64]*list.Element),
+	}
+}
+
+// Get a copy of an entry, if it is cached.
+func (rc *readCache) get(id uint64) ([]byte, bool) {
+	if rc == nil {
+		return nil, false
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	el, ok := rc.entries[id]
+	if !ok {
+		rc.misses++
+		return nil, false
+	}
+	rc.hits++
+	rc.order.MoveToFront(el)
+	entry := el.Value.(*cachedEntry).entry
+	out := make([]byte, len(entry))
+	copy(out, entry)
+	return out, true
+}
+
+// Add a copy of an entry, evicting the least recently used entry if the cache is full.
+func (rc *readCache) add(id uint64, entry []byte) {
+	if rc == nil {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if el, ok := rc.entries[id]; ok {
+		rc.order.MoveToFront(el)
+		return
+	}
+	if rc.order.Len() >= rc.max {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cachedEntry).id)
+	}
+	rc.entries[id] = rc.order.PushFront(&cachedEntry{id: id, entry: append([]byte(nil), entry...)})
+}
+
+// Remove the entries with IDs in the range ['from', 'to').
+func (rc *readCache) remove(from, to uint64) {
+	if rc == nil {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	for id, el := range rc.entries {
+		if id >= from && id < to {
+			rc.order.Remove(el)
+			delete(rc.entries, id)
+		}
+	}
+}
+
+// Remove every entry.
+func (rc *readCache) clear() {
+	if rc == nil {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	rc.order.Init()
+	rc.entries = make(map[uint64]*list.Element)
+}
+
+// Get the number of hits and misses, and the number of entries.
+func (rc *readCache) stats() (uint64, uint64, int) {
+	if rc == nil {
+		return 0, 0, 0
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	return rc.hits, rc.misses, rc.order.Len()
+}
@@ -1,11 +1,14 @@
 package logdb
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -17,22 +20,78 @@ const (
 	sep              = "_"
 	initialChunkFile = chunkPrefix + sep + "0" + sep + "1"
 	initialMetaFile  = initialChunkFile + sep + metaSuffix
+
+	// The temporary file used while rewriting the metadata of a chunk. This is not a valid chunk filename,
+	// so it is ignored, and deleted, when the database is opened.
+	syncMetaFile = "syncing" + sep + metaSuffix
+)
+
+// The start of a checksummed chunk metadata file, and the sizes of its parts.
+const (
+	metaMagic        = uint32(0x6174656d) // "meta"
+	metaHeaderSize   = 10
+	metaRecordSize   = 12
+	metaChecksumSize = 4
 )
 
-// A chunk is one memory-mapped file.
+// The checksum of chunk metadata files.
+var metaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A chunk is one memory-mapped file, or with the file backend one file which is read and written directly.
 type chunk struct {
+	// The filesystem the chunk files live in.
+	fs FileSystem
+
+	// How the data file is accessed. With the file backend, the 'bytes' slice is always nil, and the data is
+	// read and written through the 'mmapf' file instead.
+	backend Backend
+
 	// Path to the data file. The metadata file name and oldest entry ID are derived from this.
 	path string
 
 	// The memory-mapped data file. The 'bytes' slice is produced by mmaping the fd in the 'mmapf' file,
 	// meaning that it can be fsynced easily.
 	bytes []byte
-	mmapf *os.File
+	mmapf File
+
+	// When the chunk was last read, if the number of memory-mapped chunks is limited. The 'bytes' slice is
+	// nil if the chunk is not currently mapped.
+	lastUsed uint64
+
+	// Whether the 'bytes' slice is locked into memory, by the 'WithMlockNewest' option.
+	locked bool
+
+	// The checksum of the chunk for 'Manifest', if it has been computed since the chunk last changed. Only chunks
+	// which are no longer appended to have one.
+	digest []byte
+
+	// Whether the data file has been cut off after the final entry, by the 'WithTrimTail' option. If so,
+	// the 'bytes' slice only covers the entries.
+	trimmed bool
+
+	// Whether the metadata was rebuilt from the frames in the data file, as it was missing or damaged, and so
+	// needs to be written out.
+	rebuilt bool
 
 	// One past the ending addresses of entries in the 'bytes' slice. This means that entries are contained
 	// in the segment 'bytes[prior end:end]', with the 'prior end' for the first entry being 0.
 	ends []int32
 
+	// The time each entry was appended, in nanoseconds since the Unix epoch. This is parallel to 'ends' if
+	// the disk format version stores timestamps, and nil otherwise.
+	stamps []uint64
+
+	// The disk format version, which determines the metadata format.
+	version uint16
+
+	// The alignment of the database, which each entry after the first starts at the next multiple of, after
+	// the end of the entry before. This is 0 or 1 if entries are not padded.
+	align int32
+
+	// The chunk size when the chunk was created, which is the size of the data file unless it has been
+	// trimmed. This differs from the chunk size of the database if that has since been changed.
+	size uint32
+
 	// ID of the oldest entry in the chunk. This can be determined from the filename, but it's cheaper to
 	// store it here.
 	oldest uint64
@@ -48,12 +107,197 @@ func (c *chunk) next() uint64 {
 	return c.oldest + uint64(len(c.ends))
 }
 
+// Discard all but the first 'n' entries of a chunk.
+func (c *chunk) truncateEntries(n int) {
+	c.digest = nil
+	c.ends = c.ends[0:n]
+	if versionHasTimestamps(c.version) {
+		c.stamps = c.stamps[0:n]
+	}
+}
+
+// Check if a disk format version stores entry timestamps.
+func versionHasTimestamps(version uint16) bool {
+	return version >= 1
+}
+
+// Check if a disk format version stores chunk metadata with a header and checksum.
+func versionHasMetaChecksums(version uint16) bool {
+	return version >= 2
+}
+
+// Check if a disk format version frames each entry in a chunk data file with its length, so that the metadata
+// can be rebuilt from the data.
+func versionHasFraming(version uint16) bool {
+	return version >= 3
+}
+
+// Get the frame header for an entry of the given size: the size plus one, as a uvarint. As the header is never
+// zero, a zero byte, as in the unwritten part of a chunk data file, marks the end of the entries.
+func frameHeader(size int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(size)+1)
+	return buf[:n]
+}
+
+// Get the size of the frame header before an entry of the given size, which is 0 if the disk format version
+// doesn't have framing.
+func frameHeaderSize(version uint16, size int) int {
+	if !versionHasFraming(version) {
+		return 0
+	}
+	return len(frameHeader(size))
+}
+
+// Get the offsets in the data file of the first byte of an entry and one past the last, given its index in the
+// chunk. Frame headers are not included.
+func (c *chunk) entryRange(off uint64) (int32, int32) {
+	start := int32(0)
+	if off > 0 {
+		start = alignUp(c.ends[off-1], c.align)
+	}
+	end := c.ends[off]
+
+	// A larger entry never has a smaller header, so only one header size fits the frame.
+	if versionHasFraming(c.version) {
+		frame := int(end - start)
+		for n := 1; n <= frame; n++ {
+			if frameHeaderSize(c.version, frame-n) == n {
+				start += int32(n)
+				break
+			}
+		}
+	}
+	return start, end
+}
+
+// Round an offset up to a multiple of the alignment, which is a power of two, or 0 or 1 for no alignment.
+func alignUp(off, align int32) int32 {
+	if align <= 1 {
+		return off
+	}
+	return (off + align - 1) &^ (align - 1)
+}
+
+// Find the ends of the frames in the data of a chunk with framing. The frames stop at a zero byte, or at a header
+// which is malformed or describes an entry running past the end of the data.
+func scanFrames(data []byte) []int32 {
+	var ends []int32
+	pos := 0
+	for pos < len(data) && data[pos] != 0 {
+		size, n := binary.Uvarint(data[pos:])
+		if n <= 0 || size-1 > uint64(len(data)-pos-n) {
+			break
+		}
+		pos += n + int(size-1)
+		ends = append(ends, int32(pos))
+	}
+	return ends
+}
+
+// Rebuild the metadata of a chunk with framing from its data file. The timestamps of the entries are lost, so
+// they are all 0.
+func rebuildMetadata(fs FileSystem, dataFilePath string) ([]int32, []uint64, error) {
+	file, err := fs.OpenFile(dataFilePath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	ends := scanFrames(data)
+	return ends, make([]uint64, len(ends)), nil
+}
+
 // Delete the files associated with a chunk.
 func (c *chunk) closeAndRemove() error {
-	if err := closeAndRemove(c.mmapf); err != nil {
+	if err := closeAndRemove(c.fs, c.mmapf, c.bytes); err != nil {
 		return err
 	}
-	return os.Remove(c.metaFilePath())
+	return c.fs.Remove(c.metaFilePath())
+}
+
+// Unmap and close the data file associated with a chunk.
+func (c *chunk) close() error {
+	return munmapAndClose(c.fs, c.mmapf, c.bytes)
+}
+
+// Memory-map the data file of a chunk which has been unmapped.
+func (c *chunk) remap(chunkSize uint32) error {
+	bytes, err := c.fs.Mmap(c.mmapf, int(chunkSize))
+	if err != nil {
+		return err
+	}
+	c.bytes = bytes
+	return nil
+}
+
+// Change the size of the data file of a chunk, and map it again at the new size. If the size can't be changed, or
+// the data file can't be mapped at the new size, the chunk is left mapped at the old size.
+func (c *chunk) resize(size uint32) error {
+	if c.backend == BackendFile {
+		return c.mmapf.Truncate(int64(size))
+	}
+
+	oldSize := len(c.bytes)
+	if err := c.unmap(); err != nil {
+		return err
+	}
+	if err := c.mmapf.Truncate(int64(size)); err != nil {
+		if rerr := c.remap(uint32(oldSize)); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := c.remap(size); err != nil {
+		if terr := c.mmapf.Truncate(int64(oldSize)); terr != nil {
+			return terr
+		}
+		if rerr := c.remap(uint32(oldSize)); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	return nil
+}
+
+// The size the data file of a chunk is trimmed to: just after its final entry, but never empty, as an empty file
+// can't be mapped.
+func (c *chunk) trimmedSize() uint32 {
+	if len(c.ends) == 0 || c.ends[len(c.ends)-1] < 1 {
+		return 1
+	}
+	return uint32(c.ends[len(c.ends)-1])
+}
+
+// Unmap the data file of a chunk, leaving it open so it can be mapped again.
+func (c *chunk) unmap() error {
+	if c.bytes == nil {
+		return nil
+	}
+	if err := c.fs.Msync(c.bytes); err != nil {
+		return err
+	}
+	if err := c.fs.Munmap(c.bytes); err != nil {
+		return err
+	}
+	c.bytes = nil
+	c.locked = false
+	return nil
+}
+
+// Read bytes of the data file of a chunk with the file backend, starting at the given offset.
+func (c *chunk) readAt(dst []byte, off int32) error {
+	_, err := c.mmapf.(io.ReaderAt).ReadAt(dst, int64(off))
+	return err
+}
+
+// Write bytes to the data file of a chunk with the file backend, starting at the given offset.
+func (c *chunk) writeAt(src []byte, off int32) error {
+	_, err := c.mmapf.(io.WriterAt).WriteAt(src, int64(off))
+	return err
 }
 
 // Get the data file path associated with a chunk meta file path.
@@ -115,28 +359,22 @@ func isBasenameChunkMetaFile(basename string) bool {
 	return strings.HasSuffix(basename, suff) && isBasenameChunkDataFile(strings.TrimSuffix(basename, suff))
 }
 
+// Get the filename of the first chunk, given the ID of its oldest entry.
+func initialDataFileName(oldest uint64) string {
+	return fmt.Sprintf("%s%s0%s%v", chunkPrefix, sep, sep, oldest)
+}
+
 // Given a chunk, get the filename of the next chunk.
 //
 // This function panics if the chunk path is invalid. This should never happen unless openChunkSliceDB or
 // isChunkDataFile is broken.
 func (c *chunk) nextDataFileName(oldest uint64) string {
-	// If there are directories in the path, correctly identify the basename.
-	firstSep := chunkPrefix + sep
-	if strings.ContainsRune(c.path, '/') {
-		firstSep = "/" + firstSep
-	}
-
-	bits := strings.Split(c.path, firstSep)
-	if len(bits) < 2 {
+	bits := strings.Split(filepath.Base(c.path), sep)
+	if len(bits) != 3 || bits[0] != chunkPrefix {
 		panic("malformed chunk file name: " + c.path)
 	}
 
-	bits = strings.Split(bits[len(bits)-1], sep)
-	if len(bits) != 2 {
-		panic("malformed chunk file name: " + c.path)
-	}
-
-	num, err := strconv.ParseUint(bits[0], 10, 0)
+	num, err := strconv.ParseUint(bits[1], 10, 0)
 	if err != nil {
 		panic("malformed chunk file name: " + c.path)
 	}
@@ -146,19 +384,105 @@ func (c *chunk) nextDataFileName(oldest uint64) string {
 
 // Create the files for a new chunk. As an empty chunk is not allowed, it is assumed that an entry will be
 // immediately written.
-func createChunkFiles(dataFilePath string, chunkSize uint32, oldest uint64) error {
+func createChunkFiles(fs FileSystem, dataFilePath string, chunkSize uint32, oldest uint64) error {
 	// Create the chunk files.
-	if err := createFile(dataFilePath, chunkSize); err != nil {
+	if err := createFile(fs, dataFilePath, chunkSize); err != nil {
 		return err
 	}
-	file, err := os.OpenFile(metaFilePath(dataFilePath), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	file.Close()
-	return err
+	return createMetaFile(fs, dataFilePath)
+}
+
+// Create the empty metadata file for a new chunk, given the path of its data file.
+func createMetaFile(fs FileSystem, dataFilePath string) error {
+	file, err := fs.OpenFile(metaFilePath(dataFilePath), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Extend a chunk data file which has been trimmed back to the chunk size. A file which is already at least that
+// size is left alone.
+func growChunkFile(fs FileSystem, dataFilePath string, chunkSize uint32) error {
+	fi, err := fs.Stat(dataFilePath)
+	if err != nil || fi.Size() >= int64(chunkSize) {
+		return err
+	}
+	file, err := fs.OpenFile(dataFilePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Truncate(int64(chunkSize))
 }
 
 // Open a chunk file
-func openChunkFile(basedir string, fi os.FileInfo, priorChunk *chunk, chunkSize uint32) (chunk, error) {
-	chunk := chunk{path: basedir + "/" + fi.Name()}
+func openChunkFile(fs FileSystem, backend Backend, version uint16, basedir string, fi os.FileInfo, priorChunk *chunk, chunkSize uint32) (chunk, error) {
+	chunk, err := readChunkFile(fs, version, basedir, fi, priorChunk, chunkSize, false)
+	if err != nil {
+		return chunk, err
+	}
+	chunk.backend = backend
+
+	// With the file backend, just open the data file: readChunkFile has checked its size.
+	if backend == BackendFile {
+		f, err := fs.OpenFile(chunk.path, os.O_RDWR, 0644)
+		if err != nil {
+			return chunk, &ReadError{err}
+		}
+		if _, ok := f.(interface {
+			io.ReaderAt
+			io.WriterAt
+		}); !ok {
+			_ = f.Close()
+			return chunk, &ReadError{errors.New("chunk data file does not support ReadAt and WriteAt")}
+		}
+		chunk.mmapf = f
+		return chunk, nil
+	}
+
+	// mmap the data file
+	mmapf, bytes, err := mmap(fs, chunk.path)
+	if err != nil {
+		return chunk, &ReadError{err}
+	}
+	if uint32(len(bytes)) != chunkSize {
+		_ = munmapAndClose(fs, mmapf, bytes)
+		return chunk, &FormatError{
+			FilePath: chunk.path,
+			Err: &ChunkSizeError{
+				ChunkFilePath: chunk.path,
+				Expected:      chunkSize,
+				Actual:        uint32(len(bytes)),
+			},
+		}
+	}
+	chunk.bytes = bytes
+	chunk.mmapf = mmapf
+
+	return chunk, nil
+}
+
+// Get the end of the final entry recorded in a chunk metadata file, if it can be read and records any entries.
+func metadataEnd(fs FileSystem, metaPath string, version uint16) (int32, bool) {
+	mfile, err := fs.OpenFile(metaPath, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, false
+	}
+	defer mfile.Close()
+
+	ends, _, err := readMetadata(mfile, version)
+	if err != nil || len(ends) == 0 {
+		return 0, false
+	}
+	return ends[len(ends)-1], true
+}
+
+// Read the metadata of a chunk file and check that it is consistent, without mapping the data file. If the
+// chunk may have been trimmed, the data file may be cut off after its final entry. If the disk format version
+// has framing and the metadata is missing or damaged, it is rebuilt from the data file.
+func readChunkFile(fs FileSystem, version uint16, basedir string, fi os.FileInfo, priorChunk *chunk, chunkSize uint32, trimmed bool) (chunk, error) {
+	chunk := chunk{fs: fs, version: version, path: filepath.Join(basedir, fi.Name()), size: chunkSize}
 	// Get the oldest ID from the file name
 	if !isBasenameChunkDataFile(fi.Name()) {
 		return chunk, &ChunkFileNameError{fi.Name()}
@@ -168,41 +492,78 @@ func openChunkFile(basedir string, fi os.FileInfo, priorChunk *chunk, chunkSize
 	oldnum, _ := strconv.ParseUint(nameBits[2], 10, 0)
 	chunk.oldest = uint64(oldnum)
 
-	// mmap the data file
-	mmapf, bytes, err := mmap(chunk.path)
+	// Check the size of the data file
+	info, err := fs.Stat(chunk.path)
 	if err != nil {
 		return chunk, &ReadError{err}
 	}
-	if uint32(len(bytes)) != chunkSize {
+	if info.IsDir() {
+		return chunk, &ReadError{errors.New("chunk data file is a directory")}
+	}
+	if info.Size() != int64(chunkSize) && !(trimmed && info.Size() < int64(chunkSize)) {
+		// If the metadata is intact and says there should be more data, the data file has been cut short.
+		if info.Size() < int64(chunkSize) {
+			if end, ok := metadataEnd(fs, (&chunk).metaFilePath(), version); ok && int64(end) > info.Size() {
+				return chunk, &FormatError{
+					FilePath: chunk.path,
+					Err: &DataFileTruncatedError{
+						ChunkFilePath: chunk.path,
+						Size:          uint32(info.Size()),
+						End:           end,
+					},
+				}
+			}
+		}
 		return chunk, &FormatError{
 			FilePath: chunk.path,
 			Err: &ChunkSizeError{
 				ChunkFilePath: chunk.path,
 				Expected:      chunkSize,
-				Actual:        uint32(len(bytes)),
+				Actual:        uint32(info.Size()),
 			},
 		}
 	}
-	chunk.bytes = bytes
-	chunk.mmapf = mmapf
 
 	// read the ending address metadata
-	mfile, err := os.Open((&chunk).metaFilePath())
-	if err != nil {
+	var ends []int32
+	var stamps []uint64
+	mfile, err := fs.OpenFile((&chunk).metaFilePath(), os.O_RDONLY, 0)
+	if err == nil {
+		ends, stamps, err = readMetadata(mfile, version)
+		_ = mfile.Close()
+		if err != nil && !versionHasFraming(version) {
+			return chunk, &FormatError{
+				FilePath: (&chunk).metaFilePath(),
+				Err: &ChunkMetaError{
+					ChunkFilePath: chunk.path,
+					Err:           err,
+				},
+			}
+		}
+	} else if !versionHasFraming(version) {
 		return chunk, &ReadError{err}
 	}
-	defer mfile.Close()
-	ends, err := readMetadata(mfile)
 	if err != nil {
+		ends, stamps, err = rebuildMetadata(fs, chunk.path)
+		if err != nil {
+			return chunk, &ReadError{err}
+		}
+		chunk.rebuilt = true
+	}
+
+	limit := int32(info.Size())
+	if len(ends) > 0 && (ends[0] < 0 || ends[len(ends)-1] > limit) {
 		return chunk, &FormatError{
 			FilePath: (&chunk).metaFilePath(),
 			Err: &ChunkMetaError{
 				ChunkFilePath: chunk.path,
-				Err:           err,
+				Err:           &MetaBoundsError{Limit: limit, Actual: ends[len(ends)-1]},
 			},
 		}
 	}
 	chunk.ends = ends
+	chunk.stamps = stamps
+	chunk.newFrom = len(ends)
 
 	// Chunk oldest/next IDs must match: there can be no gaps!
 	if priorChunk != nil && chunk.oldest != priorChunk.next() {
@@ -219,30 +580,57 @@ func openChunkFile(basedir string, fi os.FileInfo, priorChunk *chunk, chunkSize
 	return chunk, nil
 }
 
-// Write a chunk to disk.
-func (c *chunk) sync() error {
+// Write a chunk to disk. The sync mode determines how the data file is flushed: the metadata file is always
+// fully synced.
+func (c *chunk) sync(mode SyncMode) error {
 	// To ensure ACID, sync the data first and only then the metadata. This means that if there is a failure
 	// between the two syncs, even if the newly-written data is corrupt, there will be no metadata referring
 	// to it, and so it will be invisible to the database when next opened.
-	if err := fsync(c.mmapf); err != nil {
+	if err := c.syncData(mode); err != nil {
 		return err
 	}
+	return c.syncMeta()
+}
 
-	// Construct the metadata as a buffer. This is done rather than appending to the output file directly
-	// because individual "write" syscalls with a small enough buffer (which this will be for any reasonable
-	// syncing period) are atomic. Multiple appends would have the possibility of failure in the middle.
-	buf := new(bytes.Buffer)
-	for i := c.newFrom; i < len(c.ends); i++ {
-		if err := binary.Write(buf, binary.LittleEndian, int32(i)); err != nil {
+// Flush a chunk's data file to disk. This must happen before 'syncMeta'.
+func (c *chunk) syncData(mode SyncMode) error {
+	flush := fsync
+	if mode == SyncData {
+		flush = fdatasync
+	}
+	if c.bytes != nil {
+		if err := c.fs.Msync(c.bytes); err != nil {
+			return err
+		}
+	}
+	return flush(c.mmapf)
+}
+
+// Write a chunk's new metadata records to disk. If the disk format version has checksummed metadata, the
+// whole file is rewritten instead, by writing a temporary file and renaming it over the old one.
+func (c *chunk) syncMeta() error {
+	if versionHasMetaChecksums(c.version) {
+		buf, err := encodeMetadataFile(c.version, c.ends, c.stamps)
+		if err != nil {
 			return err
 		}
-		if err := binary.Write(buf, binary.LittleEndian, c.ends[i]); err != nil {
+		if err := replaceFile(c.fs, c.metaFilePath(), syncMetaFile, buf); err != nil {
 			return err
 		}
+		c.newFrom = len(c.ends)
+		return nil
+	}
+
+	// Construct the metadata as a buffer. This is done rather than appending to the output file directly
+	// because individual "write" syscalls with a small enough buffer (which this will be for any reasonable
+	// syncing period) are atomic. Multiple appends would have the possibility of failure in the middle.
+	buf, err := encodeMetadata(c.version, c.newFrom, c.ends, c.stamps)
+	if err != nil {
+		return err
 	}
 
 	// Write the new end points.
-	if err := appendFile(c.metaFilePath(), buf.Bytes()); err != nil {
+	if err := appendFile(c.fs, c.metaFilePath(), buf); err != nil {
 		return err
 	}
 	c.newFrom = len(c.ends)
@@ -250,13 +638,76 @@ func (c *chunk) sync() error {
 	return nil
 }
 
+// Encode the metadata records for the entries from index 'from' onwards, in the format read by
+// 'readMetadata'. The 'stamps' are ignored if the disk format version doesn't store timestamps.
+//
+// The records are encoded directly into one buffer, rather than with 'binary.Write', which allocates for every
+// value written.
+func encodeMetadata(version uint16, from int, ends []int32, stamps []uint64) ([]byte, error) {
+	recordSize := 8
+	if versionHasTimestamps(version) {
+		recordSize = 16
+	}
+	if from >= len(ends) {
+		return nil, nil
+	}
+
+	buf := make([]byte, (len(ends)-from)*recordSize)
+	for i := from; i < len(ends); i++ {
+		record := buf[(i-from)*recordSize:]
+		binary.LittleEndian.PutUint32(record[0:], uint32(int32(i)))
+		binary.LittleEndian.PutUint32(record[4:], uint32(ends[i]))
+		if versionHasTimestamps(version) {
+			binary.LittleEndian.PutUint64(record[8:], stamps[i])
+		}
+	}
+	return buf, nil
+}
+
+// Encode the complete metadata file of a chunk, in the format read by 'readMetadata'.
+//
+// Checksummed metadata is in the format [magic uint32][version uint16][count uint32], followed by a [end int32]
+// [timestamp uint64] record for each entry, and then a [checksum uint32] of everything before it. Other
+// versions are as written by 'encodeMetadata'.
+func encodeMetadataFile(version uint16, ends []int32, stamps []uint64) ([]byte, error) {
+	if !versionHasMetaChecksums(version) {
+		return encodeMetadata(version, 0, ends, stamps)
+	}
+
+	buf := make([]byte, metaHeaderSize+len(ends)*metaRecordSize+metaChecksumSize)
+	binary.LittleEndian.PutUint32(buf[0:], metaMagic)
+	binary.LittleEndian.PutUint16(buf[4:], version)
+	binary.LittleEndian.PutUint32(buf[6:], uint32(len(ends)))
+	for i := range ends {
+		record := buf[metaHeaderSize+i*metaRecordSize:]
+		binary.LittleEndian.PutUint32(record[0:], uint32(ends[i]))
+		binary.LittleEndian.PutUint64(record[4:], stamps[i])
+	}
+	sumAt := len(buf) - metaChecksumSize
+	binary.LittleEndian.PutUint32(buf[sumAt:], crc32.Checksum(buf[:sumAt], metaCRCTable))
+	return buf, nil
+}
+
 // Read a chunk metadata file.
 //
 // Metadata is in the format [index int32][end int32], it ends at EOF. If the indices go backwards, that means
-// entries have been rolled back
-func readMetadata(r io.Reader) ([]int32, error) {
+// entries have been rolled back. An end may equal the one before, which is an empty entry: rollbacks are only
+// told apart by the index. In disk format versions which store timestamps, each record is followed by a
+// [timestamp uint64], and the timestamps are returned parallel to the ends; otherwise the timestamps are nil.
+//
+// Disk format versions with checksummed metadata are in the format written by 'encodeMetadataFile' instead. An
+// empty file, which is what a new chunk has until it is first synced, has no entries.
+func readMetadata(r io.Reader, version uint16) ([]int32, []uint64, error) {
+	if versionHasMetaChecksums(version) {
+		return readChecksummedMetadata(r, version)
+	}
+
 	var ends []int32
+	var stamps []uint64
 	var idx, this int32
+	var stamp uint64
+
+	hasTimestamps := versionHasTimestamps(version)
 
 	for {
 		// Read the index into the ends slice.
@@ -264,10 +715,10 @@ func readMetadata(r io.Reader) ([]int32, error) {
 			if err == io.EOF {
 				break
 			}
-			return ends, err
+			return ends, stamps, err
 		}
 		if idx > int32(len(ends)) {
-			return ends, &MetaContinuityError{
+			return ends, stamps, &MetaContinuityError{
 				Expected: int32(len(ends)),
 				Actual:   idx,
 			}
@@ -275,20 +726,69 @@ func readMetadata(r io.Reader) ([]int32, error) {
 
 		// Read the offset. If this fails, it means that syncing failed between the two writes.
 		if err := binary.Read(r, binary.LittleEndian, &this); err != nil {
-			return ends, err
+			return ends, stamps, err
 		}
 
 		// Check the offset is geq the prior offset.
 		if idx > 0 && this < ends[idx-1] {
-			return ends, &MetaOffsetError{
+			return ends, stamps, &MetaOffsetError{
 				Expected: int32(ends[idx-1]),
 				Actual:   this,
 			}
 		}
 
+		// Read the timestamp. As with the offset, failure here means that syncing failed part-way.
+		if hasTimestamps {
+			if err := binary.Read(r, binary.LittleEndian, &stamp); err != nil {
+				return ends, stamps, err
+			}
+			stamps = append(stamps[0:idx], stamp)
+		}
+
 		// Pop entries from the "ends" slice so that the current index is one past the end, and append it.
 		ends = append(ends[0:idx], this)
 	}
 
-	return ends, nil
+	return ends, stamps, nil
+}
+
+// Read a chunk metadata file with a header and checksum. Nothing is returned unless the whole file is valid.
+func readChecksummedMetadata(r io.Reader, version uint16) ([]int32, []uint64, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(buf) == 0 {
+		return nil, nil, nil
+	}
+
+	// Check the header, and that the file is as long as it says.
+	if len(buf) < metaHeaderSize+metaChecksumSize {
+		return nil, nil, &MetaLengthError{Expected: metaHeaderSize + metaChecksumSize, Actual: len(buf)}
+	}
+	if binary.LittleEndian.Uint32(buf[0:]) != metaMagic || binary.LittleEndian.Uint16(buf[4:]) != version {
+		return nil, nil, ErrCorrupt
+	}
+	count := int(binary.LittleEndian.Uint32(buf[6:]))
+	if expected := metaHeaderSize + count*metaRecordSize + metaChecksumSize; count < 0 || len(buf) != expected {
+		return nil, nil, &MetaLengthError{Expected: expected, Actual: len(buf)}
+	}
+
+	sumAt := len(buf) - metaChecksumSize
+	expected := binary.LittleEndian.Uint32(buf[sumAt:])
+	if actual := crc32.Checksum(buf[:sumAt], metaCRCTable); actual != expected {
+		return nil, nil, &MetaChecksumError{Expected: expected, Actual: actual}
+	}
+
+	ends := make([]int32, count)
+	stamps := make([]uint64, count)
+	for i := range ends {
+		record := buf[metaHeaderSize+i*metaRecordSize:]
+		ends[i] = int32(binary.LittleEndian.Uint32(record[0:]))
+		stamps[i] = binary.LittleEndian.Uint64(record[4:])
+		if i > 0 && ends[i] < ends[i-1] {
+			return nil, nil, &MetaOffsetError{Expected: ends[i-1], Actual: ends[i]}
+		}
+	}
+	return ends, stamps, nil
 }
@@ -84,53 +84,95 @@ func TestChunk_Filenames_MetaFilePath(t *testing.T) {
 
 func TestChunk_Metadata_Works(t *testing.T) {
 	metadata := makeMetadata(t, []int32{0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5})
-	ends, err := readMetadata(metadata)
+	ends, _, err := readMetadata(metadata, 0)
 	assert.Nil(t, err, "failed to read metadata: %s", err)
 	assert.Equal(t, []int32{0, 1, 2, 3, 4, 5}, ends, "ends")
 }
 
 func TestChunk_Metadata_NonContiguousIndices(t *testing.T) {
 	metadata := makeMetadata(t, []int32{0, 0, 1, 1, 5, 2})
-	_, err := readMetadata(metadata)
+	_, _, err := readMetadata(metadata, 0)
 	assert.True(t, errwrap.ContainsType(err, new(MetaContinuityError)), "expected continuity error")
 }
 
 func TestChunk_Metadata_NonIncreasingEnds(t *testing.T) {
 	metadata := makeMetadata(t, []int32{0, 0, 1, 1, 2, 0})
-	_, err := readMetadata(metadata)
+	_, _, err := readMetadata(metadata, 0)
 	assert.True(t, errwrap.ContainsType(err, new(MetaOffsetError)), "expected offset error")
 }
 
 func TestChunk_Metadata_Rollback(t *testing.T) {
 	metadata := makeMetadata(t, []int32{0, 0, 1, 1, 0, 1})
-	ends, err := readMetadata(metadata)
+	ends, _, err := readMetadata(metadata, 0)
 	assert.Nil(t, err, "failed to read metadata: %s", err)
 	assert.Equal(t, []int32{1}, ends, "failed to apply rollback, got: %v", ends)
 }
 
 func TestChunk_Metadata_Incomplete(t *testing.T) {
 	metadata := makeMetadata(t, []int32{0, 0, 1})
-	ends, err := readMetadata(metadata)
+	ends, _, err := readMetadata(metadata, 0)
 	assert.NotNil(t, err, "expected to not parse that, got: %v", ends)
 }
 
 func TestChunk_Metadata_IncompleteRollback(t *testing.T) {
 	metadata := makeMetadata(t, []int32{0, 0, 1, 1, 0})
-	ends, err := readMetadata(metadata)
+	ends, _, err := readMetadata(metadata, 0)
 	assert.NotNil(t, err, "expected to not parse that, got: %v", ends)
 }
 
+func TestChunk_Metadata_ChecksumWorks(t *testing.T) {
+	buf, err := encodeMetadataFile(2, []int32{0, 1, 1, 3}, []uint64{10, 20, 30, 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ends, stamps, err := readMetadata(bytes.NewReader(buf), 2)
+	assert.Nil(t, err, "failed to read metadata: %s", err)
+	assert.Equal(t, []int32{0, 1, 1, 3}, ends, "ends")
+	assert.Equal(t, []uint64{10, 20, 30, 40}, stamps, "timestamps")
+
+	// A chunk which has never been synced has an empty metadata file.
+	ends, _, err = readMetadata(bytes.NewReader(nil), 2)
+	assert.Nil(t, err, "failed to read metadata: %s", err)
+	assert.Empty(t, ends)
+}
+
+func TestChunk_Metadata_ChecksumFlippedByte(t *testing.T) {
+	buf, err := encodeMetadataFile(2, []int32{0, 1, 2, 3}, []uint64{10, 20, 30, 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{metaHeaderSize, metaHeaderSize + metaRecordSize + 5, len(buf) - 1} {
+		flipped := append([]byte(nil), buf...)
+		flipped[i] ^= 0x10
+		ends, _, err := readMetadata(bytes.NewReader(flipped), 2)
+		assert.True(t, errwrap.ContainsType(err, new(MetaChecksumError)), "expected checksum error flipping byte %v, got: %s", i, err)
+		assert.Nil(t, ends, "expected no entries flipping byte %v", i)
+	}
+}
+
+func TestChunk_Metadata_ChecksumTruncated(t *testing.T) {
+	buf, err := encodeMetadataFile(2, []int32{0, 1, 2, 3}, []uint64{10, 20, 30, 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, metaHeaderSize, len(buf) - metaRecordSize, len(buf) - 1} {
+		ends, _, err := readMetadata(bytes.NewReader(buf[:n]), 2)
+		assert.True(t, errwrap.ContainsType(err, new(MetaLengthError)), "expected length error truncating to %v, got: %s", n, err)
+		assert.Nil(t, ends, "expected no entries truncating to %v", n)
+	}
+}
+
 /* ***** Opening */
 
 func TestChunk_Open_BadFilePath(t *testing.T) {
 	dir, fi := makeFile(t, "open_bad_file_path", "file", 1)
-	_, err := openChunkFile(dir, fi, nil, 0)
+	_, err := openChunkFile(OSFileSystem{}, BackendMmap, latestVersion, dir, fi, nil, 0)
 	assert.True(t, errwrap.ContainsType(err, new(ChunkFileNameError)), "expected chunk file name error, got: %s", err)
 }
 
 func TestChunk_Open_BadBasedir(t *testing.T) {
 	dir, fi := makeFile(t, "open_bad_basedir", initialChunkFile, 1)
-	_, err := openChunkFile(dir+"incorrect!", fi, nil, 500)
+	_, err := openChunkFile(OSFileSystem{}, BackendMmap, latestVersion, dir+"incorrect!", fi, nil, 500)
 	assert.True(t, errwrap.ContainsType(err, new(ReadError)), "expected read error, got: %s", err)
 }
 
@@ -144,21 +186,53 @@ func TestChunk_Open_Directory(t *testing.T) {
 		t.Fatal("error stating directory:", err)
 	}
 
-	_, err = openChunkFile("test_db/open_directory", fi, nil, 500)
+	_, err = openChunkFile(OSFileSystem{}, BackendMmap, latestVersion, "test_db/open_directory", fi, nil, 500)
 	assert.True(t, errwrap.ContainsType(err, new(ReadError)), "expected read error, got: %s", err)
 }
 
 func TestChunk_Open_BadSize(t *testing.T) {
 	dir, fi := makeFile(t, "open_bad_size", initialChunkFile, 1)
-	_, err := openChunkFile(dir, fi, nil, 500)
+	_, err := openChunkFile(OSFileSystem{}, BackendMmap, latestVersion, dir, fi, nil, 500)
 	assert.True(t, errwrap.ContainsType(err, new(ChunkSizeError)), "expected chunk size error, got: %s", err)
 }
 
+func TestChunk_Open_TruncatedData(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "open_truncated_data", chunkSize)
+	filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	dataPath := "test_db/open_truncated_data/" + initialChunkFile
+	ends, _ := readTestMetadata(t, metaFilePath(dataPath), latestVersion)
+	end := ends[len(ends)-1]
+	if end == chunkSize {
+		t.Fatal("expected first chunk not to be full")
+	}
+
+	// Cutting off entries is blamed on the data file, not the metadata.
+	if err := os.Truncate(dataPath, int64(end)-1); err != nil {
+		t.Fatal(err)
+	}
+	err := assertOpenError(t, false, "open_truncated_data")
+	if terr, ok := errwrap.GetType(err, new(DataFileTruncatedError)).(*DataFileTruncatedError); assert.True(t, ok, "expected data file truncated error, got: %s", err) {
+		assert.Equal(t, uint32(end-1), terr.Size)
+		assert.Equal(t, end, terr.End)
+	}
+	assert.False(t, errwrap.ContainsType(err, new(ChunkMetaError)), "expected no chunk meta error, got: %s", err)
+
+	// Cutting off only unused space is just the wrong size.
+	if err := os.Truncate(dataPath, int64(end)); err != nil {
+		t.Fatal(err)
+	}
+	err = assertOpenError(t, false, "open_truncated_data")
+	assert.True(t, errwrap.ContainsType(err, new(ChunkSizeError)), "expected chunk size error, got: %s", err)
+	assert.False(t, errwrap.ContainsType(err, new(DataFileTruncatedError)), "expected no data file truncated error, got: %s", err)
+}
+
 func TestChunk_Open_BadMetadata(t *testing.T) {
 	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "open_bad_metadata", chunkSize)
 	filldb(t, db, numEntries)
 	assertClose(t, db)
-	if err := createFile("test_db/open_bad_metadata/"+initialMetaFile, 3); err != nil {
+	if err := createFile(OSFileSystem{}, "test_db/open_bad_metadata/"+initialMetaFile, 3); err != nil {
 		t.Fatal("could not truncate metadata file:", err)
 	}
 
@@ -167,13 +241,28 @@ func TestChunk_Open_BadMetadata(t *testing.T) {
 		t.Fatal("error stating chunk file:", err)
 	}
 
-	_, err = openChunkFile("test_db/open_bad_metadata", fi, nil, chunkSize)
+	_, err = openChunkFile(OSFileSystem{}, BackendMmap, latestVersion, "test_db/open_bad_metadata", fi, nil, chunkSize)
+	assert.True(t, errwrap.ContainsType(err, new(ChunkMetaError)), "expected chunk meta error, got: %s", err)
+}
+
+func TestChunk_Open_BadMetadataChecksum(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "open_bad_metadata_checksum", chunkSize)
+	filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	metaPath := "test_db/open_bad_metadata_checksum/" + initialMetaFile
+	meta := readTestFile(t, metaPath)
+	meta[metaHeaderSize+1] ^= 0x01
+	writeTestFile(t, metaPath, meta)
+
+	err := assertOpenError(t, false, "open_bad_metadata_checksum")
 	assert.True(t, errwrap.ContainsType(err, new(ChunkMetaError)), "expected chunk meta error, got: %s", err)
+	assert.True(t, errwrap.ContainsType(err, new(MetaChecksumError)), "expected checksum error, got: %s", err)
 }
 
 func TestChunk_Open_MissingMetadata(t *testing.T) {
 	dir, fi := makeFile(t, "open_missing_metadata", initialChunkFile, chunkSize)
-	_, err := openChunkFile(dir, fi, nil, chunkSize)
+	_, err := openChunkFile(OSFileSystem{}, BackendMmap, latestVersion, dir, fi, nil, chunkSize)
 	assert.True(t, errwrap.ContainsType(err, new(ReadError)), "expected read error, got: %s", err)
 }
 
@@ -187,7 +276,7 @@ func TestChunk_Open_BadContinuity(t *testing.T) {
 		t.Fatal("error stating chunk file:", err)
 	}
 
-	_, err = openChunkFile("test_db/open_bad_continuity", fi, &chunk{oldest: 90}, chunkSize)
+	_, err = openChunkFile(OSFileSystem{}, BackendMmap, latestVersion, "test_db/open_bad_continuity", fi, &chunk{oldest: 90}, chunkSize)
 	assert.True(t, errwrap.ContainsType(err, new(ChunkContinuityError)), "expected chunk continuity error, got: %s", err)
 }
 
@@ -213,7 +302,7 @@ func makeFile(t testing.TB, testName, fileName string, size uint32) (string, os.
 	if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
 		t.Fatal("error creating directory:", err)
 	}
-	if err := createFile(path, size); err != nil {
+	if err := createFile(OSFileSystem{}, path, size); err != nil {
 		t.Fatal("error creating test file:", err)
 	}
 	fi, err := os.Stat(path)
@@ -1,15 +1,52 @@
 package logdb
 
 import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const latestVersion = uint16(0)
+// The disk format version of newly-created databases. The versions are:
+//
+//  - 0: the original format.
+//  - 1: chunk metadata also stores the time each entry was appended.
+//  - 2: chunk metadata has a header and a checksum, and is rewritten in full, atomically, when synced.
+//
+// There are also versions which are only created when asked for with an option:
+//
+//  - 3: as 2, but each entry in a chunk data file is preceded by its length (see 'WithFraming').
+const latestVersion = uint16(2)
+
+// The disk format version of newly-created databases with the 'WithFraming' option.
+const framedVersion = uint16(3)
+
+// Opens a database with the given disk format version, once the version has been read. The chunk size and
+// options are as for 'opendb'.
+type versionOpener func(path string, expectedChunkSize uint32, version uint16, o options) (*LockFreeChunkDB, error)
+
+// The openers for each known disk format version. Versions which differ only in details handled by the chunk
+// code, such as whether timestamps are stored, share an opener.
+var versionOpeners = map[uint16]versionOpener{
+	0: opendbVersion,
+	1: opendbVersion,
+	2: opendbVersion,
+	3: opendbVersion,
+}
+
+// Check if a disk format version is known.
+func knownVersion(version uint16) bool {
+	_, ok := versionOpeners[version]
+	return ok
+}
 
 ////////// LOG-STRUCTURED DATABASE //////////
 
@@ -32,42 +69,83 @@ type ChunkDB struct {
 	// the necessary write locks. This would complicate locking but allow for more concurrent reading, and
 	// so may be better under some work loads.
 	rwlock sync.RWMutex
+
+	// Held while delivering notifications to the observer.
+	deliverLock sync.Mutex
+
+	// Held while a large batch is staged by 'AppendEntries', so only one is staged at a time.
+	stageLock sync.Mutex
+
+	// The background scrubber, if the 'WithBackgroundScrub' option was given: closing 'scrubStop' tells it to
+	// stop, and it closes 'scrubDone' once it has.
+	scrubStop     chan struct{}
+	scrubDone     chan struct{}
+	scrubStopOnce sync.Once
 }
 
 // A LockFreeChunkDB is a 'ChunkDB' with no internal locks. It is NOT safe for concurrent use.
 type LockFreeChunkDB struct {
+	// Copies of the oldest and newest entry IDs. These are not a source of internal truth! They are only here
+	// to make 'OldestID', 'NewestID', and 'NextID' lock-free, even for a 'ChunkDB', and so are only accessed
+	// atomically. 'publicOldest' is set with 'oldest', by 'setOldest', and 'publicNewest' is set by
+	// 'updateNewest' at the end of every operation which appends or removes entries from the back. They come
+	// first so that they are 64-bit aligned, as atomic access needs on 32-bit platforms.
+	publicOldest uint64
+	publicNewest uint64
+
 	// Path to the database directory.
 	path string
 
 	// Lock file used to prevent multiple simultaneous open handles: concurrent use of one handle is fine,
 	// multiple handles is not. This file is locked exclusive, not shared.
-	lockfile *os.File
+	lockfile File
+
+	// Settings given to 'Open'.
+	options
 
 	// Flag indicating that the handle has been closed. This is used to give 'ErrClosed' errors.
 	closed bool
 
+	// Flag indicating that the database was opened with 'WithReadOnly', or that a write failed because the
+	// filesystem is read-only, with the 'WithReadOnlyOnError' option. This is used to give 'ErrReadOnly' errors.
+	// It is set with 'slock' held if set by a sync.
+	readOnly bool
+
+	// The disk format version.
+	version uint16
+
 	// Size of individual chunks. Entries are not split over chunks, and so they cannot be bigger than this.
 	chunkSize uint32
 
 	// Chunks, in order.
 	chunks []*chunk
 
-	// Oldest entry ID. This may be > the first chunk oldest if forgetting has happened.
+	// Oldest entry ID. This may be > the first chunk oldest if forgetting has happened. It is only changed
+	// with 'setOldest'.
 	oldest uint64
 
-	// Newest entry ID. This is not a source of internal truth! It is only here to make 'NewestID'
-	// lock-free! This should always be equal to 'db.next() - 1', and is updated in 'AppendEntries',
-	// 'Rollback', and 'Truncate'. It doesn't need to be updated in 'Append', as that calls
-	// 'AppendEntries', or in 'Forget', as that only deletes from the back.
-	newest uint64
-
-	// Data syncing: 'syncEvery' is how many changes (entries appended/truncated) to allow before syncing,
-	// 'sinceLastSync' keeps track of this, and 'syncDirty' is the set of chunks to sync. When syncing,
-	// first chunks are deleted newest-first, then data is flushed oldest-first. This is to maintain
-	// consistency,
-	syncEvery     int
-	sinceLastSync uint64
-	syncDirty     map[*chunk]struct{}
+	// IDs of deleted entries, which may include forgotten ones, and whether the "tombstones" file needs
+	// rewriting by the next sync.
+	tombstones      map[uint64]struct{}
+	tombstonesDirty bool
+
+	// Recently-read entries, or nil if the 'WithReadCache' option wasn't given.
+	cache *readCache
+
+	// Data syncing: 'syncEvery' is how many changes (entries appended/truncated) to allow before syncing, with
+	// 0 treated as 1 and a negative value never syncing, 'sinceLastSync' keeps track of this, 'syncBytes' and
+	// 'bytesSinceLastSync' are the same but for the number of bytes appended, and 'syncDirty' is the set of
+	// chunks to sync. When syncing, first chunks are
+	// deleted newest-first, then data is flushed oldest-first. This is to maintain consistency,
+	syncEvery          int
+	sinceLastSync      uint64
+	syncBytes          uint64
+	bytesSinceLastSync uint64
+	syncDirty          map[*chunk]struct{}
+
+	// Whether entries which had been synced have been rolled back since the last sync. Their bytes may then
+	// have been overwritten by new entries, so the synced state is no longer intact on disk.
+	rolledBackSynced bool
 
 	// Concurrent syncing/reading is safe, but syncing/writing and syncing/syncing is not. To prevent the
 	// first, syncing claims a read lock. To prevent the latter, a special sync lock is used. Claiming a
@@ -75,6 +153,40 @@ type LockFreeChunkDB struct {
 	//
 	// This is inside LockFreeChunkDB because picking it out would be a real pain. TODO: fix :(
 	slock sync.Mutex
+
+	// Compaction of the oldest chunk: 'wrapperLock' is the lock of the 'ChunkDB' wrapping this database, if
+	// there is one, in which case compaction happens in the background; 'compacting' is set while a
+	// background compaction is in progress, and 'compactWG' lets 'Close' wait for it; and 'rollbacks' counts
+	// rollbacks, so a compaction can tell if the chunk it copied has been changed.
+	wrapperLock *sync.RWMutex
+	compacting  bool
+	compactWG   sync.WaitGroup
+	rollbacks   uint64
+
+	// Notifications waiting to be delivered to the observer by a 'ChunkDB', once its lock is released. These
+	// are queued by both readers and writers, so have their own lock.
+	eventLock sync.Mutex
+	events    []func(Observer)
+
+	// If the number of memory-mapped chunks is limited, reading a chunk may map it and unmap another, so
+	// readers hold 'mapLock' while using chunk bytes. 'useClock' orders chunk accesses, to find the least
+	// recently used.
+	mapLock  sync.Mutex
+	useClock uint64
+
+	// The access pattern advice given to the operating system for mapped chunks.
+	accessPattern AccessPattern
+
+	// Whether locking a chunk into memory has failed, in which case no more are locked. See 'lockNewest'.
+	mlockFailed bool
+
+	// Held while 'Manifest' uses the remembered checksums of the chunks, as readers share the database lock.
+	digestLock sync.Mutex
+
+	// Spare chunk data files made by 'Preallocate', which new chunks use before creating files. These are
+	// basenames, and the last is used first. 'nextSpare' is the number for the next spare file's name.
+	spares    []string
+	nextSpare uint64
 }
 
 // Open a 'LockFreeChunkDB' database.
@@ -89,26 +201,68 @@ type LockFreeChunkDB struct {
 // 'Forget' and 'Rollback'), so a larger chunk size means fewer files, but longer persistence.
 //
 // If the 'create' flag is true and the database doesn't already exist, the database is created using the given
-// chunk size. If the database does exist, the chunk size parameter is ignored, and detected automatically from
-// the chunk files.
-func Open(path string, chunkSize uint32, create bool) (*LockFreeChunkDB, error) {
+// chunk size. If the database does exist, the chunk size must either match the one it was created with (or the
+// one most recently given to 'SetChunkSize'), or be 0 to use that automatically. A mismatched chunk size gives a
+// 'ChunkSizeError' value.
+//
+// Any number of options may be given to further configure the database. Later options override earlier ones.
+func Open(path string, chunkSize uint32, create bool, opts ...Option) (*LockFreeChunkDB, error) {
+	o := applyOptions(opts)
+
 	// Check if it already exists.
-	if stat, _ := os.Stat(path); stat != nil {
-		if !stat.IsDir() {
-			return nil, ErrNotDirectory
+	err := checkDatabasePath(o.fs, path)
+	if err == nil {
+		db, err := opendb(path, chunkSize, o)
+		if err == nil && o.scrubRate > 0 && !versionHasFraming(db.version) {
+			_ = db.Close()
+			return nil, ErrScrubNeedsFraming
+		}
+		return db, err
+	}
+	// Don't try to create over a dangling symbolic link.
+	if perr, ok := err.(*DatabasePathError); ok && perr.Mode == 0 && create && !o.openReadOnly {
+		if o.scrubRate > 0 && !versionHasFraming(o.createVersion()) {
+			return nil, ErrScrubNeedsFraming
 		}
-		return opendb(path)
+		return createdb(path, chunkSize, o.createVersion(), o)
+	}
+	return nil, err
+}
+
+// Check that a database path exists and is a directory, returning a 'DatabasePathError' value describing what
+// was found if not.
+func checkDatabasePath(fs FileSystem, path string) error {
+	stat, _ := fs.Stat(path)
+	if stat != nil && stat.IsDir() {
+		return nil
+	}
+
+	err := &DatabasePathError{Path: path, Err: ErrPathDoesntExist}
+	if stat != nil {
+		err.Err = ErrNotDirectory
+		err.Mode = stat.Mode()
+		err.TargetMode = stat.Mode()
 	}
-	if create {
-		return createdb(path, chunkSize)
+	if lstat, _ := lstatFile(fs, path); lstat != nil {
+		err.Mode = lstat.Mode()
 	}
-	return nil, ErrPathDoesntExist
+	return err
 }
 
 // Wrap a 'LockFreeChunkDB' into a 'ChunkDB', which is safe for concurrent use. The underlying
 // 'LockFreeChunkDB' should not be used while the returned 'ChunkDB' is live.
 func WrapForConcurrency(db *LockFreeChunkDB) *ChunkDB {
-	return &ChunkDB{LockFreeChunkDB: db}
+	cdb := &ChunkDB{LockFreeChunkDB: db}
+	db.wrapperLock = &cdb.rwlock
+	if db.scrubRate > 0 {
+		cdb.startScrub()
+	}
+	return cdb
+}
+
+// Append implements the 'LogDB', 'PersistDB', 'BoundedDB', and 'CloseDB' interfaces.
+func (db *ChunkDB) Append(entry []byte) (uint64, error) {
+	return db.AppendEntries([][]byte{entry})
 }
 
 // Append implements the 'LogDB', 'PersistDB', 'BoundedDB', and 'CloseDB' interfaces.
@@ -117,7 +271,15 @@ func (db *LockFreeChunkDB) Append(entry []byte) (uint64, error) {
 }
 
 // AppendEntries implements the 'LogDB', 'PersistDB', 'BoundedDB', and 'CloseDB' interfaces.
+//
+// A batch of at least 'stagedBatchBytes' which needs new chunks is written to them without holding the lock, so
+// readers are not blocked for the whole of a large import. See 'appendStaged' for details.
 func (db *ChunkDB) AppendEntries(entries [][]byte) (uint64, error) {
+	if id, ok, err := db.appendStaged(entries); ok {
+		return id, err
+	}
+
+	defer db.deliverEvents()
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
 
@@ -125,30 +287,225 @@ func (db *ChunkDB) AppendEntries(entries [][]byte) (uint64, error) {
 }
 
 // AppendEntries implements the 'LogDB', 'PersistDB', 'BoundedDB', and 'CloseDB' interfaces.
+//
+// If an entry of a batch of more than one can't be appended, the error is wrapped in a 'BatchAppendError' value
+// saying which entry it was. A batch of one entry gives the same errors as 'Append'.
 func (db *LockFreeChunkDB) AppendEntries(entries [][]byte) (uint64, error) {
-	defer func() { db.newest = db.next() - 1 }()
+	return db.appendEntries(entries, 0)
+}
+
+// AppendEntriesEvery is like 'AppendEntries', but syncs after every 'syncEvery' entries, atomically. See the
+// 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) AppendEntriesEvery(entries [][]byte, syncEvery int) (uint64, error) {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.AppendEntriesEvery(entries, syncEvery)
+}
+
+// AppendEntriesEvery is like 'AppendEntries', but syncs after every 'syncEvery' entries of the batch, regardless
+// of the periodic sync setting. This bounds how much of a large batch is lost if the program crashes part-way
+// through, at the cost of throughput: entries up to the last sync survive the crash, even though the batch as a
+// whole was never finished.
+//
+// If appending fails, every entry of the batch is still rolled back, including those already synced, and the
+// rollback is synced too.
+func (db *LockFreeChunkDB) AppendEntriesEvery(entries [][]byte, syncEvery int) (uint64, error) {
+	return db.appendEntries(entries, syncEvery)
+}
+
+// AppendEntriesGetIDs is like 'AppendEntries', but returns the ID of every entry, atomically. See the
+// 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) AppendEntriesGetIDs(entries [][]byte) ([]uint64, error) {
+	first, err := db.AppendEntries(entries)
+	return appendedIDs(first, len(entries)), err
+}
+
+// AppendEntriesGetIDs is like 'AppendEntries', but returns the ID of every entry, in order, rather than only the
+// first, so a caller indexing the batch doesn't have to work them out.
+//
+// If the batch can't be appended, it is rolled back, as with 'AppendEntries', and no IDs are returned. If it is
+// appended but the sync which follows fails, the IDs are returned along with the error, as the entries are in
+// the log. An empty batch has no IDs.
+func (db *LockFreeChunkDB) AppendEntriesGetIDs(entries [][]byte) ([]uint64, error) {
+	first, err := db.AppendEntries(entries)
+	return appendedIDs(first, len(entries)), err
+}
+
+// Get the IDs of a batch of 'n' entries appended from the given ID, or nil if the batch wasn't appended, which
+// 'AppendEntries' signals by returning 0.
+func appendedIDs(first uint64, n int) []uint64 {
+	if first == 0 || n == 0 {
+		return nil
+	}
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = first + uint64(i)
+	}
+	return ids
+}
+
+// Append a batch of entries, syncing after every 'syncEvery' if it is positive.
+func (db *LockFreeChunkDB) appendEntries(entries [][]byte, syncEvery int) (uint64, error) {
+	defer db.updateNewest()
 
 	if db.closed {
 		return 0, ErrClosed
 	}
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
 
 	originalNewest := db.next() - 1
 
-	var appended bool
-	for _, entry := range entries {
-		if err := db.append(entry); err != nil {
+	var appended, synced bool
+	for i, entry := range entries {
+		err := db.append(entry)
+		if err != nil && len(entries) > 1 {
+			err = &BatchAppendError{Index: i, Count: len(entries), Size: len(entry), Err: err}
+		}
+		if err == nil && syncEvery > 0 && (i+1)%syncEvery == 0 && i+1 < len(entries) {
+			err = db.sync()
+			synced = true
+		}
+		if err != nil {
 			// Rollback on error if we've already appended some entries.
 			if appended {
-				if rerr := db.rollback(originalNewest); rerr != nil {
+				rerr := db.rollback(originalNewest)
+				if rerr == nil && synced {
+					rerr = db.sync()
+				}
+				if rerr != nil {
 					return 0, &AtomicityError{AppendErr: err, RollbackErr: rerr}
 				}
 			}
+			db.noteReadOnly(err)
 			return 0, err
 		}
 		appended = true
 	}
 
-	return originalNewest + 1, db.periodicSync()
+	if db.observer != nil {
+		for i, entry := range entries {
+			id, size := originalNewest+1+uint64(i), len(entry)
+			db.observe(func(o Observer) { o.OnAppend(id, size) })
+		}
+	}
+
+	if err := db.periodicSync(); err != nil {
+		return originalNewest + 1, err
+	}
+	return originalNewest + 1, db.enforceMaxBytes(0)
+}
+
+// CompareAndAppend appends an entry only if the next ID is as expected, atomically. See the 'LockFreeChunkDB'
+// method for details.
+func (db *ChunkDB) CompareAndAppend(expectedNextID uint64, entry []byte) (uint64, error) {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.CompareAndAppend(expectedNextID, entry)
+}
+
+// CompareAndAppend appends an entry only if the ID it would be given is 'expectedNextID', returning that ID. This
+// allows a writer to append only if nothing else has changed the log since it last looked, as with an
+// optimistic lock: the expected ID is one more than the 'NewestID' the writer saw.
+//
+// Returns 'ErrConflict' if the next ID is not as expected, in which case nothing is appended, and otherwise the
+// same errors as 'Append'.
+func (db *LockFreeChunkDB) CompareAndAppend(expectedNextID uint64, entry []byte) (uint64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if db.next() != expectedNextID {
+		return 0, ErrConflict
+	}
+	return db.Append(entry)
+}
+
+// AppendIfFits appends an entry only if it fits in the final chunk, atomically. See the 'LockFreeChunkDB' method
+// for details.
+func (db *ChunkDB) AppendIfFits(entry []byte) (uint64, error) {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.AppendIfFits(entry)
+}
+
+// AppendIfFits appends an entry only if there is space for it in the final chunk, returning its ID, so that a new
+// chunk is never started. This gives control over where chunks begin: append with 'AppendIfFits' until it
+// returns 'ErrChunkFull', and then with 'Append' to start the next chunk. If there are no chunks yet, the first
+// one is created, as there is no final chunk to fill.
+//
+// Returns 'ErrChunkFull' if the entry doesn't fit, in which case nothing is appended, and otherwise the same
+// errors as 'Append'.
+func (db *LockFreeChunkDB) AppendIfFits(entry []byte) (uint64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if uint64(len(entry)) <= db.MaxEntrySize() && !db.fitsInFinalChunk(len(entry)) {
+		return 0, ErrChunkFull
+	}
+	return db.Append(entry)
+}
+
+// Check if an entry of the given size fits after the entries of the final chunk, or if there are no chunks.
+// Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) fitsInFinalChunk(size int) bool {
+	if len(db.chunks) == 0 {
+		return true
+	}
+	c := db.chunks[len(db.chunks)-1]
+	var start int32
+	if len(c.ends) > 0 {
+		start = alignUp(c.ends[len(c.ends)-1], c.align)
+	}
+	return uint64(start)+uint64(frameHeaderSize(db.version, size)+size) <= uint64(c.size)
+}
+
+// AppendReader appends an entry of exactly 'n' bytes read from the reader, atomically. The reader is read while
+// the write lock is held, so it should not block for long. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) AppendReader(r io.Reader, n int) (uint64, error) {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.AppendReader(r, n)
+}
+
+// AppendReader appends an entry of exactly 'n' bytes read from the reader, returning its ID. The bytes are read
+// straight into the chunk, rather than into an intermediate buffer.
+//
+// Returns 'ErrEntryLength' if the reader holds fewer or more than 'n' bytes, and 'ErrTooBig' if 'n' is larger
+// than the chunk size. If reading fails, the error from the reader is returned. In all these cases the entry is
+// not appended.
+func (db *LockFreeChunkDB) AppendReader(r io.Reader, n int) (uint64, error) {
+	defer db.updateNewest()
+
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if n < 0 {
+		return 0, ErrEntryLength
+	}
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	id := db.next()
+	if err := db.appendWith(n, nil, r); err != nil {
+		db.noteReadOnly(err)
+		return 0, err
+	}
+	db.observe(func(o Observer) { o.OnAppend(id, n) })
+
+	if err := db.periodicSync(); err != nil {
+		return id, err
+	}
+	return id, db.enforceMaxBytes(0)
 }
 
 // Get implements the 'LogDB' and 'CloseDB' interfaces.
@@ -165,43 +522,253 @@ func (db *LockFreeChunkDB) Get(id uint64) ([]byte, error) {
 		return nil, ErrClosed
 	}
 
-	// Check ID is in range.
-	if id < db.oldest || id >= db.next() || len(db.chunks) == 0 {
-		return nil, ErrIDOutOfRange
+	chunk, err := db.chunkFor(id)
+	if err != nil {
+		return nil, err
 	}
+	return db.readEntry(chunk, id)
+}
 
-	// Binary search through chunks for the one containing the ID.
-	lo := 0
-	hi := len(db.chunks)
-	mid := hi / 2
-	for ; !(db.chunks[mid].oldest <= id && id < db.chunks[mid].next()); mid = (hi + lo) / 2 {
-		if hi < lo {
-			panic("hi < lo")
+// GetMany looks up several entries by ID, atomically. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) GetMany(ids []uint64) ([][]byte, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.GetMany(ids)
+}
+
+// GetMany looks up several entries by ID, which may be in any order and may repeat, and returns them in the same
+// order as the IDs. The IDs are looked up in sorted order, so the chunk holding an entry is only searched for
+// when it differs from the one holding the entry before: this is faster than calling 'Get' for each ID.
+//
+// Returns an 'IDError' value wrapping 'ErrIDOutOfRange' if any ID is lower than the oldest or higher than the
+// newest, or wrapping 'ErrDeleted' if any entry has been deleted, in which case no entries are returned.
+func (db *LockFreeChunkDB) GetMany(ids []uint64) ([][]byte, error) {
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	for _, id := range ids {
+		if id < db.oldest || id >= db.next() {
+			return nil, &IDError{ID: id, Err: ErrIDOutOfRange}
 		}
-		if db.chunks[mid].next() <= id {
-			lo = mid + 1
-		} else if db.chunks[mid].oldest > id {
-			hi = mid - 1
+	}
+
+	order := idOrder{ids: ids, order: make([]int, len(ids))}
+	for i := range order.order {
+		order.order[i] = i
+	}
+	sort.Sort(order)
+
+	out := make([][]byte, len(ids))
+	var c *chunk
+	for _, i := range order.order {
+		id := ids[i]
+		if c == nil || id >= c.next() {
+			var err error
+			if c, err = db.chunkFor(id); err != nil {
+				return nil, &IDError{ID: id, Err: err}
+			}
+		}
+		entry, err := db.readEntry(c, id)
+		if err != nil {
+			return nil, &IDError{ID: id, Err: err}
 		}
+		out[i] = entry
 	}
+	return out, nil
+}
 
-	// Calculate the start and end offset, and return a copy of the relevant byte slice.
-	chunk := db.chunks[mid]
-	off := id - chunk.oldest
-	start := int32(0)
-	if off > 0 {
-		start = chunk.ends[off-1]
+// GetLatestN gets up to 'n' of the newest entries, atomically. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) GetLatestN(n int, newestFirst bool) ([]uint64, [][]byte, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.GetLatestN(n, newestFirst)
+}
+
+// GetLatestN gets the 'n' newest entries, or every entry if there are fewer, as a slice of IDs and a slice of
+// entries in the same order. The entries are oldest-first, or newest-first if 'newestFirst' is true. This is
+// for showing the most recent entries, such as the last few events on a dashboard.
+//
+// If the database is empty, or 'n' is not positive, both slices are empty.
+func (db *LockFreeChunkDB) GetLatestN(n int, newestFirst bool) ([]uint64, [][]byte, error) {
+	if db.closed {
+		return nil, nil, ErrClosed
+	}
+	if n <= 0 || db.empty() {
+		return nil, nil, nil
+	}
+
+	next := db.next()
+	start := db.oldest
+	if next > uint64(n) && next-uint64(n) > start {
+		start = next - uint64(n)
+	}
+
+	var ids []uint64
+	for id := start; id < next; id++ {
+		ids = append(ids, id)
+	}
+	if newestFirst {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+
+	entries, err := db.GetMany(ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ids, entries, nil
+}
+
+// Get a copy of an entry from the chunk which holds it. Assumes a lock (read or write) is held.
+//
+// Returns 'ErrDeleted' if the entry has been deleted.
+func (db *LockFreeChunkDB) readEntry(chunk *chunk, id uint64) ([]byte, error) {
+	if db.isDeleted(id) {
+		return nil, ErrDeleted
+	}
+	if entry, ok := db.cache.get(id); ok {
+		return entry, nil
 	}
-	end := chunk.ends[off]
+	out, err := db.readEntryBytes(chunk, id)
+	if err == nil {
+		db.cache.add(id, out)
+	}
+	return out, err
+}
+
+// Get a copy of an entry from the chunk file which holds it, bypassing the cache. Assumes a lock (read or write)
+// is held.
+func (db *LockFreeChunkDB) readEntryBytes(chunk *chunk, id uint64) ([]byte, error) {
+	// Calculate the start and end offset, and return a copy of the relevant byte slice.
+	start, end := chunk.entryRange(id - chunk.oldest)
 	out := make([]byte, end-start)
-	for i := start; i < end; i++ {
-		out[i-start] = chunk.bytes[i]
+
+	// With the file backend, read just the entry rather than every entry before it.
+	if db.backend == BackendFile {
+		if err := chunk.readAt(out, start); err != nil {
+			return nil, &ReadError{err}
+		}
+		return out, nil
+	}
+
+	err := db.withChunkBytes(chunk, func(bytes []byte) error {
+		copy(out, bytes[start:end])
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return out, nil
 }
 
+// GetNoCopy gets an entry without copying it, holding the read lock until the returned release function is
+// called. See the 'LockFreeChunkDB' method for the dangers of this.
+func (db *ChunkDB) GetNoCopy(id uint64) ([]byte, func(), error) {
+	db.rwlock.RLock()
+
+	entry, release, err := db.LockFreeChunkDB.GetNoCopy(id)
+	if err != nil {
+		db.rwlock.RUnlock()
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	return entry, func() {
+		once.Do(func() {
+			release()
+			db.rwlock.RUnlock()
+		})
+	}, nil
+}
+
+// GetNoCopy gets an entry without copying it: the returned slice refers directly to the memory-mapped chunk
+// file. The release function must be called once the entry is no longer needed.
+//
+// This is dangerous! The slice must not be modified, as that would change the database file without going
+// through 'Append'; and it must not be used after the release function is called, as the chunk may then be
+// unmapped, in which case using the slice will crash the program. Until the release function is called, no
+// writes can happen to a 'ChunkDB', and with the 'WithMaxMappedChunks' option no other reads can happen either.
+// Prefer 'Get' unless profiling shows the copy to be a problem.
+//
+// With the 'BackendFile' option there is nothing to refer to, so this is the same as 'Get', and the release
+// function does nothing.
+//
+// Returns 'ErrIDOutOfRange' if the requested ID is lower than the oldest or higher than the newest, and
+// 'ErrDeleted' if the entry has been deleted.
+func (db *LockFreeChunkDB) GetNoCopy(id uint64) ([]byte, func(), error) {
+	if db.closed {
+		return nil, nil, ErrClosed
+	}
+
+	if db.backend == BackendFile {
+		entry, err := db.Get(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		return entry, func() {}, nil
+	}
+
+	chunk, err := db.chunkFor(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if db.isDeleted(id) {
+		return nil, nil, ErrDeleted
+	}
+
+	release := func() {}
+	if db.maxMappedChunks > 0 {
+		db.mapLock.Lock()
+		if err := db.useChunk(chunk); err != nil {
+			db.mapLock.Unlock()
+			return nil, nil, err
+		}
+		var once sync.Once
+		release = func() { once.Do(db.mapLock.Unlock) }
+	}
+
+	start, end := chunk.entryRange(id - chunk.oldest)
+
+	// Limit the capacity, so appending to the entry can't write over the next one.
+	return chunk.bytes[start:end:end], release, nil
+}
+
+// GetSize gets the size in bytes of an entry, atomically.
+func (db *ChunkDB) GetSize(id uint64) (int, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.GetSize(id)
+}
+
+// GetSize gets the size in bytes of an entry, without copying it.
+//
+// Returns 'ErrIDOutOfRange' if the requested ID is lower than the oldest or higher than the newest, and
+// 'ErrDeleted' if the entry has been deleted.
+func (db *LockFreeChunkDB) GetSize(id uint64) (int, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+
+	chunk, err := db.chunkFor(id)
+	if err != nil {
+		return 0, err
+	}
+	if db.isDeleted(id) {
+		return 0, ErrDeleted
+	}
+
+	start, end := chunk.entryRange(id - chunk.oldest)
+	return int(end - start), nil
+}
+
 // Forget implements the 'LogDB', 'PersistDB', and 'CloseDB' interfaces.
 func (db *ChunkDB) Forget(newOldestID uint64) error {
+	defer db.deliverEvents()
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
 
@@ -213,11 +780,18 @@ func (db *LockFreeChunkDB) Forget(newOldestID uint64) error {
 	if db.closed {
 		return ErrClosed
 	}
-	return db.forget(newOldestID)
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.forget(newOldestID); err != nil {
+		return err
+	}
+	return db.maybeCompact()
 }
 
 // Rollback implements the 'LogDB', 'PersistDB', and 'CloseDB' interfaces.
 func (db *ChunkDB) Rollback(newNewestID uint64) error {
+	defer db.deliverEvents()
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
 
@@ -226,15 +800,56 @@ func (db *ChunkDB) Rollback(newNewestID uint64) error {
 
 // Rollback implements the 'LogDB', 'PersistDB', and 'CloseDB' interfaces.
 func (db *LockFreeChunkDB) Rollback(newNewestID uint64) error {
-	defer func() { db.newest = db.next() - 1 }()
+	defer db.updateNewest()
 	if db.closed {
 		return ErrClosed
 	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
 	return db.rollback(newNewestID)
 }
 
+// RollbackReporting is like 'Rollback', but returns the paths of the chunk data files deleted, atomically. See the
+// 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) RollbackReporting(newNewestID uint64) ([]string, error) {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.RollbackReporting(newNewestID)
+}
+
+// RollbackReporting is like 'Rollback', but returns the paths of the data files of the chunks deleted because all
+// of their entries were rolled back, oldest first, so that it can be checked how much disk space was freed. Each
+// chunk's metadata file is deleted along with its data file.
+//
+// If the rollback fails, the chunks which were deleted before the error are still returned, along with it.
+func (db *LockFreeChunkDB) RollbackReporting(newNewestID uint64) ([]string, error) {
+	defer db.updateNewest()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	before := append([]*chunk(nil), db.chunks...)
+	err := db.rollback(newNewestID)
+
+	// The chunks deleted are those no longer in the database.
+	var removed []string
+	for i, c := range before {
+		if i >= len(db.chunks) || db.chunks[i] != c {
+			removed = append(removed, c.path)
+		}
+	}
+	return removed, err
+}
+
 // Truncate implements the 'LogDB', 'PersistDB', and 'CloseDB' interfaces.
 func (db *ChunkDB) Truncate(newOldestID, newNewestID uint64) error {
+	defer db.deliverEvents()
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
 
@@ -243,31 +858,317 @@ func (db *ChunkDB) Truncate(newOldestID, newNewestID uint64) error {
 
 // Truncate implements the 'LogDB', 'PersistDB', and 'CloseDB' interfaces.
 func (db *LockFreeChunkDB) Truncate(newOldestID, newNewestID uint64) error {
-	defer func() { db.newest = db.next() - 1 }()
+	defer db.updateNewest()
 	if db.closed {
 		return ErrClosed
 	}
-	if newNewestID < newOldestID {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	// Check both ends before changing anything, so a bad range leaves the log as it was.
+	if newNewestID < newOldestID || newOldestID >= db.next() || newNewestID < db.oldest {
 		return ErrIDOutOfRange
 	}
-	if err := db.forget(newOldestID); err != nil {
+
+	// Remove entries from both ends before considering a periodic sync, so that the sync sees the whole
+	// truncation rather than firing in between.
+	if newOldestID >= db.oldest {
+		if err := db.removeOldest(newOldestID); err != nil {
+			return err
+		}
+	}
+	if newNewestID+1 <= db.next() {
+		if err := db.removeNewest(newNewestID + 1); err != nil {
+			return err
+		}
+	}
+	if err := db.periodicSync(); err != nil {
 		return err
 	}
-	return db.rollback(newNewestID)
+	return db.maybeCompact()
 }
 
-// OldestID implements the 'LogDB' interface.
-func (db *LockFreeChunkDB) OldestID() uint64 {
-	return db.oldest
+// TruncateCounting performs a 'Truncate', and returns how many entries were forgotten from the start of the
+// log and how many were rolled back from the end.
+func (db *ChunkDB) TruncateCounting(newOldestID, newNewestID uint64) (uint64, uint64, error) {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.TruncateCounting(newOldestID, newNewestID)
 }
 
-// NewestID implements the 'LogDB' interface.
-func (db *LockFreeChunkDB) NewestID() uint64 {
-	return db.newest
+// TruncateCounting performs a 'Truncate', and returns how many entries were forgotten from the start of the
+// log and how many were rolled back from the end.
+//
+// The counts reflect what was actually removed, so they are still meaningful if an error is returned part-way
+// through.
+func (db *LockFreeChunkDB) TruncateCounting(newOldestID, newNewestID uint64) (uint64, uint64, error) {
+	if db.closed {
+		return 0, 0, ErrClosed
+	}
+
+	oldOldest, oldNext := db.oldest, db.next()
+	err := db.Truncate(newOldestID, newNewestID)
+	return db.oldest - oldOldest, oldNext - db.next(), err
+}
+
+// TimestampOf looks up the time at which an entry was appended. This is fixed when the entry is appended, and
+// never changes. Timestamps never decrease: an entry is never older than one appended before it.
+//
+// Returns 'ErrIDOutOfRange' if the requested ID is not present in the log, and 'ErrNoTimestamps' if the disk
+// format version of the database does not store timestamps.
+func (db *ChunkDB) TimestampOf(id uint64) (time.Time, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.TimestampOf(id)
+}
+
+// TimestampOf looks up the time at which an entry was appended. This is fixed when the entry is appended, and
+// never changes. Timestamps never decrease: an entry is never older than one appended before it.
+//
+// Returns 'ErrIDOutOfRange' if the requested ID is not present in the log, and 'ErrNoTimestamps' if the disk
+// format version of the database does not store timestamps.
+func (db *LockFreeChunkDB) TimestampOf(id uint64) (time.Time, error) {
+	if db.closed {
+		return time.Time{}, ErrClosed
+	}
+	if !versionHasTimestamps(db.version) {
+		return time.Time{}, ErrNoTimestamps
+	}
+
+	chunk, err := db.chunkFor(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(chunk.stamps[id-chunk.oldest])), nil
+}
+
+// ForgetBefore removes all entries appended before the given time, and returns the new oldest ID. If no entries
+// are that old, this is a no-op.
+//
+// If every entry is older than the given time, then every entry is removed: 'OldestID' becomes one greater than
+// 'NewestID', and newly appended entries continue on from the old IDs.
+//
+// Returns 'ErrNoTimestamps' if the disk format version of the database does not store timestamps.
+func (db *ChunkDB) ForgetBefore(t time.Time) (uint64, error) {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.ForgetBefore(t)
+}
+
+// ForgetBefore removes all entries appended before the given time, and returns the new oldest ID. If no entries
+// are that old, this is a no-op.
+//
+// If every entry is older than the given time, then every entry is removed: 'OldestID' becomes one greater than
+// 'NewestID', and newly appended entries continue on from the old IDs.
+//
+// Returns 'ErrNoTimestamps' if the disk format version of the database does not store timestamps.
+func (db *LockFreeChunkDB) ForgetBefore(t time.Time) (uint64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	if !versionHasTimestamps(db.version) {
+		return 0, ErrNoTimestamps
+	}
+
+	// Timestamps are nanoseconds since the epoch, so nothing is older than it.
+	var cutoff uint64
+	if t.After(time.Unix(0, 0)) {
+		cutoff = uint64(t.UnixNano())
+	}
+
+	// As timestamps never decrease, binary search for the first chunk with an entry at least as new as the
+	// cut-off, and then for the first such entry in it.
+	cid := sort.Search(len(db.chunks), func(i int) bool {
+		c := db.chunks[i]
+		return len(c.stamps) > 0 && c.stamps[len(c.stamps)-1] >= cutoff
+	})
+	newOldestID := db.next()
+	if cid < len(db.chunks) {
+		c := db.chunks[cid]
+		newOldestID = c.oldest + uint64(sort.Search(len(c.stamps), func(i int) bool { return c.stamps[i] >= cutoff }))
+	}
+
+	if newOldestID > db.oldest {
+		if err := db.forgetUpTo(newOldestID); err != nil {
+			return db.oldest, err
+		}
+	}
+	return db.oldest, db.maybeCompact()
+}
+
+// Drain removes every entry, and deletes every chunk file. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) Drain() error {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.Drain()
+}
+
+// Drain removes every entry, and deletes every chunk file, so the database takes up as little space as it can.
+// Afterwards 'OldestID' is one greater than 'NewestID', and newly appended entries continue on from the old IDs.
+// Unlike forgetting every entry, this deletes the final chunk too. The database is synced.
+func (db *LockFreeChunkDB) Drain() error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// Once every chunk is gone, the next ID can only be found from the "oldest" file, so write it first.
+	next := db.next()
+	if err := writeOldestFile(db.fs, db.path, next); err != nil {
+		return &WriteError{err}
+	}
+	if next > db.oldest {
+		db.setOldest(next)
+		db.observe(func(o Observer) { o.OnForget(next) })
+	}
+
+	for _, c := range db.chunks {
+		db.syncDirty[c] = struct{}{}
+		c.delete = true
+	}
+	if err := db.sync(); err != nil {
+		return err
+	}
+	db.chunks = nil
+	return nil
+}
+
+// OldestID implements the 'LogDB' interface. It doesn't take a lock, even for a 'ChunkDB', so it can be called
+// as often as needed, for example for monitoring, without getting in the way of writers.
+func (db *LockFreeChunkDB) OldestID() uint64 {
+	return atomic.LoadUint64(&db.publicOldest)
+}
+
+// NewestID implements the 'LogDB' interface. Like 'OldestID', it doesn't take a lock.
+func (db *LockFreeChunkDB) NewestID() uint64 {
+	return atomic.LoadUint64(&db.publicNewest)
+}
+
+// NextID gets the ID the next appended entry will have, which is one more than 'NewestID'. Like 'OldestID', it
+// doesn't take a lock.
+func (db *LockFreeChunkDB) NextID() uint64 {
+	return atomic.LoadUint64(&db.publicNewest) + 1
+}
+
+// OldestEntry gets the ID and contents of the oldest log entry, atomically.
+//
+// Returns 'ErrEmpty' if the database is empty.
+func (db *ChunkDB) OldestEntry() (uint64, []byte, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.OldestEntry()
+}
+
+// OldestEntry gets the ID and contents of the oldest log entry.
+//
+// Returns 'ErrEmpty' if the database is empty.
+func (db *LockFreeChunkDB) OldestEntry() (uint64, []byte, error) {
+	if db.closed {
+		return 0, nil, ErrClosed
+	}
+	if db.empty() {
+		return 0, nil, ErrEmpty
+	}
+
+	entry, err := db.Get(db.oldest)
+	if err != nil {
+		return 0, nil, err
+	}
+	return db.oldest, entry, nil
+}
+
+// NewestEntry gets the ID and contents of the newest log entry, atomically.
+//
+// Returns 'ErrEmpty' if the database is empty.
+func (db *ChunkDB) NewestEntry() (uint64, []byte, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.NewestEntry()
+}
+
+// NewestEntry gets the ID and contents of the newest log entry.
+//
+// Returns 'ErrEmpty' if the database is empty.
+func (db *LockFreeChunkDB) NewestEntry() (uint64, []byte, error) {
+	if db.closed {
+		return 0, nil, ErrClosed
+	}
+	if db.empty() {
+		return 0, nil, ErrEmpty
+	}
+
+	newest := db.next() - 1
+	entry, err := db.Get(newest)
+	if err != nil {
+		return 0, nil, err
+	}
+	return newest, entry, nil
+}
+
+// Len gets the number of entries in the log, atomically.
+func (db *ChunkDB) Len() uint64 {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.Len()
+}
+
+// Len gets the number of entries in the log. This is the number of IDs from the oldest to the newest, so entries
+// which have been deleted with 'Delete' are still counted.
+func (db *LockFreeChunkDB) Len() uint64 {
+	if db.oldest == 0 {
+		return 0
+	}
+	return db.next() - db.oldest
+}
+
+// IsEmpty checks if there are no entries in the log, atomically.
+func (db *ChunkDB) IsEmpty() bool {
+	return db.Len() == 0
+}
+
+// IsEmpty checks if there are no entries in the log. This is the case both for a database which has never
+// been written to, and for one where every entry has been forgotten.
+func (db *LockFreeChunkDB) IsEmpty() bool {
+	return db.Len() == 0
+}
+
+// Exists checks if an entry is in the log, atomically.
+func (db *ChunkDB) Exists(id uint64) bool {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.Exists(id)
+}
+
+// Exists checks if an entry is in the log: that is, it has been appended and not forgotten, rolled back, or
+// deleted. This is cheaper than 'Get', as the entry is not copied.
+//
+// Returns false if the database is closed.
+func (db *LockFreeChunkDB) Exists(id uint64) bool {
+	if db.closed || db.oldest == 0 {
+		return false
+	}
+	return id >= db.oldest && id < db.next() && !db.isDeleted(id)
 }
 
 // SetSync implements the 'PersistDB' and 'CloseDB' interface.
 func (db *ChunkDB) SetSync(every int) error {
+	defer db.deliverEvents()
 	db.syncEvery = every
 
 	// Immediately perform a periodic sync.
@@ -290,29 +1191,150 @@ func (db *LockFreeChunkDB) SetSync(every int) error {
 	return db.periodicSync()
 }
 
-// Sync implements the 'PersistDB' and 'CloseDB' interface.
-func (db *ChunkDB) Sync() error {
+// SetSyncBytes sets a threshold on the number of bytes appended between syncs, in addition to the number of
+// changes set with 'SetSync'. A sync happens when either threshold is exceeded. A value of 0 disables the byte
+// threshold, which is the default.
+func (db *ChunkDB) SetSyncBytes(n uint64) error {
+	defer db.deliverEvents()
+	db.syncBytes = n
+
+	// Immediately perform a periodic sync.
 	db.rwlock.RLock()
 	defer db.rwlock.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.periodicSync()
+}
+
+// SetSyncBytes sets a threshold on the number of bytes appended between syncs, in addition to the number of
+// changes set with 'SetSync'. A sync happens when either threshold is exceeded. A value of 0 disables the byte
+// threshold, which is the default.
+func (db *LockFreeChunkDB) SetSyncBytes(n uint64) error {
+	db.syncBytes = n
+
+	// Immediately perform a periodic sync.
+	if db.closed {
+		return ErrClosed
+	}
+	return db.periodicSync()
+}
+
+// Sync implements the 'PersistDB' and 'CloseDB' interface.
+//
+// If the 'WithTrimTail' option is used, the write lock is taken, as the final chunk is mapped again after it is
+// trimmed.
+func (db *ChunkDB) Sync() error {
+	defer db.deliverEvents()
+	lock := db.rwlock.RLocker()
+	if db.trimTail {
+		lock = &db.rwlock
+	}
+	lock.Lock()
+	defer lock.Unlock()
 
 	return db.LockFreeChunkDB.Sync()
 }
 
 // Sync implements the 'PersistDB' and 'CloseDB' interface.
+//
+// If the 'WithTrimTail' option is used, the data file of the final chunk is then cut off after its final entry.
 func (db *LockFreeChunkDB) Sync() error {
 	if db.closed {
 		return ErrClosed
 	}
-	return db.sync()
+	if err := db.sync(); err != nil {
+		return err
+	}
+	if db.trimTail && len(db.chunks) > 0 {
+		if c := db.chunks[len(db.chunks)-1]; !c.trimmed && len(c.ends) > 0 {
+			if err := c.resize(c.trimmedSize()); err != nil {
+				return &SyncError{err}
+			}
+			c.trimmed = true
+		}
+	}
+	return nil
+}
+
+// Checkpoint syncs the database and returns the next ID at the time of the sync, atomically. See the
+// 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) Checkpoint() (uint64, error) {
+	defer db.deliverEvents()
+	lock := db.rwlock.RLocker()
+	if db.trimTail {
+		lock = &db.rwlock
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	return db.LockFreeChunkDB.Checkpoint()
+}
+
+// Checkpoint performs a 'Sync', and returns the ID the next appended entry would have had at the time: every
+// entry with a lower ID is then durable, unless it is later forgotten or rolled back. This is a watermark which
+// can be handed to consumers which must only see entries that survive a crash.
+func (db *LockFreeChunkDB) Checkpoint() (uint64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+
+	next := db.next()
+	if err := db.Sync(); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// DiskUsage returns the total size, in bytes, of the files in the database directory.
+func (db *ChunkDB) DiskUsage() (uint64, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.DiskUsage()
+}
+
+// DiskUsage returns the total size, in bytes, of the files in the database directory.
+func (db *LockFreeChunkDB) DiskUsage() (uint64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+
+	usage, err := db.diskUsage()
+	if err != nil {
+		return 0, &ReadError{err}
+	}
+	return usage, nil
+}
+
+// MaxEntrySize implements the 'BoundedDB' interface, atomically. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) MaxEntrySize() uint64 {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.MaxEntrySize()
 }
 
-// MaxEntrySize implements the 'BoundedDB' interface.
+// MaxEntrySize implements the 'BoundedDB' interface. This is the chunk size, less the size of the frame header
+// if the disk format version has framing. Alignment doesn't reduce it, as the first entry of a chunk is never
+// padded. The chunk size can be changed with 'SetChunkSize', so this should be asked again afterwards.
 func (db *LockFreeChunkDB) MaxEntrySize() uint64 {
-	return uint64(db.chunkSize)
+	size := int(db.chunkSize)
+	for size > 0 && size+frameHeaderSize(db.version, size) > int(db.chunkSize) {
+		size--
+	}
+	return uint64(size)
 }
 
 // Close implements the 'CloseDB' interface. This also closes the underlying 'LockFreeChunkDB'.
 func (db *ChunkDB) Close() error {
+	defer db.deliverEvents()
+
+	db.stopScrub()
+
+	// A background compaction needs the lock to finish.
+	db.compactWG.Wait()
+
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
 
@@ -320,17 +1342,25 @@ func (db *ChunkDB) Close() error {
 }
 
 // Close implements the 'CloseDB' interface.
+//
+// The database is synced in full before the chunk files are unmapped and the lock is released, whatever the
+// 'SetSync' and 'SetSyncBytes' settings, so every change made before 'Close' is durable once it returns. If the
+// sync fails, the files are closed and the lock released anyway, and the error is returned. Use 'CloseAbort' to
+// discard the changes since the last sync instead.
 func (db *LockFreeChunkDB) Close() error {
 	if db.closed {
 		return ErrClosed
 	}
 
-	// First sync everything
-	err := db.sync()
+	// First sync everything, unless nothing can have changed.
+	var err error
+	if !db.openReadOnly {
+		err = db.sync()
+	}
 
 	// Then close the open files
 	for _, c := range db.chunks {
-		_ = c.mmapf.Close()
+		_ = c.close()
 	}
 
 	// Then release the lock
@@ -343,75 +1373,488 @@ func (db *LockFreeChunkDB) Close() error {
 	return err
 }
 
+// CloseAbort closes the database without syncing it, discarding the changes made since the last sync. See the
+// 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) CloseAbort() error {
+	defer db.deliverEvents()
+
+	db.stopScrub()
+
+	// A background compaction needs the lock to finish.
+	db.compactWG.Wait()
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.CloseAbort()
+}
+
+// CloseAbort closes the database without syncing it, discarding the entries appended since the last sync. This
+// is useful for abandoning an import which failed part-way through.
+//
+// This relies on entries only becoming visible on disk when their metadata is synced. However, a chunk is always
+// synced before the next one is started, so if entries filled a chunk since the last sync then they are kept,
+// and only those in the final chunk are discarded. Forgets and rollbacks since the last sync are discarded too,
+// but if entries which had been synced were rolled back, the bytes of those entries may since have been
+// overwritten, so the database is synced as by 'Close' instead, and 'ErrCannotAbort' is returned.
+func (db *LockFreeChunkDB) CloseAbort() error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.rolledBackSynced {
+		if err := db.Close(); err != nil {
+			return err
+		}
+		return ErrCannotAbort
+	}
+
+	for _, c := range db.chunks {
+		_ = c.close()
+	}
+
+	funlock(db.lockfile)
+	db.closed = true
+
+	return nil
+}
+
 ////////// HELPERS //////////
 
-// Create a database. It is an error to call this function if the database directory already exists.
-func createdb(path string, chunkSize uint32) (*LockFreeChunkDB, error) {
+// Create a database with the given disk format version. It is an error to call this function if the database
+// directory already exists.
+func createdb(path string, chunkSize uint32, version uint16, o options) (*LockFreeChunkDB, error) {
+	fs := o.fs
+
+	if o.alignment&(o.alignment-1) != 0 || (o.alignment > 1 && versionHasFraming(version)) {
+		return nil, ErrAlignment
+	}
+
 	// Create the directory.
-	if err := os.MkdirAll(path, os.ModeDir|0755); err != nil {
+	if err := fs.MkdirAll(path, os.ModeDir|0755); err != nil {
 		return nil, &PathError{err}
 	}
 
 	// Write the version file
-	if err := writeFile(path+"/version", latestVersion); err != nil {
+	if err := writeFile(fs, filepath.Join(path, "version"), version); err != nil {
 		return nil, &WriteError{err}
 	}
 
 	// Lock the "version" file.
-	lockfile, err := flock(path + "/version")
+	lockfile, err := flock(fs, filepath.Join(path, "version"))
 	if err != nil {
 		return nil, &LockError{err}
 	}
 
 	// Write the chunk size file
-	if err := writeFile(path+"/chunk_size", chunkSize); err != nil {
+	if err := writeFile(fs, filepath.Join(path, "chunk_size"), chunkSize); err != nil {
 		return nil, &WriteError{err}
 	}
 
-	// Write the "oldest" file.
-	if err := writeFile(path+"/oldest", uint64(0)); err != nil {
+	// Write the "oldest" file, which records where the IDs start until the first entry is appended.
+	if err := writeOldestFile(fs, path, o.startID); err != nil {
 		return nil, &WriteError{err}
 	}
 
-	return &LockFreeChunkDB{
+	// Write the "alignment" file, if entries are padded.
+	if o.alignment > 1 {
+		if err := writeFile(fs, filepath.Join(path, "alignment"), o.alignment); err != nil {
+			return nil, &WriteError{err}
+		}
+	}
+
+	db := &LockFreeChunkDB{
 		path:      path,
 		closed:    false,
 		lockfile:  lockfile,
+		version:   version,
+		options:   o,
 		chunkSize: chunkSize,
+		cache:     newReadCache(o.readCacheEntries),
 		syncEvery: 256,
 		syncDirty: make(map[*chunk]struct{}),
-	}, nil
+	}
+	db.setOldest(o.startID)
+	db.updateNewest()
+	return db, nil
+}
+
+// Open an existing database. It is an error to call this function if the database directory does not exist. If
+// the expected chunk size is 0, the stored chunk size is used without checking.
+func opendb(path string, expectedChunkSize uint32, o options) (*LockFreeChunkDB, error) {
+	fs := o.fs
+
+	// Read the "version" file.
+	var version uint16
+	if err := readFile(fs, filepath.Join(path, "version"), &version); err != nil {
+		return nil, &ReadError{err}
+	}
+
+	// Open the database in the way its version calls for.
+	open, ok := versionOpeners[version]
+	if !ok {
+		return nil, ErrUnknownVersion
+	}
+	return open(path, expectedChunkSize, version, o)
+}
+
+// Open an existing database with one of the chunk-based disk format versions, which all versions so far are.
+func opendbVersion(path string, expectedChunkSize uint32, version uint16, o options) (*LockFreeChunkDB, error) {
+	fs := o.fs
+
+	// Lock the "version" file, unless the database is only being read.
+	var lockfile File
+	if !o.openReadOnly {
+		var err error
+		if lockfile, err = flock(fs, filepath.Join(path, "version")); err != nil {
+			return nil, &LockError{err}
+		}
+	}
+
+	// If opening fails, release the lock, so the files can be repaired.
+	opened := false
+	defer func() {
+		if !opened {
+			funlock(lockfile)
+		}
+	}()
+
+	chunkSize, chunks, oldest, err := loadChunks(path, expectedChunkSize, version, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the IDs of deleted entries, and find any spare chunk data files left by 'Preallocate', which are
+	// only of use to a writer.
+	tombstones, err := readTombstones(fs, path)
+	if err != nil {
+		err = &ReadError{err}
+	}
+	var spares []string
+	var nextSpare uint64
+	if err == nil && !o.openReadOnly {
+		spares, nextSpare, err = findSpareFiles(fs, path, chunkSize)
+	}
+	if err != nil {
+		for _, c := range chunks {
+			_ = c.close()
+		}
+		return nil, err
+	}
+
+	db := &LockFreeChunkDB{
+		path:       path,
+		closed:     false,
+		lockfile:   lockfile,
+		version:    version,
+		options:    o,
+		readOnly:   o.openReadOnly,
+		chunkSize:  chunkSize,
+		chunks:     chunks,
+		tombstones: tombstones,
+		cache:      newReadCache(o.readCacheEntries),
+		syncEvery:  100,
+		syncDirty:  make(map[*chunk]struct{}),
+		spares:     spares,
+		nextSpare:  nextSpare,
+	}
+	db.setOldest(oldest)
+	db.updateNewest()
+	db.dropStaleTombstones()
+	db.loadDigests()
+	db.lockNewest()
+	opened = true
+
+	return db, nil
+}
+
+// Read the chunk size, chunks, and oldest ID of an existing database, setting the alignment in the options. If
+// the database is being opened with 'WithReadOnly', nothing is changed on disk: leftovers from interrupted
+// operations are not tidied up, and trimmed, corrupt, or rebuilt chunks are not fixed.
+//
+// If reading fails, any chunks opened so far are closed.
+func loadChunks(path string, expectedChunkSize uint32, version uint16, o *options) (uint32, []*chunk, uint64, error) {
+	fs := o.fs
+	writable := !o.openReadOnly
+
+	var chunks []*chunk
+	loaded := false
+	defer func() {
+		if !loaded {
+			for _, c := range chunks {
+				if c != nil {
+					_ = c.close()
+				}
+			}
+		}
+	}()
+
+	// Read the "chunk_size" file. Chunks created before the chunk size was changed may have one of the older
+	// sizes.
+	sizes, err := readChunkSizes(fs, path)
+	if err != nil {
+		return 0, nil, 0, &ReadError{err}
+	}
+	chunkSize := sizes[0]
+
+	// Read the "alignment" file, if entries are padded.
+	if o.alignment, err = readAlignment(fs, path); err != nil {
+		return 0, nil, 0, &ReadError{err}
+	}
+
+	// Check the chunk size matches, if one was given.
+	if expectedChunkSize != 0 && expectedChunkSize != chunkSize {
+		return 0, nil, 0, &ChunkSizeError{
+			ChunkFilePath: filepath.Join(path, "chunk_size"),
+			Expected:      chunkSize,
+			Actual:        expectedChunkSize,
+		}
+	}
+
+	// Get all the chunk files.
+	chunkFiles, err := findChunkFiles(fs, path, version, writable)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	// Populate the chunk slice.
+	chunks = make([]*chunk, len(chunkFiles))
+	var prior *chunk
+	var empty bool
+	for i, fi := range chunkFiles {
+		// Normally a chunk contains at least one entry. This may only false for the final chunk. So if
+		// we have a chunk file to process and the 'empty' flag is set, then we have an error.
+		if empty {
+			err := &FormatError{
+				FilePath: prior.metaFilePath(),
+				Err:      ErrEmptyNonfinalChunk,
+			}
+			if !o.truncateAtDamage {
+				return 0, nil, 0, err
+			}
+			if err := discardChunksFrom(path, chunkFiles[i:], o, err); err != nil {
+				return 0, nil, 0, err
+			}
+			chunks = chunks[:i]
+			break
+		}
+
+		// A trimmed final chunk is grown back to the full size, so that it can be appended to.
+		size := chunkSizeFor(fi.Size(), sizes)
+		if o.trimTail && writable && i == len(chunkFiles)-1 {
+			if err := growChunkFile(fs, filepath.Join(path, fi.Name()), size); err != nil {
+				return 0, nil, 0, &WriteError{err}
+			}
+		}
+
+		c, err := openChunkFile(fs, o.backend, version, path, fi, prior, size)
+		c.align = int32(o.alignment)
+		if err != nil && isDamage(err) && o.skipCorruptTail && writable && i == len(chunkFiles)-1 {
+			if err := discardChunkFiles(fs, path, fi, o.observer, err); err != nil {
+				return 0, nil, 0, err
+			}
+			if o.logger != nil {
+				o.log("warn", "discarded corrupt final chunk", "path", filepath.Join(path, fi.Name()), "error", err)
+			}
+			chunks = chunks[:i]
+			break
+		} else if err != nil && isDamage(err) && o.truncateAtDamage {
+			if err := discardChunksFrom(path, chunkFiles[i:], o, err); err != nil {
+				return 0, nil, 0, err
+			}
+			chunks = chunks[:i]
+			break
+		} else if err != nil {
+			return 0, nil, 0, err
+		}
+		chunks[i] = &c
+		prior = &c
+		empty = len(c.ends) == 0
+
+		// Write out metadata which had to be rebuilt from the frames in the data file.
+		if c.rebuilt && writable {
+			if err := c.syncMeta(); err != nil {
+				return 0, nil, 0, &WriteError{err}
+			}
+			c.rebuilt = false
+			if o.logger != nil {
+				o.log("warn", "rebuilt chunk metadata", "path", c.path)
+			}
+		}
+
+		// Only keep the newest chunks mapped, if the number of mapped chunks is limited.
+		if o.maxMappedChunks > 0 && i >= o.maxMappedChunks {
+			if err := chunks[i-o.maxMappedChunks].unmap(); err != nil {
+				return 0, nil, 0, &ReadError{err}
+			}
+		}
+	}
+
+	// The final chunk may have no entries, if the program died between creating it and appending to it. Unless
+	// it is the only chunk, in which case its name is all that records the next ID, delete it: the chunk before
+	// it ends at the same ID.
+	if n := len(chunks); writable && n > 1 && len(chunks[n-1].ends) == 0 {
+		if err := chunks[n-1].closeAndRemove(); err != nil {
+			return 0, nil, 0, &DeleteError{err}
+		}
+		if o.logger != nil {
+			o.log("warn", "deleted empty final chunk", "path", chunks[n-1].path)
+		}
+		chunks = chunks[:n-1]
+	}
+
+	// If we cannot read the "oldest" file OR the oldest entry according to the metadata is older than the
+	// oldest entry we actually have, bump it up to the newer one. This could happen if a chunk is forgotten
+	// and then the program crashes before the "oldest" file gets rewritten.
+	// A damaged "oldest" file is treated as missing, rather than trusting whatever it holds.
+	oldest, err := readOldestFile(fs, path)
+	if err != nil || (len(chunks) > 0 && oldest < chunks[0].oldest) {
+		oldest = 0
+		if len(chunks) > 0 {
+			oldest = chunks[0].oldest
+		}
+		if o.logger != nil {
+			o.log("warn", "oldest ID taken from chunks", "oldest", oldest, "error", err)
+		}
+	}
+
+	// Similarly, if the final chunk was lost, the "oldest" file may refer to entries which are now gone.
+	if len(chunks) > 0 && oldest > chunks[len(chunks)-1].next() {
+		last := chunks[len(chunks)-1]
+		if o.strictOldest {
+			return 0, nil, 0, &ChunkContinuityError{
+				ChunkFilePath: last.path,
+				Expected:      last.next(),
+				Actual:        oldest,
+			}
+		}
+		oldest = last.next()
+		if o.logger != nil {
+			o.log("warn", "oldest ID taken from chunks", "oldest", oldest)
+		}
+	}
+
+	loaded = true
+	return chunkSize, chunks, oldest, nil
+}
+
+// The "oldest" file holds the oldest ID followed by a checksum of it, so that a damaged file can be told apart from
+// a good one. Files written before the checksum was added hold just the ID, and are trusted.
+type oldestRecord struct {
+	Oldest   uint64
+	Checksum uint32
+}
+
+// The size of an "oldest" file without a checksum.
+const uncheckedOldestSize = 8
+
+// Make the "oldest" file contents for an ID.
+func newOldestRecord(oldest uint64) oldestRecord {
+	var buf [uncheckedOldestSize]byte
+	binary.LittleEndian.PutUint64(buf[:], oldest)
+	return oldestRecord{Oldest: oldest, Checksum: crc32.Checksum(buf[:], metaCRCTable)}
+}
+
+// Write the "oldest" file of the database at the given path.
+func writeOldestFile(fs FileSystem, path string, oldest uint64) error {
+	return writeFile(fs, filepath.Join(path, "oldest"), newOldestRecord(oldest))
+}
+
+// Read the "alignment" file of the database at the given path, which only exists if entries are padded. Returns 0
+// if there is no such file, and 'ErrCorrupt' if the alignment is not a power of two.
+func readAlignment(fs FileSystem, path string) (uint32, error) {
+	var alignment uint32
+	err := readFile(fs, filepath.Join(path, "alignment"), &alignment)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if alignment&(alignment-1) != 0 {
+		return 0, ErrCorrupt
+	}
+	return alignment, nil
+}
+
+// Read the "oldest" file of the database at the given path. Returns 'ErrCorrupt' if it is the wrong size or the
+// checksum doesn't match.
+func readOldestFile(fs FileSystem, path string) (uint64, error) {
+	file, err := fs.OpenFile(filepath.Join(path, "oldest"), os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	bs, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+
+	switch len(bs) {
+	case uncheckedOldestSize:
+		return binary.LittleEndian.Uint64(bs), nil
+	case binary.Size(oldestRecord{}):
+		oldest := binary.LittleEndian.Uint64(bs)
+		if newOldestRecord(oldest).Checksum != binary.LittleEndian.Uint32(bs[uncheckedOldestSize:]) {
+			return 0, ErrCorrupt
+		}
+		return oldest, nil
+	default:
+		return 0, ErrCorrupt
+	}
 }
 
-// Open an existing database. It is an error to call this function if the database directory does not exist.
-func opendb(path string) (*LockFreeChunkDB, error) {
-	// Read the "version" file.
-	var version uint16
-	if err := readFile(path+"/version", &version); err != nil {
-		return nil, &ReadError{err}
+// Delete the files of a chunk which is being discarded as it could not be opened, and tell the observer.
+func discardChunkFiles(fs FileSystem, path string, fi os.FileInfo, observer Observer, openErr error) error {
+	dataPath := filepath.Join(path, fi.Name())
+	if err := fs.Remove(dataPath); err != nil {
+		return &DeleteError{err}
 	}
-
-	// Check the version.
-	if version != 0 {
-		return nil, ErrUnknownVersion
+	if err := fs.Remove(metaFilePath(dataPath)); err != nil && !os.IsNotExist(err) {
+		return &DeleteError{err}
 	}
+	if co, ok := observer.(CorruptTailObserver); ok {
+		co.OnCorruptTail(dataPath, openErr)
+	}
+	return nil
+}
 
-	// Lock the "version" file.
-	lockfile, err := flock(path + "/version")
-	if err != nil {
-		return nil, &LockError{err}
+// Check if an error opening a chunk is from damage to its files. Other errors, such as failing to read a file or
+// running out of memory to map it, may not happen again, so they must not cause the chunk to be discarded.
+func isDamage(err error) bool {
+	_, ok := err.(*FormatError)
+	return ok
+}
+
+// Cut the log short at a chunk which is damaged, by deleting the files of it and every later chunk, and telling the
+// observer of each. A read-only database is left as it is, and the chunks are just not opened.
+func discardChunksFrom(path string, chunkFiles []os.FileInfo, o *options, openErr error) error {
+	if o.logger != nil {
+		o.log("warn", "discarded chunks from damaged chunk", "path", filepath.Join(path, chunkFiles[0].Name()), "chunks", len(chunkFiles), "error", openErr)
+	}
+	if o.openReadOnly {
+		return nil
 	}
+	for _, fi := range chunkFiles {
+		if err := discardChunkFiles(o.fs, path, fi, o.observer, openErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Read the "chunk_size" file.
-	var chunkSize uint32
-	if err := readFile(path+"/chunk_size", &chunkSize); err != nil {
-		return nil, &ReadError{err}
+// Find the chunk data files of a database, in order. Leftovers from an interrupted forget, rollback, or
+// compaction, and a final chunk which was never fully created, are skipped, and deleted if 'tidy' is true.
+func findChunkFiles(fs FileSystem, path string, version uint16, tidy bool) ([]os.FileInfo, error) {
+	remove := func(name string) {
+		if tidy {
+			_ = fs.Remove(name)
+		}
 	}
 
-	// Get all the chunk files.
 	var chunkFiles []os.FileInfo
 	var metaFiles []os.FileInfo
-	fis, err := ioutil.ReadDir(path)
+	fis, err := fs.ReadDir(path)
 	if err != nil {
 		return nil, &ReadError{err}
 	}
@@ -428,13 +1871,24 @@ func opendb(path string) (*LockFreeChunkDB, error) {
 
 	sort.Sort(fileInfoSlice(chunkFiles))
 
+	// Discard any half-finished compaction, metadata rewrite, or staged append.
+	if tidy {
+		removeCompactionFiles(fs, path)
+		_ = fs.Remove(filepath.Join(path, syncMetaFile))
+		for _, fi := range fis {
+			if strings.HasPrefix(fi.Name(), stagedFilePrefix) {
+				_ = fs.Remove(filepath.Join(path, fi.Name()))
+			}
+		}
+	}
+
 	if len(metaFiles) > 0 {
 		// There may be metadata files without accompanying
 		// data files, if the program died while deleting.
 		// Delete such files.
 		for _, fi := range metaFiles {
-			if _, err := os.Stat(path + "/" + dataFilePath(fi.Name())); err != nil {
-				_ = os.Remove(path + "/" + fi.Name())
+			if _, err := fs.Stat(filepath.Join(path, dataFilePath(fi.Name()))); err != nil {
+				remove(filepath.Join(path, fi.Name()))
 			}
 		}
 	}
@@ -445,6 +1899,7 @@ func opendb(path string) (*LockFreeChunkDB, error) {
 		// be retained; all chunks before a gap can be deleted.
 		first := 0
 		priorCID := uint64(0)
+		var deleting bool
 		for i := len(chunkFiles) - 1; i >= 0; i-- {
 			// This does no validation because isBasenameChunkDataFile took care of that.
 			nameBits := strings.Split(chunkFiles[i].Name(), sep)
@@ -452,12 +1907,17 @@ func opendb(path string) (*LockFreeChunkDB, error) {
 
 			// priorCID keeps track of the ID of the prior chunk. Because we're traversing
 			// backwards, these should decrease by 1 every time with no gaps. If there is a gap,
-			// we can enter chunk deleting mode.
-			if priorCID > 0 && cid < priorCID-1 {
-				filePath := path + "/" + chunkFiles[i].Name()
+			// we can enter chunk deleting mode. Two chunks with the same ID means the program died
+			// while compacting the oldest: the compacted one sorts later and is complete, so the
+			// other can be deleted in the same way.
+			if i < len(chunkFiles)-1 && (cid < priorCID-1 || cid == priorCID) {
+				deleting = true
+			}
+			if deleting {
+				filePath := filepath.Join(path, chunkFiles[i].Name())
 				metaPath := metaFilePath(filePath)
-				_ = os.Remove(filePath)
-				_ = os.Remove(metaPath)
+				remove(filePath)
+				remove(metaPath)
 			} else {
 				priorCID = cid
 				first = i
@@ -466,66 +1926,79 @@ func opendb(path string) (*LockFreeChunkDB, error) {
 		chunkFiles = chunkFiles[first:]
 
 		// The final chunk may be zero-size, if the program died between the file being created and it
-		// being sized. If it is, delete it. Similarly, the final chunk may have no metadata file.
+		// being sized. If it is, and its metadata records no entries, delete it. Similarly, the final
+		// chunk may have no metadata file, unless the disk format version has framing, in which case the
+		// metadata can be rebuilt.
 		final := chunkFiles[len(chunkFiles)-1]
-		filePath := path + "/" + final.Name()
+		filePath := filepath.Join(path, final.Name())
 		metaPath := metaFilePath(filePath)
-		if _, err := os.Stat(metaPath); final.Size() == 0 || err != nil {
-			_ = os.Remove(filePath)
-			_ = os.Remove(metaPath)
+		_, err := fs.Stat(metaPath)
+		_, hasEntries := metadataEnd(fs, metaPath, version)
+		if (final.Size() == 0 && !hasEntries) || (err != nil && !versionHasFraming(version)) {
+			remove(filePath)
+			remove(metaPath)
 			chunkFiles = chunkFiles[:len(chunkFiles)-1]
 		}
 	}
 
-	// Populate the chunk slice.
-	chunks := make([]*chunk, len(chunkFiles))
-	var prior *chunk
-	var empty bool
-	for i, fi := range chunkFiles {
-		// Normally a chunk contains at least one entry. This may only false for the final chunk. So if
-		// we have a chunk file to process and the 'empty' flag is set, then we have an error.
-		if empty {
-			return nil, &FormatError{
-				FilePath: prior.metaFilePath(),
-				Err:      ErrEmptyNonfinalChunk,
-			}
-		}
+	return chunkFiles, nil
+}
 
-		c, err := openChunkFile(path, fi, prior, chunkSize)
-		if err != nil {
-			return nil, err
-		}
-		chunks[i] = &c
-		prior = &c
-		empty = len(c.ends) == 0
+// Find the chunk containing an entry. Assumes a read lock is held.
+//
+// Returns 'ErrIDOutOfRange' if the ID is not present in the log.
+func (db *LockFreeChunkDB) chunkFor(id uint64) (*chunk, error) {
+	// Check ID is in range.
+	if id < db.oldest || id >= db.next() || len(db.chunks) == 0 {
+		return nil, ErrIDOutOfRange
 	}
 
-	// If we cannot read the "oldest" file OR the oldest entry according to the metadata is older than the
-	// oldest entry we actually have, bump it up to the newer one. This could happen if a chunk is forgotten
-	// and then the program crashes before the "oldest" file gets rewritten.
-	var oldest uint64
-	if err := readFile(path+"/oldest", &oldest); err != nil || (len(chunks) > 0 && oldest < chunks[0].oldest) {
-		oldest = chunks[0].oldest
+	// Binary search through chunks for the one containing the ID. The search space is 'db.chunks[lo:hi]'.
+	lo := 0
+	hi := len(db.chunks)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		c := db.chunks[mid]
+		switch {
+		case id < c.oldest:
+			hi = mid
+		case id >= c.next():
+			lo = mid + 1
+		default:
+			return c, nil
+		}
 	}
 
-	db := &LockFreeChunkDB{
-		path:      path,
-		closed:    false,
-		lockfile:  lockfile,
-		chunkSize: chunkSize,
-		chunks:    chunks,
-		oldest:    oldest,
-		syncEvery: 100,
-		syncDirty: make(map[*chunk]struct{}),
-	}
-	db.newest = db.next() - 1
+	// This should be impossible if the range check passed, but it's better to return an error than to
+	// index out of bounds.
+	return nil, ErrIDOutOfRange
+}
 
-	return db, nil
+// Set the oldest ID, and its copy for 'OldestID'. Assumes a write lock is held.
+func (db *LockFreeChunkDB) setOldest(oldest uint64) {
+	db.oldest = oldest
+	atomic.StoreUint64(&db.publicOldest, oldest)
+}
+
+// Update the copy of the newest ID for 'NewestID' and 'NextID', after entries have been appended or removed from
+// the back. Assumes a write lock is held.
+func (db *LockFreeChunkDB) updateNewest() {
+	atomic.StoreUint64(&db.publicNewest, db.next()-1)
+}
+
+// Check if there are no entries. Assumes a read lock is held.
+func (db *LockFreeChunkDB) empty() bool {
+	return db.oldest == 0 || db.oldest >= db.next()
 }
 
 // Return the 'next' value of the last chunk. Assumes a read lock is held.
+//
+// If there are no chunks, entries will start from the oldest ID, if it has been set.
 func (db *LockFreeChunkDB) next() uint64 {
 	if len(db.chunks) == 0 {
+		if db.oldest > 0 {
+			return db.oldest
+		}
 		return 1
 	}
 	return db.chunks[len(db.chunks)-1].next()
@@ -534,10 +2007,21 @@ func (db *LockFreeChunkDB) next() uint64 {
 // Append an entry to the database, creating a new chunk if necessary, and incrementing the dirty counter.
 // Assumes a write lock is held.
 func (db *LockFreeChunkDB) append(entry []byte) error {
-	if uint32(len(entry)) > db.chunkSize {
+	return db.appendWith(len(entry), entry, nil)
+}
+
+// Add an entry of the given size to the end of the last chunk, creating a new chunk if necessary. The contents
+// are copied from 'entry', or read from 'r' if it is not nil. If reading fails, the entry is not added. Assumes a
+// write lock is held.
+func (db *LockFreeChunkDB) appendWith(size int, entry []byte, r io.Reader) error {
+	// With framing, the entry is preceded by its frame header in the chunk.
+	hdrSize := frameHeaderSize(db.version, size)
+	if uint64(hdrSize+size) > uint64(db.chunkSize) {
 		return ErrTooBig
 	}
 
+	numChunks := len(db.chunks)
+
 	// If there are no chunks, create a new one.
 	if len(db.chunks) == 0 {
 		if err := db.newChunk(); err != nil {
@@ -547,10 +2031,19 @@ func (db *LockFreeChunkDB) append(entry []byte) error {
 
 	lastChunk := db.chunks[len(db.chunks)-1]
 
+	// A trimmed chunk must be grown back to the full size before it is appended to, or left behind by a new
+	// chunk.
+	if lastChunk.trimmed {
+		if err := lastChunk.resize(lastChunk.size); err != nil {
+			return &WriteError{err}
+		}
+		lastChunk.trimmed = false
+	}
+
 	// If the last chunk doesn't have the space for this entry, create a new one.
 	if len(lastChunk.ends) > 0 {
-		lastEnd := lastChunk.ends[len(lastChunk.ends)-1]
-		if db.chunkSize-uint32(lastEnd) < uint32(len(entry)) {
+		lastEnd := alignUp(lastChunk.ends[len(lastChunk.ends)-1], lastChunk.align)
+		if uint32(lastEnd) > lastChunk.size || lastChunk.size-uint32(lastEnd) < uint32(hdrSize+size) {
 			if err := db.newChunk(); err != nil {
 				return &WriteError{err}
 			}
@@ -561,25 +2054,129 @@ func (db *LockFreeChunkDB) append(entry []byte) error {
 	// Add the entry to the last chunk
 	var start int32
 	if len(lastChunk.ends) > 0 {
-		start = lastChunk.ends[len(lastChunk.ends)-1]
+		start = alignUp(lastChunk.ends[len(lastChunk.ends)-1], lastChunk.align)
+	}
+	end := start + int32(hdrSize+size)
+	err := db.fillEntry(lastChunk, start+int32(hdrSize), end, entry, r)
+	if err == nil && hdrSize > 0 {
+		err = db.fillFrame(lastChunk, start, end, size)
 	}
-	end := start + int32(len(entry))
-	for i, b := range entry {
-		lastChunk.bytes[start+int32(i)] = b
+	if err != nil {
+		// A chunk cannot be empty, so get rid of the one made for this entry.
+		if len(db.chunks) > numChunks {
+			db.chunks = db.chunks[:numChunks]
+			if rerr := lastChunk.closeAndRemove(); rerr != nil {
+				return &DeleteError{rerr}
+			}
+		}
+		return err
 	}
 	lastChunk.ends = append(lastChunk.ends, end)
+	if versionHasTimestamps(db.version) {
+		lastChunk.stamps = append(lastChunk.stamps, db.timestamp())
+	}
 
 	// If this is the first entry ever, set the oldest ID to 1 (IDs start from 1, not 0)
 	if db.oldest == 0 {
-		db.oldest = 1
+		db.setOldest(1)
 	}
 
 	// Mark the current chunk as dirty.
 	db.sinceLastSync++
+	db.bytesSinceLastSync += uint64(size)
 	db.syncDirty[lastChunk] = struct{}{}
 	return nil
 }
 
+// Write the contents of a new entry into a chunk, as 'appendWith' does. This doesn't use 'withChunkBytes', to
+// avoid allocating a closure for every entry appended.
+func (db *LockFreeChunkDB) fillEntry(c *chunk, start, end int32, entry []byte, r io.Reader) error {
+	if db.backend == BackendFile {
+		if r != nil {
+			entry = make([]byte, end-start)
+			if err := readExactly(r, entry); err != nil {
+				return err
+			}
+		}
+		if err := c.writeAt(entry, start); err != nil {
+			return &WriteError{err}
+		}
+		return nil
+	}
+
+	if db.maxMappedChunks > 0 {
+		db.mapLock.Lock()
+		defer db.mapLock.Unlock()
+		if err := db.useChunk(c); err != nil {
+			return err
+		}
+	}
+
+	if r != nil {
+		return readExactly(r, c.bytes[start:end])
+	}
+	copy(c.bytes[start:end], entry)
+	return nil
+}
+
+// Write the frame header of a new entry of the given size into a chunk with framing, and mark the end of the
+// entries after it. Assumes a write lock is held.
+func (db *LockFreeChunkDB) fillFrame(c *chunk, start, end int32, size int) error {
+	hdr := frameHeader(size)
+	if err := db.fillEntry(c, start, start+int32(len(hdr)), hdr, nil); err != nil {
+		return err
+	}
+	return db.endFrames(c, end)
+}
+
+// Write a zero byte after the final entry of a chunk with framing, so that nothing after it is taken for an
+// entry if the metadata is rebuilt, such as the frames of entries which have been rolled back. Nothing is
+// written if the entries fill the chunk. Assumes a write lock is held.
+func (db *LockFreeChunkDB) endFrames(c *chunk, end int32) error {
+	if uint32(end) >= c.size {
+		return nil
+	}
+	return db.fillEntry(c, end, end+1, []byte{0}, nil)
+}
+
+// Fill a buffer from a reader, checking that the reader then has nothing left.
+func readExactly(r io.Reader, dst []byte) error {
+	if _, err := io.ReadFull(r, dst); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrEntryLength
+	} else if err != nil {
+		return err
+	}
+
+	var extra [1]byte
+	for {
+		m, err := r.Read(extra[:])
+		if m > 0 {
+			return ErrEntryLength
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Get the timestamp for a newly-appended entry. This is the current time, unless the newest entry has a later
+// timestamp (if the clock has gone backwards), in which case that is used instead. Assumes a write lock is held.
+func (db *LockFreeChunkDB) timestamp() uint64 {
+	now := uint64(db.now().UnixNano())
+	for i := len(db.chunks) - 1; i >= 0; i-- {
+		if c := db.chunks[i]; len(c.stamps) > 0 {
+			if latest := c.stamps[len(c.stamps)-1]; latest > now {
+				return latest
+			}
+			break
+		}
+	}
+	return now
+}
+
 // Adds a new chunk to the database. Assumes a write lock is held.
 //
 // A chunk cannot be empty, so it is only valid to call this if an entry is going to be inserted into the chunk
@@ -593,21 +2190,29 @@ func (db *LockFreeChunkDB) newChunk() error {
 		}
 	}
 
-	chunkFile := db.path + "/" + initialChunkFile
+	// Make room for the new chunk, if there is a size cap.
+	if err := db.enforceMaxBytes(uint64(db.chunkSize)); err != nil {
+		return err
+	}
+
+	chunkFile := filepath.Join(db.path, initialDataFileName(db.next()))
 
 	// Filename is "chunk-<1 + last chunk file name>_<next id>"
 	if len(db.chunks) > 0 {
-		chunkFile = db.path + "/" + db.chunks[len(db.chunks)-1].nextDataFileName(db.next())
+		chunkFile = filepath.Join(db.path, db.chunks[len(db.chunks)-1].nextDataFileName(db.next()))
 	}
 
-	// Create the files for a new chunk.
-	err := createChunkFiles(chunkFile, db.chunkSize, db.next())
+	// Create the files for a new chunk, and make sure they stay created.
+	err := db.createChunkFiles(chunkFile)
 	if err != nil {
 		return err
 	}
+	if err := dirSync(db.fs, db.path); err != nil {
+		return err
+	}
 
 	// Open the newly-created chunk file.
-	fi, err := os.Stat(chunkFile)
+	fi, err := db.fs.Stat(chunkFile)
 	if err != nil {
 		return err
 	}
@@ -615,12 +2220,28 @@ func (db *LockFreeChunkDB) newChunk() error {
 	if len(db.chunks) > 0 {
 		prior = db.chunks[len(db.chunks)-1]
 	}
-	c, err := openChunkFile(db.path, fi, prior, db.chunkSize)
+	c, err := openChunkFile(db.fs, db.backend, db.version, db.path, fi, prior, db.chunkSize)
 	if err != nil {
 		return err
 	}
+	c.align = int32(db.alignment)
 	db.chunks = append(db.chunks, &c)
+	if db.logger != nil {
+		db.log("debug", "new chunk", "path", c.path, "oldest", c.oldest)
+	}
+	if db.accessPattern != AccessNormal {
+		if err := db.advise(&c); err != nil {
+			return err
+		}
+	}
 
+	// The prior chunk can be unmapped now that it's no longer being appended to.
+	defer db.lockNewest()
+	if db.maxMappedChunks > 0 {
+		db.mapLock.Lock()
+		defer db.mapLock.Unlock()
+		return db.trimMappings(&c)
+	}
 	return nil
 }
 
@@ -634,12 +2255,31 @@ func (db *LockFreeChunkDB) forget(newOldestID uint64) error {
 		return ErrIDOutOfRange
 	}
 
+	return db.forgetUpTo(newOldestID)
+}
+
+// Remove entries from the beginning of the log, performing a sync if necessary. Assumes a write lock is held.
+//
+// Unlike 'forget', the new oldest ID may be the next ID, in which case every entry is removed. The final chunk
+// is never deleted, even if all of its entries are, as the next ID is derived from it.
+func (db *LockFreeChunkDB) forgetUpTo(newOldestID uint64) error {
+	if err := db.removeOldest(newOldestID); err != nil {
+		return err
+	}
+	return db.periodicSync()
+}
+
+// Like 'forgetUpTo', but without the periodic sync. The new oldest ID must be no less than the current one.
+// Assumes a write lock is held.
+func (db *LockFreeChunkDB) removeOldest(newOldestID uint64) error {
+	db.cache.remove(db.oldest, newOldestID)
 	db.sinceLastSync += newOldestID - db.oldest
-	db.oldest = newOldestID
+	db.setOldest(newOldestID)
+	db.observe(func(o Observer) { o.OnForget(newOldestID) })
 
 	// Mark too-old chunks for deletion.
 	var first int
-	for first = 0; first < len(db.chunks) && db.chunks[first].next() <= newOldestID; first++ {
+	for first = 0; first < len(db.chunks)-1 && db.chunks[first].next() <= newOldestID; first++ {
 		c := db.chunks[first]
 		db.syncDirty[c] = struct{}{}
 		c.delete = true
@@ -653,8 +2293,48 @@ func (db *LockFreeChunkDB) forget(newOldestID uint64) error {
 		db.chunks = db.chunks[first:]
 	}
 
-	// Perform a periodic sync.
-	return db.periodicSync()
+	return nil
+}
+
+// Forget whole chunks, oldest first, until the disk usage plus the given number of extra bytes is within the
+// size cap, if there is one. Spare files from 'Preallocate' are left out of the disk usage until a chunk uses
+// them, so reserving space doesn't cost entries. The final chunk is never forgotten. Assumes a write lock is held.
+func (db *LockFreeChunkDB) enforceMaxBytes(extra uint64) error {
+	if db.maxBytes == 0 {
+		return nil
+	}
+
+	for len(db.chunks) > 1 {
+		usage, err := db.diskUsage()
+		if err != nil {
+			return &ReadError{err}
+		}
+		usage -= uint64(len(db.spares)) * uint64(db.chunkSize)
+		if usage+extra <= db.maxBytes {
+			break
+		}
+		if err := db.forgetUpTo(db.chunks[0].next()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compute the total size of the files in the database directory. Assumes a read lock is held.
+func (db *LockFreeChunkDB) diskUsage() (uint64, error) {
+	fis, err := db.fs.ReadDir(db.path)
+	if err != nil {
+		return 0, err
+	}
+
+	var usage uint64
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			usage += uint64(fi.Size())
+		}
+	}
+	return usage, nil
 }
 
 // Remove entries from the end of the log, performing a sync if necessary. Assumes a write lock is held.
@@ -669,7 +2349,39 @@ func (db *LockFreeChunkDB) rollback(newNewestID uint64) error {
 		return ErrIDOutOfRange
 	}
 
+	if err := db.removeNewest(newNextID); err != nil {
+		return err
+	}
+	return db.periodicSync()
+}
+
+// Stop the frames of entries rolled back from a chunk with framing from being found if the metadata is rebuilt.
+// A trimmed chunk is cut off after its new final entry, and otherwise the end of the entries is marked. Assumes a
+// write lock is held.
+func (db *LockFreeChunkDB) endRolledBackFrames(c *chunk) error {
+	if !versionHasFraming(c.version) {
+		return nil
+	}
+	end := c.ends[len(c.ends)-1]
+	if c.trimmed {
+		if err := c.resize(c.trimmedSize()); err != nil {
+			return &WriteError{err}
+		}
+		return nil
+	}
+	return db.endFrames(c, end)
+}
+
+// Like 'rollback', but without the periodic sync, and taking the new next ID. This must be greater than the
+// oldest ID and no greater than the current next ID. Assumes a write lock is held.
+func (db *LockFreeChunkDB) removeNewest(newNextID uint64) error {
+	if err := db.dropDigestsFrom(newNextID); err != nil {
+		return err
+	}
 	db.sinceLastSync += db.next() - newNextID
+	db.rollbacks++
+	db.dropTombstonesFrom(newNextID)
+	db.cache.remove(newNextID, db.next())
 
 	// Update chunk metadata and mark too-new chunks for deletion.
 	var last int
@@ -677,19 +2389,24 @@ func (db *LockFreeChunkDB) rollback(newNewestID uint64) error {
 		c := db.chunks[last]
 		db.syncDirty[c] = struct{}{}
 		if newNextID <= c.oldest {
-			c.ends = nil
+			c.truncateEntries(0)
 			c.delete = true
 		} else {
 			toRemove := c.next() - newNextID
-			c.ends = c.ends[0 : uint64(len(c.ends))-toRemove]
+			c.truncateEntries(len(c.ends) - int(toRemove))
 			if len(c.ends) < c.newFrom {
+				db.rolledBackSynced = true
 				// Force the new last entry to be written out again.
 				c.newFrom = len(c.ends) - 1
 			}
+			if err := db.endRolledBackFrames(c); err != nil {
+				return err
+			}
 			break
 		}
 	}
 	last++
+	db.observe(func(o Observer) { o.OnRollback(newNextID) })
 
 	// If this deleted any chunks, perform a sync.
 	if last < len(db.chunks) {
@@ -697,26 +2414,43 @@ func (db *LockFreeChunkDB) rollback(newNewestID uint64) error {
 			return err
 		}
 		db.chunks = db.chunks[:last]
+		db.lockNewest()
 	}
 
-	// Perform a periodic sync
-	return db.periodicSync()
+	return nil
 }
 
 // Perform a sync only if needed. Assumes a lock (read or write) is held.
 func (db *LockFreeChunkDB) periodicSync() error {
-	if db.syncEvery >= 0 && db.sinceLastSync > uint64(db.syncEvery) {
+	if db.syncEvery >= 0 && db.sinceLastSync > 0 && db.sinceLastSync >= uint64(db.syncEvery) {
+		return db.sync()
+	}
+	if db.syncBytes > 0 && db.bytesSinceLastSync >= db.syncBytes {
 		return db.sync()
 	}
 	return nil
 }
 
 // Perform a sync immediately. Assumes a lock (read or write) is held.
-func (db *LockFreeChunkDB) sync() error {
+func (db *LockFreeChunkDB) sync() (err error) {
 	// Suboptimal!
 	db.slock.Lock()
 	defer db.slock.Unlock()
 
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	defer func() { db.noteReadOnly(err) }()
+
+	// Readers may be mapping and unmapping chunks.
+	if db.maxMappedChunks > 0 {
+		db.mapLock.Lock()
+		defer db.mapLock.Unlock()
+	}
+
+	start := time.Now()
+	dirty := len(db.syncDirty)
+
 	// Produce a sorted list of chunks to sync.
 	dirtyChunks := make([]*chunk, len(db.syncDirty))
 	var i int
@@ -731,29 +2465,110 @@ func (db *LockFreeChunkDB) sync() error {
 	// smaller entries are written into chunk N, the "next" of chunk N might be greater than the "oldest" of
 	// chunk N+1. By deleting first, we avoid this situation.
 	var toSync []*chunk
+	deleted := false
 	for _, c := range dirtyChunks {
 		if c.delete {
 			if err := c.closeAndRemove(); err != nil {
 				return &SyncError{&DeleteError{err}}
 			}
+			if db.logger != nil {
+				db.log("debug", "chunk deleted", "path", c.path)
+			}
+			deleted = true
 		} else {
 			toSync = append([]*chunk{c}, toSync...)
 		}
 	}
+	if deleted {
+		// The deletions must be durable before anything else is written, for the reason above.
+		if err := dirSync(db.fs, db.path); err != nil {
+			return &SyncError{&DeleteError{err}}
+		}
+	}
+	if err := syncChunkData(toSync, db.syncMode, db.syncParallelism); err != nil {
+		return &SyncError{err}
+	}
 	for _, c := range toSync {
-		if err := c.sync(); err != nil {
+		if err := c.syncMeta(); err != nil {
 			return &SyncError{err}
 		}
 	}
 
 	// Write the oldest entry ID.
-	if err := writeFile(db.path+"/oldest", db.oldest); err != nil {
+	if err := writeOldestFile(db.fs, db.path, db.oldest); err != nil {
 		return &SyncError{err}
 	}
 
+	// Write the IDs of deleted entries, if any have been rolled back.
+	if db.tombstonesDirty {
+		if err := db.writeTombstones(); err != nil {
+			return &SyncError{err}
+		}
+	}
+
 	db.syncDirty = make(map[*chunk]struct{})
 	db.sinceLastSync = 0
+	db.bytesSinceLastSync = 0
+	db.rolledBackSynced = false
+
+	dur := time.Since(start)
+	if db.logger != nil {
+		db.log("debug", "sync", "dirty", dirty, "duration", dur)
+	}
+	db.observe(func(o Observer) { o.OnSync(dirty, dur) })
+
+	return nil
+}
 
+// Make the database read-only if an error is caused by the filesystem being read-only, and the
+// 'WithReadOnlyOnError' option was given. Assumes the write lock, or 'slock', is held.
+func (db *LockFreeChunkDB) noteReadOnly(err error) {
+	if db.readOnlyOnError && err != nil && isReadOnlyError(err) {
+		db.readOnly = true
+	}
+}
+
+// Flush the data files of some chunks to disk, with up to 'parallelism' flushes in progress at once. The
+// metadata must only be written once this has succeeded, and in chunk order, so that a crash part-way through
+// can't leave a later chunk referring to entries which follow ones an earlier chunk has lost.
+func syncChunkData(chunks []*chunk, mode SyncMode, parallelism int) error {
+	if parallelism <= 1 || len(chunks) <= 1 {
+		for _, c := range chunks {
+			if err := c.syncData(mode); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if parallelism > len(chunks) {
+		parallelism = len(chunks)
+	}
+
+	work := make(chan *chunk)
+	errs := make(chan error, len(chunks))
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				errs <- c.syncData(mode)
+			}
+		}()
+	}
+	for _, c := range chunks {
+		work <- c
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -767,7 +2582,12 @@ func (db *LockFreeChunkDB) syncOne(c *chunk) error {
 		return nil
 	}
 
-	if err := c.sync(); err != nil {
+	if db.maxMappedChunks > 0 {
+		db.mapLock.Lock()
+		defer db.mapLock.Unlock()
+	}
+
+	if err := c.sync(db.syncMode); err != nil {
 		return &SyncError{err}
 	}
 
@@ -775,3 +2595,77 @@ func (db *LockFreeChunkDB) syncOne(c *chunk) error {
 
 	return nil
 }
+
+// Call a function with the bytes of a chunk, memory-mapping it first if it has been unmapped. With the file
+// backend, the bytes up to the end of the final entry are read into a new slice instead. The bytes must not be
+// used after the function returns. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) withChunkBytes(c *chunk, f func([]byte) error) error {
+	if db.backend == BackendFile {
+		var bytes []byte
+		if len(c.ends) > 0 {
+			bytes = make([]byte, c.ends[len(c.ends)-1])
+			if err := c.readAt(bytes, 0); err != nil {
+				return &ReadError{err}
+			}
+		}
+		return f(bytes)
+	}
+
+	if db.maxMappedChunks <= 0 {
+		return f(c.bytes)
+	}
+
+	db.mapLock.Lock()
+	defer db.mapLock.Unlock()
+
+	if err := db.useChunk(c); err != nil {
+		return err
+	}
+	return f(c.bytes)
+}
+
+// Mark a chunk as used, memory-mapping it if it has been unmapped. Assumes 'mapLock' is held, and that the
+// number of mapped chunks is limited.
+func (db *LockFreeChunkDB) useChunk(c *chunk) error {
+	db.useClock++
+	c.lastUsed = db.useClock
+	if c.bytes != nil {
+		return nil
+	}
+
+	if err := c.remap(c.size); err != nil {
+		return &ReadError{err}
+	}
+	if err := db.advise(c); err != nil {
+		return err
+	}
+	defer db.lockNewest()
+	return db.trimMappings(c)
+}
+
+// Unmap the least recently used chunks until no more than the limit are mapped. The final chunk, which is
+// appended to, and the given chunk, which is about to be used, are never unmapped. Assumes 'mapLock' is held.
+func (db *LockFreeChunkDB) trimMappings(keep *chunk) error {
+	for {
+		var mapped int
+		var lru *chunk
+		for i, c := range db.chunks {
+			if c.bytes == nil {
+				continue
+			}
+			mapped++
+			if c == keep || i == len(db.chunks)-1 {
+				continue
+			}
+			if lru == nil || c.lastUsed < lru.lastUsed {
+				lru = c
+			}
+		}
+		if mapped <= db.maxMappedChunks || lru == nil {
+			return nil
+		}
+		if err := lru.unmap(); err != nil {
+			return &ReadError{err}
+		}
+	}
+}
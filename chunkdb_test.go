@@ -1,17 +1,31 @@
 package logdb
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/stretchr/testify/assert"
 )
 
-// These all test the 'LockFreeChunkDB' loading error cases, so there's no need to try other databases.
+// These all test 'LockFreeChunkDB'-specific behaviour (mostly the loading error cases), so there's no need to
+// try other databases.
 
 func TestChunkDB_NoOpenFile(t *testing.T) {
-	if err := writeFile("test_db/no_open_file", uint8(1)); err != nil {
+	if err := writeFile(OSFileSystem{}, "test_db/no_open_file", uint8(1)); err != nil {
 		t.Fatal("could not write file: ", err)
 	}
 
@@ -25,6 +39,42 @@ func TestChunkDB_NoOpenFile(t *testing.T) {
 func TestChunkDB_NoOpenMissing(t *testing.T) {
 	openErr := assertOpenError(t, false, "no_open_missing")
 	assert.True(t, errwrap.ContainsType(openErr, ErrPathDoesntExist))
+	assert.Equal(t, os.FileMode(0), assertDatabasePathError(t, openErr, ErrPathDoesntExist).Mode)
+}
+
+func TestChunkDB_NoOpenFileDetail(t *testing.T) {
+	if err := writeFile(OSFileSystem{}, "test_db/no_open_file_detail", uint8(1)); err != nil {
+		t.Fatal("could not write file: ", err)
+	}
+
+	openErr := assertOpenError(t, false, "no_open_file_detail")
+	assert.True(t, assertDatabasePathError(t, openErr, ErrNotDirectory).Mode.IsRegular(), "expected regular file")
+	assert.Contains(t, openErr.Error(), "regular file")
+}
+
+func TestChunkDB_NoOpenSymlink(t *testing.T) {
+	if err := writeFile(OSFileSystem{}, "test_db/no_open_symlink_target", uint8(1)); err != nil {
+		t.Fatal("could not write file: ", err)
+	}
+	_ = os.Remove("test_db/no_open_symlink")
+	if err := os.Symlink("no_open_symlink_target", "test_db/no_open_symlink"); err != nil {
+		t.Skip("could not create symbolic link: ", err)
+	}
+
+	openErr := assertOpenError(t, true, "no_open_symlink")
+	perr := assertDatabasePathError(t, openErr, ErrNotDirectory)
+	assert.True(t, perr.Mode&os.ModeSymlink != 0, "expected symbolic link")
+	assert.True(t, perr.TargetMode.IsRegular(), "expected link to regular file")
+	assert.Contains(t, openErr.Error(), "symbolic link to regular file")
+
+	// A dangling link doesn't count as an existing path, but isn't created over either.
+	if err := os.Remove("test_db/no_open_symlink_target"); err != nil {
+		t.Fatal(err)
+	}
+	openErr = assertOpenError(t, true, "no_open_symlink")
+	perr = assertDatabasePathError(t, openErr, ErrPathDoesntExist)
+	assert.True(t, perr.Mode&os.ModeSymlink != 0, "expected symbolic link")
+	assert.Contains(t, openErr.Error(), "dangling symbolic link")
 }
 
 func TestChunkDB_NoConcurrentOpen(t *testing.T) {
@@ -44,13 +94,13 @@ func TestChunkDB_NoOpenBadFiles(t *testing.T) {
 
 	_ = assertOpenError(t, false, "no_open_bad_files")
 
-	if err := writeFile("test_db/no_open_bad_files/version", uint16(42)); err != nil {
+	if err := writeFile(OSFileSystem{}, "test_db/no_open_bad_files/version", uint16(42)); err != nil {
 		t.Fatal("could not write dummy version file: ", err)
 	}
 
 	_ = assertOpenError(t, false, "no_open_bad_files")
 
-	if err := writeFile("test_db/no_open_bad_files/chunk_size", uint32(1024)); err != nil {
+	if err := writeFile(OSFileSystem{}, "test_db/no_open_bad_files/chunk_size", uint32(1024)); err != nil {
 		t.Fatal("could not write dummy version file: ", err)
 	}
 
@@ -59,6 +109,34 @@ func TestChunkDB_NoOpenBadFiles(t *testing.T) {
 	assert.True(t, errwrap.ContainsType(err, ErrUnknownVersion))
 }
 
+func TestChunkDB_VersionOpeners(t *testing.T) {
+	const fakeVersion = uint16(100)
+
+	db := assertOpenOptions(t, true, "version_openers", chunkSize)
+	filldb(t, db, numEntries)
+	assertClose(t, db)
+	if err := writeFile(OSFileSystem{}, "test_db/version_openers/version", fakeVersion); err != nil {
+		t.Fatal("could not write version file: ", err)
+	}
+
+	// An unregistered version can't be opened.
+	err := assertOpenError(t, false, "version_openers")
+	assert.Equal(t, ErrUnknownVersion, err)
+
+	// A registered version is opened with its own opener.
+	var openedVersion uint16
+	versionOpeners[fakeVersion] = func(path string, expectedChunkSize uint32, version uint16, o options) (*LockFreeChunkDB, error) {
+		openedVersion = version
+		return opendbVersion(path, expectedChunkSize, latestVersion, o)
+	}
+	defer delete(versionOpeners, fakeVersion)
+
+	db2 := assertOpenOptions(t, false, "version_openers", chunkSize)
+	defer assertClose(t, db2)
+	assert.Equal(t, fakeVersion, openedVersion, "expected fake opener to be used")
+	assert.Equal(t, uint64(numEntries), db2.NewestID())
+}
+
 func TestChunkDB_CorruptOldest(t *testing.T) {
 	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "corrupt_oldest", chunkSize)
 
@@ -82,12 +160,97 @@ func TestChunkDB_CorruptOldest(t *testing.T) {
 	assert.Equal(t, uint64(16), db2.OldestID(), "oldest %v", db2.OldestID())
 }
 
+func TestChunkDB_DamagedOldest(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "damaged_oldest", chunkSize)
+	filldb(t, db, numEntries)
+	assertTruncate(t, db, 20, 40)
+	assertClose(t, db)
+
+	// With the checksum wrong, the oldest ID comes from the chunks, as if the file were missing.
+	oldestPath := "test_db/damaged_oldest/oldest"
+	oldest := readTestFile(t, oldestPath)
+	assert.Equal(t, 12, len(oldest), "expected oldest ID and checksum")
+	damaged := append([]byte(nil), oldest...)
+	damaged[0] ^= 0x01
+	writeTestFile(t, oldestPath, damaged)
+
+	db2 := assertOpen(t, dbTypes["lock free chunkdb"], false, "damaged_oldest", chunkSize)
+	assert.Equal(t, uint64(16), db2.OldestID(), "oldest %v", db2.OldestID())
+	assert.Equal(t, uint64(40), db2.NewestID(), "newest %v", db2.NewestID())
+	assertClose(t, db2)
+
+	// Likewise if it is cut short.
+	writeTestFile(t, oldestPath, oldest[:10])
+	db2 = assertOpen(t, dbTypes["lock free chunkdb"], false, "damaged_oldest", chunkSize)
+	assert.Equal(t, uint64(16), db2.OldestID(), "oldest %v", db2.OldestID())
+	assertClose(t, db2)
+
+	// A file without a checksum, from before they were added, is trusted.
+	writeTestFile(t, oldestPath, oldest[:8])
+	db2 = assertOpen(t, dbTypes["lock free chunkdb"], false, "damaged_oldest", chunkSize)
+	defer assertClose(t, db2)
+	assert.Equal(t, uint64(20), db2.OldestID(), "oldest %v", db2.OldestID())
+}
+
+func TestChunkDB_StrictOldest(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "strict_oldest", chunkSize)
+	filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	// An "oldest" file with a valid checksum, but an ID after the end of the log.
+	if err := writeOldestFile(OSFileSystem{}, "test_db/strict_oldest", numEntries+10); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Open("test_db/strict_oldest", chunkSize, false, WithStrictOldest())
+	cerr, ok := err.(*ChunkContinuityError)
+	if !ok {
+		t.Fatalf("expected ChunkContinuityError, got %v", err)
+	}
+	assert.Equal(t, uint64(numEntries+1), cerr.Expected)
+	assert.Equal(t, uint64(numEntries+10), cerr.Actual)
+
+	// Without the option, the oldest ID is taken from the chunks.
+	db2 := assertOpen(t, dbTypes["lock free chunkdb"], false, "strict_oldest", chunkSize)
+	defer assertClose(t, db2)
+	assert.Equal(t, uint64(numEntries+1), db2.OldestID())
+}
+
+func TestChunkDB_EmptyFinalChunk(t *testing.T) {
+	db := assertOpenOptions(t, true, "empty_final_chunk", chunkSize)
+	vs := filldb(t, db, numEntries)
+	numChunks := len(db.chunks)
+
+	// Start a new chunk, as if the program died before appending to it.
+	if err := db.newChunk(); err != nil {
+		t.Fatal(err)
+	}
+	emptyPath := db.chunks[numChunks].path
+	assertClose(t, db)
+
+	db = assertOpenOptions(t, false, "empty_final_chunk", chunkSize)
+	assert.Equal(t, numChunks, len(db.chunks), "expected empty chunk to be deleted")
+	_, err := os.Stat(emptyPath)
+	assert.True(t, os.IsNotExist(err), "expected empty chunk file to be deleted")
+	assert.Equal(t, uint64(numEntries), db.NewestID())
+
+	// The database carries on as usual.
+	vs = append(vs, []byte("after"))
+	assertAppend(t, db, vs[len(vs)-1])
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "empty_final_chunk", chunkSize)
+	defer assertClose(t, db)
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+}
+
 func TestChunkDB_NoEmptyNonfinalChunk(t *testing.T) {
 	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "no_empty_nonfinal_chunk", chunkSize)
 	filldb(t, db, numEntries)
 	assertClose(t, db)
 
-	if err := createFile("test_db/no_empty_nonfinal_chunk/"+initialMetaFile, 0); err != nil {
+	if err := createFile(OSFileSystem{}, "test_db/no_empty_nonfinal_chunk/"+initialMetaFile, 0); err != nil {
 		t.Fatal("failed to truncate meta file to 0 bytes:", err)
 	}
 
@@ -98,7 +261,7 @@ func TestChunkDB_ZeroSizeFinalChunk(t *testing.T) {
 	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "zero_size_final_chunk", chunkSize)
 	assertClose(t, db)
 
-	if err := createFile("test_db/zero_size_final_chunk/"+initialChunkFile, 0); err != nil {
+	if err := createFile(OSFileSystem{}, "test_db/zero_size_final_chunk/"+initialChunkFile, 0); err != nil {
 		t.Fatal("failed to create zero-sized chunk file:", err)
 	}
 
@@ -110,7 +273,7 @@ func TestChunkDB_NoOpenZeroSizeNonfinalChunk(t *testing.T) {
 	filldb(t, db, numEntries)
 	assertClose(t, db)
 
-	if err := createFile("test_db/no_open_zero_size_nonfinal_chunk/"+initialChunkFile, 0); err != nil {
+	if err := createFile(OSFileSystem{}, "test_db/no_open_zero_size_nonfinal_chunk/"+initialChunkFile, 0); err != nil {
 		t.Fatal("failed to truncate chunk file to 0 bytes:", err)
 	}
 
@@ -121,7 +284,7 @@ func TestChunkDB_MissingMetaFinalChunk(t *testing.T) {
 	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "missing_meta_final_chunk", chunkSize)
 	assertClose(t, db)
 
-	if err := createFile("test_db/missing_meta_final_chunk/"+initialChunkFile, chunkSize); err != nil {
+	if err := createFile(OSFileSystem{}, "test_db/missing_meta_final_chunk/"+initialChunkFile, chunkSize); err != nil {
 		t.Fatal("failed to create chunk file:", err)
 	}
 
@@ -162,3 +325,2637 @@ func TestChunkDB_Gap(t *testing.T) {
 		}
 	}
 }
+
+func TestChunkDB_TrailingSeparator(t *testing.T) {
+	testDir := "test_db/trailing_separator" + string(filepath.Separator)
+	_ = os.RemoveAll(testDir)
+
+	db, err := Open(testDir, chunkSize, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+	assertClose(t, db)
+
+	for _, path := range []string{testDir, filepath.Clean(testDir)} {
+		db2, err := Open(path, chunkSize, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, uint64(20), db2.OldestID(), "oldest ID opening %s", path)
+		for i := db2.OldestID(); i <= db2.NewestID(); i++ {
+			assert.Equal(t, vs[i-1], assertGet(t, db2, i), "entry %v opening %s", i, path)
+		}
+		assertClose(t, db2)
+	}
+}
+
+func TestChunkDB_NoOpenMismatchedChunkSize(t *testing.T) {
+	assertClose(t, assertOpen(t, dbTypes["lock free chunkdb"], true, "no_open_mismatched_chunk_size", chunkSize))
+
+	_, err := Open("test_db/no_open_mismatched_chunk_size", chunkSize+1, false)
+	if cerr, ok := err.(*ChunkSizeError); assert.True(t, ok, "expected chunk size error, got: %s", err) {
+		assert.Equal(t, uint32(chunkSize), cerr.Expected, "expected stored chunk size")
+		assert.Equal(t, uint32(chunkSize+1), cerr.Actual, "expected given chunk size")
+	}
+
+	// The failed open must not leave the database locked, and a chunk size of 0 adopts the stored one.
+	db, err := Open("test_db/no_open_mismatched_chunk_size", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(chunkSize), db.MaxEntrySize())
+}
+
+/* ***** Timestamps */
+
+func TestChunkDB_Timestamps(t *testing.T) {
+	before := time.Now()
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "timestamps", chunkSize)
+	filldb(t, db, numEntries)
+	after := time.Now()
+
+	lfdb := db.(*LockFreeChunkDB)
+	stamps := make([]time.Time, numEntries)
+	for i := range stamps {
+		stamps[i] = assertTimestampOf(t, lfdb, uint64(i+1))
+		assert.False(t, stamps[i].Before(before), "timestamp of %v before append started", i+1)
+		assert.False(t, stamps[i].After(after), "timestamp of %v after append finished", i+1)
+		if i > 0 {
+			assert.False(t, stamps[i].Before(stamps[i-1]), "timestamp of %v before that of %v", i+1, i)
+		}
+	}
+
+	_, err := lfdb.TimestampOf(numEntries + 1)
+	assert.Equal(t, ErrIDOutOfRange, err)
+
+	assertClose(t, db)
+
+	db2 := assertOpen(t, dbTypes["lock free chunkdb"], false, "timestamps", chunkSize)
+	defer assertClose(t, db2)
+
+	for i, stamp := range stamps {
+		assert.True(t, stamp.Equal(assertTimestampOf(t, db2.(*LockFreeChunkDB), uint64(i+1))), "timestamp of %v changed", i+1)
+	}
+}
+
+func TestChunkDB_NoTimestampsOldVersion(t *testing.T) {
+	assertClose(t, assertOpen(t, dbTypes["lock free chunkdb"], true, "no_timestamps_old_version", chunkSize))
+
+	if err := writeFile(OSFileSystem{}, "test_db/no_timestamps_old_version/version", uint16(0)); err != nil {
+		t.Fatal("could not write version file:", err)
+	}
+
+	db := assertOpen(t, dbTypes["lock free chunkdb"], false, "no_timestamps_old_version", chunkSize)
+	filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	db2 := assertOpen(t, dbTypes["lock free chunkdb"], false, "no_timestamps_old_version", chunkSize)
+	defer assertClose(t, db2)
+
+	_, err := db2.(*LockFreeChunkDB).TimestampOf(1)
+	assert.Equal(t, ErrNoTimestamps, err)
+	assert.Equal(t, []byte("entry-0"), assertGet(t, db2, 1))
+}
+
+func TestChunkDB_ForgetBefore(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "forget_before", chunkSize)
+
+	// Entry i is appended at time i seconds.
+	lfdb := db.(*LockFreeChunkDB)
+	clock := fakeClock(lfdb)
+	vs := filldb(t, db, numEntries)
+	assert.Equal(t, time.Unix(int64(numEntries), 0), assertTimestampOf(t, lfdb, numEntries))
+
+	// Nothing is that old.
+	assert.Equal(t, uint64(1), assertForgetBefore(t, lfdb, time.Unix(0, 0)))
+	assert.Equal(t, uint64(1), assertForgetBefore(t, lfdb, time.Unix(1, 0)))
+	assert.Equal(t, uint64(1), assertForgetBefore(t, lfdb, time.Unix(-1, 0)))
+	assert.Equal(t, uint64(1), assertForgetBefore(t, lfdb, time.Time{}))
+
+	// Forget into the middle of a chunk, and then up to a chunk boundary.
+	assert.Equal(t, uint64(50), assertForgetBefore(t, lfdb, time.Unix(50, 0)))
+	assert.Equal(t, uint64(50), db.OldestID())
+	assert.Equal(t, uint64(100), assertForgetBefore(t, lfdb, time.Unix(99, 500)))
+	assert.Equal(t, vs[99], assertGet(t, db, 100))
+
+	// Going backwards is a no-op.
+	assert.Equal(t, uint64(100), assertForgetBefore(t, lfdb, time.Unix(10, 0)))
+
+	// Forget everything.
+	assert.Equal(t, uint64(numEntries+1), assertForgetBefore(t, lfdb, time.Unix(1000, 0)))
+	assert.Equal(t, uint64(numEntries+1), db.OldestID())
+	assert.Equal(t, uint64(numEntries), db.NewestID())
+	_, err := db.Get(numEntries)
+	assert.Equal(t, ErrIDOutOfRange, err)
+
+	// IDs continue on after forgetting everything, and the database is still openable.
+	*clock = 2000
+	assert.Equal(t, uint64(numEntries+1), assertAppend(t, db, []byte("hello world")))
+	assertClose(t, db)
+
+	db2 := assertOpen(t, dbTypes["lock free chunkdb"], false, "forget_before", chunkSize)
+	defer assertClose(t, db2)
+	assert.Equal(t, uint64(numEntries+1), db2.OldestID())
+	assert.Equal(t, []byte("hello world"), assertGet(t, db2, numEntries+1))
+}
+
+/* ***** Size cap */
+
+func TestChunkDB_MaxBytes(t *testing.T) {
+	maxBytes := uint64(1024)
+	db := assertOpenOptions(t, true, "max_bytes", chunkSize, WithMaxBytes(maxBytes))
+	defer assertClose(t, db)
+
+	for i := 0; i < numEntries*4; i++ {
+		v := []byte(fmt.Sprintf("entry-%v", i))
+		assert.Equal(t, uint64(i+1), assertAppend(t, db, v))
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+		assert.True(t, assertDiskUsage(t, db) <= maxBytes, "disk usage over cap after append %v", i+1)
+	}
+
+	assert.True(t, db.OldestID() > firstID, "expected oldest entries to be forgotten")
+	assert.Equal(t, uint64(numEntries*4), db.NewestID())
+	for i := db.OldestID(); i <= db.NewestID(); i++ {
+		assert.Equal(t, []byte(fmt.Sprintf("entry-%v", i-1)), assertGet(t, db, i))
+	}
+}
+
+func TestChunkDB_MaxBytesPreallocate(t *testing.T) {
+	db := assertOpenOptions(t, true, "max_bytes_preallocate", chunkSize, WithMaxBytes(1024))
+	defer assertClose(t, db)
+
+	// Spares take the disk usage well over the cap, but don't count towards it until they are used.
+	vs := filldb(t, db, 20)
+	assert.Nil(t, db.Preallocate(2000))
+	assert.True(t, assertDiskUsage(t, db) > 1024, "expected spares over the cap")
+	chunks := len(db.chunks)
+	for i := 0; len(db.chunks) == chunks; i++ {
+		vs = append(vs, []byte(fmt.Sprintf("entry-%v", i)))
+		assertAppend(t, db, vs[len(vs)-1])
+	}
+	assert.Equal(t, uint64(firstID), db.OldestID(), "expected no entries to be forgotten")
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+}
+
+/* ***** Entry count */
+
+func TestChunkDB_Len(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "len", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	assert.Equal(t, uint64(0), db.Len(), "expected never-written database to have no entries")
+	assert.True(t, db.IsEmpty(), "expected never-written database to be empty")
+
+	filldb(t, db, numEntries)
+	assertTruncate(t, db, 20, 200)
+	assert.Equal(t, uint64(181), db.Len(), "expected filled database to count live entries")
+	assert.False(t, db.IsEmpty(), "expected filled database not to be empty")
+
+	if _, err := db.ForgetBefore(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(0), db.Len(), "expected fully-forgotten database to have no entries")
+	assert.True(t, db.IsEmpty(), "expected fully-forgotten database to be empty")
+}
+
+func TestChunkDB_CloseSyncs(t *testing.T) {
+	db := assertOpenOptions(t, true, "close_syncs", chunkSize)
+	vs := filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	// Changes which never reach the sync threshold are still written by 'Close'.
+	db = assertOpenOptions(t, false, "close_syncs", chunkSize)
+	assertSetSync(t, db, -1)
+	assertForget(t, db, 2)
+	vs = append(vs, []byte("a"), []byte("b"))
+	assertAppend(t, db, []byte("a"))
+	assertAppend(t, db, []byte("b"))
+	assertClose(t, db)
+	assert.Equal(t, ErrClosed, db.Close())
+
+	db = assertOpenOptions(t, false, "close_syncs", chunkSize)
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(2), db.OldestID(), "expected forget to be synced")
+	assert.Equal(t, uint64(len(vs)), db.NewestID(), "expected entries to be synced")
+	for i := 1; i < len(vs); i++ {
+		assert.Equal(t, vs[i], assertGet(t, db, uint64(i+1)))
+	}
+}
+
+func TestOpenAll(t *testing.T) {
+	_ = os.RemoveAll("test_db/open_all")
+
+	db := assertOpenOptions(t, true, "open_all/tenant_a", chunkSize)
+	vsA := filldb(t, db, 20)
+	assertClose(t, db)
+	db = assertOpenOptions(t, true, "open_all/tenant_b", chunkSize*2)
+	vsB := filldb(t, db, 30)
+	assertClose(t, db)
+
+	// Directories and files which aren't databases are skipped.
+	assert.Nil(t, os.MkdirAll("test_db/open_all/junk", 0755))
+	writeTestFile(t, "test_db/open_all/junk/version", []byte{2, 0})
+	writeTestFile(t, "test_db/open_all/notes.txt", []byte("hello"))
+
+	dbs, err := OpenAll("test_db/open_all", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(dbs))
+	for name, vs := range map[string][][]byte{"tenant_a": vsA, "tenant_b": vsB} {
+		db := dbs[name]
+		if !assert.NotNil(t, db, "expected %s to be opened", name) {
+			continue
+		}
+		assert.Equal(t, uint64(len(vs)), db.NewestID())
+		for i, v := range vs {
+			assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+		}
+	}
+
+	// If a database can't be opened, those already opened are closed.
+	_, err = OpenAll("test_db/open_all", 0)
+	assert.True(t, errwrap.ContainsType(err, new(DatabaseError)), "expected database error, got: %s", err)
+	for _, db := range dbs {
+		assertClose(t, db)
+	}
+
+	writeTestFile(t, "test_db/open_all/tenant_b/version", []byte{99, 0})
+	_, err = OpenAll("test_db/open_all", 0)
+	assert.Equal(t, &DatabaseError{Name: "tenant_b", Err: ErrUnknownVersion}, err)
+
+	db = assertOpenOptions(t, false, "open_all/tenant_a", 0)
+	assertClose(t, db)
+}
+
+func TestChunkDB_Checkpoint(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "checkpoint", chunkSize).(*ChunkDB)
+	assertSetSync(t, db, -1)
+
+	vs := filldb(t, db, numEntries)
+	checkpoint, err := db.Checkpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, db.NextID(), checkpoint)
+	assert.Equal(t, uint64(len(vs)+1), checkpoint)
+
+	// Entries appended after the checkpoint aren't covered by it, and are lost if the database isn't synced.
+	assertAppend(t, db, []byte("unsynced"))
+	assert.Nil(t, db.CloseAbort())
+
+	db = assertOpen(t, dbTypes["chunkdb"], false, "checkpoint", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+	assert.Equal(t, checkpoint, db.NextID())
+	for id := uint64(1); id < checkpoint; id++ {
+		assert.Equal(t, vs[id-1], assertGet(t, db, id))
+	}
+}
+
+func TestChunkDB_Refresh(t *testing.T) {
+	writer := assertOpenOptions(t, true, "refresh", chunkSize)
+	defer assertClose(t, writer)
+	vs := filldb(t, writer, numEntries)
+	assertSync(t, writer)
+
+	// A reader doesn't take the lock, so it can be open alongside the writer, but it can't change anything.
+	reader := assertOpenOptions(t, false, "refresh", chunkSize, WithReadOnly())
+	assert.Equal(t, writer.NextID(), reader.NextID())
+	_, err := reader.Append([]byte("nope"))
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, ErrReadOnly, reader.Forget(firstID+1))
+
+	// The reader doesn't see what the writer does next until it refreshes.
+	next := reader.NextID()
+	for i := 0; i < numEntries; i++ {
+		v := []byte(fmt.Sprintf("more-%v", i))
+		assertAppend(t, writer, v)
+		vs = append(vs, v)
+	}
+	assertForget(t, writer, firstID+10)
+	assertSync(t, writer)
+	assert.Equal(t, next, reader.NextID())
+	assert.Equal(t, firstID, reader.OldestID())
+
+	assert.Nil(t, reader.Refresh())
+	assert.Equal(t, writer.OldestID(), reader.OldestID())
+	assert.Equal(t, writer.NextID(), reader.NextID())
+	for id := reader.OldestID(); id < reader.NextID(); id++ {
+		assert.Equal(t, vs[id-1], assertGet(t, reader, id))
+	}
+
+	assertClose(t, reader)
+	assert.Equal(t, ErrClosed, reader.Refresh())
+
+	// A read-only open never creates a database.
+	_, err = Open("test_db/refresh_missing", chunkSize, true, WithReadOnly())
+	assert.IsType(t, &DatabasePathError{}, err)
+}
+
+func TestChunkDB_Delete(t *testing.T) {
+	db := assertOpenOptions(t, true, "delete", chunkSize)
+	vs := filldb(t, db, numEntries)
+
+	assert.Nil(t, db.Delete(10))
+	assert.Nil(t, db.Delete(10), "expected deleting twice to do nothing")
+	assert.Equal(t, ErrIDOutOfRange, db.Delete(db.NextID()))
+
+	// The deleted entry is gone, but its neighbours and the IDs after it are not.
+	_, err := db.Get(10)
+	assert.Equal(t, ErrDeleted, err)
+	assert.Equal(t, vs[8], assertGet(t, db, 9))
+	assert.Equal(t, vs[10], assertGet(t, db, 11))
+	assert.Equal(t, uint64(numEntries), db.NewestID())
+	assert.False(t, db.Exists(10))
+	assert.True(t, db.Exists(11))
+	assert.Equal(t, uint64(numEntries), db.Len(), "expected deleted entry to be counted")
+	_, err = db.GetMany([]uint64{9, 10})
+	assert.Equal(t, &IDError{ID: 10, Err: ErrDeleted}, err)
+
+	// Visiting every entry skips it.
+	var ids []uint64
+	assert.Nil(t, db.Scan(func(id uint64, _ []byte) bool {
+		ids = append(ids, id)
+		return true
+	}))
+	assert.Equal(t, numEntries-1, len(ids))
+	assert.NotContains(t, ids, uint64(10))
+	it, err := db.Iterator(9)
+	assert.Nil(t, err)
+	assert.True(t, it.Next())
+	assert.True(t, it.Next())
+	assert.Equal(t, uint64(11), it.ID())
+
+	// The deletion survives a reopen.
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "delete", chunkSize)
+	_, err = db.Get(10)
+	assert.Equal(t, ErrDeleted, err)
+	assert.Equal(t, vs[10], assertGet(t, db, 11))
+
+	// Rolling back past it undoes it, as the ID is reused.
+	assertRollback(t, db, 9)
+	assertAppend(t, db, []byte("reused"))
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "delete", chunkSize)
+	defer assertClose(t, db)
+	assert.Equal(t, []byte("reused"), assertGet(t, db, 10))
+}
+
+func TestChunkDB_DeleteUnsynced(t *testing.T) {
+	db := assertOpenOptions(t, true, "delete_unsynced", chunkSize)
+	assertSetSync(t, db, -1)
+	for i := 0; i < 5; i++ {
+		assertAppend(t, db, []byte(fmt.Sprintf("entry-%v", i)))
+	}
+	assertSync(t, db)
+
+	// Deleting an entry which hasn't been synced syncs it, so the deletion can't outlive it.
+	assertAppend(t, db, []byte("entry-5"))
+	assert.Nil(t, db.Delete(6))
+	assert.Nil(t, db.CloseAbort())
+	db = assertOpenOptions(t, false, "delete_unsynced", chunkSize)
+	assert.Equal(t, uint64(6), db.NewestID())
+	_, err := db.Get(6)
+	assert.Equal(t, ErrDeleted, err)
+	assertClose(t, db)
+
+	// A tombstone for an ID after the end of the log, as a crash could have left before, is ignored, so the
+	// entry which is next given the ID isn't deleted.
+	writeTestFile(t, "test_db/delete_unsynced/tombstones", []byte{6, 0, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0})
+	db = assertOpenOptions(t, false, "delete_unsynced", chunkSize)
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(7), assertAppend(t, db, []byte("entry-6")))
+	assert.Equal(t, []byte("entry-6"), assertGet(t, db, 7))
+	_, err = db.Get(6)
+	assert.Equal(t, ErrDeleted, err)
+}
+
+func TestChunkDB_DeleteCompacted(t *testing.T) {
+	db := assertOpenOptions(t, true, "delete_compacted", chunkSize, WithCompactThreshold(0.5))
+	defer assertClose(t, db)
+
+	// Every entry is the same size, so the first chunk holds 14 of them, 3 to 9 of which are deleted.
+	var vs [][]byte
+	for i := 1; i <= 30; i++ {
+		v := []byte(fmt.Sprintf("entry-%02d", i))
+		if i >= 3 && i <= 9 {
+			v = []byte(fmt.Sprintf("secret-%v", i))
+		}
+		vs = append(vs, v)
+	}
+	assertAppendEntries(t, db, vs)
+	for id := uint64(3); id <= 9; id++ {
+		assert.Nil(t, db.Delete(id))
+	}
+	assertSync(t, db)
+	oldestPath := db.chunks[0].path
+	assert.True(t, bytes.Contains(readTestFile(t, oldestPath), []byte("secret")))
+
+	// Forgetting one more entry leaves the chunk less than half live, so it's compacted, without the deleted
+	// entries.
+	assertForget(t, db, 2)
+	assert.NotEqual(t, oldestPath, db.chunks[0].path, "expected oldest chunk to be compacted")
+	assert.False(t, bytes.Contains(readTestFile(t, db.chunks[0].path), []byte("secret")))
+	for id := uint64(2); id <= 30; id++ {
+		entry, err := db.Get(id)
+		if id >= 3 && id <= 9 {
+			assert.Equal(t, ErrDeleted, err)
+		} else {
+			assert.Equal(t, vs[id-1], entry)
+		}
+	}
+}
+
+func TestChunkDB_ReadCache(t *testing.T) {
+	db := assertOpenOptions(t, true, "read_cache", chunkSize, WithReadCache(4))
+	defer assertClose(t, db)
+	vs := filldb(t, db, numEntries)
+
+	// The second read of an entry is a hit, and modifying what it returns doesn't change the cache.
+	entry := assertGet(t, db, 20)
+	entry[0] = 'x'
+	assert.Equal(t, vs[19], assertGet(t, db, 20))
+	stats := db.Stats()
+	assert.Equal(t, uint64(1), stats.CacheHits)
+	assert.Equal(t, uint64(1), stats.CacheMisses)
+
+	// The least recently read entries are evicted.
+	for id := uint64(21); id <= 25; id++ {
+		assertGet(t, db, id)
+	}
+	assert.Equal(t, 4, db.Stats().CachedEntries)
+	assertGet(t, db, 20)
+	assert.Equal(t, uint64(7), db.Stats().CacheMisses)
+
+	// Truncated entries are evicted, so an ID which is reused is read afresh.
+	assertGet(t, db, 24)
+	assert.Nil(t, db.Truncate(firstID, 23))
+	assertAppend(t, db, []byte("new-24"))
+	assert.Equal(t, []byte("new-24"), assertGet(t, db, 24))
+
+	// As are forgotten and deleted entries.
+	assertGet(t, db, 5)
+	assertForget(t, db, 6)
+	_, err := db.Get(5)
+	assert.Equal(t, ErrIDOutOfRange, err)
+	assertGet(t, db, 7)
+	assert.Nil(t, db.Delete(7))
+	_, err = db.Get(7)
+	assert.Equal(t, ErrDeleted, err)
+}
+
+func TestChunkDB_BackgroundScrub(t *testing.T) {
+	obs := &scrubObserver{ids: make(chan uint64, 1)}
+	lfdb := assertOpenOptions(t, true, "background_scrub", chunkSize, WithFraming(), WithObserver(obs), WithBackgroundScrub(1<<20))
+	filldb(t, lfdb, numEntries)
+
+	// Zero the frame header of the third entry, as if the data file had been damaged.
+	c := lfdb.chunks[0]
+	c.bytes[c.ends[1]] = 0
+
+	db := WrapForConcurrency(lfdb)
+	defer assertClose(t, db)
+	select {
+	case id := <-obs.ids:
+		assert.Equal(t, uint64(3), id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the scrubber to report the damaged entry")
+	}
+}
+
+func TestChunkDB_BackgroundScrubNeedsFraming(t *testing.T) {
+	// Neither a new nor an existing database without framing can be scrubbed.
+	_ = os.RemoveAll("test_db/background_scrub_unframed")
+	_, err := Open("test_db/background_scrub_unframed", chunkSize, true, WithBackgroundScrub(1<<20))
+	assert.Equal(t, ErrScrubNeedsFraming, err)
+	_, err = os.Stat("test_db/background_scrub_unframed")
+	assert.True(t, os.IsNotExist(err), "expected no database to be created")
+
+	db := assertOpenOptions(t, true, "background_scrub_unframed", chunkSize)
+	filldb(t, db, 10)
+	assertClose(t, db)
+	_, err = Open("test_db/background_scrub_unframed", chunkSize, false, WithBackgroundScrub(1<<20))
+	assert.Equal(t, ErrScrubNeedsFraming, err)
+}
+
+func TestChunkDB_DataBytes(t *testing.T) {
+	db := assertOpenOptions(t, true, "data_bytes", chunkSize)
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(0), db.DataBytes())
+
+	filldb(t, db, numEntries)
+	sumEntries := func() uint64 {
+		var total uint64
+		for id := db.OldestID(); id <= db.NewestID(); id++ {
+			total += uint64(len(assertGet(t, db, id)))
+		}
+		return total
+	}
+	assert.Equal(t, sumEntries(), db.DataBytes())
+
+	// Forgetting part of a chunk only counts the rest of it.
+	assertForget(t, db, 20)
+	assert.Equal(t, sumEntries(), db.DataBytes())
+	assertForget(t, db, 100)
+	assert.Equal(t, sumEntries(), db.DataBytes())
+	assertRollback(t, db, 200)
+	assert.Equal(t, sumEntries(), db.DataBytes())
+}
+
+func TestChunkDB_MlockNewest(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("no mlock on " + runtime.GOOS)
+	}
+
+	// Options which wrap the filesystem mustn't stop chunks being locked.
+	for name, opt := range map[string]Option{
+		"plain":      WithMlockNewest(2),
+		"file mode":  WithFileMode(0600),
+		"open retry": WithOpenRetry(3, time.Millisecond),
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := assertOpenOptions(t, true, "mlock_newest", chunkSize, WithMlockNewest(2), opt)
+			defer assertClose(t, db)
+			vs := filldb(t, db, numEntries)
+			if db.mlockFailed {
+				t.Skip("can't lock memory here")
+			}
+
+			assertLocked := func() {
+				for i, c := range db.chunks {
+					assert.Equal(t, i >= len(db.chunks)-2, c.locked, "chunk %v", i)
+				}
+			}
+			assertLocked()
+			for i, v := range vs {
+				assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+			}
+
+			// Rolling back a chunk locks the one before it.
+			assertRollback(t, db, db.chunks[len(db.chunks)-1].oldest-1)
+			assertLocked()
+		})
+	}
+}
+
+func TestChunkDB_Manifest(t *testing.T) {
+	db := assertOpenOptions(t, true, "manifest", chunkSize)
+	vs := filldb(t, db, numEntries)
+	assertSync(t, db)
+
+	assertManifest := func() []ChunkDigest {
+		manifest, err := db.Manifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manifest
+	}
+	before := assertManifest()
+	assert.Equal(t, len(db.chunks), len(before))
+	for i, cd := range before {
+		assert.Equal(t, db.chunks[i].path, cd.Path)
+		assert.Equal(t, db.chunks[i].oldest, cd.Oldest)
+		assert.Equal(t, db.chunks[i].next(), cd.Next)
+	}
+	assert.Equal(t, before, assertManifest())
+
+	// Rewriting the entries of one chunk, keeping their sizes, changes only its checksum.
+	c := db.chunks[3]
+	assertRollback(t, db, c.oldest)
+	for id := c.oldest + 1; id < before[3].Next; id++ {
+		entry := append([]byte(nil), vs[id-1]...)
+		for i := range entry {
+			entry[i] ^= 0xff
+		}
+		assertAppend(t, db, entry)
+	}
+	assertSync(t, db)
+	after := assertManifest()
+	assert.Equal(t, 4, len(after))
+	assert.Equal(t, before[:3], after[:3])
+	assert.Equal(t, before[3].Next, after[3].Next)
+	assert.NotEqual(t, before[3].Digest, after[3].Digest)
+	assertClose(t, db)
+
+	// The remembered checksums are kept in the "digests" file, so they aren't computed again after reopening.
+	db = assertOpenOptions(t, false, "manifest", chunkSize)
+	defer assertClose(t, db)
+	for i, c := range db.chunks[:3] {
+		assert.Equal(t, after[i].Digest, c.digest, "digest of chunk %v", i)
+	}
+	assert.Nil(t, db.chunks[3].digest)
+	assert.Equal(t, after, assertManifest())
+}
+
+func TestChunkDB_RollbackReporting(t *testing.T) {
+	db := assertOpenOptions(t, true, "rollback_reporting", chunkSize)
+	defer assertClose(t, db)
+	filldb(t, db, numEntries)
+
+	// Rolling back to the middle of a chunk deletes every later chunk, but not that one.
+	var expected []string
+	for _, c := range db.chunks[6:] {
+		expected = append(expected, c.path)
+	}
+	kept := db.chunks[5]
+	removed, err := db.RollbackReporting(kept.oldest + 1)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, removed)
+	assert.Equal(t, kept.oldest+1, db.NewestID())
+	for _, path := range removed {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "expected %s to be deleted", path)
+		_, err = os.Stat(metaFilePath(path))
+		assert.True(t, os.IsNotExist(err), "expected metadata of %s to be deleted", path)
+	}
+	_, err = os.Stat(kept.path)
+	assert.Nil(t, err)
+
+	// Rolling back within the final chunk deletes nothing.
+	removed, err = db.RollbackReporting(kept.oldest)
+	assert.Nil(t, err)
+	assert.Nil(t, removed)
+}
+
+func TestChunkDB_StartID(t *testing.T) {
+	db := assertOpenOptions(t, true, "start_id", chunkSize, WithStartID(1000))
+	assert.Equal(t, uint64(1000), db.NextID())
+	assert.True(t, db.IsEmpty())
+
+	// The base survives reopening before anything is appended.
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "start_id", chunkSize)
+	assert.Equal(t, uint64(1000), db.NextID())
+
+	var vs [][]byte
+	for i := 0; i < 50; i++ {
+		v := []byte(fmt.Sprintf("entry-%v", i))
+		vs = append(vs, v)
+		assert.Equal(t, uint64(1000+i), assertAppend(t, db, v))
+	}
+	assert.Equal(t, uint64(1000), db.OldestID())
+	assert.Equal(t, uint64(1049), db.NewestID())
+	_, err := db.Get(999)
+	assert.Equal(t, ErrIDOutOfRange, err)
+	assertClose(t, db)
+
+	// The option does nothing for an existing database.
+	db = assertOpenOptions(t, false, "start_id", chunkSize, WithStartID(5))
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(1000), db.OldestID())
+	assert.Equal(t, uint64(1049), db.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(1000+i)))
+	}
+}
+
+func TestChunkDB_CloseAbort(t *testing.T) {
+	db := assertOpenOptions(t, true, "close_abort", chunkSize)
+	vs := filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	// Entries which fit in the final chunk are discarded.
+	db = assertOpenOptions(t, false, "close_abort", chunkSize)
+	assertSetSync(t, db, -1)
+	assertForget(t, db, 2)
+	assertAppend(t, db, []byte("a"))
+	assertAppend(t, db, []byte("b"))
+	assert.Nil(t, db.CloseAbort())
+	assert.Equal(t, ErrClosed, db.CloseAbort())
+
+	db = assertOpenOptions(t, false, "close_abort", chunkSize)
+	assert.Equal(t, firstID, db.OldestID(), "expected forget to be discarded")
+	assert.Equal(t, uint64(len(vs)), db.NewestID(), "expected unsynced entries to be discarded")
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+
+	// Entries in chunks which have been filled are kept.
+	assertSetSync(t, db, -1)
+	for i := 0; i < 5; i++ {
+		vs = append(vs, bytes.Repeat([]byte{byte(i)}, chunkSize/2))
+		assertAppend(t, db, vs[len(vs)-1])
+	}
+	chunks := db.Chunks()
+	kept := chunks[len(chunks)-1].OldestID - 1
+	assert.True(t, kept > uint64(numEntries), "expected a chunk to be filled")
+	assert.Nil(t, db.CloseAbort())
+
+	db2 := assertOpenOptions(t, false, "close_abort", chunkSize)
+	defer assertClose(t, db2)
+	assert.Equal(t, kept, db2.NewestID(), "expected entries in the final chunk to be discarded")
+	for i, v := range vs[:kept] {
+		assert.Equal(t, v, assertGet(t, db2, uint64(i+1)))
+	}
+	assert.Equal(t, kept+1, assertAppend(t, db2, []byte("hello")))
+}
+
+func TestChunkDB_CloseAbortAfterRollback(t *testing.T) {
+	db := assertOpenOptions(t, true, "close_abort_rollback", chunkSize)
+	vs := filldb(t, db, numEntries)
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "close_abort_rollback", chunkSize)
+
+	// Rolling back a synced entry and appending over it means the synced state is gone. Rolling back within
+	// the final chunk doesn't delete any chunks, so doesn't force a sync.
+	assertSetSync(t, db, -1)
+	assertRollback(t, db, uint64(len(vs)-1))
+	vs = append(vs[:len(vs)-1], []byte("hello"))
+	assertAppend(t, db, []byte("hello"))
+	assert.Equal(t, ErrCannotAbort, db.CloseAbort())
+
+	db2 := assertOpenOptions(t, false, "close_abort_rollback", chunkSize)
+	defer assertClose(t, db2)
+	assert.Equal(t, uint64(len(vs)), db2.NewestID(), "expected database to be synced")
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db2, uint64(i+1)))
+	}
+}
+
+func TestChunkDB_TruncateCounting(t *testing.T) {
+	db := assertOpenOptions(t, true, "truncate_counting", chunkSize)
+	defer assertClose(t, db)
+
+	filldb(t, db, numEntries)
+
+	forgotten, rolledBack, err := db.TruncateCounting(20, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(20-firstID), forgotten, "forgotten")
+	assert.Equal(t, uint64(numEntries-200), rolledBack, "rolled back")
+
+	// IDs outside the log are not counted.
+	forgotten, rolledBack, err = db.TruncateCounting(10, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(0), forgotten, "forgotten")
+	assert.Equal(t, uint64(0), rolledBack, "rolled back")
+}
+
+func TestChunkDB_AppendEntriesEvery(t *testing.T) {
+	db := assertOpenOptions(t, true, "append_entries_every", chunkSize)
+	defer assertClose(t, db)
+	assertSetSync(t, db, -1)
+
+	vs := make([][]byte, 25)
+	for i := range vs {
+		vs[i] = []byte(fmt.Sprintf("entry-%v", i))
+	}
+	id, err := db.AppendEntriesEvery(vs, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, firstID, id)
+
+	// Simulate a crash by copying the files as they are, without the final sync: the batch is synced up to
+	// the last multiple of 10.
+	copyTestDir(t, "test_db/append_entries_every", "test_db/append_entries_every_crashed")
+	crashed := assertOpenOptions(t, false, "append_entries_every_crashed", chunkSize)
+	defer assertClose(t, crashed)
+	assert.Equal(t, uint64(20), crashed.NewestID(), "expected synced prefix to survive")
+	for i, v := range vs[:20] {
+		assert.Equal(t, v, assertGet(t, crashed, uint64(i+1)))
+	}
+
+	// A failure part-way through rolls back the synced entries too.
+	bad := append(append([][]byte(nil), vs...), make([]byte, chunkSize+1))
+	_, err = db.AppendEntriesEvery(bad, 10)
+	assert.Equal(t, &BatchAppendError{Index: len(vs), Count: len(bad), Size: chunkSize + 1, Err: ErrTooBig}, err)
+	assert.Equal(t, uint64(len(vs)), db.NewestID(), "expected failed batch to be rolled back")
+
+	copyTestDir(t, "test_db/append_entries_every", "test_db/append_entries_every_rolled_back")
+	rolledBack := assertOpenOptions(t, false, "append_entries_every_rolled_back", chunkSize)
+	defer assertClose(t, rolledBack)
+	assert.Equal(t, uint64(len(vs)), rolledBack.NewestID(), "expected rollback to be synced")
+}
+
+func TestChunkDB_AppendEntriesGetIDs(t *testing.T) {
+	db := WrapForConcurrency(assertOpenOptions(t, true, "append_entries_get_ids", chunkSize))
+	defer assertClose(t, db)
+	filldb(t, db, 10)
+
+	// The batch spans several chunks.
+	entries := make([][]byte, 40)
+	for i := range entries {
+		entries[i] = []byte(fmt.Sprintf("batch-%v", i))
+	}
+	ids, err := db.AppendEntriesGetIDs(entries)
+	assert.Nil(t, err)
+	assert.Equal(t, 40, len(ids))
+	for i, id := range ids {
+		assert.Equal(t, uint64(11+i), id)
+		assert.Equal(t, entries[i], assertGet(t, db, id))
+	}
+
+	// A failed batch is rolled back, and has no IDs.
+	ids, err = db.AppendEntriesGetIDs([][]byte{[]byte("ok"), make([]byte, chunkSize+1)})
+	assert.NotNil(t, err)
+	assert.Nil(t, ids)
+	assert.Equal(t, uint64(50), db.NewestID())
+
+	ids, err = db.AppendEntriesGetIDs(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, ids)
+}
+
+func TestChunkDB_AppendIfFits(t *testing.T) {
+	db := WrapForConcurrency(assertOpenOptions(t, true, "append_if_fits", chunkSize))
+	defer assertClose(t, db)
+
+	// Fill the first chunk until the next entry doesn't fit.
+	entry := make([]byte, 10)
+	var n int
+	for {
+		_, err := db.AppendIfFits(entry)
+		if err == ErrChunkFull {
+			break
+		}
+		assert.Nil(t, err)
+		n++
+	}
+	assert.Equal(t, chunkSize/len(entry), n)
+	assert.Equal(t, 1, len(db.chunks), "expected no new chunk")
+	assert.Equal(t, uint64(n), db.NewestID())
+
+	// A smaller entry may still fit, and one which is too big for any chunk is an error as usual.
+	id, err := db.AppendIfFits(make([]byte, chunkSize%len(entry)))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(n+1), id)
+	_, err = db.AppendIfFits(make([]byte, chunkSize+1))
+	assert.Equal(t, ErrTooBig, err)
+
+	// 'Append' starts the next chunk.
+	assertAppend(t, db, entry)
+	assert.Equal(t, 2, len(db.chunks))
+	_, err = db.AppendIfFits(entry)
+	assert.Nil(t, err)
+}
+
+func TestChunkDB_CompareAndAppend(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "compare_and_append", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	// An empty database starts at the first ID.
+	id, err := db.CompareAndAppend(firstID, []byte("first"))
+	assert.Nil(t, err, "expected append to empty database to succeed")
+	assert.Equal(t, firstID, id)
+
+	vs := [][]byte{[]byte("first")}
+	for i := 1; i < numEntries; i++ {
+		vs = append(vs, []byte(fmt.Sprintf("entry-%v", i)))
+		id, err := db.CompareAndAppend(db.NewestID()+1, vs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, uint64(len(vs)), id)
+	}
+
+	// Both a stale and a future next ID conflict, and leave the log alone.
+	for _, expected := range []uint64{db.NewestID(), db.NewestID() + 2, 0} {
+		_, err := db.CompareAndAppend(expected, []byte("conflict"))
+		assert.Equal(t, ErrConflict, err, "expected next ID %v to conflict", expected)
+		assert.Equal(t, uint64(len(vs)), db.NewestID(), "expected conflicting append not to happen")
+	}
+
+	// After a rollback, the next ID goes back.
+	assertRollback(t, db, 100)
+	id, err = db.CompareAndAppend(101, []byte("after rollback"))
+	assert.Nil(t, err, "expected append after rollback to succeed")
+	assert.Equal(t, uint64(101), id)
+	assert.Equal(t, []byte("after rollback"), assertGet(t, db, 101))
+}
+
+func TestChunkDB_AppendReader(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "append_reader", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	// Exact lengths, across chunk boundaries.
+	var vs [][]byte
+	for i := 0; i < numEntries; i++ {
+		v := []byte(fmt.Sprintf("entry-%v", i))
+		id, err := db.AppendReader(bytes.NewReader(v), len(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs = append(vs, v)
+		assert.Equal(t, uint64(len(vs)), id)
+	}
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+
+	// Fill the last chunk, so the next entry needs a new one.
+	last := db.chunks[len(db.chunks)-1]
+	assertAppend(t, db, make([]byte, chunkSize-uint32(last.ends[len(last.ends)-1])))
+	newest, numChunks := db.NewestID(), len(db.chunks)
+
+	failures := []struct {
+		name string
+		r    io.Reader
+		n    int
+		err  error
+	}{
+		{"short read", bytes.NewReader([]byte("hello")), 10, ErrEntryLength},
+		{"over-long reader", bytes.NewReader([]byte("hello world")), 5, ErrEntryLength},
+		{"empty reader", bytes.NewReader(nil), 5, ErrEntryLength},
+		{"read error", iotest.TimeoutReader(bytes.NewReader([]byte("hello hello"))), 10, iotest.ErrTimeout},
+		{"too big", bytes.NewReader(make([]byte, chunkSize+1)), chunkSize + 1, ErrTooBig},
+	}
+	for _, f := range failures {
+		_, err := db.AppendReader(f.r, f.n)
+		assert.Equal(t, f.err, err, f.name)
+		assert.Equal(t, newest, db.NewestID(), "expected %s not to append", f.name)
+		assert.Equal(t, numChunks, len(db.chunks), "expected %s not to leave a new chunk", f.name)
+	}
+
+	// Appending still works afterwards.
+	id, err := db.AppendReader(bytes.NewReader([]byte("hello")), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, newest+1, id)
+	assert.Equal(t, []byte("hello"), assertGet(t, db, id))
+}
+
+func TestChunkDB_AsyncAppender(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "async_appender", chunkSize).(*ChunkDB)
+
+	entries, errs, stop := db.AsyncAppender(16)
+
+	var vs [][]byte
+	for i := 0; i < 20*numEntries; i++ {
+		v := []byte(fmt.Sprintf("entry-%v", i))
+		vs = append(vs, v)
+		entries <- v
+		if i == numEntries {
+			entries <- make([]byte, chunkSize+1)
+		}
+	}
+
+	assert.Equal(t, ErrTooBig, stop(), "expected stop to return the first error")
+	assert.Equal(t, ErrTooBig, stop(), "expected stopping again to return the same error")
+	assert.Equal(t, ErrTooBig, <-errs, "expected too-big entry to be reported")
+	_, ok := <-errs
+	assert.False(t, ok, "expected error channel to be closed")
+	assertClose(t, db)
+
+	// Every entry was synced, in order, apart from the one which was too big.
+	db = assertOpen(t, dbTypes["chunkdb"], false, "async_appender", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)), "entry %v", i+1)
+	}
+}
+
+func TestChunkDB_Exists(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "exists", chunkSize).(*ChunkDB)
+
+	assert.False(t, db.Exists(0), "expected ID 0 not to exist")
+	assert.False(t, db.Exists(firstID), "expected nothing to exist in never-written database")
+
+	filldb(t, db, numEntries)
+	assertTruncate(t, db, 20, 200)
+	for _, id := range []uint64{0, 1, 19, 201, 255, 1000} {
+		assert.False(t, db.Exists(id), "expected ID %v not to exist", id)
+	}
+	for _, id := range []uint64{20, 100, 200} {
+		assert.True(t, db.Exists(id), "expected ID %v to exist", id)
+	}
+
+	assertClose(t, db)
+	assert.False(t, db.Exists(100), "expected nothing to exist in closed database")
+}
+
+func TestChunkDB_GetNoCopy(t *testing.T) {
+	for _, maxMapped := range []int{0, 3} {
+		db := WrapForConcurrency(assertOpenOptions(t, true, "get_no_copy", chunkSize, WithMaxMappedChunks(maxMapped)))
+		vs := filldb(t, db, numEntries)
+		assertForget(t, db, 20)
+
+		for id := db.OldestID(); id <= db.NewestID(); id++ {
+			entry, release, err := db.GetNoCopy(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, vs[id-1], entry, "entry %v with max mapped chunks %v", id, maxMapped)
+			assert.Equal(t, len(entry), cap(entry), "expected capacity of entry %v to be limited", id)
+			release()
+			release()
+		}
+
+		for _, id := range []uint64{19, db.NewestID() + 1} {
+			_, _, err := db.GetNoCopy(id)
+			assert.Equal(t, ErrIDOutOfRange, err, "expected entry %v to be out of range", id)
+		}
+
+		// The lock is released, so writing works.
+		assertAppend(t, db, []byte("hello"))
+		assertClose(t, db)
+	}
+}
+
+func TestChunkDB_GetSize(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "get_size", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	_, err := db.GetSize(firstID)
+	assert.Equal(t, ErrIDOutOfRange, err, "expected size in empty database to be out of range")
+
+	// Entries of varying sizes, so they end at different places in each chunk.
+	for i := 0; i < numEntries; i++ {
+		assertAppend(t, db, make([]byte, i%(chunkSize/3)))
+	}
+	assertForget(t, db, 20)
+
+	for id := db.OldestID(); id <= db.NewestID(); id++ {
+		size, err := db.GetSize(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(assertGet(t, db, id)), size, "size of entry %v", id)
+	}
+
+	for _, id := range []uint64{19, db.NewestID() + 1} {
+		_, err := db.GetSize(id)
+		assert.Equal(t, ErrIDOutOfRange, err, "expected size of entry %v to be out of range", id)
+	}
+}
+
+func TestChunkDB_EmptyEntries(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "empty_entries", chunkSize)
+
+	// Empty entries everywhere: at the start of the log, in runs, at the start and end of chunks.
+	var vs [][]byte
+	for i := 0; i < numEntries; i++ {
+		v := []byte{}
+		if i%3 == 1 {
+			v = []byte(fmt.Sprintf("entry-%v", i))
+		}
+		vs = append(vs, v)
+	}
+	for i := 0; i < 20; i++ {
+		vs = append(vs, make([]byte, chunkSize/4), []byte{})
+	}
+	assertAppendEntries(t, db, vs)
+
+	// A rollback over empty entries is still told apart from them.
+	assertRollback(t, db, uint64(len(vs)-5))
+	vs = vs[:len(vs)-5]
+	vs = append(vs, []byte{}, []byte("after rollback"))
+	assertAppendEntries(t, db, vs[len(vs)-2:])
+	assertClose(t, db)
+
+	db = assertOpen(t, dbTypes["lock free chunkdb"], false, "empty_entries", chunkSize)
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)), "entry %v", i+1)
+	}
+}
+
+func TestChunkDB_WriteMetrics(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "write_metrics", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	// Entries of 10 bytes, so 11 fit in each chunk.
+	for i := 0; i < 100; i++ {
+		assertAppend(t, db, make([]byte, 10))
+	}
+	assertForget(t, db, 12)
+	assertSync(t, db)
+	assertAppend(t, db, make([]byte, 10))
+
+	var buf bytes.Buffer
+	assert.Nil(t, db.WriteMetrics(&buf))
+
+	values := make(map[string]uint64)
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		fields := strings.Fields(line)
+		if fields[0] == "#" {
+			if fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		if len(fields) != 2 {
+			t.Fatalf("malformed metric line %q", line)
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			t.Fatalf("malformed metric value %q", line)
+		}
+		values[fields[0]] = v
+	}
+
+	expected := map[string]uint64{
+		"logdb_entries":          90,
+		"logdb_chunks":           9,
+		"logdb_disk_bytes":       assertDiskUsage(t, db.LockFreeChunkDB),
+		"logdb_oldest_id":        12,
+		"logdb_next_id":          102,
+		"logdb_bytes_since_sync": 10,
+	}
+	assert.Equal(t, expected, values)
+	for name := range expected {
+		assert.Equal(t, "gauge", types[name], "type of %s", name)
+	}
+}
+
+func TestChunkDB_Chunks(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "chunks", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	assert.Empty(t, db.Chunks(), "expected empty database to have no chunks")
+
+	// Entries of 10 bytes, so 11 fit in each chunk.
+	for i := 0; i < 100; i++ {
+		assertAppend(t, db, make([]byte, 10))
+	}
+
+	infos := db.Chunks()
+	assert.Equal(t, 10, len(infos), "chunk count")
+	for i, info := range infos {
+		entries := 11
+		if i == len(infos)-1 {
+			entries = 1
+		}
+		oldest := uint64(1 + 11*i)
+		assert.Equal(t, fmt.Sprintf("chunk_%v_%v", i, oldest), filepath.Base(info.Path), "path of chunk %v", i)
+		assert.Equal(t, oldest, info.OldestID, "oldest ID of chunk %v", i)
+		assert.Equal(t, oldest+uint64(entries), info.NextID, "next ID of chunk %v", i)
+		assert.Equal(t, entries, info.Entries, "entries in chunk %v", i)
+		assert.Equal(t, uint32(10*entries), info.UsedBytes, "used bytes of chunk %v", i)
+
+		// Chunks are synced when the next one is created, so only the final chunk is dirty.
+		assert.Equal(t, i == len(infos)-1, info.Dirty, "dirty flag of chunk %v", i)
+	}
+
+	assertSync(t, db)
+	assert.False(t, db.Chunks()[9].Dirty, "expected final chunk to be clean after syncing")
+}
+
+func TestChunkDB_Drain(t *testing.T) {
+	db := assertOpenOptions(t, true, "drain", chunkSize)
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+
+	assert.Nil(t, db.Drain())
+	assert.Equal(t, uint64(len(vs)+1), db.OldestID())
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+	assert.Empty(t, db.Chunks(), "expected every chunk to be deleted")
+	_, err := db.Get(uint64(len(vs)))
+	assert.Equal(t, ErrIDOutOfRange, err)
+
+	// Only the "version", "chunk_size", and "oldest" files are left.
+	assert.Equal(t, uint64(2+4+12), assertDiskUsage(t, db))
+
+	// Draining an empty database does nothing.
+	assert.Nil(t, db.Drain())
+	assert.Equal(t, uint64(len(vs)+1), db.OldestID())
+
+	assert.Equal(t, uint64(len(vs)+1), assertAppend(t, db, []byte("hello")))
+	assertClose(t, db)
+
+	// The IDs carry on after reopening, too.
+	db = assertOpenOptions(t, false, "drain", chunkSize)
+	assert.Equal(t, uint64(len(vs)+1), db.OldestID())
+	assert.Equal(t, []byte("hello"), assertGet(t, db, uint64(len(vs)+1)))
+	assert.Nil(t, db.Drain())
+	assertClose(t, db)
+
+	db = assertOpenOptions(t, false, "drain", chunkSize)
+	assert.Equal(t, uint64(len(vs)+2), db.OldestID())
+	assert.Equal(t, uint64(len(vs)+2), assertAppend(t, db, []byte("world")))
+	assertClose(t, db)
+}
+
+func TestChunkDB_TrimTail(t *testing.T) {
+	db := assertOpenOptions(t, true, "trim_tail", chunkSize, WithTrimTail())
+
+	fileSize := func(path string) int64 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	assertTrimmed := func() {
+		infos := db.Chunks()
+		for i, info := range infos {
+			expected := int64(chunkSize)
+			if i == len(infos)-1 {
+				expected = int64(info.UsedBytes)
+			}
+			assert.Equal(t, expected, fileSize(info.Path), "size of chunk %v", i)
+		}
+	}
+
+	// Periodic syncs while appending don't trim the final chunk, but an explicit sync does.
+	assertSetSync(t, db, 1)
+	var vs [][]byte
+	for i := 0; i < 5; i++ {
+		vs = append(vs, []byte(fmt.Sprintf("entry-%v", i)))
+		assertAppend(t, db, vs[i])
+	}
+	assert.Equal(t, int64(chunkSize), fileSize(db.chunks[0].path), "expected untrimmed chunk")
+	assertSync(t, db)
+	assertTrimmed()
+
+	// The chunk is grown back when appended to, including when it fills up.
+	for i := 5; i < numEntries; i++ {
+		vs = append(vs, []byte(fmt.Sprintf("entry-%v", i)))
+		assertAppend(t, db, vs[i])
+	}
+	assert.True(t, len(db.chunks) > 2, "expected several chunks")
+	assert.Equal(t, int64(chunkSize), fileSize(db.chunks[len(db.chunks)-1].path), "expected grown chunk")
+	assertSync(t, db)
+	assertTrimmed()
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+	assertClose(t, db)
+
+	// The trimmed database is consistent, and can be opened and appended to.
+	assert.Nil(t, HealthCheck("test_db/trim_tail", WithTrimTail()))
+	db = assertOpenOptions(t, false, "trim_tail", chunkSize, WithTrimTail())
+	defer assertClose(t, db)
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+	assertAppend(t, db, []byte("hello"))
+	assertSync(t, db)
+	assertTrimmed()
+}
+
+func TestChunkDB_TrimTailEmptyEntries(t *testing.T) {
+	db := assertOpenOptions(t, true, "trim_tail_empty", chunkSize, WithTrimTail())
+
+	// A final chunk of only empty entries is trimmed, but not to nothing, and can still be appended to.
+	assertAppend(t, db, nil)
+	assertAppend(t, db, nil)
+	assertSync(t, db)
+	fi, err := os.Stat(db.chunks[0].path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), fi.Size())
+	assertAppend(t, db, []byte("hello"))
+	assertAppend(t, db, nil)
+	assertSync(t, db)
+	assertClose(t, db)
+
+	// The synced entries survive reopening.
+	db = assertOpenOptions(t, false, "trim_tail_empty", chunkSize, WithTrimTail())
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(1), db.OldestID())
+	assert.Equal(t, uint64(4), db.NewestID())
+	assert.Equal(t, []byte{}, assertGet(t, db, 1))
+	assert.Equal(t, []byte("hello"), assertGet(t, db, 3))
+	assertAppend(t, db, []byte("world"))
+	assert.Equal(t, []byte("world"), assertGet(t, db, 5))
+}
+
+func TestChunkDB_FileBackend(t *testing.T) {
+	db := assertOpenOptions(t, true, "file_backend", chunkSize, WithBackend(BackendFile), WithMaxMappedChunks(2), WithTrimTail())
+
+	var vs [][]byte
+	for i := 0; i < numEntries; i++ {
+		vs = append(vs, []byte(fmt.Sprintf("entry-%v", i)))
+		assertAppend(t, db, vs[i])
+	}
+	assert.True(t, len(db.chunks) > 2, "expected several chunks")
+	assert.Equal(t, 0, db.Stats().MappedChunks, "expected no mapped chunks")
+
+	entry, release, err := db.GetNoCopy(3)
+	assert.Nil(t, err)
+	assert.Equal(t, vs[2], entry)
+	release()
+	assertSync(t, db)
+	assertClose(t, db)
+
+	// The files are the same for both backends, so the database can be opened with either.
+	db = assertOpenOptions(t, false, "file_backend", chunkSize, WithTrimTail())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+	vs = append(vs, []byte("hello"))
+	assertAppend(t, db, vs[len(vs)-1])
+	assertClose(t, db)
+
+	db = assertOpenOptions(t, false, "file_backend", chunkSize, WithBackend(BackendFile))
+	defer assertClose(t, db)
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+}
+
+func TestChunkDB_MaxEntrySize(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts     []Option
+		expected uint64
+	}{
+		"default": {nil, chunkSize},
+		"framing": {[]Option{WithFraming()}, chunkSize - 1},
+		"aligned": {[]Option{WithAlignment(8)}, chunkSize},
+	} {
+		db := WrapForConcurrency(assertOpenOptions(t, true, "max_entry_size", chunkSize, tc.opts...))
+		assert.Equal(t, tc.expected, db.MaxEntrySize(), name)
+
+		// An entry of exactly the maximum size fits, in a chunk of its own, but one byte more doesn't.
+		assertAppend(t, db, []byte("small"))
+		assertAppend(t, db, make([]byte, tc.expected))
+		_, err := db.Append(make([]byte, tc.expected+1))
+		assert.Equal(t, ErrTooBig, err, name)
+
+		// The limit follows the chunk size, which must leave room for an entry and its frame header.
+		minSize := uint32(1 + frameHeaderSize(db.version, 1))
+		assert.Equal(t, ErrChunkSizeTooSmall, db.SetChunkSize(minSize-1), name)
+		assert.Nil(t, db.SetChunkSize(2*chunkSize))
+		assert.True(t, db.MaxEntrySize() > tc.expected, name)
+		assertClose(t, db)
+	}
+}
+
+func TestChunkDB_FramingRebuildsMeta(t *testing.T) {
+	db := assertOpenOptions(t, true, "framing_rebuilds_meta", chunkSize, WithFraming())
+	assert.Equal(t, uint64(chunkSize-1), db.MaxEntrySize())
+	_, err := db.Append(make([]byte, chunkSize))
+	assert.Equal(t, ErrTooBig, err)
+
+	// Entries of all sizes, including empty ones, some of which are rolled back and written over by smaller
+	// ones. The rolled back entries must not come back.
+	var vs [][]byte
+	for i := 0; i < numEntries; i++ {
+		vs = append(vs, make([]byte, i%(chunkSize/2)))
+		for j := range vs[i] {
+			vs[i][j] = byte(i)
+		}
+		assertAppend(t, db, vs[i])
+	}
+	vs = append(vs, make([]byte, chunkSize-1))
+	assertAppend(t, db, vs[len(vs)-1])
+	for i := 0; i < 3; i++ {
+		vs = append(vs, []byte("long rolled back entry"))
+		assertAppend(t, db, vs[len(vs)-1])
+	}
+	assertRollback(t, db, uint64(len(vs)-3))
+	vs = append(vs[:len(vs)-3], []byte("short"))
+	assertAppend(t, db, vs[len(vs)-1])
+	assertClose(t, db)
+
+	// Delete every metadata file: the index is rebuilt from the framed data.
+	infos, err := ioutil.ReadDir("test_db/framing_rebuilds_meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deleted int
+	for _, fi := range infos {
+		if isBasenameChunkMetaFile(fi.Name()) {
+			if err := os.Remove(filepath.Join("test_db/framing_rebuilds_meta", fi.Name())); err != nil {
+				t.Fatal(err)
+			}
+			deleted++
+		}
+	}
+	assert.True(t, deleted > 2, "expected several chunks")
+	assert.Nil(t, HealthCheck("test_db/framing_rebuilds_meta"))
+
+	db = assertOpenOptions(t, false, "framing_rebuilds_meta", chunkSize)
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)), "entry %v", i+1)
+	}
+	for _, info := range db.Chunks() {
+		_, err := os.Stat(metaFilePath(info.Path))
+		assert.Nil(t, err, "expected metadata to be written out")
+	}
+}
+
+func TestChunkDB_SetChunkSize(t *testing.T) {
+	db := assertOpenOptions(t, true, "set_chunk_size", 100)
+
+	var vs [][]byte
+	appendEntries := func(n int) {
+		for i := 0; i < n; i++ {
+			v := []byte(fmt.Sprintf("entry-%04v", len(vs)))
+			vs = append(vs, v)
+			assertAppend(t, db, v)
+		}
+	}
+	chunkSizes := func() []uint32 {
+		var sizes []uint32
+		for _, info := range db.Chunks() {
+			sizes = append(sizes, info.Size)
+		}
+		return sizes
+	}
+
+	// 10-byte entries: 10 fit in a chunk at first, and the last chunk is half full.
+	appendEntries(25)
+	assert.Nil(t, db.Preallocate(200))
+	b := db.NewBatch()
+	assert.Equal(t, ErrTooBig, b.Append(make([]byte, 200)))
+
+	// A chunk size which can't hold an entry is refused.
+	assert.Equal(t, ErrChunkSizeTooSmall, db.SetChunkSize(0))
+	assert.Equal(t, uint64(100), db.MaxEntrySize())
+
+	// The final chunk is filled before a chunk of the new size is made.
+	assert.Nil(t, db.SetChunkSize(250))
+	assert.Empty(t, db.spares, "expected spares of the old size to be deleted")
+	assert.Equal(t, uint64(250), db.MaxEntrySize())
+	assert.Nil(t, b.Append(make([]byte, 200)), "expected batch to use the new maximum entry size")
+	b.Discard()
+	appendEntries(30)
+	assert.Equal(t, []uint32{100, 100, 100, 250}, chunkSizes())
+	assertAppend(t, db, make([]byte, 200))
+	vs = append(vs, make([]byte, 200))
+
+	// Shrinking works too: the final chunk has room for 5 more entries.
+	assert.Nil(t, db.SetChunkSize(50))
+	appendEntries(10)
+	assert.Equal(t, []uint32{100, 100, 100, 250, 250, 50}, chunkSizes())
+	assertClose(t, db)
+	assert.Nil(t, HealthCheck("test_db/set_chunk_size"))
+
+	// The database opens with the new size, but not an old one.
+	_, err := Open("test_db/set_chunk_size", 100, false)
+	assert.True(t, errwrap.ContainsType(err, &ChunkSizeError{}), "expected old chunk size to be rejected")
+	db = assertOpenOptions(t, false, "set_chunk_size", 50)
+	assert.Equal(t, []uint32{100, 100, 100, 250, 250, 50}, chunkSizes())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)), "entry %v", i+1)
+	}
+
+	// A snapshot of the mixed chunks can be restored.
+	var buf bytes.Buffer
+	assert.Nil(t, db.Snapshot(&buf))
+	_ = os.RemoveAll("test_db/set_chunk_size_restored")
+	assert.Nil(t, RestoreSnapshot("test_db/set_chunk_size_restored", &buf))
+	restored := assertOpenOptions(t, false, "set_chunk_size_restored", 50)
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, restored, uint64(i+1)), "restored entry %v", i+1)
+	}
+	assertClose(t, restored)
+
+	// Once the older chunks are forgotten, the database carries on as if it had always had the new size.
+	assertForget(t, db, uint64(len(vs)-4))
+	assertSync(t, db)
+	appendEntries(5)
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "set_chunk_size", 0)
+	defer assertClose(t, db)
+	assert.Equal(t, []uint32{50, 50}, chunkSizes())
+	assert.Equal(t, vs[len(vs)-1], assertGet(t, db, uint64(len(vs))))
+}
+
+func TestChunkDB_Preallocate(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := assertOpenOptions(t, true, "preallocate", 100, WithFileSystem(fs))
+
+	// 200 entries of 10 bytes fill 20 chunks exactly.
+	assert.Nil(t, db.Preallocate(2000))
+	assert.Equal(t, 20, len(db.spares))
+	assert.Nil(t, db.Preallocate(2000))
+	assert.Equal(t, 20, len(db.spares), "expected existing spares to count")
+
+	// The bulk load uses the spares, so it doesn't reserve space for any new files.
+	fs.failAllocate = func(string) error { return fmt.Errorf("no space allocation expected") }
+	vs := make([][]byte, 200)
+	for i := range vs {
+		vs[i] = []byte(fmt.Sprintf("entry-%04v", i))
+	}
+	_, err := db.AppendEntries(vs)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(db.chunks))
+	assert.Equal(t, 0, len(db.spares))
+	fs.failAllocate = nil
+
+	// Spares are kept when the database is closed, and aren't mistaken for chunks.
+	assert.Nil(t, db.Preallocate(250))
+	assert.Equal(t, 3, len(db.spares))
+	assertClose(t, db)
+	assert.Nil(t, HealthCheck("test_db/preallocate"))
+
+	db = assertOpenOptions(t, false, "preallocate", 100)
+	defer assertClose(t, db)
+	assert.Equal(t, []string{"spare_20", "spare_21", "spare_22"}, db.spares)
+	assert.Equal(t, 20, len(db.chunks))
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+	assertAppend(t, db, []byte("hello"))
+	assert.Equal(t, 21, len(db.chunks))
+	assert.Equal(t, []string{"spare_20", "spare_21"}, db.spares)
+}
+
+func TestChunkDB_GetMany(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "get_many", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+	assert.True(t, len(db.Chunks()) > 2, "expected several chunks")
+
+	// Shuffled IDs from every chunk, with some repeated.
+	var ids []uint64
+	for _, i := range rand.New(rand.NewSource(1)).Perm(numEntries - 19) {
+		ids = append(ids, uint64(i+20))
+	}
+	ids = append(ids, ids[5], ids[0], ids[5])
+
+	entries, err := db.GetMany(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(ids), len(entries))
+	for i, id := range ids {
+		assert.Equal(t, vs[id-1], entries[i], "entry %v", id)
+	}
+
+	entries, err = db.GetMany(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	// A forgotten or nonexistent ID is reported.
+	for _, bad := range []uint64{19, numEntries + 1} {
+		_, err = db.GetMany([]uint64{30, 100, bad, 50})
+		assert.Equal(t, &IDError{ID: bad, Err: ErrIDOutOfRange}, err)
+	}
+}
+
+func TestChunkDB_GetLatestN(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "get_latest_n", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	ids, entries, err := db.GetLatestN(10, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ids), "expected no entries in an empty database")
+	assert.Equal(t, 0, len(entries))
+
+	vs := filldb(t, db, 50)
+	assertForget(t, db, 21)
+
+	for _, c := range []struct {
+		n      int
+		oldest uint64
+	}{
+		{n: 5, oldest: 46},
+		{n: 30, oldest: 21},
+		{n: 100, oldest: 21},
+		{n: 0, oldest: 51},
+	} {
+		ids, entries, err = db.GetLatestN(c.n, false)
+		assert.Nil(t, err)
+		assert.Equal(t, int(51-c.oldest), len(ids), "n = %v", c.n)
+		assert.Equal(t, len(ids), len(entries), "n = %v", c.n)
+		for i, id := range ids {
+			assert.Equal(t, c.oldest+uint64(i), id, "n = %v", c.n)
+			assert.Equal(t, vs[id-1], entries[i], "n = %v", c.n)
+		}
+
+		ids, entries, err = db.GetLatestN(c.n, true)
+		assert.Nil(t, err)
+		assert.Equal(t, int(51-c.oldest), len(ids), "n = %v", c.n)
+		for i, id := range ids {
+			assert.Equal(t, uint64(50-i), id, "n = %v", c.n)
+			assert.Equal(t, vs[id-1], entries[i], "n = %v", c.n)
+		}
+	}
+}
+
+func TestChunkDB_LocateID(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "locate_id", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	// Entries of 10 bytes, so 11 fit in each chunk.
+	for i := 0; i < 100; i++ {
+		assertAppend(t, db, make([]byte, 10))
+	}
+	assertForget(t, db, 5)
+
+	for _, loc := range []struct {
+		id    uint64
+		chunk string
+		start int32
+	}{
+		{5, "chunk_0_1", 40},
+		{11, "chunk_0_1", 100},
+		{12, "chunk_1_12", 0},
+		{50, "chunk_4_45", 50},
+		{100, "chunk_9_100", 0},
+	} {
+		path, start, end, err := db.LocateID(loc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loc.chunk, filepath.Base(path), "chunk of entry %v", loc.id)
+		assert.Equal(t, loc.start, start, "start of entry %v", loc.id)
+		assert.Equal(t, loc.start+10, end, "end of entry %v", loc.id)
+	}
+
+	for _, id := range []uint64{0, 4, 101} {
+		_, _, _, err := db.LocateID(id)
+		assert.Equal(t, ErrIDOutOfRange, err, "ID %v", id)
+	}
+}
+
+func TestChunkDB_ChunkReader(t *testing.T) {
+	for _, maxMapped := range []int{0, 2} {
+		db := assertOpenOptions(t, true, "chunk_reader", chunkSize, WithMaxMappedChunks(maxMapped))
+		filldb(t, db, numEntries)
+		assertForget(t, db, 5)
+
+		next := db.OldestID()
+		for i := range db.Chunks() {
+			r, ends, oldest, err := db.ChunkReader(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bs, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, next, oldest, "oldest ID of chunk %v", i)
+			assert.Equal(t, int(ends[len(ends)-1]), len(bs), "bytes of chunk %v", i)
+
+			start := int32(0)
+			for j, end := range ends {
+				assert.Equal(t, assertGet(t, db, oldest+uint64(j)), bs[start:end], "entry %v", oldest+uint64(j))
+				start = end
+			}
+			next = oldest + uint64(len(ends))
+		}
+		assert.Equal(t, db.NewestID()+1, next, "expected every entry to be read")
+
+		_, _, _, err := db.ChunkReader(len(db.Chunks()))
+		assert.Equal(t, ErrIDOutOfRange, err)
+		assertClose(t, db)
+	}
+}
+
+func TestChunkDB_MaxMappedChunks(t *testing.T) {
+	db := assertOpenOptions(t, true, "max_mapped_chunks", chunkSize, WithMaxMappedChunks(3))
+	vs := filldb(t, db, numEntries)
+	assert.True(t, db.Stats().Chunks > 3, "expected more chunks than the mapping limit")
+	assert.Equal(t, 3, db.Stats().MappedChunks, "mapped chunks after appending")
+	assertClose(t, db)
+
+	db = assertOpenOptions(t, false, "max_mapped_chunks", chunkSize, WithMaxMappedChunks(3))
+	cdb := WrapForConcurrency(db)
+	defer assertClose(t, cdb)
+	assert.Equal(t, 3, cdb.Stats().MappedChunks, "mapped chunks after opening")
+
+	// Read backwards and forwards, so chunks are repeatedly unmapped and mapped again.
+	for id := uint64(len(vs)); id >= firstID; id-- {
+		assert.Equal(t, vs[id-1], assertGet(t, cdb, id))
+		assert.True(t, cdb.Stats().MappedChunks <= 3, "mapped chunks reading entry %v", id)
+	}
+	for id := firstID; id <= uint64(len(vs)); id++ {
+		assert.Equal(t, vs[id-1], assertGet(t, cdb, id))
+		assert.True(t, cdb.Stats().MappedChunks <= 3, "mapped chunks reading entry %v", id)
+	}
+
+	// Concurrent readers see the right entries.
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for id := firstID + uint64(r); id <= uint64(len(vs)); id += 4 {
+				entry, err := cdb.Get(id)
+				assert.Nil(t, err, "could not get entry %v", id)
+				assert.Equal(t, vs[id-1], entry)
+			}
+		}(r)
+	}
+	wg.Wait()
+	assert.True(t, cdb.Stats().MappedChunks <= 3, "mapped chunks after concurrent reads")
+
+	// Appending still works when the final chunk was not the most recently read.
+	assertAppend(t, cdb, []byte("hello"))
+	assert.Equal(t, []byte("hello"), assertGet(t, cdb, cdb.NewestID()))
+}
+
+func TestChunkDB_Advise(t *testing.T) {
+	for _, maxMapped := range []int{0, 3} {
+		db := assertOpenOptions(t, true, "advise", chunkSize, WithMaxMappedChunks(maxMapped))
+		vs := filldb(t, db, numEntries/2)
+
+		// Advice is applied to the existing chunks, to new chunks, and to chunks which are mapped again.
+		for _, pattern := range []AccessPattern{AccessSequential, AccessRandom, AccessNormal} {
+			assert.Nil(t, db.Advise(pattern), "could not advise %v with max mapped chunks %v", pattern, maxMapped)
+			for i := 0; i < numEntries/6; i++ {
+				vs = append(vs, []byte(fmt.Sprintf("entry-%v", len(vs))))
+				assertAppend(t, db, vs[len(vs)-1])
+			}
+			for i, v := range vs {
+				assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+			}
+		}
+
+		assertClose(t, db)
+		assert.Equal(t, ErrClosed, db.Advise(AccessSequential), "expected advising closed database to fail")
+	}
+}
+
+/* ***** Sync modes */
+
+func TestChunkDB_SyncModeOrdering(t *testing.T) {
+	for _, mode := range []SyncMode{SyncFull, SyncData} {
+		fs := &recordingFileSystem{}
+		db := assertOpenOptions(t, true, "sync_mode_ordering", chunkSize, WithFileSystem(fs), WithSyncMode(mode))
+
+		filldb(t, db, 10)
+		data := filepath.Base(db.chunks[0].path)
+		meta := filepath.Base(db.chunks[0].metaFilePath())
+
+		fs.events = nil
+		assertSync(t, db)
+		assertClose(t, db)
+
+		// The metadata is written to a temporary file, which is renamed into place.
+		dataSync, metaWrite, metaSync, metaRename := -1, -1, -1, -1
+		for i, event := range fs.events {
+			switch {
+			case event == "sync "+data && dataSync == -1:
+				dataSync = i
+			case event == "write "+syncMetaFile && metaWrite == -1:
+				metaWrite = i
+			case event == "sync "+syncMetaFile && metaSync == -1:
+				metaSync = i
+			case event == "rename "+meta && metaRename == -1:
+				metaRename = i
+			}
+		}
+
+		// The metadata is always fully synced, after it is written and before it replaces the old metadata.
+		assert.True(t, metaWrite != -1, "expected metadata to be written (mode %v)", mode)
+		assert.True(t, metaSync > metaWrite, "expected metadata to be synced after it is written (mode %v)", mode)
+		assert.True(t, metaRename > metaSync, "expected metadata to be renamed after it is synced (mode %v)", mode)
+
+		if mode == SyncData && runtime.GOOS == "linux" {
+			// The data is flushed with fdatasync, which bypasses 'File.Sync'.
+			assert.Equal(t, -1, dataSync, "expected data not to be fully synced (mode %v)", mode)
+		} else {
+			assert.True(t, dataSync != -1, "expected data to be synced (mode %v)", mode)
+			assert.True(t, dataSync < metaWrite, "expected data to be synced before metadata is written (mode %v)", mode)
+		}
+	}
+}
+
+func BenchmarkChunkDB_AppendSyncFull(b *testing.B) {
+	benchmarkAppendSyncMode(b, SyncFull)
+}
+
+func BenchmarkChunkDB_AppendSyncData(b *testing.B) {
+	benchmarkAppendSyncMode(b, SyncData)
+}
+
+func BenchmarkChunkDB_Append(b *testing.B) {
+	db := assertOpenOptions(b, true, "bench_append", 1024*1024)
+	defer db.Close()
+	if err := db.SetSync(-1); err != nil {
+		b.Fatal(err)
+	}
+
+	entry := make([]byte, 4096)
+	b.SetBytes(int64(len(entry)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Append(entry); err != nil {
+			b.Fatal(err)
+		}
+		benchmarkForgetChunks(b, db)
+	}
+}
+
+func BenchmarkChunkDB_AppendEntries(b *testing.B) {
+	db := assertOpenOptions(b, true, "bench_append_entries", 1024*1024)
+	defer db.Close()
+	if err := db.SetSync(-1); err != nil {
+		b.Fatal(err)
+	}
+
+	entries := make([][]byte, 64)
+	for i := range entries {
+		entries[i] = make([]byte, 128)
+	}
+	b.SetBytes(int64(len(entries) * len(entries[0])))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.AppendEntries(entries); err != nil {
+			b.Fatal(err)
+		}
+		benchmarkForgetChunks(b, db)
+	}
+}
+
+func BenchmarkChunkDB_Get(b *testing.B) {
+	db := benchmarkGetDB(b)
+	defer db.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(uint64(i%1000) + 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChunkDB_GetNoCopy(b *testing.B) {
+	db := benchmarkGetDB(b)
+	defer db.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, release, err := db.GetNoCopy(uint64(i%1000) + 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		release()
+	}
+}
+
+func BenchmarkChunkDB_GetRange(b *testing.B) {
+	db := benchmarkGetDB(b)
+	defer db.Close()
+
+	b.SetBytes(100 * 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		from := uint64(i%900) + 1
+		for id := from; id < from+100; id++ {
+			if _, err := db.Get(id); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// Forget all but the newest entry if there are many chunks, so appending benchmarks don't fill the disk. This
+// is not timed.
+func benchmarkForgetChunks(b *testing.B, db *LockFreeChunkDB) {
+	if len(db.chunks) < 64 {
+		return
+	}
+	b.StopTimer()
+	if err := db.Forget(db.NewestID()); err != nil {
+		b.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		b.Fatal(err)
+	}
+	b.StartTimer()
+}
+
+// Create a database of 1000 entries of 1KiB each, for benchmarking reads.
+func BenchmarkChunkDB_GetUnaligned(b *testing.B) {
+	benchmarkGetAlignment(b, 0)
+}
+
+func BenchmarkChunkDB_GetAligned(b *testing.B) {
+	benchmarkGetAlignment(b, 64)
+}
+
+// Read entries of a size which is not a multiple of the word size.
+func benchmarkGetAlignment(b *testing.B, alignment uint32) {
+	db := assertOpenOptions(b, true, "bench_get_alignment", 1024*1024, WithAlignment(alignment))
+	defer db.Close()
+
+	entry := make([]byte, 1001)
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Append(entry); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(len(entry)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(uint64(i%1000) + 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkGetDB(b *testing.B) *ChunkDB {
+	db := WrapForConcurrency(assertOpenOptions(b, true, "bench_get", 1024*1024))
+	entry := make([]byte, 1024)
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Append(entry); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(len(entry)))
+	return db
+}
+
+func benchmarkAppendSyncMode(b *testing.B, mode SyncMode) {
+	db := assertOpenOptions(b, true, "bench_sync_mode", 1024*1024, WithSyncMode(mode))
+	defer db.Close()
+
+	entry := make([]byte, 128)
+	b.SetBytes(int64(len(entry)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Append(entry); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestChunkDB_SyncParallelism(t *testing.T) {
+	fs := &recordingFileSystem{}
+	db := assertOpenOptions(t, true, "sync_parallelism", chunkSize, WithFileSystem(fs), WithSyncParallelism(4))
+	vs := filldb(t, db, numEntries)
+	assertSync(t, db)
+
+	// Make every chunk rewrite its last metadata record, as happens after a rollback.
+	for _, c := range db.chunks {
+		c.newFrom = len(c.ends) - 1
+		db.syncDirty[c] = struct{}{}
+	}
+	fs.events = nil
+	assertSync(t, db)
+
+	// Every data file is flushed before any metadata is written, and then the metadata is written in order.
+	var metaWrites []string
+	for _, event := range fs.events {
+		if strings.HasPrefix(event, "rename ") && strings.HasSuffix(event, metaSuffix) {
+			metaWrites = append(metaWrites, event)
+		} else if strings.HasPrefix(event, "sync ") && isBasenameChunkDataFile(strings.TrimPrefix(event, "sync ")) {
+			assert.Empty(t, metaWrites, "expected data to be synced before metadata is written: %v", fs.events)
+		}
+	}
+	var expected []string
+	for _, c := range db.chunks {
+		expected = append(expected, "rename "+filepath.Base(c.metaFilePath()))
+	}
+	assert.Equal(t, expected, metaWrites)
+
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "sync_parallelism", chunkSize)
+	defer assertClose(t, db)
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+}
+
+func BenchmarkChunkDB_SyncParallelism1(b *testing.B) {
+	benchmarkSyncParallelism(b, 1)
+}
+
+func BenchmarkChunkDB_SyncParallelism4(b *testing.B) {
+	benchmarkSyncParallelism(b, 4)
+}
+
+func benchmarkSyncParallelism(b *testing.B, parallelism int) {
+	db := assertOpenOptions(b, true, "bench_sync_parallelism", 64*1024, WithSyncParallelism(parallelism))
+	defer db.Close()
+
+	entry := make([]byte, 1024)
+	for i := 0; i < 16*64; i++ {
+		if _, err := db.Append(entry); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range db.chunks {
+			c.newFrom = len(c.ends) - 1
+			db.syncDirty[c] = struct{}{}
+		}
+		if err := db.Sync(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestChunkDB_SyncEveryAppend(t *testing.T) {
+	for _, every := range []int{0, 1} {
+		obs := &recordingObserver{}
+		db := assertOpenOptions(t, true, "sync_every_append", chunkSize, WithObserver(obs))
+		assertSetSync(t, db, every)
+
+		var expected []string
+		for i := 1; i <= numEntries; i++ {
+			assertAppend(t, db, []byte{byte(i)})
+			assert.Equal(t, uint64(0), db.sinceLastSync, "expected a sync after append %v with SetSync(%v)", i, every)
+			expected = append(expected, fmt.Sprintf("append %v 1", i), "sync 1")
+		}
+		assert.Equal(t, expected, obs.events, "expected a sync after every append with SetSync(%v)", every)
+
+		// Nothing has changed, so setting it again doesn't sync.
+		assertSetSync(t, db, every)
+		assert.Equal(t, len(expected), len(obs.events), "expected no sync without changes")
+		assertClose(t, db)
+	}
+}
+
+func TestChunkDB_SyncBytes(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "sync_bytes", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	assertSetSync(t, db, 100)
+	if err := db.SetSyncBytes(chunkSize * 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two full-size entries reach the byte threshold long before the entry threshold.
+	assertAppend(t, db, make([]byte, chunkSize))
+	assert.Equal(t, uint64(1), db.sinceLastSync, "expected no sync after one entry")
+	assertAppend(t, db, make([]byte, chunkSize))
+	assert.Equal(t, uint64(0), db.sinceLastSync, "expected a sync after two entries")
+	assert.Equal(t, uint64(0), db.bytesSinceLastSync, "expected the byte count to be reset by a sync")
+
+	// Disabling the byte threshold leaves only the entry threshold.
+	if err := db.SetSyncBytes(0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		assertAppend(t, db, make([]byte, chunkSize))
+	}
+	assert.Equal(t, uint64(5), db.sinceLastSync, "expected no sync with the byte threshold disabled")
+}
+
+func TestChunkDB_TruncateSyncsOnce(t *testing.T) {
+	// Everything fits in one chunk, so the truncate deletes no chunks and only a periodic sync can happen.
+	db := assertOpenOptions(t, true, "truncate_syncs_once", 1024*1024)
+	defer assertClose(t, db)
+
+	filldb(t, db, numEntries)
+	assertSync(t, db)
+	assertSetSync(t, db, 100)
+
+	// Neither end alone reaches the threshold once the other has been removed, so syncing in between would
+	// leave the rolled back entries counted as unsynced.
+	assertTruncate(t, db, 111, numEntries-20)
+	assert.Equal(t, uint64(0), db.sinceLastSync, "expected a sync after the whole truncate")
+	assertSync(t, db)
+
+	assertTruncate(t, db, 121, numEntries-30)
+	assert.Equal(t, uint64(20), db.sinceLastSync, "expected each removed entry to be counted once")
+}
+
+func TestChunkDB_TruncateEmptyRange(t *testing.T) {
+	db := assertOpenOptions(t, true, "truncate_empty_range", chunkSize)
+
+	vs := filldb(t, db, numEntries)
+	assertTruncate(t, db, 20, 200)
+	since := db.sinceLastSync
+
+	// An empty range, and a range ending before the oldest entry, are both rejected without changing anything.
+	for _, r := range [][2]uint64{{100, 99}, {10, 15}} {
+		assert.Equal(t, ErrIDOutOfRange, db.Truncate(r[0], r[1]), "truncate %v", r)
+		assert.Equal(t, uint64(20), db.OldestID(), "oldest after truncate %v", r)
+		assert.Equal(t, uint64(200), db.NewestID(), "newest after truncate %v", r)
+		assert.Equal(t, since, db.sinceLastSync, "unsynced changes after truncate %v", r)
+	}
+
+	assertClose(t, db)
+	db2 := assertOpenOptions(t, false, "truncate_empty_range", chunkSize)
+	defer assertClose(t, db2)
+	assert.Equal(t, uint64(20), db2.OldestID())
+	assert.Equal(t, uint64(200), db2.NewestID())
+	for id := uint64(20); id <= 200; id++ {
+		assert.Equal(t, vs[id-1], assertGet(t, db2, id))
+	}
+}
+
+func TestChunkDB_Excise(t *testing.T) {
+	db := assertOpenOptions(t, true, "excise", chunkSize)
+
+	vs := filldb(t, db, numEntries)
+	stamp := assertTimestampOf(t, db, 150)
+
+	// Bad ranges change nothing.
+	for _, r := range [][2]uint64{{100, 99}, {0, 10}, {250, numEntries + 1}} {
+		assert.Equal(t, ErrIDOutOfRange, db.Excise(r[0], r[1]), "excise %v", r)
+		assert.Equal(t, uint64(numEntries), db.NewestID(), "newest after excise %v", r)
+	}
+
+	// The entries after the range move down to fill the gap, keeping their timestamps.
+	assert.Nil(t, db.Excise(100, 149))
+	vs = append(vs[:99:99], vs[149:]...)
+	assert.Equal(t, firstID, db.OldestID())
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+	assert.Equal(t, stamp, assertTimestampOf(t, db, 100))
+
+	// A range at the start keeps the oldest ID, even if entries before it have been forgotten.
+	assertForget(t, db, 20)
+	assert.Nil(t, db.Excise(20, 29))
+	vs = append(vs[:19:19], vs[29:]...)
+	assert.Equal(t, uint64(20), db.OldestID())
+
+	// A range at the end is just a rollback.
+	assert.Nil(t, db.Excise(uint64(len(vs)-4), uint64(len(vs))))
+	vs = vs[:len(vs)-5]
+
+	checkEntries := func() {
+		assert.Equal(t, uint64(20), db.OldestID())
+		assert.Equal(t, uint64(len(vs)), db.NewestID())
+		for id := db.OldestID(); id <= db.NewestID(); id++ {
+			assert.Equal(t, vs[id-1], assertGet(t, db, id), "entry %v", id)
+		}
+	}
+	checkEntries()
+
+	// The changes are on disk, and appending carries on from the new newest ID.
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "excise", chunkSize)
+	defer assertClose(t, db)
+	checkEntries()
+	assert.Equal(t, uint64(len(vs)+1), assertAppend(t, db, []byte("hello")))
+
+	// Excising everything leaves the log empty, but starting from the same oldest ID.
+	assert.Nil(t, db.Excise(db.OldestID(), db.NewestID()))
+	assert.True(t, db.IsEmpty())
+	assert.Equal(t, uint64(20), assertAppend(t, db, []byte("world")))
+}
+
+func TestChunkDB_ExciseWriteFailure(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := assertOpenOptions(t, true, "excise_write_failure", chunkSize, WithFileSystem(fs))
+
+	vs := filldb(t, db, numEntries)
+
+	// If the moved entries can't all be written, nothing is changed, and the new chunks are thrown away.
+	fs.failCreate = func(name string) error {
+		if filepath.Base(name) == stagedFileName(2) {
+			return fmt.Errorf("no space left")
+		}
+		return nil
+	}
+	_, ok := db.Excise(10, 19).(*WriteError)
+	assert.True(t, ok, "expected write error")
+	fs.failCreate = nil
+
+	checkEntries := func() {
+		assert.Equal(t, uint64(numEntries), db.NewestID())
+		for id := db.OldestID(); id <= db.NewestID(); id++ {
+			assert.Equal(t, vs[id-1], assertGet(t, db, id), "entry %v", id)
+		}
+		staged, err := filepath.Glob(filepath.Join(db.path, stagedFilePrefix+"*"))
+		assert.Nil(t, err)
+		assert.Empty(t, staged)
+	}
+	checkEntries()
+
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "excise_write_failure", chunkSize)
+	defer assertClose(t, db)
+	checkEntries()
+	assert.Nil(t, db.Excise(10, 19))
+	assert.Equal(t, vs[19], assertGet(t, db, 10))
+}
+
+/* ***** Compaction */
+
+func TestChunkDB_Alignment(t *testing.T) {
+	db := assertOpenOptions(t, true, "alignment", 100, WithAlignment(8), WithCompactThreshold(0.5))
+
+	// Entries of awkward sizes, which would mostly start part-way through a word if not padded.
+	vs := make([][]byte, 60)
+	for i := range vs {
+		vs[i] = bytes.Repeat([]byte{byte(i + 1)}, 1+i%13)
+	}
+	assertAppendEntries(t, db, vs)
+
+	assertAligned := func(db *LockFreeChunkDB) {
+		for id := db.OldestID(); id <= db.NewestID(); id++ {
+			_, start, end, err := db.LocateID(id)
+			assert.Nil(t, err)
+			assert.Equal(t, int32(0), start%8, "expected entry %v to be aligned", id)
+			assert.Equal(t, int32(len(vs[id-1])), end-start, "expected entry %v to be unpadded", id)
+			assert.Equal(t, vs[id-1], assertGet(t, db, id))
+		}
+	}
+	assertAligned(db)
+
+	// Compacting the oldest chunk keeps the entries aligned.
+	oldestPath := db.chunks[0].path
+	assertForget(t, db, db.chunks[0].next()-1)
+	assert.NotEqual(t, oldestPath, db.chunks[0].path, "expected oldest chunk to be compacted")
+	assertAligned(db)
+
+	// The alignment is kept by snapshots, and by the database itself, without the option.
+	buf := new(bytes.Buffer)
+	assert.Nil(t, db.Snapshot(buf))
+	assertClose(t, db)
+	db = assertOpenOptions(t, false, "alignment", 100)
+	assertAligned(db)
+	assertClose(t, db)
+
+	_ = os.RemoveAll("test_db/alignment_restored")
+	assert.Nil(t, RestoreSnapshot("test_db/alignment_restored", buf))
+	db = assertOpenOptions(t, false, "alignment_restored", 100)
+	defer assertClose(t, db)
+	assertAligned(db)
+
+	// Only powers of two, without framing, are allowed.
+	_, err := Open("test_db/alignment_bad", 100, true, WithAlignment(12))
+	assert.Equal(t, ErrAlignment, err)
+	_, err = Open("test_db/alignment_bad", 100, true, WithAlignment(8), WithFraming())
+	assert.Equal(t, ErrAlignment, err)
+}
+
+func TestChunkDB_CompactOnForget(t *testing.T) {
+	const bigChunkSize = 1024 * 1024
+	const entrySize = 1024
+
+	lfdb := assertOpenOptions(t, true, "compact_on_forget", bigChunkSize, WithCompactThreshold(0.5))
+	db := WrapForConcurrency(lfdb)
+
+	// Fill the first chunk exactly, and half of the second.
+	vs := make([][]byte, bigChunkSize/entrySize*3/2)
+	for i := range vs {
+		vs[i] = make([]byte, entrySize)
+		vs[i][0] = byte(i)
+		vs[i][1] = byte(i >> 8)
+	}
+	assertAppendEntries(t, db, vs)
+	assertSync(t, db)
+
+	oldestPath := db.chunks[0].path
+	before := allocatedBytes(t, oldestPath)
+
+	// Forget a little at a time: this should eventually trigger a compaction.
+	for id := uint64(64); id < bigChunkSize/entrySize; id += 64 {
+		assertForget(t, db, id)
+		db.compactWG.Wait()
+
+		for i := id; i <= db.NewestID(); i += 37 {
+			assert.Equal(t, vs[i-1], assertGet(t, db, i), "entry %v after forgetting up to %v", i, id)
+		}
+	}
+
+	assert.NotEqual(t, oldestPath, db.chunks[0].path, "expected oldest chunk to be compacted")
+	_, err := os.Stat(oldestPath)
+	assert.True(t, os.IsNotExist(err), "expected uncompacted chunk to be deleted")
+	after := allocatedBytes(t, db.chunks[0].path)
+	assert.True(t, after < before/2, "expected space to be reclaimed (before %v, after %v)", before, after)
+
+	// Compaction survives a reopen.
+	oldest := db.OldestID()
+	assertClose(t, db)
+	db2 := assertOpen(t, dbTypes["lock free chunkdb"], false, "compact_on_forget", bigChunkSize)
+	defer assertClose(t, db2)
+	assert.Equal(t, oldest, db2.OldestID())
+	assert.Equal(t, uint64(len(vs)), db2.NewestID())
+	for i := db2.OldestID(); i <= db2.NewestID(); i++ {
+		assert.Equal(t, vs[i-1], assertGet(t, db2, i), "entry %v after reopening", i)
+	}
+}
+
+func TestChunkDB_CompactInterrupted(t *testing.T) {
+	db := assertOpenOptions(t, true, "compact_interrupted", chunkSize, WithCompactThreshold(0.5))
+	vs := filldb(t, db, numEntries)
+	assertSync(t, db)
+
+	// Keep a copy of the oldest chunk as it was before compaction.
+	oldestPath := db.chunks[0].path
+	data := readTestFile(t, oldestPath)
+	meta := readTestFile(t, metaFilePath(oldestPath))
+
+	assertForget(t, db, db.chunks[0].next()-1)
+	assert.NotEqual(t, oldestPath, db.chunks[0].path, "expected oldest chunk to be compacted")
+	oldest := db.OldestID()
+	assertClose(t, db)
+
+	// Put the uncompacted chunk back, as if the program died before deleting it.
+	writeTestFile(t, oldestPath, data)
+	writeTestFile(t, metaFilePath(oldestPath), meta)
+
+	db2 := assertOpen(t, dbTypes["lock free chunkdb"], false, "compact_interrupted", chunkSize)
+	defer assertClose(t, db2)
+
+	_, err := os.Stat(oldestPath)
+	assert.True(t, os.IsNotExist(err), "expected uncompacted chunk to be deleted")
+	assert.Equal(t, oldest, db2.OldestID())
+	for i := db2.OldestID(); i <= db2.NewestID(); i++ {
+		assert.Equal(t, vs[i-1], assertGet(t, db2, i), "entry %v after reopening", i)
+	}
+}
+
+/* ***** Entry accessors */
+
+func TestChunkDB_OldestNewestEntry(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "oldest_newest_entry", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+
+	_, _, err := db.OldestEntry()
+	assert.Equal(t, ErrEmpty, err, "expected oldest of fresh database to be empty")
+	_, _, err = db.NewestEntry()
+	assert.Equal(t, ErrEmpty, err, "expected newest of fresh database to be empty")
+
+	// A single entry is both the oldest and the newest.
+	assertAppend(t, db, []byte("only"))
+	assertEntry(t, firstID, []byte("only"))(db.OldestEntry())
+	assertEntry(t, firstID, []byte("only"))(db.NewestEntry())
+
+	// Across many chunks, with some forgotten.
+	vs := [][]byte{[]byte("only")}
+	for i := 1; i < numEntries; i++ {
+		vs = append(vs, []byte(fmt.Sprintf("entry-%v", i)))
+	}
+	assertAppendEntries(t, db, vs[1:])
+	assertForget(t, db, 20)
+	assertEntry(t, 20, vs[19])(db.OldestEntry())
+	assertEntry(t, uint64(len(vs)), vs[len(vs)-1])(db.NewestEntry())
+
+	// With everything forgotten, the database is empty again.
+	assertTruncate(t, db, uint64(len(vs)), uint64(len(vs)))
+	assert.Nil(t, db.forgetUpTo(db.next()))
+	_, _, err = db.OldestEntry()
+	assert.Equal(t, ErrEmpty, err, "expected oldest of forgotten database to be empty")
+	_, _, err = db.NewestEntry()
+	assert.Equal(t, ErrEmpty, err, "expected newest of forgotten database to be empty")
+
+	// Likewise when drained, and entries can still be looked up after appending again.
+	next := assertAppend(t, db, []byte("again"))
+	assert.Nil(t, db.Drain())
+	_, _, err = db.OldestEntry()
+	assert.Equal(t, ErrEmpty, err, "expected oldest of drained database to be empty")
+	_, _, err = db.NewestEntry()
+	assert.Equal(t, ErrEmpty, err, "expected newest of drained database to be empty")
+	assertAppend(t, db, []byte("after"))
+	assertEntry(t, next+1, []byte("after"))(db.OldestEntry())
+}
+
+func TestChunkDB_LockFreeIDs(t *testing.T) {
+	db := assertOpen(t, dbTypes["chunkdb"], true, "lock_free_ids", chunkSize).(*ChunkDB)
+	defer assertClose(t, db)
+	assertSetSync(t, db, -1)
+
+	// Readers see the IDs only ever go forwards, and never see the oldest ID past the next.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var lastOldest, lastNext uint64
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				oldest, next := db.OldestID(), db.NextID()
+				if oldest < lastOldest || next < lastNext || oldest > next {
+					t.Errorf("oldest %v and next %v after oldest %v and next %v", oldest, next, lastOldest, lastNext)
+					return
+				}
+				lastOldest, lastNext = oldest, next
+			}
+		}()
+	}
+
+	for i := 1; i <= 20*numEntries; i++ {
+		assertAppend(t, db, []byte(fmt.Sprintf("entry-%v", i)))
+		if i%numEntries == 0 {
+			assertForget(t, db, uint64(i-10))
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	assert.Equal(t, uint64(20*numEntries-10), db.OldestID())
+	assert.Equal(t, uint64(20*numEntries), db.NewestID())
+	assert.Equal(t, uint64(20*numEntries+1), db.NextID())
+}
+
+func TestChunkDB_SkipCorruptTail(t *testing.T) {
+	var finalPath string
+	var lost int
+	vs, _ := assertCorruptFinalChunk(t, "skip_corrupt_tail", latestVersion, func(dataPath, metaPath string) {
+		finalPath = dataPath
+		ends, _ := readTestMetadata(t, metaPath, latestVersion)
+		lost = len(ends)
+		if err := os.Truncate(dataPath, chunkSize/2); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	obs := &recordingObserver{}
+	db := assertOpenOptions(t, false, "skip_corrupt_tail", chunkSize, WithSkipCorruptTail(), WithObserver(obs))
+	defer assertClose(t, db)
+
+	assert.Equal(t, []string{"corrupt tail " + filepath.Base(finalPath)}, obs.events)
+	assert.Equal(t, uint64(len(vs)-lost), db.NewestID())
+	for i, v := range vs[:len(vs)-lost] {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+
+	// Appending carries on from the end of the last good chunk.
+	assert.Equal(t, uint64(len(vs)-lost+1), assertAppend(t, db, []byte("hello")))
+}
+
+func TestChunkDB_NoSkipCorruptNonfinalChunk(t *testing.T) {
+	db := assertOpenOptions(t, true, "skip_corrupt_nonfinal", chunkSize)
+	filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	dir := "test_db/skip_corrupt_nonfinal"
+	chunkFiles, err := findChunkFiles(OSFileSystem{}, dir, latestVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath := metaFilePath(filepath.Join(dir, chunkFiles[0].Name()))
+	writeTestFile(t, metaPath, append(readTestFile(t, metaPath), 0xff, 0xff))
+
+	_, err = Open(dir, chunkSize, false, WithSkipCorruptTail())
+	assert.NotNil(t, err, "expected corrupt non-final chunk to be an error")
+}
+
+func TestChunkDB_CorruptionPolicy(t *testing.T) {
+	// Rename the fourth chunk so that its first ID is one too high, so it doesn't follow on from the third.
+	breakLog := func(name string) ([][]byte, uint64, []string) {
+		db := assertOpenOptions(t, true, name, chunkSize)
+		vs := filldb(t, db, numEntries)
+		moved := db.chunks[3]
+		later := []string{fmt.Sprintf("chunk_3_%v", moved.oldest+1)}
+		for _, c := range db.chunks[4:] {
+			later = append(later, filepath.Base(c.path))
+		}
+		assertClose(t, db)
+		renamed := filepath.Join(filepath.Dir(moved.path), later[0])
+		if err := os.Rename(moved.path, renamed); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(metaFilePath(moved.path), metaFilePath(renamed)); err != nil {
+			t.Fatal(err)
+		}
+		return vs, moved.oldest - 1, later
+	}
+
+	t.Run("fail fast", func(t *testing.T) {
+		breakLog("corruption_fail_fast")
+		_, err := Open("test_db/corruption_fail_fast", chunkSize, false, WithCorruptionPolicy(CorruptionFailFast))
+		if ferr, ok := err.(*FormatError); assert.True(t, ok, "expected FormatError, got %v", err) {
+			assert.IsType(t, &ChunkContinuityError{}, ferr.Err)
+		}
+	})
+
+	t.Run("best effort", func(t *testing.T) {
+		vs, newest, later := breakLog("corruption_best_effort")
+		obs := &recordingObserver{}
+		db := assertOpenOptions(t, false, "corruption_best_effort", chunkSize, WithCorruptionPolicy(CorruptionBestEffort), WithObserver(obs))
+
+		var events []string
+		for _, name := range later {
+			events = append(events, "corrupt tail "+name)
+		}
+		assert.Equal(t, events, obs.events)
+		assert.Equal(t, newest, db.NewestID())
+		for i, v := range vs[:newest] {
+			assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+		}
+
+		// The discarded chunks are gone, so the database opens normally afterwards.
+		assert.Equal(t, newest+1, assertAppend(t, db, []byte("hello")))
+		assertClose(t, db)
+		db = assertOpenOptions(t, false, "corruption_best_effort", chunkSize)
+		defer assertClose(t, db)
+		assert.Equal(t, newest+1, db.NewestID())
+	})
+
+	t.Run("resource error", func(t *testing.T) {
+		db := assertOpenOptions(t, true, "corruption_resource_error", chunkSize)
+		vs := filldb(t, db, numEntries)
+		failed := []string{filepath.Base(db.chunks[3].path), filepath.Base(db.chunks[len(db.chunks)-1].path)}
+		assertClose(t, db)
+
+		// Failing to map a chunk isn't damage, so neither a middle nor the final chunk is discarded.
+		for _, name := range failed {
+			fs := &faultyFileSystem{failMmap: func(path string) error {
+				if filepath.Base(path) == name {
+					return syscall.ENOMEM
+				}
+				return nil
+			}}
+			obs := &recordingObserver{}
+			_, err := Open("test_db/corruption_resource_error", chunkSize, false, WithFileSystem(fs), WithCorruptionPolicy(CorruptionBestEffort), WithObserver(obs))
+			assert.True(t, errwrap.ContainsType(err, new(ReadError)), "expected read error, got: %s", err)
+			assert.Empty(t, obs.events)
+		}
+
+		db = assertOpenOptions(t, false, "corruption_resource_error", chunkSize)
+		defer assertClose(t, db)
+		for i, v := range vs {
+			assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+		}
+	})
+}
+
+/// ASSERTIONS
+
+func assertEntry(t *testing.T, expectedID uint64, expected []byte) func(uint64, []byte, error) {
+	return func(id uint64, entry []byte, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedID, id, "entry ID")
+		assert.Equal(t, expected, entry, "entry contents")
+	}
+}
+
+func assertOpenOptions(t testing.TB, create bool, testName string, cSize uint32, opts ...Option) *LockFreeChunkDB {
+	testDir := "test_db/" + testName
+	if create {
+		_ = os.RemoveAll(testDir)
+	}
+	db, err := Open(testDir, cSize, create, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func assertDiskUsage(t *testing.T, db *LockFreeChunkDB) uint64 {
+	usage, err := db.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage
+}
+
+func assertTimestampOf(t *testing.T, db *LockFreeChunkDB, id uint64) time.Time {
+	stamp, err := db.TimestampOf(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stamp
+}
+
+func assertForgetBefore(t *testing.T, db *LockFreeChunkDB, before time.Time) uint64 {
+	oldest, err := db.ForgetBefore(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oldest
+}
+
+/// HELPERS
+
+// Make a database use a fake clock which starts at 1 second and advances by a second every time it is read.
+// The returned pointer can be used to change the number of seconds.
+func fakeClock(db *LockFreeChunkDB) *int64 {
+	secs := int64(0)
+	db.now = func() time.Time {
+		secs++
+		return time.Unix(secs, 0)
+	}
+	return &secs
+}
+
+func readTestFile(t *testing.T, path string) []byte {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+// Copy the regular files of a directory into a new directory, replacing it if it exists.
+func copyTestDir(t *testing.T, from, to string) {
+	_ = os.RemoveAll(to)
+	if err := os.MkdirAll(to, os.ModeDir|0755); err != nil {
+		t.Fatal(err)
+	}
+	fis, err := ioutil.ReadDir(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			writeTestFile(t, filepath.Join(to, fi.Name()), readTestFile(t, filepath.Join(from, fi.Name())))
+		}
+	}
+}
+
+func assertDatabasePathError(t *testing.T, err error, expected error) *DatabasePathError {
+	perr, ok := err.(*DatabasePathError)
+	if !ok {
+		t.Fatalf("expected database path error, got: %s", err)
+	}
+	assert.Equal(t, expected, perr.Err)
+	return perr
+}
+
+func writeTestFile(t *testing.T, path string, bs []byte) {
+	if err := ioutil.WriteFile(path, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,130 @@
+package logdb
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The "chunk_size" file holds the size of new chunks, followed by the sizes of older chunks which were created
+// before it was changed with 'SetChunkSize'. It is replaced through this temporary file.
+const chunkSizeTmpFile = "chunk_size" + sep + "new"
+
+// SetChunkSize changes the size of chunks created from now on, atomically. See the 'LockFreeChunkDB' method for
+// details.
+func (db *ChunkDB) SetChunkSize(newSize uint32) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.SetChunkSize(newSize)
+}
+
+// SetChunkSize changes the size of chunks created from now on. Existing chunks, including the final one, keep
+// the size they were created with, so nothing is rewritten: the final chunk is appended to until it is full, as
+// usual, and only then is a chunk of the new size created. Afterwards the database must be opened with the new
+// chunk size, or 0, and 'MaxEntrySize' is based on the new size.
+//
+// Spare chunk files made by 'Preallocate' are the old size, and so are deleted. A 'Batch' or 'AsyncAppender'
+// which already exists checks entries against the new 'MaxEntrySize' from then on.
+//
+// Returns 'ErrChunkSizeTooSmall' if a chunk of the new size can't hold a one-byte entry, and a 'WriteError' value
+// if the "chunk_size" file can't be replaced. In either case the chunk size is not changed.
+func (db *LockFreeChunkDB) SetChunkSize(newSize uint32) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if newSize == db.chunkSize {
+		return nil
+	}
+	if int(newSize) < 1+frameHeaderSize(db.version, 1) {
+		return ErrChunkSizeTooSmall
+	}
+
+	if err := replaceFile(db.fs, filepath.Join(db.path, "chunk_size"), chunkSizeTmpFile, db.chunkSizes(newSize)); err != nil {
+		_ = db.fs.Remove(filepath.Join(db.path, chunkSizeTmpFile))
+		return &WriteError{err}
+	}
+	db.chunkSize = newSize
+
+	for _, spare := range db.spares {
+		_ = db.fs.Remove(filepath.Join(db.path, spare))
+	}
+	db.spares = nil
+	return nil
+}
+
+// Get the contents of the "chunk_size" file: the given size of new chunks, followed by the other sizes of the
+// chunks. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) chunkSizes(current uint32) []uint32 {
+	sizes := []uint32{current}
+	for _, c := range db.chunks {
+		if !hasChunkSize(sizes, c.size) {
+			sizes = append(sizes, c.size)
+		}
+	}
+	return sizes
+}
+
+// Read the "chunk_size" file of the database at the given path. The first size is that of new chunks.
+func readChunkSizes(fs FileSystem, path string) ([]uint32, error) {
+	file, err := fs.OpenFile(filepath.Join(path, "chunk_size"), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bs, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunkSizes(bs)
+}
+
+// Decode the contents of a "chunk_size" file. Returns 'ErrCorrupt' if there are no sizes, or a partial one.
+func decodeChunkSizes(bs []byte) ([]uint32, error) {
+	if len(bs) == 0 || len(bs)%4 != 0 {
+		return nil, ErrCorrupt
+	}
+	sizes := make([]uint32, len(bs)/4)
+	for i := range sizes {
+		sizes[i] = binary.LittleEndian.Uint32(bs[i*4:])
+	}
+	return sizes, nil
+}
+
+// Get the chunk size of a data file from its size in bytes. A file which is exactly one of the chunk sizes is a
+// chunk of that size. A file which is shorter, as it has been trimmed or cut short, is taken to be a chunk of the
+// current size, if it fits, and otherwise of the smallest older size it fits. If there is no such size, the
+// current size is returned, which the file will then fail to match.
+func chunkSizeFor(fileSize int64, sizes []uint32) uint32 {
+	for _, size := range sizes {
+		if int64(size) == fileSize {
+			return size
+		}
+	}
+	if fileSize <= int64(sizes[0]) {
+		return sizes[0]
+	}
+
+	best := sizes[0]
+	for _, size := range sizes[1:] {
+		if int64(size) >= fileSize && (best == sizes[0] || size < best) {
+			best = size
+		}
+	}
+	return best
+}
+
+// Check if a size is in a list of chunk sizes.
+func hasChunkSize(sizes []uint32, size uint32) bool {
+	for _, s := range sizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
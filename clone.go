@@ -0,0 +1,175 @@
+package logdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+)
+
+// CloneVersion copies the database to a new database directory, using the given disk format version and chunk
+// size. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) CloneVersion(path string, version uint16, chunkSize uint32, opts ...Option) error {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.CloneVersion(path, version, chunkSize, opts...)
+}
+
+// CloneVersion copies the database to a new database directory, using the given disk format version and chunk
+// size. This can write an older version than 'Open' creates, so that a database can be read by an older
+// version of this package. If the chunk size is 0, the chunk size of this database is used. The options are as
+// for 'Open'. The clone is not left open.
+//
+// Entries keep their IDs. Timestamps are copied if both versions store them. If only the clone stores them, then
+// each entry is given the time at which it was copied. Deleted entries are copied as empty entries, and are
+// deleted in the clone too.
+//
+// Nothing is silently lost: cloning to a version which doesn't store timestamps fails if any entry has one, and
+// cloning to an older version than this database's fails if any entry is deleted, as readers of the older version
+// may not know of deleted entries and would see them as empty ones.
+//
+// Returns 'ErrUnknownVersion' if the version is not known, 'ErrDowngrade' if the version can't express the
+// timestamps or deleted entries, 'ErrTooBig' if an entry doesn't fit in the chunk size, and a 'PathError' value
+// if the path already exists. If an error is returned after the directory has been created, it is deleted.
+func (db *LockFreeChunkDB) CloneVersion(path string, version uint16, chunkSize uint32, opts ...Option) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if !knownVersion(version) {
+		return ErrUnknownVersion
+	}
+	if chunkSize == 0 {
+		chunkSize = db.chunkSize
+	}
+	if !db.expressibleIn(version) {
+		return ErrDowngrade
+	}
+
+	o := applyOptions(opts)
+	if _, err := o.fs.Stat(path); err == nil {
+		return &PathError{&os.PathError{Op: "create", Path: path, Err: os.ErrExist}}
+	}
+
+	clone, err := createdb(path, chunkSize, version, o)
+	if err != nil {
+		return err
+	}
+	err = db.cloneInto(clone)
+	if cerr := clone.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = removeDatabase(o.fs, path)
+	}
+	return err
+}
+
+// Check if the timestamps and deleted entries of the database can be expressed in the given disk format version.
+// Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) expressibleIn(version uint16) bool {
+	if version < db.version && len(db.tombstoneIDs()) > 0 {
+		return false
+	}
+	if versionHasTimestamps(version) || !versionHasTimestamps(db.version) {
+		return true
+	}
+	for _, c := range db.chunks {
+		for i, stamp := range c.stamps {
+			if stamp != 0 && c.oldest+uint64(i) >= db.oldest {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Copy every entry to a newly-created database, and sync it. Assumes a lock (read or write) is held on this
+// database.
+func (db *LockFreeChunkDB) cloneInto(clone *LockFreeChunkDB) error {
+	if db.oldest > 0 {
+		clone.setOldest(db.oldest)
+		clone.updateNewest()
+		if err := writeOldestFile(clone.fs, clone.path, clone.oldest); err != nil {
+			return &WriteError{err}
+		}
+	}
+
+	// Only sync once all the entries are in.
+	clone.syncEvery, clone.syncBytes = -1, 0
+	copyStamps := versionHasTimestamps(db.version) && versionHasTimestamps(clone.version)
+
+	var err error
+	for _, c := range db.chunks {
+		stop, serr := db.scanChunk(c, func(id uint64, entry []byte) bool {
+			if db.isDeleted(id) {
+				entry = nil
+			}
+			if err = clone.append(entry); err != nil {
+				return false
+			}
+			if copyStamps {
+				last := clone.chunks[len(clone.chunks)-1]
+				last.stamps[len(last.stamps)-1] = c.stamps[id-c.oldest]
+			}
+			return true
+		})
+		if serr != nil {
+			return serr
+		}
+		if stop {
+			return err
+		}
+	}
+
+	if len(db.tombstones) > 0 {
+		clone.tombstones = make(map[uint64]struct{}, len(db.tombstones))
+		for id := range db.tombstones {
+			clone.tombstones[id] = struct{}{}
+		}
+		if err := clone.writeTombstones(); err != nil {
+			return err
+		}
+	}
+
+	return clone.sync()
+}
+
+// Digest computes a checksum of the entries in the database, atomically. See the 'LockFreeChunkDB' method for
+// details.
+func (db *ChunkDB) Digest() ([]byte, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.Digest()
+}
+
+// Digest computes a SHA-256 checksum of the oldest ID and of the ID and contents of every entry which hasn't been
+// forgotten or deleted, so that a clone or backup can be checked against the original without copying the entries.
+// Two databases with the same entries under the same IDs have the same digest, whatever their chunk size, disk
+// format version, or layout of chunks; timestamps are not included.
+func (db *LockFreeChunkDB) Digest() ([]byte, error) {
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	h := sha256.New()
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:], db.oldest)
+	h.Write(buf[:8])
+
+	for _, c := range db.chunks {
+		_, err := db.scanChunk(c, db.skipDeleted(func(id uint64, entry []byte) bool {
+			// The length is included so that the boundaries between entries are part of the digest.
+			binary.LittleEndian.PutUint64(buf[0:], id)
+			binary.LittleEndian.PutUint64(buf[8:], uint64(len(entry)))
+			h.Write(buf[:])
+			h.Write(entry)
+			return true
+		}))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h.Sum(nil), nil
+}
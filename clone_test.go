@@ -0,0 +1,162 @@
+package logdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClone_Downgrade(t *testing.T) {
+	db := assertOpenOptions(t, true, "clone_downgrade", chunkSize)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+
+	// Version 0 has no timestamps, so the entries can't be cloned to it.
+	path := "test_db/clone_downgrade_v0"
+	_ = os.RemoveAll(path)
+	assert.Equal(t, ErrDowngrade, db.CloneVersion(path, 0, 0))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "expected no clone to be made")
+
+	// Version 1 has timestamps but no metadata checksums, and the clone is read with that format.
+	path = "test_db/clone_downgrade_v1"
+	_ = os.RemoveAll(path)
+	if err := db.CloneVersion(path, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	db1 := assertOpenOptions(t, false, "clone_downgrade_v1", chunkSize)
+	defer assertClose(t, db1)
+
+	assert.Equal(t, uint16(1), db1.version)
+	assert.Equal(t, uint64(20), db1.OldestID())
+	assert.Equal(t, uint64(len(vs)), db1.NewestID())
+	for id := db1.OldestID(); id <= db1.NewestID(); id++ {
+		assert.Equal(t, vs[id-1], assertGet(t, db1, id))
+		assert.Equal(t, assertTimestampOf(t, db, id), assertTimestampOf(t, db1, id), "entry %v", id)
+	}
+
+	// A deleted entry can't be cloned to an older version.
+	assert.Nil(t, db.Delete(30))
+	path = "test_db/clone_downgrade_deleted"
+	_ = os.RemoveAll(path)
+	assert.Equal(t, ErrDowngrade, db.CloneVersion(path, 1, 0))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "expected no clone to be made")
+}
+
+func TestClone_Upgrade(t *testing.T) {
+	_ = os.RemoveAll("test_db/clone_upgrade")
+	db0, err := createdb("test_db/clone_upgrade", chunkSize, 0, applyOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer assertClose(t, db0)
+	vs := filldb(t, db0, numEntries)
+	_, err = db0.TimestampOf(20)
+	assert.Equal(t, ErrNoTimestamps, err)
+
+	// Cloning a version 0 database up gives every entry a timestamp.
+	path := "test_db/clone_upgrade_latest"
+	_ = os.RemoveAll(path)
+	if err := db0.CloneVersion(path, latestVersion, 0); err != nil {
+		t.Fatal(err)
+	}
+	db := assertOpenOptions(t, false, "clone_upgrade_latest", chunkSize)
+	defer assertClose(t, db)
+	assert.Equal(t, vs[19], assertGet(t, db, 20))
+	assertTimestampOf(t, db, 20)
+
+	// There are no timestamps to lose cloning it back down.
+	path = "test_db/clone_upgrade_v0"
+	_ = os.RemoveAll(path)
+	assert.Nil(t, db0.CloneVersion(path, 0, 0))
+}
+
+func TestClone_KeepsTimestamps(t *testing.T) {
+	db := assertOpenOptions(t, true, "clone_timestamps", chunkSize)
+	defer assertClose(t, db)
+
+	filldb(t, db, numEntries)
+
+	path := "test_db/clone_timestamps_copy"
+	_ = os.RemoveAll(path)
+	if err := db.CloneVersion(path, latestVersion, 2*chunkSize); err != nil {
+		t.Fatal(err)
+	}
+	db2 := assertOpenOptions(t, false, "clone_timestamps_copy", 2*chunkSize)
+	defer assertClose(t, db2)
+
+	assert.True(t, len(db2.chunks) < len(db.chunks), "expected fewer, larger chunks")
+	for id := db.OldestID(); id <= db.NewestID(); id++ {
+		assert.Equal(t, assertTimestampOf(t, db, id), assertTimestampOf(t, db2, id), "entry %v", id)
+	}
+}
+
+func TestClone_Digest(t *testing.T) {
+	db := assertOpenOptions(t, true, "clone_digest", chunkSize)
+	defer assertClose(t, db)
+
+	filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+	digest, err := db.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunks of the clone are laid out differently, but the digest is the same.
+	for _, size := range []uint32{chunkSize, chunkSize * 3} {
+		_ = os.RemoveAll("test_db/clone_digest_copy")
+		if err := db.CloneVersion("test_db/clone_digest_copy", latestVersion, size); err != nil {
+			t.Fatal(err)
+		}
+		clone := assertOpenOptions(t, false, "clone_digest_copy", size)
+		if size != chunkSize {
+			assert.NotEqual(t, len(db.chunks), len(clone.chunks), "expected a different layout of chunks")
+		}
+		cloneDigest, err := clone.Digest()
+		assert.Nil(t, err)
+		assert.Equal(t, digest, cloneDigest, "digest of clone with chunk size %v", size)
+
+		// Any change to the entries changes the digest.
+		assertForget(t, clone, 21)
+		cloneDigest, err = clone.Digest()
+		assert.Nil(t, err)
+		assert.NotEqual(t, digest, cloneDigest, "digest after forgetting an entry")
+		assertClose(t, clone)
+	}
+
+	// Entries are told apart by more than their concatenated contents.
+	a := assertOpenOptions(t, true, "clone_digest_a", chunkSize)
+	defer assertClose(t, a)
+	b := assertOpenOptions(t, true, "clone_digest_b", chunkSize)
+	defer assertClose(t, b)
+	assertAppendEntries(t, a, [][]byte{[]byte("ab"), []byte("c")})
+	assertAppendEntries(t, b, [][]byte{[]byte("a"), []byte("bc")})
+	digestA, _ := a.Digest()
+	digestB, _ := b.Digest()
+	assert.NotEqual(t, digestA, digestB, "expected different entries to have different digests")
+}
+
+func TestClone_Errors(t *testing.T) {
+	db := assertOpenOptions(t, true, "clone_errors", chunkSize)
+	defer assertClose(t, db)
+
+	filldb(t, db, numEntries)
+
+	path := "test_db/clone_errors_copy"
+	_ = os.RemoveAll(path)
+	assert.Equal(t, ErrUnknownVersion, db.CloneVersion(path, 100, 0))
+
+	// A chunk size too small for some entry can't hold the log, and the partial clone is deleted.
+	assert.Equal(t, ErrTooBig, db.CloneVersion(path, latestVersion, 4))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "expected failed clone to be deleted")
+
+	// Cloning over an existing database is refused.
+	err = db.CloneVersion("test_db/clone_errors", latestVersion, 0)
+	_, ok := err.(*PathError)
+	assert.True(t, ok, "expected path error, got: %s", err)
+}
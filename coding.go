@@ -2,6 +2,7 @@ package logdb
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
@@ -14,6 +15,10 @@ var ErrNotValueSlice = errors.New("AppendValues must be called with a slice argu
 
 // A CodingDB wraps a 'LogDB' with functions to encode and decode values of some sort, giving a higher-level
 // interface than raw byte slices.
+//
+// Values which implement 'encoding.BinaryMarshaler' are encoded with 'MarshalBinary' rather than 'Encode', and
+// targets which implement 'encoding.BinaryUnmarshaler' are decoded with 'UnmarshalBinary' rather than 'Decode'.
+// This gives types control over their own stored representation, whichever coder is used.
 type CodingDB struct {
 	LogDB
 
@@ -83,7 +88,7 @@ func GobCoder(logdb LogDB) *CodingDB {
 // AppendValue encodes a value using the encoder, and stores it in the underlying 'LogDB' is there is no
 // error.
 func (db *CodingDB) AppendValue(value interface{}) (uint64, error) {
-	bs, err := db.Encode(value)
+	bs, err := db.encode(value)
 	if err != nil {
 		return 0, err
 	}
@@ -105,7 +110,7 @@ func (db *CodingDB) AppendValues(values interface{}) (uint64, error) {
 
 	bss := make([][]byte, v.Len())
 	for i := 0; i < v.Len(); i++ {
-		bs, err := db.Encode(v.Index(i).Interface())
+		bs, err := db.encode(v.Index(i).Interface())
 		if err != nil {
 			return 0, err
 		}
@@ -120,5 +125,50 @@ func (db *CodingDB) GetValue(id uint64, data interface{}) error {
 	if err != nil {
 		return err
 	}
+	return db.decode(bs, data)
+}
+
+// GetValues retrieves the values with IDs in the inclusive range ['fromID', 'toID'] from the underlying
+// 'LogDB' and decodes them, in order. The 'makeTarget' function is called to produce a fresh value to decode
+// each entry into, such as a pointer to a new struct, and these are returned.
+//
+// Entries are fetched one at a time, so if the underlying 'LogDB' is concurrently modified the range may not
+// be consistent.
+//
+// Returns 'ErrIDOutOfRange' if 'toID' is lesser than 'fromID' or the range is not entirely in the log, the same
+// errors as 'Get', and a 'DecodeError' value if an entry could not be decoded.
+func (db *CodingDB) GetValues(fromID, toID uint64, makeTarget func() interface{}) ([]interface{}, error) {
+	if toID < fromID || fromID < db.OldestID() || toID > db.NewestID() {
+		return nil, ErrIDOutOfRange
+	}
+
+	values := make([]interface{}, 0, toID-fromID+1)
+	for id := fromID; id <= toID; id++ {
+		bs, err := db.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		target := makeTarget()
+		if err := db.decode(bs, target); err != nil {
+			return nil, &DecodeError{ID: id, Err: err}
+		}
+		values = append(values, target)
+	}
+	return values, nil
+}
+
+// Encode a value, with 'MarshalBinary' if it has one and the encoder if not.
+func (db *CodingDB) encode(value interface{}) ([]byte, error) {
+	if m, ok := value.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+	return db.Encode(value)
+}
+
+// Decode a value, with 'UnmarshalBinary' if the target has one and the decoder if not.
+func (db *CodingDB) decode(bs []byte, data interface{}) error {
+	if u, ok := data.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(bs)
+	}
 	return db.Decode(bs, data)
 }
@@ -2,7 +2,9 @@ package logdb
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -69,3 +71,108 @@ func TestCoding_AppendValues(t *testing.T) {
 		}
 	}
 }
+
+func TestCoding_BinaryMarshaler(t *testing.T) {
+	for coderName, coderFactory := range coderTypes {
+		t.Logf("Coder: %s\n", coderName)
+		coder := coderFactory()
+
+		p := point{X: 3, Y: -7}
+		id, err := coder.AppendValue(p)
+		assert.Nil(t, err, "expected no error in append")
+
+		bs, err := coder.Get(id)
+		assert.Nil(t, err, "expected no error in get")
+		assert.Equal(t, []byte("3,-7"), bs, "expected 'MarshalBinary' encoding")
+
+		var v point
+		assert.Nil(t, coder.GetValue(id, &v), "expected no error in get")
+		assert.Equal(t, p, v, "expected equal 'point' values")
+
+		_, err = coder.AppendValues([]point{{1, 2}, {3, 4}})
+		assert.Nil(t, err, "expected no error in append")
+		values, err := coder.GetValues(id+1, id+2, func() interface{} { return new(point) })
+		assert.Nil(t, err, "expected no error in get")
+		assert.Equal(t, []interface{}{&point{1, 2}, &point{3, 4}}, values, "expected equal 'point' values")
+	}
+}
+
+func TestCoding_BinaryMarshalerFallback(t *testing.T) {
+	type record struct {
+		Name  string
+		Count int
+	}
+
+	coder := GobCoder(&InMemDB{})
+
+	r := record{Name: "hello", Count: 42}
+	id, err := coder.AppendValue(r)
+	assert.Nil(t, err, "expected no error in append")
+
+	bs, err := coder.Get(id)
+	assert.Nil(t, err, "expected no error in get")
+	expected, _ := coder.Encode(r)
+	assert.Equal(t, expected, bs, "expected gob encoding")
+
+	var v record
+	assert.Nil(t, coder.GetValue(id, &v), "expected no error in get")
+	assert.Equal(t, r, v, "expected equal records")
+}
+
+func TestCoding_GetValues(t *testing.T) {
+	type record struct {
+		Name  string
+		Count int
+	}
+
+	coder := &CodingDB{LogDB: &InMemDB{}, Encode: json.Marshal, Decode: json.Unmarshal}
+
+	records := make([]record, 255)
+	for i := range records {
+		records[i] = record{Name: fmt.Sprintf("entry %v", i), Count: i}
+	}
+	_, err := coder.AppendValues(records)
+	assert.Nil(t, err, "expected no error in append")
+
+	values, err := coder.GetValues(10, 20, func() interface{} { return new(record) })
+	assert.Nil(t, err, "expected no error in get")
+	assert.Equal(t, 11, len(values), "expected one value per ID")
+	for i, v := range values {
+		assert.Equal(t, &records[i+9], v, "expected equal records")
+	}
+
+	_, err = coder.GetValues(20, 10, func() interface{} { return new(record) })
+	assert.Equal(t, ErrIDOutOfRange, err, "expected backwards range to be out of range")
+
+	_, err = coder.GetValues(250, 260, func() interface{} { return new(record) })
+	assert.Equal(t, ErrIDOutOfRange, err, "expected range past the newest to be out of range")
+
+	_, err = coder.GetValues(1, math.MaxUint64, func() interface{} { return new(record) })
+	assert.Equal(t, ErrIDOutOfRange, err, "expected huge range to be out of range")
+
+	_, err = coder.GetValues(0, math.MaxUint64, func() interface{} { return new(record) })
+	assert.Equal(t, ErrIDOutOfRange, err, "expected range of every ID to be out of range")
+
+	// A malformed entry reports its ID.
+	id, _ := coder.Append([]byte("not json"))
+	_, err = coder.GetValues(250, id, func() interface{} { return new(record) })
+	if derr, ok := err.(*DecodeError); assert.True(t, ok, "expected decode error, got: %s", err) {
+		assert.Equal(t, id, derr.ID, "expected offending ID")
+	}
+}
+
+/// HELPERS
+
+// A type with its own binary encoding, which none of the coders would produce.
+type point struct {
+	X, Y int
+}
+
+func (p point) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d,%d", p.X, p.Y)), nil
+}
+
+func (p *point) UnmarshalBinary(bs []byte) error {
+	_, err := fmt.Sscanf(string(bs), "%d,%d", &p.X, &p.Y)
+	return err
+}
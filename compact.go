@@ -0,0 +1,294 @@
+package logdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Filenames used while compacting a chunk. These are not valid chunk filenames, so if the program dies
+// part-way through a compaction they are ignored, and deleted, when the database is next opened.
+const (
+	compactDataFile = "compacting"
+	compactMetaFile = compactDataFile + sep + metaSuffix
+)
+
+// A compaction is a copy of the entries in the oldest chunk which have not been forgotten, on its way to
+// replacing the chunk. Deleted entries are copied as empty entries.
+type compaction struct {
+	// The chunk being compacted, and enough of its state to check that it hasn't changed by the time the
+	// compaction is committed.
+	chunk     *chunk
+	entries   int
+	rollbacks uint64
+
+	// The path of the new data file, and the new chunk contents.
+	path   string
+	bytes  []byte
+	ends   []int32
+	stamps []uint64
+}
+
+// Check if the oldest chunk should be compacted. Assumes a lock (read or write) is held.
+//
+// The final chunk is never compacted, as it is still being written to.
+func (db *LockFreeChunkDB) compactionCandidate() *chunk {
+	if db.compactThreshold <= 0 || len(db.chunks) < 2 {
+		return nil
+	}
+
+	c := db.chunks[0]
+	if db.oldest <= c.oldest || db.oldest >= c.next() {
+		return nil
+	}
+
+	written := c.ends[len(c.ends)-1]
+	live := written - c.ends[db.oldest-c.oldest-1]
+	for id := range db.tombstones {
+		if id >= db.oldest && id < c.next() {
+			start, end := c.entryRange(id - c.oldest)
+			live -= end - start
+		}
+	}
+	if written == 0 || float64(live)/float64(written) >= db.compactThreshold {
+		return nil
+	}
+	return c
+}
+
+// Start compacting the oldest chunk, if it needs it and there isn't a compaction already in progress. Assumes a
+// write lock is held.
+//
+// If the database is wrapped in a 'ChunkDB', the compaction happens in a new goroutine, otherwise it happens
+// immediately.
+func (db *LockFreeChunkDB) maybeCompact() error {
+	if db.compacting || db.compactionCandidate() == nil {
+		return nil
+	}
+
+	if db.wrapperLock != nil {
+		db.compacting = true
+		db.compactWG.Add(1)
+		go db.compactInBackground()
+		return nil
+	}
+
+	cp := db.prepareCompaction()
+	err := cp.write(db.fs, db.path, db.version, cp.chunk.size)
+	if err == nil {
+		err = db.commitCompaction(cp)
+	}
+	if err != nil {
+		removeCompactionFiles(db.fs, db.path)
+	}
+	return err
+}
+
+// Compact the oldest chunk, taking the 'ChunkDB' locks as needed. Errors are not reported: the chunk is left as
+// it was, and will be considered for compaction again after the next forget.
+func (db *LockFreeChunkDB) compactInBackground() {
+	defer db.compactWG.Done()
+
+	// Copy the entries under the read lock, so readers aren't blocked.
+	db.wrapperLock.RLock()
+	var cp *compaction
+	if !db.closed {
+		cp = db.prepareCompaction()
+	}
+	db.wrapperLock.RUnlock()
+
+	// Write the new chunk files without holding any lock at all: this is the slow part.
+	var err error
+	if cp != nil {
+		err = cp.write(db.fs, db.path, db.version, cp.chunk.size)
+	}
+
+	// Swap the new chunk in under the write lock.
+	db.wrapperLock.Lock()
+	defer db.wrapperLock.Unlock()
+
+	db.compacting = false
+	if cp == nil {
+		return
+	}
+	if err == nil && !db.closed {
+		err = db.commitCompaction(cp)
+	}
+	if err != nil || db.closed {
+		removeCompactionFiles(db.fs, db.path)
+	}
+}
+
+// Copy the entries of the oldest chunk which have not been forgotten. Assumes a lock (read or write) is held.
+//
+// Returns nil if the chunk doesn't need compacting, or can't be read.
+func (db *LockFreeChunkDB) prepareCompaction() *compaction {
+	c := db.compactionCandidate()
+	if c == nil {
+		return nil
+	}
+
+	off := db.oldest - c.oldest
+	start := alignUp(c.ends[off-1], c.align)
+	end := c.ends[len(c.ends)-1]
+
+	cp := &compaction{
+		chunk:     c,
+		entries:   len(c.ends),
+		rollbacks: db.rollbacks,
+		path:      filepath.Join(db.path, c.compactedDataFileName(db.oldest)),
+		ends:      make([]int32, len(c.ends)-int(off)),
+	}
+	err := db.withChunkBytes(c, func(bytes []byte) error {
+		if len(db.tombstones) == 0 {
+			cp.bytes = append([]byte(nil), bytes[start:end]...)
+			for i, e := range c.ends[off:] {
+				cp.ends[i] = e - start
+			}
+			return nil
+		}
+
+		// Copy the entries one at a time, leaving out the bytes of deleted ones.
+		for i := range cp.ends {
+			from, to := c.entryRange(off + uint64(i))
+			if db.isDeleted(db.oldest + uint64(i)) {
+				from = to
+			}
+			pad := int(alignUp(int32(len(cp.bytes)), c.align)) - len(cp.bytes)
+			cp.bytes = append(cp.bytes, make([]byte, pad)...)
+			if versionHasFraming(c.version) {
+				cp.bytes = append(cp.bytes, frameHeader(int(to-from))...)
+			}
+			cp.bytes = append(cp.bytes, bytes[from:to]...)
+			cp.ends[i] = int32(len(cp.bytes))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	if versionHasTimestamps(c.version) {
+		cp.stamps = append([]uint64(nil), c.stamps[off:]...)
+	}
+	return cp
+}
+
+// Write the compacted chunk to temporary files, and sync them to disk.
+func (cp *compaction) write(fs FileSystem, path string, version uint16, chunkSize uint32) error {
+	return writeChunkFiles(fs, filepath.Join(path, compactDataFile), version, chunkSize, cp.bytes, cp.ends, cp.stamps)
+}
+
+// Write the data and metadata files of a whole chunk, which are not in use, and sync them to disk. The metadata
+// file is named after the data file, as usual.
+func writeChunkFiles(fs FileSystem, dataPath string, version uint16, chunkSize uint32, bytes []byte, ends []int32, stamps []uint64) error {
+	file, err := fs.OpenFile(dataPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return &WriteError{err}
+	}
+	defer file.Close()
+
+	// The file must be the usual chunk size, but only the start of it is written, so the rest is a hole.
+	if _, err := file.Write(bytes); err != nil {
+		return &WriteError{err}
+	}
+	if err := file.Truncate(int64(chunkSize)); err != nil {
+		return &WriteError{err}
+	}
+	if err := fsync(file); err != nil {
+		return &SyncError{err}
+	}
+
+	meta, err := encodeMetadataFile(version, ends, stamps)
+	if err != nil {
+		return &WriteError{err}
+	}
+	if err := writeFile(fs, metaFilePath(dataPath), meta); err != nil {
+		return &WriteError{err}
+	}
+	return nil
+}
+
+// Replace the oldest chunk with its compacted version. Assumes a write lock is held.
+//
+// If the chunk has changed since the compaction was prepared, the compaction is abandoned.
+func (db *LockFreeChunkDB) commitCompaction(cp *compaction) error {
+	c := cp.chunk
+	if len(db.chunks) < 2 || db.chunks[0] != c || c.delete || len(c.ends) != cp.entries || db.rollbacks != cp.rollbacks {
+		removeCompactionFiles(db.fs, db.path)
+		return nil
+	}
+	if _, ok := db.syncDirty[c]; ok {
+		removeCompactionFiles(db.fs, db.path)
+		return nil
+	}
+
+	// The compacted chunk may have the same extent as the old one, so its checksum mustn't be remembered.
+	if c.digest != nil {
+		c.digest = nil
+		if err := db.writeDigests(); err != nil {
+			return err
+		}
+	}
+
+	// The forgotten entries are about to be gone for good, so make sure the "oldest" file doesn't refer to
+	// them.
+	if err := writeOldestFile(db.fs, db.path, db.oldest); err != nil {
+		return &WriteError{err}
+	}
+
+	// Move the new files into place: first the metadata, as metadata without a data file is ignored; then the
+	// data. Until the old files are deleted there are two chunks with the same number, in which case the one
+	// with the larger oldest ID wins.
+	if err := db.fs.Rename(filepath.Join(db.path, compactMetaFile), metaFilePath(cp.path)); err != nil {
+		return &WriteError{err}
+	}
+	if err := db.fs.Rename(filepath.Join(db.path, compactDataFile), cp.path); err != nil {
+		return &WriteError{err}
+	}
+
+	// Swap in the new chunk before deleting the old one, so the old one is never used after it is unmapped.
+	fi, err := db.fs.Stat(cp.path)
+	if err != nil {
+		return &ReadError{err}
+	}
+	nc, err := openChunkFile(db.fs, db.backend, db.version, db.path, fi, nil, c.size)
+	if err != nil {
+		return err
+	}
+	nc.align = c.align
+	db.chunks[0] = &nc
+	if err := db.advise(&nc); err != nil {
+		return err
+	}
+
+	if err := c.closeAndRemove(); err != nil {
+		return &DeleteError{err}
+	}
+
+	// The new chunk is mapped, even though it may not be read again for a while.
+	defer db.lockNewest()
+	if db.maxMappedChunks > 0 {
+		db.mapLock.Lock()
+		defer db.mapLock.Unlock()
+		return db.trimMappings(nil)
+	}
+	return nil
+}
+
+// Delete any temporary compaction files.
+func removeCompactionFiles(fs FileSystem, path string) {
+	_ = fs.Remove(filepath.Join(path, compactDataFile))
+	_ = fs.Remove(filepath.Join(path, compactMetaFile))
+}
+
+// Given a chunk, get the filename it has after compaction: the same chunk number, but a new oldest ID.
+//
+// This function panics if the chunk path is invalid, as 'nextDataFileName' does.
+func (c *chunk) compactedDataFileName(oldest uint64) string {
+	bits := strings.Split(filepath.Base(c.path), sep)
+	if len(bits) != 3 || bits[0] != chunkPrefix {
+		panic("malformed chunk file name: " + c.path)
+	}
+	return fmt.Sprintf("%s%s%s%s%v", chunkPrefix, sep, bits[1], sep, oldest)
+}
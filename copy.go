@@ -0,0 +1,58 @@
+package logdb
+
+// The number of entries 'CopyTo' appends at once.
+const copyBatchEntries = 64
+
+// CopyTo appends every entry of one database to another, oldest first, and returns how many were copied. The
+// copied entries get new IDs, carrying on from the newest entry of the destination. Entries are read with 'Get'
+// and appended in batches with 'AppendEntries', so this works with any pair of 'LogDB' values, but neither
+// should be changed by anything else while it runs.
+//
+// If an entry can't be read or appended, the destination is rolled back to how it was before, and the error is
+// returned. A 'BatchAppendError' value from 'AppendEntries' is changed to say which entry of the whole copy
+// failed, rather than of one batch. Returns an 'AtomicityError' value if rolling back fails.
+func CopyTo(dst LogDB, src LogDB) (uint64, error) {
+	originalNewest := dst.NewestID()
+	oldest, newest := src.OldestID(), src.NewestID()
+	if oldest == 0 || newest < oldest {
+		return 0, nil
+	}
+
+	var copied uint64
+	batch := make([][]byte, 0, copyBatchEntries)
+	for id := oldest; id <= newest; id += uint64(len(batch)) {
+		batch = batch[:0]
+		for i := id; i <= newest && len(batch) < copyBatchEntries; i++ {
+			entry, err := src.Get(i)
+			if err != nil {
+				return 0, rollbackCopy(dst, originalNewest, copied, err)
+			}
+			batch = append(batch, entry)
+		}
+		if _, err := dst.AppendEntries(batch); err != nil {
+			if berr, ok := err.(*BatchAppendError); ok {
+				err = &BatchAppendError{
+					Index: int(copied) + berr.Index,
+					Count: int(newest - oldest + 1),
+					Size:  berr.Size,
+					Err:   berr.Err,
+				}
+			}
+			return 0, rollbackCopy(dst, originalNewest, copied, err)
+		}
+		copied += uint64(len(batch))
+	}
+
+	return copied, nil
+}
+
+// Undo a failed 'CopyTo', if any entries were copied, and return the error it should give.
+func rollbackCopy(dst LogDB, originalNewest, copied uint64, err error) error {
+	if copied == 0 {
+		return err
+	}
+	if rerr := dst.Rollback(originalNewest); rerr != nil {
+		return &AtomicityError{AppendErr: err, RollbackErr: rerr}
+	}
+	return err
+}
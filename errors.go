@@ -3,30 +3,86 @@ package logdb
 import (
 	"errors"
 	"fmt"
+	"os"
 )
 
 var (
 	// ErrIDOutOfRange means that the requested ID is not present in the log.
 	ErrIDOutOfRange = errors.New("log ID out of range")
 
+	// ErrDeleted means that the requested entry has been deleted with 'Delete'. Its ID is still in the log.
+	ErrDeleted = errors.New("log entry deleted")
+
+	// ErrEmpty means that the log has no entries, so there is no oldest or newest entry to get. Unlike
+	// 'ErrIDOutOfRange', it does not refer to any particular ID.
+	ErrEmpty = errors.New("log has no entries")
+
 	// ErrUnknownVersion means that the disk format version of an opened database is unknown.
 	ErrUnknownVersion = errors.New("unknown disk format version")
 
-	// ErrNotDirectory means that the path given to 'Open' exists and is not a directory.
+	// ErrNotDirectory means that the path given to 'Open' exists and is not a directory. It is wrapped in a
+	// 'DatabasePathError' value.
 	ErrNotDirectory = errors.New("database path not a directory")
 
 	// ErrPathDoesntExist means that the path given to 'Open' does not exist and the 'create' flag was
-	// false.
+	// false. It is wrapped in a 'DatabasePathError' value.
 	ErrPathDoesntExist = errors.New("database directory does not exist")
 
 	// ErrTooBig means that an entry could not be appended because it is larger than the chunk size.
 	ErrTooBig = errors.New("entry larger than chunksize")
 
+	// ErrChunkFull means that an entry could not be appended with 'AppendIfFits' because there is not enough
+	// space left in the final chunk.
+	ErrChunkFull = errors.New("entry doesn't fit in the final chunk")
+
+	// ErrBatchFull means that an entry could not be added to a 'Batch' because it would take the batch over
+	// its maximum size.
+	ErrBatchFull = errors.New("batch full")
+
+	// ErrEntryLength means that an entry could not be appended from a reader because the reader did not
+	// contain exactly the given number of bytes.
+	ErrEntryLength = errors.New("reader length does not match entry size")
+
+	// ErrConflict means that an entry could not be appended with 'CompareAndAppend' because the log has
+	// changed since the expected next ID was read.
+	ErrConflict = errors.New("log has changed since expected next ID was read")
+
 	// ErrClosed means that the database handle is closed.
 	ErrClosed = errors.New("database is closed")
 
+	// ErrCannotAbort means that 'CloseAbort' synced the database rather than discarding the changes since the
+	// last sync, because entries which had been synced were rolled back. The database is closed.
+	ErrCannotAbort = errors.New("synced entries rolled back, database synced instead of aborted")
+
 	// ErrEmptyNonfinalChunk means that the metadata for a non-final chunk has zero entries.
 	ErrEmptyNonfinalChunk = errors.New("metadata of non-final chunk contains no entries")
+
+	// ErrCorrupt means that serialised data is malformed or truncated.
+	ErrCorrupt = errors.New("corrupt or truncated data")
+
+	// ErrReadOnly means that the database can't be changed, as it was opened with 'WithReadOnly' or 'OpenFS', or
+	// as a write failed because the filesystem is read-only and the 'WithReadOnlyOnError' option was given.
+	// Entries can still be read.
+	ErrReadOnly = errors.New("database is read-only")
+
+	// ErrAlignment means that a database could not be created, as the alignment given with 'WithAlignment' is not
+	// a power of two, or is combined with 'WithFraming'.
+	ErrAlignment = errors.New("alignment not a power of two, or used with framing")
+
+	// ErrDowngrade means that a database could not be cloned with 'CloneVersion' to an older disk format version,
+	// as it has timestamps or deleted entries which that version can't express.
+	ErrDowngrade = errors.New("database has features the disk format version can't express")
+
+	// ErrChunkSizeTooSmall means that the chunk size given to 'SetChunkSize' can't hold even a one-byte entry,
+	// with its frame header if the database has framing.
+	ErrChunkSizeTooSmall = errors.New("chunk size too small to hold an entry")
+
+	// ErrScrubNeedsFraming means that a database could not be opened with 'WithBackgroundScrub', as its disk
+	// format version doesn't frame entries, so the scrubber would have nothing to check.
+	ErrScrubNeedsFraming = errors.New("background scrub needs a disk format version with framing")
+
+	// ErrNoTimestamps means that the disk format version of the database does not store entry timestamps.
+	ErrNoTimestamps = errors.New("disk format version does not store timestamps")
 )
 
 // ReadError means that a read failed. It wraps the actual error.
@@ -80,6 +136,76 @@ func (e *AtomicityError) WrappedErrors() []error {
 	return []error{e.AppendErr, e.RollbackErr}
 }
 
+// BatchAppendError means that an entry of a batch given to 'AppendEntries' could not be appended. It records
+// which entry it was, counting from 0, how many entries the batch had, and the size of the entry, and wraps the
+// actual error.
+type BatchAppendError struct {
+	Index int
+	Count int
+	Size  int
+	Err   error
+}
+
+func (e *BatchAppendError) Error() string {
+	return fmt.Sprintf("error appending entry %v of %v (%v bytes): %s", e.Index, e.Count, e.Size, e.Err.Error())
+}
+
+func (e *BatchAppendError) WrappedErrors() []error {
+	return []error{e.Err}
+}
+
+// DatabasePathError means that the path given to 'Open' can't be used as a database directory. It wraps
+// 'ErrNotDirectory' or 'ErrPathDoesntExist', and records what was found at the path.
+type DatabasePathError struct {
+	Path string
+
+	// The mode of the path itself, not following symbolic links, or 0 if there is nothing there. On
+	// platforms or filesystems without symbolic links, this is the same as 'TargetMode'.
+	Mode os.FileMode
+
+	// The mode of what the path refers to, following symbolic links, or 0 if there is nothing there.
+	TargetMode os.FileMode
+
+	Err error
+}
+
+func (e *DatabasePathError) Error() string {
+	switch {
+	case e.Mode == 0:
+		return fmt.Sprintf("%s: %s", e.Path, e.Err.Error())
+	case e.Mode&os.ModeSymlink == 0:
+		return fmt.Sprintf("%s: %s: found %s", e.Path, e.Err.Error(), describeFileMode(e.Mode))
+	case e.TargetMode == 0:
+		return fmt.Sprintf("%s: %s: found dangling symbolic link", e.Path, e.Err.Error())
+	default:
+		return fmt.Sprintf("%s: %s: found symbolic link to %s", e.Path, e.Err.Error(), describeFileMode(e.TargetMode))
+	}
+}
+
+func (e *DatabasePathError) WrappedErrors() []error {
+	return []error{e.Err}
+}
+
+// Describe the type of a file, for error messages.
+func describeFileMode(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "regular file"
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symbolic link"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	default:
+		return "irregular file"
+	}
+}
+
 // FormatError means that there is a problem with the database files. It wraps the actual error.
 type FormatError struct {
 	FilePath string
@@ -94,6 +220,50 @@ func (e *FormatError) WrappedErrors() []error {
 	return []error{e.Err}
 }
 
+// DecodeError means that an entry could not be decoded by a 'CodingDB'. It wraps the actual error.
+type DecodeError struct {
+	ID  uint64
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("error decoding entry %v: %s", e.ID, e.Err.Error())
+}
+
+func (e *DecodeError) WrappedErrors() []error {
+	return []error{e.Err}
+}
+
+// IDError means that an operation on one of several entries failed. It records the ID of the entry, and wraps the
+// actual error.
+type IDError struct {
+	ID  uint64
+	Err error
+}
+
+func (e *IDError) Error() string {
+	return fmt.Sprintf("entry %v: %s", e.ID, e.Err.Error())
+}
+
+func (e *IDError) WrappedErrors() []error {
+	return []error{e.Err}
+}
+
+// DatabaseError means that opening one of several databases failed. It records the name of the database's
+// directory, and wraps the actual error.
+type DatabaseError struct {
+	Name string
+	Err  error
+}
+
+func (e *DatabaseError) Error() string {
+	return fmt.Sprintf("database %q: %s", e.Name, e.Err.Error())
+}
+
+func (e *DatabaseError) WrappedErrors() []error {
+	return []error{e.Err}
+}
+
 // ChunkFileNameError means that a filename is not valid for a chunk file.
 type ChunkFileNameError struct {
 	FilePath string
@@ -114,6 +284,19 @@ func (e *ChunkSizeError) Error() string {
 	return fmt.Sprintf("in chunk %s: incorrect chunk file size (expected %v, got %v)", e.ChunkFilePath, e.Expected, e.Actual)
 }
 
+// DataFileTruncatedError means that a chunk data file is shorter than the chunk size, and its metadata, which
+// could be read, records entries ending past the end of the file. So it is the data file which has been cut
+// short, and entries have been lost from it, rather than the metadata being wrong.
+type DataFileTruncatedError struct {
+	ChunkFilePath string
+	Size          uint32
+	End           int32
+}
+
+func (e *DataFileTruncatedError) Error() string {
+	return fmt.Sprintf("in chunk %s: data file truncated (%v bytes long, but entries end at %v)", e.ChunkFilePath, e.Size, e.End)
+}
+
 // ChunkContinuityError means that two adjacent chunks do not contain a contiguous sequence of entries.
 type ChunkContinuityError struct {
 	ChunkFilePath string
@@ -159,3 +342,48 @@ type MetaOffsetError struct {
 func (e *MetaOffsetError) Error() string {
 	return fmt.Sprintf("entry offsets not monotonically increasing (expected >=%v, got %v)", e.Expected, e.Actual)
 }
+
+// MetaChecksumError means that the checksum in the metadata for a chunk doesn't match its contents.
+type MetaChecksumError struct {
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *MetaChecksumError) Error() string {
+	return fmt.Sprintf("metadata checksum mismatch (expected %08x, got %08x)", e.Expected, e.Actual)
+}
+
+// MetaLengthError means that the metadata for a chunk is not as long as its header says, for example because it
+// has been cut short.
+type MetaLengthError struct {
+	Expected int
+	Actual   int
+}
+
+func (e *MetaLengthError) Error() string {
+	return fmt.Sprintf("metadata has wrong length (expected %v bytes, got %v)", e.Expected, e.Actual)
+}
+
+// FrameError means that the frame header before an entry in a chunk data file does not give the size of the
+// entry recorded in the metadata.
+type FrameError struct {
+	Expected int
+	Actual   int
+}
+
+func (e *FrameError) Error() string {
+	if e.Actual < 0 {
+		return fmt.Sprintf("malformed frame header (expected entry size %v)", e.Expected)
+	}
+	return fmt.Sprintf("frame header has wrong entry size (expected %v, got %v)", e.Expected, e.Actual)
+}
+
+// MetaBoundsError means that the metadata for a chunk refers to entries outside of the chunk data file.
+type MetaBoundsError struct {
+	Limit  int32
+	Actual int32
+}
+
+func (e *MetaBoundsError) Error() string {
+	return fmt.Sprintf("entry offsets out of bounds (expected 0 to %v, got up to %v)", e.Limit, e.Actual)
+}
@@ -0,0 +1,144 @@
+package logdb
+
+// Excise removes a range of entries from the middle of the log, and renumbers the entries after it, atomically.
+// See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) Excise(fromID, toID uint64) error {
+	// The moved entries are written to staged chunks, so a staged append can't be in progress.
+	db.stageLock.Lock()
+	defer db.stageLock.Unlock()
+
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.Excise(fromID, toID)
+}
+
+// Excise removes the entries from 'fromID' to 'toID' inclusive, which may be anywhere in the log, and moves the
+// entries after them down to fill the gap: the entry which had ID 'toID+1' now has ID 'fromID', and so on. The
+// oldest ID doesn't change, and the newest goes down by the number of entries removed.
+//
+// This renumbers entries, so any ID of an entry after the range which is held outside the database, such as
+// by a reader or a replica, no longer refers to the same entry. Timestamps are kept.
+//
+// The later entries are copied, a chunk at a time, to new chunks, which are synced to disk before the log is
+// rolled back to 'fromID' and the new chunks are moved into place after it, as with a staged append. So this is
+// as expensive as copying them, and the space left in the chunk holding 'fromID' goes unused. The observer sees
+// a rollback to 'fromID' and then an append of each entry moved. The database is synced afterwards. A deleted
+// entry which is moved stays deleted, and is moved as an empty entry.
+//
+// Returns 'ErrIDOutOfRange' if the range is empty or not entirely in the log, and 'ErrTooBig' if an entry to be
+// moved is larger than the 'MaxEntrySize', which may be the case if the chunk size has been reduced with
+// 'SetChunkSize'. In either case nothing is changed, as is the case if writing the new chunks fails. If the
+// rollback or moving the new chunks into place fails, the log ends before 'fromID'.
+func (db *LockFreeChunkDB) Excise(fromID, toID uint64) error {
+	defer db.updateNewest()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if db.oldest == 0 || toID < fromID || fromID < db.oldest || toID >= db.next() {
+		return ErrIDOutOfRange
+	}
+
+	// Check the sizes before writing anything.
+	maxEntrySize := db.MaxEntrySize()
+	for _, c := range db.chunks {
+		for i := range c.ends {
+			id := c.oldest + uint64(i)
+			if id <= toID {
+				continue
+			}
+			start, end := c.entryRange(uint64(i))
+			if uint64(end-start) > maxEntrySize && !db.isDeleted(id) {
+				return ErrTooBig
+			}
+		}
+	}
+
+	// Copy the entries to move to staged chunks, and note which are deleted.
+	st := &stage{next: fromID, chunkSize: db.chunkSize, align: int32(db.alignment)}
+	w := &stageWriter{st: st, fs: db.fs, path: db.path, version: db.version}
+	var deleted []uint64
+	var sizes []int
+	keepStamps := versionHasTimestamps(db.version)
+	for _, c := range db.chunks {
+		if c.next() <= toID+1 {
+			continue
+		}
+		var werr error
+		_, err := db.scanChunk(c, func(id uint64, entry []byte) bool {
+			if id <= toID {
+				return true
+			}
+			if db.isDeleted(id) {
+				deleted = append(deleted, id)
+				entry = nil
+			}
+			var stamp uint64
+			if keepStamps {
+				stamp = c.stamps[id-c.oldest]
+			}
+			if werr = w.add(entry, stamp); werr != nil {
+				return false
+			}
+			if db.observer != nil {
+				sizes = append(sizes, len(entry))
+			}
+			return true
+		})
+		if err == nil {
+			err = werr
+		}
+		if err != nil {
+			removeStagedFiles(db.fs, db.path, len(st.counts))
+			return err
+		}
+	}
+	if err := w.flush(); err != nil {
+		removeStagedFiles(db.fs, db.path, len(st.counts))
+		return err
+	}
+
+	// Removing entries back to the oldest leaves the log empty, but still starting from the oldest ID.
+	if err := db.removeNewest(fromID); err != nil {
+		removeStagedFiles(db.fs, db.path, len(st.counts))
+		return err
+	}
+
+	// A trimmed final chunk must be grown back to the full size before it is left behind by a new chunk.
+	if len(db.chunks) > 0 {
+		st.last = db.chunks[len(db.chunks)-1]
+		if st.last.trimmed {
+			if err := st.last.resize(st.last.size); err != nil {
+				removeStagedFiles(db.fs, db.path, len(st.counts))
+				return &WriteError{err}
+			}
+			st.last.trimmed = false
+		}
+	}
+	if err := db.moveStagedChunks(st); err != nil {
+		return err
+	}
+
+	for i, size := range sizes {
+		id, size := fromID+uint64(i), size
+		db.observe(func(o Observer) { o.OnAppend(id, size) })
+	}
+
+	// The rollback undid the deletions, so redo them under the new IDs.
+	for _, id := range deleted {
+		db.tombstones[id-(toID-fromID+1)] = struct{}{}
+		db.tombstonesDirty = true
+	}
+
+	if err := db.trimStagedMappings(); err != nil {
+		return err
+	}
+	if err := db.sync(); err != nil {
+		return err
+	}
+	return db.enforceMaxBytes(0)
+}
@@ -0,0 +1,266 @@
+package logdb
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// A FileSystem is the interface through which a 'LockFreeChunkDB' accesses its files. By default the real
+// operating system is used (see 'OSFileSystem'), but this can be overridden with the 'WithFileSystem' option:
+// for example, to run against an alternative storage backend, or to inject faults in tests.
+type FileSystem interface {
+	// OpenFile opens the named file with the given flags and permissions, as 'os.OpenFile'.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Stat returns information about the named file, as 'os.Stat'.
+	Stat(name string) (os.FileInfo, error)
+
+	// Remove deletes the named file or empty directory, as 'os.Remove'.
+	Remove(name string) error
+
+	// ReadDir reads the named directory, returning its entries sorted by filename, as 'ioutil.ReadDir'.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+
+	// MkdirAll creates a directory and any necessary parents, as 'os.MkdirAll'.
+	MkdirAll(path string, perm os.FileMode) error
+
+	// Rename atomically replaces the file at 'newpath' with the file at 'oldpath', as 'os.Rename'.
+	Rename(oldpath, newpath string) error
+
+	// Allocate reserves disk space for the first 'size' bytes of a newly-created, empty, open file, extending
+	// the file to that size. If there isn't enough space, this must fail rather than creating a sparse file.
+	Allocate(file File, size int64) error
+
+	// Mmap memory-maps the first 'size' bytes of an open file. The mapping must be readable and writable,
+	// and changes to it must be written back to the file.
+	Mmap(file File, size int) ([]byte, error)
+
+	// Munmap releases a mapping produced by 'Mmap'.
+	Munmap(bytes []byte) error
+
+	// Msync writes changes to a mapping produced by 'Mmap' back to the file. This is called before the file
+	// itself is synced, so it need not wait for the changes to reach stable storage.
+	Msync(bytes []byte) error
+
+	// Lock takes an exclusive, non-blocking lock on an open file. The lock is released when the file is
+	// closed.
+	Lock(file File) error
+}
+
+// A File is an open file in a 'FileSystem'. The '*os.File' type implements this interface.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+
+	// Name returns the name of the file as presented to 'OpenFile'.
+	Name() string
+
+	// Sync commits the contents of the file to stable storage.
+	Sync() error
+
+	// Truncate changes the size of the file.
+	Truncate(size int64) error
+}
+
+// OSFileSystem is the 'FileSystem' implementation backed by the real operating system. It is the default.
+//
+// Memory-mapping and locking are implemented with 'mmap' and 'flock' on Unix-like systems, and with
+// 'CreateFileMapping', 'MapViewOfFile', and 'LockFileEx' on Windows.
+type OSFileSystem struct{}
+
+// OpenFile implements the 'FileSystem' interface.
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	// Don't return a typed nil on error.
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat implements the 'FileSystem' interface.
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Remove implements the 'FileSystem' interface.
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// ReadDir implements the 'FileSystem' interface.
+func (OSFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+// MkdirAll implements the 'FileSystem' interface.
+func (OSFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Allocate implements the 'FileSystem' interface. This uses 'fallocate' where possible, and otherwise writes
+// zeroes to the file.
+func (OSFileSystem) Allocate(file File, size int64) error {
+	return fallocate(file, size)
+}
+
+// Lstat returns information about the named file without following symbolic links, as 'os.Lstat'. This is
+// not part of the 'FileSystem' interface, but is used for error messages if a 'FileSystem' has it.
+func (OSFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// Rename implements the 'FileSystem' interface.
+func (OSFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Get information about a file without following symbolic links, if the 'FileSystem' supports that, and
+// otherwise following them.
+func lstatFile(fs FileSystem, name string) (os.FileInfo, error) {
+	if l, ok := fs.(interface {
+		Lstat(name string) (os.FileInfo, error)
+	}); ok {
+		return l.Lstat(name)
+	}
+	return fs.Stat(name)
+}
+
+// Get the underlying file descriptor of a 'File', if it has one.
+func fileDescriptor(file File) (int, error) {
+	f, ok := file.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		return 0, errors.New("file has no file descriptor")
+	}
+	return int(f.Fd()), nil
+}
+
+// Check if a 'FileSystem' is an 'OSFileSystem', under any of the wrappers which options such as 'WithFileMode' and
+// 'WithOpenRetry' add, so its memory-mapped files can be given to system calls like 'madvise'.
+func isOSFileSystem(fs FileSystem) bool {
+	for {
+		switch wrapped := fs.(type) {
+		case OSFileSystem:
+			return true
+		case *modeFileSystem:
+			fs = wrapped.FileSystem
+		case *retryFileSystem:
+			fs = wrapped.FileSystem
+		default:
+			return false
+		}
+	}
+}
+
+// A 'FileSystem' which creates files and directories with the given permissions, whatever is asked for.
+type modeFileSystem struct {
+	FileSystem
+
+	fileMode os.FileMode
+	dirMode  os.FileMode
+}
+
+func (fs *modeFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&os.O_CREATE != 0 {
+		perm = fs.fileMode
+	}
+	return fs.FileSystem.OpenFile(name, flag, perm)
+}
+
+func (fs *modeFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return fs.FileSystem.MkdirAll(path, os.ModeDir|fs.dirMode)
+}
+
+func (fs *modeFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return lstatFile(fs.FileSystem, name)
+}
+
+// A 'FileSystem' which retries opening and memory-mapping files when that fails for want of resources, such as
+// file descriptors or memory, which may soon be freed. Other errors are returned straight away.
+type retryFileSystem struct {
+	FileSystem
+
+	// The total number of attempts, and the delay before the first retry, which doubles after each one.
+	attempts int
+	backoff  time.Duration
+}
+
+func (fs *retryFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	var file File
+	err := fs.retry(func() error {
+		var err error
+		file, err = fs.FileSystem.OpenFile(name, flag, perm)
+		return err
+	})
+	return file, err
+}
+
+func (fs *retryFileSystem) Mmap(file File, size int) ([]byte, error) {
+	var bytes []byte
+	err := fs.retry(func() error {
+		var err error
+		bytes, err = fs.FileSystem.Mmap(file, size)
+		return err
+	})
+	return bytes, err
+}
+
+func (fs *retryFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return lstatFile(fs.FileSystem, name)
+}
+
+// Call a function until it succeeds, fails with an error which isn't transient, or runs out of attempts.
+func (fs *retryFileSystem) retry(f func() error) error {
+	backoff := fs.backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= fs.attempts || !isTransientError(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Check if an error is caused by the filesystem being read-only, looking through the errors wrapped by this
+// package's error types.
+func isReadOnlyError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		return isReadOnlyError(e.Err)
+	case *os.LinkError:
+		return isReadOnlyError(e.Err)
+	case *os.SyscallError:
+		return isReadOnlyError(e.Err)
+	case interface{ WrappedErrors() []error }:
+		for _, werr := range e.WrappedErrors() {
+			if isReadOnlyError(werr) {
+				return true
+			}
+		}
+		return false
+	}
+	return err == syscall.EROFS
+}
+
+// Check if an error is caused by a shortage of resources, and so may go away if the operation is retried.
+func isTransientError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	switch err {
+	case syscall.EMFILE, syscall.ENFILE, syscall.ENOMEM, syscall.EAGAIN:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,397 @@
+package logdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSystem_AppendFaultRollsBack(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := assertOpenOptions(t, true, "fs_append_fault", chunkSize, WithFileSystem(fs))
+
+	vs := filldb(t, db, 10)
+
+	// Fail the creation of the next chunk file: the batch will need a new chunk part way through.
+	fs.failCreate = func(name string) error {
+		if isBasenameChunkDataFile(filepath.Base(name)) {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+
+	batch := make([][]byte, 20)
+	for i := range batch {
+		batch[i] = make([]byte, chunkSize/4)
+	}
+	_, err := db.AppendEntries(batch)
+	assert.True(t, errwrap.ContainsType(err, new(WriteError)), "expected write error, got: %s", err)
+	assert.Equal(t, uint64(len(vs)), db.NewestID(), "expected append to be rolled back")
+
+	fs.failCreate = nil
+	assertClose(t, db)
+
+	db2 := assertOpenOptions(t, false, "fs_append_fault", chunkSize, WithFileSystem(fs))
+	defer assertClose(t, db2)
+
+	assert.Equal(t, uint64(len(vs)), db2.NewestID(), "expected rolled back entries to stay gone")
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db2, uint64(i+1)))
+	}
+}
+
+func TestFileSystem_AllocateFaultFailsCleanly(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := assertOpenOptions(t, true, "fs_allocate_fault", chunkSize, WithFileSystem(fs))
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, 10)
+
+	// Run out of space when the next chunk file is created.
+	fs.failAllocate = func(name string) error { return syscall.ENOSPC }
+
+	var err error
+	for err == nil {
+		_, err = db.Append(make([]byte, chunkSize/2))
+		if err == nil {
+			vs = append(vs, make([]byte, chunkSize/2))
+		}
+	}
+	assert.True(t, errwrap.ContainsType(err, new(WriteError)), "expected write error, got: %s", err)
+	assert.True(t, errwrap.Contains(err, syscall.ENOSPC.Error()), "expected out of space error, got: %s", err)
+	assert.Equal(t, uint64(len(vs)), db.NewestID(), "expected failed append not to be visible")
+
+	// Once there is space again, appending works.
+	fs.failAllocate = nil
+	vs = append(vs, []byte("hello"))
+	assert.Equal(t, uint64(len(vs)), assertAppend(t, db, []byte("hello")))
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+}
+
+func TestFileSystem_ReadOnlyOnError(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := assertOpenOptions(t, true, "fs_read_only", chunkSize, WithFileSystem(fs), WithReadOnlyOnError())
+
+	vs := filldb(t, db, 10)
+	assertSync(t, db)
+
+	// The filesystem is remounted read-only when the next chunk file is created.
+	fs.failCreate = func(name string) error { return syscall.EROFS }
+
+	batch := make([][]byte, 20)
+	for i := range batch {
+		batch[i] = make([]byte, chunkSize/4)
+	}
+	_, err := db.AppendEntries(batch)
+	assert.True(t, errwrap.ContainsType(err, new(WriteError)), "expected write error, got: %s", err)
+	assert.True(t, isReadOnlyError(err), "expected read-only filesystem error, got: %s", err)
+	assert.Equal(t, uint64(len(vs)), db.NewestID(), "expected append to be rolled back")
+
+	// Even once the fault clears, every change is rejected.
+	fs.failCreate = nil
+	_, err = db.Append([]byte("hello"))
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, ErrReadOnly, db.Forget(2))
+	assert.Equal(t, ErrReadOnly, db.Rollback(2))
+	assert.Equal(t, ErrReadOnly, db.Sync())
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+
+	// But reads still work.
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+
+	assert.Equal(t, ErrReadOnly, db.Close())
+
+	db = assertOpenOptions(t, false, "fs_read_only", chunkSize)
+	defer assertClose(t, db)
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+	assertAppend(t, db, []byte("hello"))
+}
+
+func TestFileSystem_ReadDuringStagedAppend(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := WrapForConcurrency(assertOpenOptions(t, true, "fs_staged_append", 1024*1024, WithFileSystem(fs)))
+
+	vs := filldb(t, db, 100)
+
+	// Hold up the batch while its first chunk is being staged.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	fs.failCreate = func(name string) error {
+		if strings.HasPrefix(filepath.Base(name), stagedFilePrefix) {
+			once.Do(func() {
+				close(started)
+				<-release
+			})
+		}
+		return nil
+	}
+
+	batch := make([][]byte, 5*1024)
+	for i := range batch {
+		batch[i] = bytes.Repeat([]byte{byte(i)}, 1024)
+	}
+	type result struct {
+		id  uint64
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		id, err := db.AppendEntries(batch)
+		done <- result{id, err}
+	}()
+	<-started
+
+	// The old entries can be read, and the new ones are not visible yet.
+	read := make(chan error)
+	go func() {
+		for i, v := range vs {
+			entry, err := db.Get(uint64(i + 1))
+			if err == nil && !bytes.Equal(v, entry) {
+				err = fmt.Errorf("entry %v: expected %q, got %q", i+1, v, entry)
+			}
+			if err != nil {
+				read <- err
+				return
+			}
+		}
+		_, err := db.Get(uint64(len(vs) + 1))
+		if err != ErrIDOutOfRange {
+			read <- fmt.Errorf("expected new entry not to be visible, got: %v", err)
+			return
+		}
+		read <- nil
+	}()
+	select {
+	case err := <-read:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("reads blocked by staged append")
+	}
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+
+	close(release)
+	res := <-done
+	assert.Nil(t, res.err)
+	assert.Equal(t, uint64(len(vs)+1), res.id)
+	vs = append(vs, batch...)
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+	assert.Equal(t, 6, len(db.Chunks()), "expected the batch to fill new chunks")
+	fs.failCreate = nil
+	assertClose(t, db)
+
+	db2 := assertOpenOptions(t, false, "fs_staged_append", 1024*1024)
+	defer assertClose(t, db2)
+	assert.Equal(t, uint64(len(vs)), db2.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db2, uint64(i+1)))
+	}
+}
+
+func TestFileSystem_CreateFileAllocates(t *testing.T) {
+	dir := "test_db/fs_create_file_allocates"
+	_ = os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "file")
+	if err := createFile(OSFileSystem{}, path, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(64*1024), fi.Size())
+	assert.True(t, allocatedBytes(t, path) >= 64*1024, "expected space to be allocated for the whole file")
+}
+
+func TestFileSystem_OpenRetry(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := assertOpenOptions(t, true, "fs_open_retry", chunkSize, WithFileSystem(fs))
+	vs := filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	// Fail every chunk mapping the first time it is tried.
+	var attempts int
+	failed := make(map[string]bool)
+	fs.failMmap = func(name string) error {
+		attempts++
+		if failed[name] {
+			return nil
+		}
+		failed[name] = true
+		return &os.SyscallError{Syscall: "mmap", Err: syscall.ENOMEM}
+	}
+
+	_, err := Open("test_db/fs_open_retry", chunkSize, false, WithFileSystem(fs))
+	assert.True(t, errwrap.Contains(err, syscall.ENOMEM.Error()), "expected out of memory error, got: %s", err)
+
+	db2 := assertOpenOptions(t, false, "fs_open_retry", chunkSize, WithFileSystem(fs), WithOpenRetry(3, time.Millisecond))
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db2, uint64(i+1)))
+	}
+	assert.Equal(t, 2*len(db2.chunks), attempts, "expected each chunk to be mapped twice")
+	assertClose(t, db2)
+
+	// Errors which aren't caused by a shortage of resources are not retried.
+	attempts = 0
+	fs.failMmap = func(name string) error {
+		attempts++
+		return syscall.EINVAL
+	}
+	_, err = Open("test_db/fs_open_retry", chunkSize, false, WithFileSystem(fs), WithOpenRetry(3, time.Millisecond))
+	assert.True(t, errwrap.Contains(err, syscall.EINVAL.Error()), "expected invalid argument error, got: %s", err)
+	assert.Equal(t, 1, attempts, "expected no retries")
+}
+
+func TestFileSystem_MetaRenameFaultKeepsOldMeta(t *testing.T) {
+	fs := &faultyFileSystem{}
+	db := assertOpenOptions(t, true, "fs_meta_rename_fault", chunkSize, WithFileSystem(fs))
+	assertSetSync(t, db, -1)
+
+	vs := filldb(t, db, 5)
+	assertSync(t, db)
+	metaPath := db.chunks[0].metaFilePath()
+	before := readTestFile(t, metaPath)
+
+	// "Crash" after the new metadata has been written, but before it is renamed into place.
+	fs.failRename = func(oldpath, newpath string) error { return syscall.EIO }
+	assertAppend(t, db, []byte("lost"))
+	err := db.Sync()
+	assert.True(t, errwrap.Contains(err, syscall.EIO.Error()), "expected I/O error, got: %s", err)
+	assert.Equal(t, before, readTestFile(t, metaPath), "expected old metadata to be intact")
+	_, err = os.Stat(filepath.Join("test_db/fs_meta_rename_fault", syncMetaFile))
+	assert.Nil(t, err, "expected new metadata to have been written")
+	assert.Nil(t, db.CloseAbort())
+
+	// Reopening ignores the new metadata, and tidies it away.
+	fs.failRename = nil
+	db2 := assertOpenOptions(t, false, "fs_meta_rename_fault", chunkSize, WithFileSystem(fs))
+	defer assertClose(t, db2)
+
+	assert.Equal(t, uint64(len(vs)), db2.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db2, uint64(i+1)))
+	}
+	_, err = os.Stat(filepath.Join("test_db/fs_meta_rename_fault", syncMetaFile))
+	assert.True(t, os.IsNotExist(err), "expected temporary metadata to be deleted")
+}
+
+/// HELPERS
+
+// A 'FileSystem' which records writes and syncs of regular files, and renames, in order. Memory-mapped writes
+// are not recorded, and nor are syncs which bypass 'File.Sync'.
+type recordingFileSystem struct {
+	OSFileSystem
+
+	// Events of the form "write <basename>", "sync <basename>", and "rename <new basename>". Files may be
+	// synced concurrently, so 'lock' is held while recording an event.
+	events []string
+	lock   sync.Mutex
+}
+
+func (fs *recordingFileSystem) record(event string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.events = append(fs.events, event)
+}
+
+func (fs *recordingFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.OSFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingFile{File: f.(*os.File), fs: fs}, nil
+}
+
+func (fs *recordingFileSystem) Rename(oldpath, newpath string) error {
+	fs.record("rename " + filepath.Base(newpath))
+	return fs.OSFileSystem.Rename(oldpath, newpath)
+}
+
+// A 'File' which records events in a 'recordingFileSystem'.
+type recordingFile struct {
+	*os.File
+	fs *recordingFileSystem
+}
+
+func (f *recordingFile) Write(b []byte) (int, error) {
+	f.fs.record("write " + filepath.Base(f.Name()))
+	return f.File.Write(b)
+}
+
+func (f *recordingFile) Sync() error {
+	f.fs.record("sync " + filepath.Base(f.Name()))
+	return f.File.Sync()
+}
+
+// A 'FileSystem' which can be made to fail when creating files.
+type faultyFileSystem struct {
+	OSFileSystem
+
+	// Called when a file is opened with 'os.O_CREATE'. If this returns an error, the open fails.
+	failCreate func(name string) error
+
+	// Called when space is allocated for a file. If this returns an error, the allocation fails.
+	failAllocate func(name string) error
+
+	// Called when a file is memory-mapped. If this returns an error, the mapping fails.
+	failMmap func(name string) error
+
+	// Called when a file is renamed. If this returns an error, the rename fails.
+	failRename func(oldpath, newpath string) error
+}
+
+func (fs *faultyFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&os.O_CREATE != 0 && fs.failCreate != nil {
+		if err := fs.failCreate(name); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	return fs.OSFileSystem.OpenFile(name, flag, perm)
+}
+
+func (fs *faultyFileSystem) Allocate(file File, size int64) error {
+	if fs.failAllocate != nil {
+		if err := fs.failAllocate(file.Name()); err != nil {
+			return err
+		}
+	}
+	return fs.OSFileSystem.Allocate(file, size)
+}
+
+func (fs *faultyFileSystem) Mmap(file File, size int) ([]byte, error) {
+	if fs.failMmap != nil {
+		if err := fs.failMmap(file.Name()); err != nil {
+			return nil, err
+		}
+	}
+	return fs.OSFileSystem.Mmap(file, size)
+}
+
+func (fs *faultyFileSystem) Rename(oldpath, newpath string) error {
+	if fs.failRename != nil {
+		if err := fs.failRename(oldpath, newpath); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+		}
+	}
+	return fs.OSFileSystem.Rename(oldpath, newpath)
+}
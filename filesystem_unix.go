@@ -0,0 +1,34 @@
+// +build !windows
+
+package logdb
+
+import "syscall"
+
+// Mmap implements the 'FileSystem' interface. The file must have been opened by an 'OSFileSystem'.
+func (OSFileSystem) Mmap(file File, size int) ([]byte, error) {
+	fd, err := fileDescriptor(file)
+	if err != nil {
+		return nil, err
+	}
+	return syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// Munmap implements the 'FileSystem' interface.
+func (OSFileSystem) Munmap(bytes []byte) error {
+	return syscall.Munmap(bytes)
+}
+
+// Msync implements the 'FileSystem' interface. This is a no-op, as a shared mapping uses the same page cache
+// as the file, so syncing the file is enough.
+func (OSFileSystem) Msync(bytes []byte) error {
+	return nil
+}
+
+// Lock implements the 'FileSystem' interface. The file must have been opened by an 'OSFileSystem'.
+func (OSFileSystem) Lock(file File) error {
+	fd, err := fileDescriptor(file)
+	if err != nil {
+		return err
+	}
+	return syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+}
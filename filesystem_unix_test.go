@@ -0,0 +1,94 @@
+// +build !windows
+
+package logdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSystem_FileMode(t *testing.T) {
+	// These modes are stricter than any usual umask, so are unaffected by it.
+	db := assertOpenOptions(t, true, "fs_file_mode", chunkSize, WithFileMode(0600), WithDirMode(0700))
+	filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	dir := "test_db/fs_file_mode"
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm(), "directory mode")
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks int
+	for _, fi := range fis {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "mode of %s", filepath.Join(dir, fi.Name()))
+		if isBasenameChunkDataFile(fi.Name()) {
+			chunks++
+		}
+	}
+	assert.True(t, chunks > 1, "expected several chunks")
+}
+
+func TestFileSystem_NoOpenNamedPipe(t *testing.T) {
+	_ = os.Remove("test_db/fs_no_open_named_pipe")
+	if err := syscall.Mkfifo("test_db/fs_no_open_named_pipe", 0644); err != nil {
+		t.Skip("could not create named pipe: ", err)
+	}
+
+	openErr := assertOpenError(t, true, "fs_no_open_named_pipe")
+	perr := assertDatabasePathError(t, openErr, ErrNotDirectory)
+	assert.True(t, perr.Mode&os.ModeNamedPipe != 0, "expected named pipe")
+	assert.Contains(t, openErr.Error(), "named pipe")
+}
+
+func TestFileSystem_DirSync(t *testing.T) {
+	fs := &recordingFileSystem{}
+	db := assertOpenOptions(t, true, "fs_dir_sync", chunkSize, WithFileSystem(fs))
+	defer assertClose(t, db)
+
+	dirSynced := func() bool {
+		for _, event := range fs.events {
+			if event == "sync fs_dir_sync" {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Creating a chunk syncs the directory...
+	filldb(t, db, numEntries)
+	assert.True(t, len(db.chunks) > 2, "expected several chunks")
+	assert.True(t, dirSynced(), "expected directory to be synced after creating a chunk")
+
+	// ...and so does deleting one.
+	fs.events = nil
+	assertTruncate(t, db, db.chunks[1].oldest, db.chunks[len(db.chunks)-2].oldest)
+	assert.True(t, dirSynced(), "expected directory to be synced after deleting chunks")
+
+	// ...and so does renaming rewritten metadata into place.
+	fs.events = nil
+	assertAppend(t, db, []byte("x"))
+	assertSync(t, db)
+	assert.True(t, dirSynced(), "expected directory to be synced after rewriting metadata")
+}
+
+/// HELPERS
+
+// Get the number of bytes of disk space allocated to a file, which may be less than its size if it has holes.
+func allocatedBytes(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
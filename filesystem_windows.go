@@ -0,0 +1,124 @@
+// +build windows
+
+package logdb
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32       = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx = kernel32.NewProc("LockFileEx")
+)
+
+// Flags for 'LockFileEx'.
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+)
+
+// The file mapping objects behind the views returned by 'Mmap', keyed by view address, so that 'Munmap' can
+// close them.
+var mappings = struct {
+	sync.Mutex
+	handles map[uintptr]syscall.Handle
+}{handles: make(map[uintptr]syscall.Handle)}
+
+// Mmap implements the 'FileSystem' interface. The file must have been opened by an 'OSFileSystem'.
+func (OSFileSystem) Mmap(file File, size int) ([]byte, error) {
+	if size <= 0 {
+		return nil, syscall.EINVAL
+	}
+	fd, err := fileDescriptor(file)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := syscall.CreateFileMapping(syscall.Handle(fd), nil, syscall.PAGE_READWRITE, uint32(uint64(size)>>32), uint32(size), nil)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	if err != nil {
+		_ = syscall.CloseHandle(h)
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+
+	mappings.Lock()
+	mappings.handles[addr] = h
+	mappings.Unlock()
+
+	var bytes []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&bytes))
+	hdr.Data = addr
+	hdr.Len = size
+	hdr.Cap = size
+	return bytes, nil
+}
+
+// Munmap implements the 'FileSystem' interface.
+func (OSFileSystem) Munmap(bytes []byte) error {
+	addr, err := viewAddress(bytes)
+	if err != nil {
+		return err
+	}
+
+	mappings.Lock()
+	h, ok := mappings.handles[addr]
+	delete(mappings.handles, addr)
+	mappings.Unlock()
+	if !ok {
+		return syscall.EINVAL
+	}
+
+	if err := syscall.UnmapViewOfFile(addr); err != nil {
+		_ = syscall.CloseHandle(h)
+		return os.NewSyscallError("UnmapViewOfFile", err)
+	}
+	return os.NewSyscallError("CloseHandle", syscall.CloseHandle(h))
+}
+
+// Msync implements the 'FileSystem' interface. Unlike on Unix-like systems, syncing the file does not write
+// out changes made through a view, so they are flushed here.
+func (OSFileSystem) Msync(bytes []byte) error {
+	addr, err := viewAddress(bytes)
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("FlushViewOfFile", syscall.FlushViewOfFile(addr, uintptr(len(bytes))))
+}
+
+// Lock implements the 'FileSystem' interface. The file must have been opened by an 'OSFileSystem'.
+func (OSFileSystem) Lock(file File) error {
+	fd, err := fileDescriptor(file)
+	if err != nil {
+		return err
+	}
+
+	var overlapped syscall.Overlapped
+	r1, _, err := procLockFileEx.Call(
+		uintptr(fd),
+		lockfileExclusiveLock|lockfileFailImmediately,
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(&overlapped)),
+	)
+	if r1 == 0 {
+		return os.NewSyscallError("LockFileEx", err)
+	}
+	return nil
+}
+
+// Get the address of a view returned by 'Mmap'.
+func viewAddress(bytes []byte) (uintptr, error) {
+	if len(bytes) == 0 {
+		return 0, errors.New("not a mapped view")
+	}
+	return uintptr(unsafe.Pointer(&bytes[0])), nil
+}
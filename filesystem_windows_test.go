@@ -0,0 +1,57 @@
+// +build windows
+
+package logdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSystem_WindowsMmap(t *testing.T) {
+	fs := OSFileSystem{}
+	path := "test_db/windows_mmap"
+	_ = os.RemoveAll(path)
+	if err := fs.MkdirAll(path, os.ModeDir|0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := createFile(fs, path+"/data", 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	file, bs, err := mmap(fs, path+"/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4096, len(bs))
+
+	copy(bs, "hello, world")
+	assert.Nil(t, fs.Msync(bs), "failed to flush view")
+	assert.Nil(t, munmapAndClose(fs, file, bs), "failed to unmap")
+
+	contents, err := ioutil.ReadFile(path + "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, bytes.HasPrefix(contents, []byte("hello, world")), "expected writes through the view to reach the file")
+}
+
+func TestFileSystem_WindowsLock(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "windows_lock", chunkSize)
+	defer assertClose(t, db)
+
+	_, err := Open("test_db/windows_lock", chunkSize, false)
+	assert.NotNil(t, err, "expected locked database not to open")
+}
+
+/// HELPERS
+
+// Get the number of bytes of disk space allocated to a file. Chunk files are not sparse on Windows, so tests
+// which depend on this are skipped.
+func allocatedBytes(t *testing.T, path string) int64 {
+	t.Skip("sparse files are not supported on Windows")
+	return 0
+}
@@ -0,0 +1,86 @@
+package logdb
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// HealthCheck checks that the database at the given path is consistent: that its version is known, that its
+// chunk files are the right size, have readable metadata which refers only to data within the chunk, and follow
+// on from each other with no gaps, and that its "oldest" and "tombstones" files are intact. The options are as
+// for 'Open'.
+//
+// Nothing is changed, and the database is not locked, so this can be used to monitor a database which another
+// process has open. Leftovers from an interrupted operation, which 'Open' would tidy up, are ignored. As the
+// database isn't locked, a check which races with a writer may report a problem which isn't really there, so
+// it is worth checking again before raising the alarm.
+//
+// Returns nil if the database is consistent, and otherwise the error that 'Open' would give. The exception is a
+// damaged "oldest" file, which 'Open' works around by taking the oldest ID from the chunks, but which is reported
+// here as a 'FormatError' value, as it is a sign of trouble on disk.
+func HealthCheck(path string, opts ...Option) error {
+	o := applyOptions(opts)
+	fs := o.fs
+
+	if err := checkDatabasePath(fs, path); err != nil {
+		return err
+	}
+
+	var version uint16
+	if err := readFile(fs, filepath.Join(path, "version"), &version); err != nil {
+		return &ReadError{err}
+	}
+	if !knownVersion(version) {
+		return ErrUnknownVersion
+	}
+
+	sizes, err := readChunkSizes(fs, path)
+	if err != nil {
+		return &ReadError{err}
+	}
+
+	chunkFiles, err := findChunkFiles(fs, path, version, false)
+	if err != nil {
+		return err
+	}
+
+	var prior *chunk
+	for i, fi := range chunkFiles {
+		if prior != nil && len(prior.ends) == 0 {
+			return &FormatError{
+				FilePath: prior.metaFilePath(),
+				Err:      ErrEmptyNonfinalChunk,
+			}
+		}
+
+		// Only the final chunk may have been trimmed.
+		trimmed := o.trimTail && i == len(chunkFiles)-1
+		c, err := readChunkFile(fs, version, path, fi, prior, chunkSizeFor(fi.Size(), sizes), trimmed)
+		if err != nil {
+			return err
+		}
+		prior = &c
+	}
+
+	oldestPath := filepath.Join(path, "oldest")
+	oldest, err := readOldestFile(fs, path)
+	switch {
+	case err == ErrCorrupt:
+		return &FormatError{FilePath: oldestPath, Err: err}
+	case os.IsNotExist(err):
+	case err != nil:
+		return &ReadError{err}
+	case o.strictOldest && prior != nil && oldest > prior.next():
+		return &ChunkContinuityError{
+			ChunkFilePath: prior.path,
+			Expected:      prior.next(),
+			Actual:        oldest,
+		}
+	}
+
+	if _, err := readTombstones(fs, path); err != nil {
+		return &ReadError{err}
+	}
+
+	return nil
+}
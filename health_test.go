@@ -0,0 +1,145 @@
+package logdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheck_Healthy(t *testing.T) {
+	db := assertOpenOptions(t, true, "health_check", chunkSize)
+	filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+
+	// The database can be checked while it is open.
+	assert.Nil(t, HealthCheck("test_db/health_check"), "expected open database to be healthy")
+	assertClose(t, db)
+	assert.Nil(t, HealthCheck("test_db/health_check"), "expected closed database to be healthy")
+
+	// Leftovers which 'Open' would delete are left alone.
+	leftover := filepath.Join("test_db/health_check", compactDataFile)
+	writeTestFile(t, leftover, []byte("leftover"))
+	assert.Nil(t, HealthCheck("test_db/health_check"), "expected database with leftovers to be healthy")
+	_, err := os.Stat(leftover)
+	assert.Nil(t, err, "expected leftover file not to be deleted")
+}
+
+func TestHealthCheck_CorruptMeta(t *testing.T) {
+	db := assertOpenOptions(t, true, "health_check_corrupt", chunkSize)
+	filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	dir := "test_db/health_check_corrupt"
+	chunkFiles, err := findChunkFiles(OSFileSystem{}, dir, latestVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath := metaFilePath(filepath.Join(dir, chunkFiles[1].Name()))
+	meta := append(readTestFile(t, metaPath), 0xff, 0xff)
+	writeTestFile(t, metaPath, meta)
+
+	err = HealthCheck(dir)
+	assert.NotNil(t, err, "expected corrupt database to be unhealthy")
+	_, openErr := Open(dir, chunkSize, false)
+	assert.Equal(t, openErr, err, "expected the same error as opening")
+}
+
+func TestHealthCheck_CorruptOldest(t *testing.T) {
+	db := assertOpenOptions(t, true, "health_check_corrupt_oldest", chunkSize)
+	filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+	assertClose(t, db)
+
+	dir := "test_db/health_check_corrupt_oldest"
+	oldestPath := filepath.Join(dir, "oldest")
+	oldest := readTestFile(t, oldestPath)
+	damaged := append([]byte(nil), oldest...)
+	damaged[0] ^= 0x01
+	writeTestFile(t, oldestPath, damaged)
+
+	// Opening works around it, but it is still reported.
+	err := HealthCheck(dir)
+	if ferr, ok := err.(*FormatError); assert.True(t, ok, "expected format error, got: %s", err) {
+		assert.Equal(t, oldestPath, ferr.FilePath)
+		assert.Equal(t, ErrCorrupt, ferr.Err)
+	}
+
+	// An ID after the end of the log is only an error if opening would reject it.
+	if err := writeOldestFile(OSFileSystem{}, dir, numEntries+10); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, HealthCheck(dir), "expected oldest ID past the end to be corrected")
+	err = HealthCheck(dir, WithStrictOldest())
+	assert.NotNil(t, err, "expected oldest ID past the end to be unhealthy")
+	_, openErr := Open(dir, chunkSize, false, WithStrictOldest())
+	assert.Equal(t, openErr, err, "expected the same error as opening")
+}
+
+func TestHealthCheck_CorruptTombstones(t *testing.T) {
+	db := assertOpenOptions(t, true, "health_check_corrupt_tombstones", chunkSize)
+	filldb(t, db, numEntries)
+	assert.Nil(t, db.Delete(10))
+	assertClose(t, db)
+
+	dir := "test_db/health_check_corrupt_tombstones"
+	assert.Nil(t, HealthCheck(dir), "expected database with deleted entry to be healthy")
+
+	tombstonesPath := filepath.Join(dir, tombstonesFile)
+	writeTestFile(t, tombstonesPath, append(readTestFile(t, tombstonesPath), 0xff))
+
+	err := HealthCheck(dir)
+	assert.NotNil(t, err, "expected corrupt tombstones to be unhealthy")
+	_, openErr := Open(dir, chunkSize, false)
+	assert.Equal(t, openErr, err, "expected the same error as opening")
+}
+
+func TestHealthCheck_NoDatabase(t *testing.T) {
+	err := HealthCheck("test_db/health_check_missing")
+	if perr, ok := err.(*DatabasePathError); assert.True(t, ok, "expected database path error, got: %s", err) {
+		assert.Equal(t, ErrPathDoesntExist, perr.Err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	db := assertOpenOptions(t, true, "inspect", chunkSize)
+	filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+	assertClose(t, db)
+
+	dir := "test_db/inspect"
+	before, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, Inspect(dir, &out))
+	assert.Regexp(t, `(?m)^oldest: +20$`, out.String())
+	assert.Regexp(t, fmt.Sprintf(`(?m)^next: +%v$`, numEntries+1), out.String())
+	assert.Regexp(t, fmt.Sprintf(`(?m)^chunk\S+ +\d+ +%v +\d+ +\d+ +%v`, numEntries+1, chunkSize), out.String())
+
+	// A damaged chunk is reported, and the others are still described.
+	chunkFiles, err := findChunkFiles(OSFileSystem{}, dir, latestVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, metaFilePath(filepath.Join(dir, chunkFiles[1].Name())), []byte("damaged"))
+	out.Reset()
+	assert.Nil(t, Inspect(dir, &out))
+	assert.Contains(t, out.String(), "error:")
+	assert.Regexp(t, fmt.Sprintf(`(?m)^next: +%v$`, numEntries+1), out.String())
+
+	// Nothing is changed.
+	after, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(before), len(after))
+
+	assert.IsType(t, &DatabasePathError{}, Inspect("test_db/inspect_missing", &out))
+}
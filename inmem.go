@@ -33,6 +33,10 @@ func (db *InMemDB) AppendEntries(entries [][]byte) (uint64, error) {
 	idx := db.newest + 1
 
 	for _, entry := range entries {
+		// A nil entry is stored as an empty one, as it would be on disk.
+		if entry == nil {
+			entry = []byte{}
+		}
 		db.newest++
 		db.entries[db.newest] = entry
 	}
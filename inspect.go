@@ -0,0 +1,103 @@
+package logdb
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// Inspect writes a human-readable description of the database at the given path to the writer: its version,
+// chunk size, oldest and next IDs, and a table of its chunks giving the file, range of IDs, number of entries,
+// and bytes used of each. The options are as for 'Open'.
+//
+// Like 'HealthCheck', this reads the files directly, changing nothing and without locking the database, so it
+// can be used on a database which another process has open. It is meant for investigating a damaged database,
+// so a file which can't be read is reported in the output rather than stopping the description, and the chunk
+// after a damaged one is described without checking that it follows on. The output is for people: its layout
+// may change.
+//
+// Returns a 'DatabasePathError' value if the path is not a database directory, and the error of the writer if
+// writing fails.
+func Inspect(path string, w io.Writer, opts ...Option) error {
+	o := applyOptions(opts)
+	fs := o.fs
+
+	if err := checkDatabasePath(fs, path); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "path:\t%s\n", path)
+
+	var version uint16
+	if err := readFile(fs, filepath.Join(path, "version"), &version); err != nil {
+		fmt.Fprintf(tw, "version:\terror: %v\n", err)
+	} else {
+		fmt.Fprintf(tw, "version:\t%v\n", version)
+	}
+
+	sizes, err := readChunkSizes(fs, path)
+	if err != nil {
+		fmt.Fprintf(tw, "chunk size:\terror: %v\n", err)
+	} else {
+		fmt.Fprintf(tw, "chunk size:\t%v\n", sizes[0])
+		if len(sizes) > 1 {
+			fmt.Fprintf(tw, "older chunk sizes:\t%v\n", sizes[1:])
+		}
+	}
+
+	if oldest, err := readOldestFile(fs, path); err != nil {
+		fmt.Fprintf(tw, "oldest:\terror: %v\n", err)
+	} else {
+		fmt.Fprintf(tw, "oldest:\t%v\n", oldest)
+	}
+
+	chunkFiles, err := findChunkFiles(fs, path, version, false)
+	if err != nil {
+		fmt.Fprintf(tw, "chunks:\terror: %v\n", err)
+		return tw.Flush()
+	}
+
+	var next uint64
+	var rows []string
+	var prior *chunk
+	for i, fi := range chunkFiles {
+		size := uint32(fi.Size())
+		if sizes != nil {
+			size = chunkSizeFor(fi.Size(), sizes)
+		}
+		trimmed := i == len(chunkFiles)-1
+		c, err := readChunkFile(fs, version, path, fi, prior, size, trimmed)
+		if err != nil {
+			rows = append(rows, fmt.Sprintf("%s\t%v\terror: %v\n", fi.Name(), c.oldest, err))
+			prior = nil
+			continue
+		}
+
+		var used int32
+		if len(c.ends) > 0 {
+			used = c.ends[len(c.ends)-1]
+		}
+		rows = append(rows, fmt.Sprintf("%s\t%v\t%v\t%v\t%v\t%v\n", fi.Name(), c.oldest, c.next(), len(c.ends), used, c.size))
+		next = c.next()
+		prior = &c
+	}
+	if len(chunkFiles) > 0 {
+		fmt.Fprintf(tw, "next:\t%v\n", next)
+	}
+
+	// The table has its own columns, so the header lines must be flushed first.
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "file\toldest\tnext\tentries\tused\tsize\n")
+	for _, row := range rows {
+		fmt.Fprint(tw, row)
+	}
+	return tw.Flush()
+}
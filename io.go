@@ -4,36 +4,73 @@ import (
 	"encoding/binary"
 	"errors"
 	"os"
-	"syscall"
+	"path/filepath"
 )
 
-// Create a new file with 0644 permissions and the given size, truncating it if it already exists.
-func createFile(path string, size uint32) error {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+// Create a new file with 0644 permissions and the given size, truncating it if it already exists. Disk space is
+// reserved for the whole file, so that writing to it later (in particular, through a memory mapping) can't fail
+// for lack of space.
+func createFile(fs FileSystem, path string, size uint32) error {
+	file, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	return syscall.Ftruncate(int(file.Fd()), int64(size))
+	if size == 0 {
+		return nil
+	}
+	return fs.Allocate(file, int64(size))
+}
+
+// Reserve disk space for the first 'size' bytes of a newly-created, empty, file by writing zeroes to it. This is
+// the fallback for platforms and filesystems without a way to allocate space directly.
+func writeZeroes(file File, size int64) error {
+	zeroes := make([]byte, 64*1024)
+	for size > 0 {
+		n := int64(len(zeroes))
+		if size < n {
+			n = size
+		}
+		if _, err := file.Write(zeroes[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
 }
 
 // Write the given value to the file using little-endian byte order. If the file doesn't exist, it is created.
 // If the file does exist, it is truncated. The contents of the file are synced to disk after the write.
-func writeFile(path string, data interface{}) error {
-	return openAndWriteFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, data)
+func writeFile(fs FileSystem, path string, data interface{}) error {
+	return openAndWriteFile(fs, path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, data)
+}
+
+// Replace a file with one holding the given value, written as by 'writeFile', so that after a crash the file
+// holds either the old or the new contents, and never a mix. The value is written to a temporary file in the
+// same directory, which is synced and then renamed over the file, and finally the directory is synced.
+func replaceFile(fs FileSystem, path, tmpName string, data interface{}) error {
+	dir := filepath.Dir(path)
+	tmpPath := filepath.Join(dir, tmpName)
+	if err := writeFile(fs, tmpPath, data); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return dirSync(fs, dir)
 }
 
 // Append the given value to the file using little-endian byte order. If the file doesn't exist, it is created.
 // The contents of the file are synced to disk after the write.
-func appendFile(path string, data interface{}) error {
-	return openAndWriteFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, data)
+func appendFile(fs FileSystem, path string, data interface{}) error {
+	return openAndWriteFile(fs, path, os.O_RDWR|os.O_CREATE|os.O_APPEND, data)
 }
 
 // Open a file with the given flags and write the given data to it in little-endian byte order. The contents of
 // the file are synced to disk after the write.
-func openAndWriteFile(path string, flags int, data interface{}) error {
-	file, err := os.OpenFile(path, flags, 0644)
+func openAndWriteFile(fs FileSystem, path string, flags int, data interface{}) error {
+	file, err := fs.OpenFile(path, flags, 0644)
 	if err != nil {
 		return err
 	}
@@ -46,9 +83,14 @@ func openAndWriteFile(path string, flags int, data interface{}) error {
 	return fsync(file)
 }
 
+// Synchronise writes to a file, including its metadata.
+func fsync(file File) error {
+	return file.Sync()
+}
+
 // Read data into the given pointer from the file using little-endian byte order.
-func readFile(path string, data interface{}) error {
-	file, err := os.Open(path)
+func readFile(fs FileSystem, path string, data interface{}) error {
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
@@ -58,8 +100,8 @@ func readFile(path string, data interface{}) error {
 }
 
 // Memory-map the given file.
-func mmap(path string) (*os.File, []byte, error) {
-	fi, err := os.Stat(path)
+func mmap(fs FileSystem, path string) (File, []byte, error) {
+	fi, err := fs.Stat(path)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -68,34 +110,49 @@ func mmap(path string) (*os.File, []byte, error) {
 		return nil, nil, errors.New("tried to mmap a directory")
 	}
 
-	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	f, err := fs.OpenFile(path, os.O_RDWR, 0644)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	bytes, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	bytes, err := fs.Mmap(f, int(fi.Size()))
 	return f, bytes, err
 }
 
-// Close and delete a file.
-func closeAndRemove(file *os.File) error {
-	if err := file.Close(); err != nil {
+// Unmap, close, and delete a file.
+func closeAndRemove(fs FileSystem, file File, bytes []byte) error {
+	if err := munmapAndClose(fs, file, bytes); err != nil {
 		return err
 	}
-	return os.Remove(file.Name())
+	return fs.Remove(file.Name())
+}
+
+// Unmap and close a file.
+func munmapAndClose(fs FileSystem, file File, bytes []byte) error {
+	if bytes != nil {
+		if err := fs.Munmap(bytes); err != nil {
+			return err
+		}
+	}
+	return file.Close()
 }
 
 // Open and lock a file.
-func flock(path string) (*os.File, error) {
-	f, err := os.Open(path)
+func flock(fs FileSystem, path string) (File, error) {
+	f, err := fs.OpenFile(path, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
-	return f, syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	return f, fs.Lock(f)
 }
 
 // Unlock and close a file.
-func funlock(file *os.File) error {
+func funlock(file File) error {
+	// A database opened with 'WithReadOnly' has no lock file.
+	if file == nil {
+		return nil
+	}
+
 	// No need to do a flock(LOCK_UN) call, as closing the fd also releases the lock.
 	return file.Close()
 }
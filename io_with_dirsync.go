@@ -0,0 +1,16 @@
+// +build !windows
+
+package logdb
+
+import "os"
+
+// Synchronise a directory, so that files created in it or removed from it stay that way after a crash.
+func dirSync(fs FileSystem, path string) error {
+	dir, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
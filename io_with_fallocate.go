@@ -0,0 +1,20 @@
+// +build linux
+
+package logdb
+
+import "syscall"
+
+// Reserve disk space for the first 'size' bytes of a newly-created, empty, file. If the filesystem doesn't
+// support 'fallocate', zeroes are written instead.
+func fallocate(file File, size int64) error {
+	fd, err := fileDescriptor(file)
+	if err != nil {
+		return writeZeroes(file, size)
+	}
+	switch err := syscall.Fallocate(fd, 0, 0, size); err {
+	case syscall.EOPNOTSUPP, syscall.ENOSYS:
+		return writeZeroes(file, size)
+	default:
+		return err
+	}
+}
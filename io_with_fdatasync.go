@@ -2,13 +2,14 @@
 
 package logdb
 
-import (
-	"os"
-	"syscall"
-)
+import "syscall"
 
-// Synchronise writes to a file descriptor.
-func fsync(file *os.File) error {
-	fd := int(file.Fd())
+// Synchronise the data written to a file descriptor, but not necessarily its metadata (such as the
+// modification time).
+func fdatasync(file File) error {
+	fd, err := fileDescriptor(file)
+	if err != nil {
+		return file.Sync()
+	}
 	return syscall.Fdatasync(fd)
 }
@@ -0,0 +1,17 @@
+// +build linux
+
+package logdb
+
+import "syscall"
+
+// Advise the operating system how a memory-mapped region is going to be read.
+func madvise(bytes []byte, pattern AccessPattern) error {
+	advice := syscall.MADV_NORMAL
+	switch pattern {
+	case AccessSequential:
+		advice = syscall.MADV_SEQUENTIAL
+	case AccessRandom:
+		advice = syscall.MADV_RANDOM
+	}
+	return syscall.Madvise(bytes, advice)
+}
@@ -0,0 +1,81 @@
+// +build linux
+
+package logdb
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Get the "VmFlags" line of /proc/self/smaps for the mapping starting at the given address.
+func vmFlags(t *testing.T, bytes []byte) []string {
+	file, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		t.Skip("no /proc/self/smaps")
+	}
+	defer file.Close()
+
+	start := fmt.Sprintf("%x-", uintptr(unsafe.Pointer(&bytes[0])))
+	found := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, start) {
+			found = true
+		} else if found && strings.HasPrefix(line, "VmFlags:") {
+			return strings.Fields(strings.TrimPrefix(line, "VmFlags:"))
+		}
+	}
+	t.Fatalf("no mapping found at %v", start)
+	return nil
+}
+
+// Check if a chunk is advised to be read sequentially.
+func isSequential(t *testing.T, c *chunk) bool {
+	for _, flag := range vmFlags(t, c.bytes) {
+		if flag == "sr" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIterator_AdvisesSequential(t *testing.T) {
+	db := assertOpenOptions(t, true, "iterator_advises_sequential", chunkSize)
+	defer assertClose(t, db)
+	filldb(t, db, numEntries)
+
+	// Only the chunk being read is advised to be read sequentially.
+	it, err := db.Iterator(db.chunks[1].oldest)
+	assert.Nil(t, err)
+	assert.True(t, it.Next())
+	assert.True(t, isSequential(t, db.chunks[1]))
+	assert.False(t, isSequential(t, db.chunks[0]))
+	assert.Nil(t, it.Seek(db.chunks[2].oldest))
+	assert.True(t, it.Next())
+	assert.False(t, isSequential(t, db.chunks[1]))
+	assert.True(t, isSequential(t, db.chunks[2]))
+
+	// Reaching the end of the log gives the final chunk the usual advice again.
+	for it.Next() {
+	}
+	assert.Nil(t, it.Err())
+	assert.False(t, isSequential(t, db.chunks[len(db.chunks)-1]))
+
+	// Scanning leaves no chunk advised to be read sequentially.
+	assert.Nil(t, db.Scan(func(id uint64, entry []byte) bool {
+		c, err := db.chunkFor(id)
+		assert.Nil(t, err)
+		assert.True(t, isSequential(t, c), "chunk of entry %v", id)
+		return id < 20
+	}))
+	for i, c := range db.chunks {
+		assert.False(t, isSequential(t, c), "chunk %v", i)
+	}
+}
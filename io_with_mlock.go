@@ -0,0 +1,15 @@
+// +build linux darwin
+
+package logdb
+
+import "syscall"
+
+// Lock a memory-mapped region into memory, so reading it never has to wait for the disk.
+func mlock(bytes []byte) error {
+	return syscall.Mlock(bytes)
+}
+
+// Unlock a memory-mapped region locked by 'mlock'.
+func munlock(bytes []byte) error {
+	return syscall.Munlock(bytes)
+}
@@ -0,0 +1,63 @@
+// +build linux,386 linux,amd64 linux,arm linux,arm64
+
+package logdb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The number of the RLIMIT_MEMLOCK resource, which the syscall package doesn't name. It differs on some other
+// architectures.
+const rlimitMemlock = 8
+
+func TestMlockNewest_OverLimit(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("the memory lock limit doesn't apply to root")
+	}
+
+	// Only lower the soft limit, so it can be put back.
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(rlimitMemlock, &limit); err != nil {
+		t.Fatal(err)
+	}
+	lowered := limit
+	lowered.Cur = 0
+	if err := syscall.Setrlimit(rlimitMemlock, &lowered); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = syscall.Setrlimit(rlimitMemlock, &limit) }()
+
+	var warnings int
+	logger := func(level, msg string, kv ...interface{}) {
+		if level == "warn" {
+			warnings++
+		}
+	}
+	obs := &recordingObserver{}
+	db := assertOpenOptions(t, true, "mlock_over_limit", chunkSize, WithMlockNewest(2), WithLogger(logger), WithObserver(obs))
+	defer assertClose(t, db)
+	vs := filldb(t, db, numEntries)
+
+	// Locking is given up on after the first failure, which the observer is told of, and reading still works.
+	assert.True(t, db.mlockFailed)
+	assert.Equal(t, 1, warnings)
+	var failures []string
+	for _, event := range obs.events {
+		if strings.HasPrefix(event, "mlock failed") {
+			failures = append(failures, event)
+		}
+	}
+	assert.Equal(t, []string{"mlock failed " + filepath.Base(db.chunks[0].path)}, failures)
+	for _, c := range db.chunks {
+		assert.False(t, c.locked)
+	}
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+}
@@ -0,0 +1,10 @@
+// +build windows
+
+package logdb
+
+// Synchronise a directory, so that files created in it or removed from it stay that way after a crash. This
+// platform can't sync directories, and its filesystems make directory changes durable themselves, so this does
+// nothing.
+func dirSync(fs FileSystem, path string) error {
+	return nil
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package logdb
+
+// Reserve disk space for the first 'size' bytes of a newly-created, empty, file. This platform has no
+// 'fallocate', so zeroes are written.
+func fallocate(file File, size int64) error {
+	return writeZeroes(file, size)
+}
@@ -2,9 +2,8 @@
 
 package logdb
 
-import "os"
-
-// Synchronise writes to a file descriptor.
-func fsync(file *os.File) error {
+// Synchronise the data written to a file descriptor, but not necessarily its metadata (such as the
+// modification time). This platform has no 'fdatasync', so the file is fully synchronised.
+func fdatasync(file File) error {
 	return file.Sync()
 }
@@ -0,0 +1,9 @@
+// +build !linux
+
+package logdb
+
+// Advise the operating system how a memory-mapped region is going to be read. This platform has no 'madvise',
+// so this does nothing.
+func madvise(bytes []byte, pattern AccessPattern) error {
+	return nil
+}
@@ -0,0 +1,15 @@
+// +build !linux,!darwin
+
+package logdb
+
+// Lock a memory-mapped region into memory. The syscall package has no 'mlock' for this platform, even where the
+// system has one, such as on the BSDs, so this does nothing.
+func mlock(bytes []byte) error {
+	return nil
+}
+
+// Unlock a memory-mapped region locked by 'mlock'. The syscall package has no 'mlock' for this platform, so this
+// does nothing.
+func munlock(bytes []byte) error {
+	return nil
+}
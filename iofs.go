@@ -0,0 +1,155 @@
+// +build go1.16
+
+package logdb
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// OpenFS opens a database read-only from the directory 'dir' of an 'fs.FS', such as an 'embed.FS' holding a
+// database built into the program. The chunk size is the one the database was created with, and any options are
+// applied after 'WithReadOnly' and the file backend, which memory-mapping an 'fs.FS' rules out: entries are read
+// with 'ReadAt' if the files have it, and otherwise each chunk data file is read into memory when it is opened.
+//
+// Every method which would change the database returns 'ErrReadOnly'. The database files aren't locked, so the
+// 'fs.FS' must not change while the database is open, and 'Refresh' only sees changes made to it before then.
+func OpenFS(fsys fs.FS, dir string, opts ...Option) (*LockFreeChunkDB, error) {
+	opts = append([]Option{WithReadOnly(), WithBackend(BackendFile), WithFileSystem(ioFS{fsys})}, opts...)
+	return Open(dir, 0, false, opts...)
+}
+
+// A 'FileSystem' which reads from an 'fs.FS'. Anything which would change it fails with 'ErrReadOnly'.
+type ioFS struct {
+	fsys fs.FS
+}
+
+// Convert a path, which may use the separator of the platform, to one valid for an 'fs.FS'.
+func (ifs ioFS) name(name string) string {
+	name = path.Clean(filepath.ToSlash(name))
+	return strings.TrimPrefix(name, "/")
+}
+
+// OpenFile implements the 'FileSystem' interface.
+func (ifs ioFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrReadOnly}
+	}
+	f, err := ifs.fsys.Open(ifs.name(name))
+	if err != nil {
+		return nil, err
+	}
+
+	// The file backend needs to read at an offset.
+	if r, ok := f.(io.ReaderAt); ok {
+		return &ioFSFile{File: f, name: name, readerAt: r}, nil
+	}
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &ioFSFile{File: f, name: name, readerAt: bytes.NewReader(bs)}, nil
+}
+
+// Stat implements the 'FileSystem' interface.
+func (ifs ioFS) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(ifs.fsys, ifs.name(name))
+}
+
+// ReadDir implements the 'FileSystem' interface.
+func (ifs ioFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(ifs.fsys, ifs.name(dirname))
+	if err != nil {
+		return nil, err
+	}
+	fis := make([]os.FileInfo, len(entries))
+	for i, entry := range entries {
+		if fis[i], err = entry.Info(); err != nil {
+			return nil, err
+		}
+	}
+	return fis, nil
+}
+
+// Remove implements the 'FileSystem' interface.
+func (ifs ioFS) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: ErrReadOnly}
+}
+
+// MkdirAll implements the 'FileSystem' interface.
+func (ifs ioFS) MkdirAll(path string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: path, Err: ErrReadOnly}
+}
+
+// Rename implements the 'FileSystem' interface.
+func (ifs ioFS) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrReadOnly}
+}
+
+// Allocate implements the 'FileSystem' interface.
+func (ifs ioFS) Allocate(file File, size int64) error {
+	return ErrReadOnly
+}
+
+// Mmap implements the 'FileSystem' interface.
+func (ifs ioFS) Mmap(file File, size int) ([]byte, error) {
+	return nil, ErrReadOnly
+}
+
+// Munmap implements the 'FileSystem' interface.
+func (ifs ioFS) Munmap(bytes []byte) error {
+	return ErrReadOnly
+}
+
+// Msync implements the 'FileSystem' interface.
+func (ifs ioFS) Msync(bytes []byte) error {
+	return ErrReadOnly
+}
+
+// Lock implements the 'FileSystem' interface.
+func (ifs ioFS) Lock(file File) error {
+	return ErrReadOnly
+}
+
+// A 'File' of an 'ioFS'. The file backend needs 'ReadAt' and 'WriteAt', but only the first works.
+type ioFSFile struct {
+	fs.File
+	name     string
+	readerAt io.ReaderAt
+}
+
+// Name implements the 'File' interface.
+func (f *ioFSFile) Name() string {
+	return f.name
+}
+
+// ReadAt implements 'io.ReaderAt', for the file backend.
+func (f *ioFSFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.readerAt.ReadAt(p, off)
+}
+
+// Write implements the 'File' interface.
+func (f *ioFSFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrReadOnly}
+}
+
+// WriteAt implements 'io.WriterAt', for the file backend.
+func (f *ioFSFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrReadOnly}
+}
+
+// Sync implements the 'File' interface.
+func (f *ioFSFile) Sync() error {
+	return nil
+}
+
+// Truncate implements the 'File' interface.
+func (f *ioFSFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: ErrReadOnly}
+}
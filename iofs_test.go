@@ -0,0 +1,52 @@
+// +build go1.16
+
+package logdb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenFS(t *testing.T) {
+	db := assertOpenOptions(t, true, "open_fs", chunkSize)
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 10)
+	assert.Nil(t, db.Delete(20))
+	assertClose(t, db)
+
+	// Copy the database into an in-memory 'fs.FS'.
+	fis, err := ioutil.ReadDir("test_db/open_fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{}
+	for _, fi := range fis {
+		fsys["embedded/db/"+fi.Name()] = &fstest.MapFile{Data: readTestFile(t, filepath.Join("test_db/open_fs", fi.Name()))}
+	}
+
+	fsdb, err := OpenFS(fsys, "embedded/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer assertClose(t, fsdb)
+
+	assert.Equal(t, uint64(10), fsdb.OldestID())
+	assert.Equal(t, uint64(numEntries), fsdb.NewestID())
+	for id := uint64(10); id <= numEntries; id++ {
+		if id == 20 {
+			_, err := fsdb.Get(id)
+			assert.Equal(t, ErrDeleted, err)
+			continue
+		}
+		assert.Equal(t, vs[id-1], assertGet(t, fsdb, id))
+	}
+
+	_, err = fsdb.Append([]byte("hello"))
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, ErrReadOnly, fsdb.Forget(20))
+	assert.Equal(t, ErrReadOnly, fsdb.Rollback(20))
+}
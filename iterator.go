@@ -0,0 +1,305 @@
+package logdb
+
+import "sync"
+
+// An Iterator steps through the entries of a database in ID order. Each step fetches a single entry, so the
+// database can be changed between steps: entries appended while iterating are reached in turn, but if the next
+// entry is forgotten or rolled back then iteration stops with 'ErrIDOutOfRange'. Deleted entries are skipped.
+//
+// The chunk being read is advised to be read sequentially (see 'Advise'), and given the access pattern of the
+// database again once the iterator moves on from it, or reaches the end of the log.
+//
+// An Iterator is not safe for concurrent use.
+type Iterator struct {
+	db   *LockFreeChunkDB
+	lock sync.Locker
+
+	// The ID of the entry which the next call to 'Next' will fetch.
+	next uint64
+
+	// The chunk advised to be read sequentially, if any.
+	chunk *chunk
+
+	// The current entry, and the error which stopped iteration, if any.
+	id    uint64
+	entry []byte
+	err   error
+}
+
+// Iterator returns an iterator starting from the given ID. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) Iterator(fromID uint64) (*Iterator, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	it, err := db.LockFreeChunkDB.Iterator(fromID)
+	if err != nil {
+		return nil, err
+	}
+	it.lock = db.rwlock.RLocker()
+	return it, nil
+}
+
+// Iterator returns an iterator starting from the given ID, which must be in the log or be the next ID to be
+// appended. As with the other 'LockFreeChunkDB' methods, the caller must ensure the database is not modified
+// during a call to 'Next' or 'Seek'.
+//
+// Returns 'ErrIDOutOfRange' if the ID is not in range.
+func (db *LockFreeChunkDB) Iterator(fromID uint64) (*Iterator, error) {
+	it := &Iterator{db: db, lock: noLock{}}
+	if err := it.seek(fromID); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// Next advances to the next entry, returning true if there is one. If it returns false then either the end of
+// the log has been reached, in which case 'Err' is nil and 'Next' may be called again once more entries have
+// been appended, or an error occurred, which 'Err' returns.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.lock.Lock()
+	defer it.lock.Unlock()
+
+	// Deleted entries are skipped.
+	for it.next < it.db.next() && it.db.isDeleted(it.next) {
+		it.next++
+	}
+	if it.next == it.db.next() && !it.db.closed {
+		it.adviseChunk(nil)
+		return false
+	}
+	if c, err := it.db.chunkFor(it.next); err == nil {
+		it.adviseChunk(c)
+	}
+	entry, err := it.db.Get(it.next)
+	if err != nil {
+		it.adviseChunk(nil)
+		it.err = err
+		return false
+	}
+	it.id, it.entry = it.next, entry
+	it.next++
+	return true
+}
+
+// ID returns the ID of the current entry.
+func (it *Iterator) ID() uint64 {
+	return it.id
+}
+
+// Entry returns the current entry. This is a copy, so it remains valid after the iterator moves on.
+func (it *Iterator) Entry() []byte {
+	return it.entry
+}
+
+// Err returns the error which stopped iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Seek moves the iterator so that the next call to 'Next' fetches the given ID, which must be in the log or be
+// the next ID to be appended. This is useful for resuming from a checkpoint. Seeking clears any error which
+// stopped iteration.
+//
+// Returns 'ErrIDOutOfRange' if the ID is not in range, in which case the iterator is unchanged.
+func (it *Iterator) Seek(id uint64) error {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+
+	if err := it.seek(id); err != nil {
+		return err
+	}
+	it.err = nil
+	return nil
+}
+
+// Advise that a chunk is going to be read sequentially, and give the chunk which was before it the access pattern
+// of the database again. If the chunk is nil, only the second is done. Assumes a lock (read or write) is held.
+func (it *Iterator) adviseChunk(c *chunk) {
+	if c == it.chunk {
+		return
+	}
+	if it.chunk != nil {
+		it.db.adviseChunk(it.chunk, it.db.accessPattern)
+	}
+	if c != nil {
+		it.db.adviseChunk(c, AccessSequential)
+	}
+	it.chunk = c
+}
+
+// Check that an ID can be seeked to and set it as the next to fetch. Assumes a lock (read or write) is held.
+func (it *Iterator) seek(id uint64) error {
+	if it.db.closed {
+		return ErrClosed
+	}
+	if id != it.db.next() {
+		if _, err := it.db.chunkFor(id); err != nil {
+			return err
+		}
+	}
+	it.next = id
+	return nil
+}
+
+// Scan calls the function with every entry in the log, in ID order, until it returns false. See the
+// 'LockFreeChunkDB' method for details.
+//
+// The read lock is held for the whole scan, so the function must not modify the database.
+func (db *ChunkDB) Scan(match func(id uint64, entry []byte) bool) error {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.Scan(match)
+}
+
+// Scan calls the function with every entry in the log, in ID order, until it returns false. This is a cheap
+// way to search the log: entries are passed straight from the chunk files, with no copying. Deleted entries are
+// skipped.
+//
+// The entry slice is only valid until the function returns, and must not be modified. Copy it to keep it.
+func (db *LockFreeChunkDB) Scan(match func(id uint64, entry []byte) bool) error {
+	if db.closed {
+		return ErrClosed
+	}
+
+	for _, c := range db.chunks {
+		if stop, err := db.scanChunk(c, db.skipDeleted(match)); err != nil || stop {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParallelScan calls the function with every entry in the log, spreading the chunks over the given number of
+// goroutines. See the 'LockFreeChunkDB' method for details.
+//
+// The read lock is held for the whole scan, so the function must not modify the database.
+func (db *ChunkDB) ParallelScan(workers int, f func(id uint64, entry []byte)) error {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.ParallelScan(workers, f)
+}
+
+// ParallelScan calls the function with every entry in the log, spreading the chunks over the given number of
+// goroutines. Each chunk is scanned by a single goroutine, in ID order, but entries from different chunks are
+// visited concurrently and in no particular order, so the function must be safe to call concurrently.
+//
+// As with 'Scan', the entry slice is only valid until the function returns, and must not be modified. If the
+// number of memory-mapped chunks is limited, then chunks are scanned one at a time.
+func (db *LockFreeChunkDB) ParallelScan(workers int, f func(id uint64, entry []byte)) error {
+	if db.closed {
+		return ErrClosed
+	}
+
+	match := func(id uint64, entry []byte) bool {
+		f(id, entry)
+		return true
+	}
+
+	if workers > len(db.chunks) {
+		workers = len(db.chunks)
+	}
+	if workers <= 1 {
+		return db.Scan(match)
+	}
+
+	work := make(chan *chunk)
+	errs := make(chan error, len(db.chunks))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				_, err := db.scanChunk(c, db.skipDeleted(match))
+				errs <- err
+			}
+		}()
+	}
+	for _, c := range db.chunks {
+		work <- c
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Call a function with each entry of a chunk which hasn't been forgotten, until it returns false, and report
+// whether it did. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) scanChunk(c *chunk, match func(id uint64, entry []byte) bool) (bool, error) {
+	stop := false
+	err := db.withChunkBytes(c, func(bytes []byte) error {
+		defer db.adviseSequential(bytes)()
+		for id := c.oldest; id < c.next(); id++ {
+			if id < db.oldest {
+				continue
+			}
+			start, end := c.entryRange(id - c.oldest)
+			if !match(id, bytes[start:end:end]) {
+				stop = true
+				break
+			}
+		}
+		return nil
+	})
+	return stop, err
+}
+
+// Wrap a function given to 'scanChunk' so that it isn't called with deleted entries. Assumes a lock (read or
+// write) is held.
+func (db *LockFreeChunkDB) skipDeleted(match func(id uint64, entry []byte) bool) func(id uint64, entry []byte) bool {
+	if len(db.tombstones) == 0 {
+		return match
+	}
+	return func(id uint64, entry []byte) bool {
+		return db.isDeleted(id) || match(id, entry)
+	}
+}
+
+// Fold threads an accumulator through every entry in the log, in ID order, and returns the final value. See the
+// 'LockFreeChunkDB' method for details.
+//
+// The read lock is held for the whole fold, so the function must not modify the database.
+func (db *ChunkDB) Fold(initial interface{}, f func(acc interface{}, id uint64, entry []byte) interface{}) (interface{}, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.Fold(initial, f)
+}
+
+// Fold threads an accumulator through every entry in the log, in ID order, and returns the final value. The
+// function is given the accumulator so far and an entry, and returns the new accumulator.
+//
+// As with 'Scan', the entry slice is only valid until the function returns, and must not be modified.
+//
+// Returns the initial value and 'ErrClosed' if the database is closed.
+func (db *LockFreeChunkDB) Fold(initial interface{}, f func(acc interface{}, id uint64, entry []byte) interface{}) (interface{}, error) {
+	acc := initial
+	err := db.Scan(func(id uint64, entry []byte) bool {
+		acc = f(acc, id, entry)
+		return true
+	})
+	if err != nil {
+		return initial, err
+	}
+	return acc, nil
+}
+
+// A 'sync.Locker' which does nothing, for iterators over a 'LockFreeChunkDB'.
+type noLock struct{}
+
+func (noLock) Lock()   {}
+func (noLock) Unlock() {}
@@ -0,0 +1,151 @@
+package logdb
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterator_Seek(t *testing.T) {
+	db := assertOpenOptions(t, true, "iterator_seek", chunkSize)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+
+	it, err := db.Iterator(db.OldestID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seek forwards, and then backwards, reading a few entries from each position.
+	for _, id := range []uint64{150, 30, uint64(numEntries) - 2} {
+		assert.Nil(t, it.Seek(id), "seek %v", id)
+		for i := uint64(0); i < 3; i++ {
+			assert.True(t, it.Next(), "expected entry %v", id+i)
+			assert.Equal(t, id+i, it.ID())
+			assert.Equal(t, vs[id+i-1], it.Entry())
+		}
+	}
+
+	// The end of the log has been reached, but newly appended entries are picked up.
+	assert.False(t, it.Next(), "expected end of log")
+	assert.Nil(t, it.Err())
+	assertAppend(t, db, []byte("hello"))
+	assert.True(t, it.Next(), "expected appended entry")
+	assert.Equal(t, []byte("hello"), it.Entry())
+
+	// Seeking out of range leaves the iterator where it was.
+	assert.Nil(t, it.Seek(100))
+	for _, id := range []uint64{10, db.NewestID() + 2} {
+		assert.Equal(t, ErrIDOutOfRange, it.Seek(id), "seek %v", id)
+	}
+	assert.True(t, it.Next())
+	assert.Equal(t, uint64(100), it.ID())
+}
+
+func TestIterator_Forgotten(t *testing.T) {
+	db := assertOpenOptions(t, true, "iterator_forgotten", chunkSize)
+	defer assertClose(t, db)
+
+	filldb(t, db, numEntries)
+
+	it, err := db.Iterator(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertForget(t, db, 20)
+
+	assert.False(t, it.Next(), "expected forgotten entry to stop iteration")
+	assert.Equal(t, ErrIDOutOfRange, it.Err())
+
+	// Seeking past the forgotten entries carries on.
+	assert.Nil(t, it.Seek(db.OldestID()))
+	assert.True(t, it.Next())
+	assert.Equal(t, uint64(20), it.ID())
+}
+
+func TestIterator_Scan(t *testing.T) {
+	db := assertOpenOptions(t, true, "iterator_scan", chunkSize)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+
+	// Count the entries with a "7" in them.
+	var expected []uint64
+	for id := uint64(20); id <= uint64(len(vs)); id++ {
+		if bytes.Contains(vs[id-1], []byte("7")) {
+			expected = append(expected, id)
+		}
+	}
+	var matched []uint64
+	err := db.Scan(func(id uint64, entry []byte) bool {
+		assert.Equal(t, vs[id-1], entry, "entry %v", id)
+		if bytes.Contains(entry, []byte("7")) {
+			matched = append(matched, id)
+		}
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, matched)
+
+	// Returning false stops the scan.
+	var seen int
+	err = db.Scan(func(id uint64, entry []byte) bool {
+		seen++
+		return seen < 5
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, seen, "expected scan to stop")
+}
+
+func TestIterator_Fold(t *testing.T) {
+	db := assertOpenOptions(t, true, "iterator_fold", chunkSize)
+
+	filldb(t, db, numEntries)
+
+	total, err := db.Fold(0, func(acc interface{}, id uint64, entry []byte) interface{} {
+		return acc.(int) + len(entry)
+	})
+	assert.Nil(t, err)
+
+	// With nothing forgotten, the chunks hold exactly the entries.
+	var used int
+	for _, c := range db.Chunks() {
+		used += int(c.UsedBytes)
+	}
+	assert.Equal(t, used, total)
+
+	assertClose(t, db)
+	total, err = db.Fold(0, func(acc interface{}, id uint64, entry []byte) interface{} {
+		return acc.(int) + len(entry)
+	})
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, 0, total)
+}
+
+func TestIterator_ParallelScan(t *testing.T) {
+	db := assertOpenOptions(t, true, "iterator_parallel_scan", chunkSize)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+
+	var lock sync.Mutex
+	seen := make(map[uint64]int)
+	err := db.ParallelScan(4, func(id uint64, entry []byte) {
+		assert.Equal(t, vs[id-1], entry, "entry %v", id)
+		lock.Lock()
+		defer lock.Unlock()
+		seen[id]++
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(vs)-19, len(seen), "expected every entry to be visited")
+	for id := uint64(20); id <= uint64(len(vs)); id++ {
+		assert.Equal(t, 1, seen[id], "expected entry %v to be visited once", id)
+	}
+}
@@ -17,7 +17,8 @@ package logdb
 
 // A LogDB is a log-structured database.
 type LogDB interface {
-	// Append writes a new entry to the log and returns its ID.
+	// Append writes a new entry to the log and returns its ID. An entry may be empty. A nil entry is the same
+	// as an empty one: either is read back as an empty, non-nil, slice.
 	//
 	// Returns 'WriteError' value if the database files could not be written to.
 	Append(entry []byte) (uint64, error)
@@ -82,8 +83,13 @@ type PersistDB interface {
 	// SetSync configures the database to synchronise the data after touching (appending, forgetting,
 	// or rolling back) at most this many entries.
 	//
-	// <0 disables periodic syncing, and 'Sync' must be called instead. The default value is 256.
-	// Both 0 and 1 cause a 'Sync' after every write.
+	//  - <0 disables periodic syncing, and 'Sync' must be called instead.
+	//  - 0 and 1 both cause a 'Sync' after every write, so that each 'Append' is durable once it returns.
+	//  - N>1 causes a 'Sync' as soon as N entries have been touched since the last one, so no more than N
+	//    entries are ever left unsynced. Earlier versions waited for N+1 entries, so this syncs slightly more
+	//    often than it used to, including with the default.
+	//
+	// The default value is 256.
 	//
 	// Returns a 'SyncError' value if this triggered an immediate synchronisation which failed, and
 	// 'ErrClosed' if the handle is closed.
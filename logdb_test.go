@@ -2,6 +2,7 @@ package logdb
 
 import (
 	"fmt"
+	"math/rand"
 	"os"
 	"testing"
 
@@ -15,9 +16,13 @@ const (
 )
 
 var dbTypes = map[string]LogDB{
-	"chunkdb":           &ChunkDB{},
-	"lock free chunkdb": &LockFreeChunkDB{},
-	"inmem":             &InMemDB{},
+	"chunkdb":              &ChunkDB{},
+	"lock free chunkdb":    &LockFreeChunkDB{},
+	"file backend chunkdb": &ChunkDB{LockFreeChunkDB: &LockFreeChunkDB{options: options{backend: BackendFile}}},
+	"framed chunkdb":       &ChunkDB{LockFreeChunkDB: &LockFreeChunkDB{options: options{framing: true}}},
+	"aligned chunkdb":      &ChunkDB{LockFreeChunkDB: &LockFreeChunkDB{options: options{alignment: 8}}},
+	"cached chunkdb":       &ChunkDB{LockFreeChunkDB: &LockFreeChunkDB{options: options{readCacheEntries: 16}}},
+	"inmem":                &InMemDB{},
 }
 
 /* ***** OldestID / NewestID */
@@ -93,6 +98,39 @@ func TestLogDB_AppendEntries(t *testing.T) {
 	}
 }
 
+func TestLogDB_AppendEmpty(t *testing.T) {
+	for dbName, dbType := range dbTypes {
+		t.Logf("Database: %s\n", dbName)
+		func() {
+			db := assertOpen(t, dbType, true, "append_empty", chunkSize)
+
+			assertAppend(t, db, nil)
+			assertAppend(t, db, []byte{})
+			assertAppend(t, db, []byte("entry"))
+			assertAppendEntries(t, db, [][]byte{nil, {}})
+
+			// A nil entry is the same as an empty one, and neither is read back as nil.
+			assertEmpty := func(db LogDB) {
+				for _, id := range []uint64{1, 2, 4, 5} {
+					bs := assertGet(t, db, id)
+					assert.NotNil(t, bs, "entry %v", id)
+					assert.Equal(t, 0, len(bs), "entry %v", id)
+				}
+				assert.Equal(t, []byte("entry"), assertGet(t, db, 3))
+			}
+			assertEmpty(db)
+			assertClose(t, db)
+
+			if _, ok := dbType.(PersistDB); !ok {
+				return
+			}
+			db = assertOpen(t, dbType, false, "append_empty", chunkSize)
+			defer assertClose(t, db)
+			assertEmpty(db)
+		}()
+	}
+}
+
 func TestLogDB_NoAppendTooBig(t *testing.T) {
 	for dbName, dbType := range dbTypes {
 		// This test only makes sense for BoundedDBs
@@ -111,6 +149,67 @@ func TestLogDB_NoAppendTooBig(t *testing.T) {
 	}
 }
 
+func TestLogDB_AppendEntriesTooBigIndex(t *testing.T) {
+	for dbName, dbType := range dbTypes {
+		// This test only makes sense for BoundedDBs
+		if _, ok := dbType.(BoundedDB); !ok {
+			continue
+		}
+
+		t.Logf("Database: %s\n", dbName)
+		func() {
+			db := assertOpen(t, dbType, true, "append_entries_too_big_index", chunkSize)
+			defer assertClose(t, db)
+			assertAppend(t, db, []byte("hello"))
+
+			vs := make([][]byte, 100)
+			for i := range vs {
+				vs[i] = []byte(fmt.Sprintf("entry-%v", i))
+			}
+			vs[37] = make([]byte, chunkSize+1)
+
+			_, err := db.AppendEntries(vs)
+			assert.Equal(t, &BatchAppendError{Index: 37, Count: 100, Size: chunkSize + 1, Err: ErrTooBig}, err)
+			assert.Equal(t, "error appending entry 37 of 100 (114 bytes): entry larger than chunksize", err.Error())
+			assert.Equal(t, uint64(1), db.NewestID(), "expected batch to be rolled back")
+		}()
+	}
+}
+
+func TestLogDB_AppendChunkSizeBoundary(t *testing.T) {
+	for dbName, dbType := range dbTypes {
+		// This test only makes sense for BoundedDBs
+		if _, ok := dbType.(BoundedDB); !ok {
+			continue
+		}
+
+		t.Logf("Database: %s\n", dbName)
+		func() {
+			db := assertOpen(t, dbType, true, "append_chunk_size_boundary", chunkSize)
+			defer assertClose(t, db)
+
+			// The largest entry is the chunk size, less any framing.
+			max := int(db.(BoundedDB).MaxEntrySize())
+
+			// Entries which fit, both into an empty chunk and after one which is partly full.
+			var vs [][]byte
+			for _, size := range []int{max - 1, max, 1, max, max - 1} {
+				v := make([]byte, size)
+				v[0] = byte(len(vs))
+				vs = append(vs, v)
+				assert.Equal(t, uint64(len(vs)), assertAppend(t, db, v), "entry of size %v", size)
+			}
+
+			_, err := db.Append(make([]byte, max+1))
+			assert.Equal(t, ErrTooBig, err, "expected Append of maximum size + 1 to fail")
+
+			for i, v := range vs {
+				assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+			}
+		}()
+	}
+}
+
 /* ***** Get */
 
 func TestLogDB_NoGetOutOfRange(t *testing.T) {
@@ -421,6 +520,124 @@ func TestLogDB_Truncate_NoNewLessOld(t *testing.T) {
 	}
 }
 
+/* ***** CopyTo */
+
+func TestLogDB_CopyTo(t *testing.T) {
+	for dbName, dbType := range dbTypes {
+		t.Logf("Database: %s\n", dbName)
+		func() {
+			src := assertOpen(t, dbType, true, "copy_to_src", chunkSize)
+			defer assertClose(t, src)
+			dst := assertOpen(t, dbType, true, "copy_to_dst", chunkSize)
+			defer assertClose(t, dst)
+
+			vs := filldb(t, src, numEntries)
+			assertForget(t, src, 20)
+			ds := filldb(t, dst, 10)
+
+			copied, err := CopyTo(dst, src)
+			assert.Nil(t, err)
+			assert.Equal(t, uint64(len(vs)-19), copied)
+
+			// The copied entries carry on from the existing ones, in order.
+			assert.Equal(t, firstID, dst.OldestID())
+			assert.Equal(t, uint64(len(ds))+copied, dst.NewestID())
+			for i, v := range append(ds, vs[19:]...) {
+				assert.Equal(t, v, assertGet(t, dst, uint64(i+1)), "entry %v", i+1)
+			}
+		}()
+	}
+}
+
+func TestLogDB_CopyToRollsBack(t *testing.T) {
+	for dbName, dbType := range dbTypes {
+		if _, ok := dbType.(*InMemDB); ok {
+			continue
+		}
+		t.Logf("Database: %s\n", dbName)
+		func() {
+			dst := assertOpen(t, dbType, true, "copy_to_rolls_back", chunkSize)
+			defer assertClose(t, dst)
+			ds := filldb(t, dst, 10)
+
+			// An entry near the end is too big for the destination, so is only found after several batches. The
+			// error says which entry of the whole copy it was.
+			src := new(InMemDB)
+			filldb(t, src, 3*copyBatchEntries)
+			assertAppend(t, src, make([]byte, chunkSize+1))
+			assertAppend(t, src, []byte("hello"))
+
+			copied, err := CopyTo(dst, src)
+			assert.Equal(t, &BatchAppendError{Index: 3 * copyBatchEntries, Count: 3*copyBatchEntries + 2, Size: chunkSize + 1, Err: ErrTooBig}, err)
+			assert.Equal(t, uint64(0), copied)
+			assert.Equal(t, uint64(len(ds)), dst.NewestID(), "expected copy to be rolled back")
+			assertAppend(t, dst, []byte("hello"))
+			assert.Equal(t, []byte("hello"), assertGet(t, dst, uint64(len(ds)+1)))
+		}()
+	}
+}
+
+/* ***** Random histories */
+
+func TestLogDB_RandomHistory(t *testing.T) {
+	for dbName, dbType := range dbTypes {
+		t.Logf("Database: %s\n", dbName)
+		func() {
+			db := assertOpen(t, dbType, true, "random_history", 64)
+			defer assertClose(t, db)
+
+			rand := rand.New(rand.NewSource(42))
+
+			// The model: 'vs[i]' is the entry with ID 'i+1', and entries before 'oldest' are forgotten.
+			var vs [][]byte
+			oldest := uint64(1)
+
+			for step := 0; step < 500; step++ {
+				newest := uint64(len(vs))
+				live := newest + 1 - oldest
+
+				switch op := rand.Intn(4); {
+				case op == 0 || live < 2:
+					entries := make([][]byte, 1+rand.Intn(8))
+					for i := range entries {
+						entries[i] = make([]byte, rand.Intn(64))
+						rand.Read(entries[i])
+					}
+					assertAppendEntries(t, db, entries)
+					vs = append(vs, entries...)
+				case op == 1:
+					oldest += uint64(rand.Int63n(int64(live)))
+					assertForget(t, db, oldest)
+				case op == 2:
+					vs = vs[:oldest-1+uint64(rand.Int63n(int64(live)))+1]
+					assertRollback(t, db, uint64(len(vs)))
+				default:
+					newOldest := oldest + uint64(rand.Int63n(int64(live)))
+					newNewest := newOldest + uint64(rand.Int63n(int64(newest-newOldest+1)))
+					oldest = newOldest
+					vs = vs[:newNewest]
+					assertTruncate(t, db, newOldest, newNewest)
+				}
+
+				newest = uint64(len(vs))
+				assert.Equal(t, oldest, db.OldestID(), "oldest ID at step %v", step)
+				assert.Equal(t, newest, db.NewestID(), "newest ID at step %v", step)
+
+				for id := oldest; id <= newest; id++ {
+					assert.Equal(t, vs[id-1], assertGet(t, db, id), "entry %v at step %v", id, step)
+				}
+				for _, id := range []uint64{0, oldest - 1, newest + 1, newest + 2} {
+					if id >= oldest && id <= newest {
+						continue
+					}
+					_, err := db.Get(id)
+					assert.Equal(t, ErrIDOutOfRange, err, "entry %v at step %v", id, step)
+				}
+			}
+		}()
+	}
+}
+
 /* ***** Persistence */
 
 func TestLogDB_Persist_Works(t *testing.T) {
@@ -619,7 +836,29 @@ func assertOpen(t *testing.T, dbType LogDB, create bool, testName string, cSize
 	if create {
 		_ = os.RemoveAll(testDir)
 	}
-	lfdb, err := Open(testDir, cSize, create)
+	// The chunk backend, framing, alignment, and read cache are taken from the template database, if it has
+	// options.
+	var o options
+	switch d := dbType.(type) {
+	case *ChunkDB:
+		if d.LockFreeChunkDB != nil {
+			o = d.options
+		}
+	case *LockFreeChunkDB:
+		o = d.options
+	}
+	opts := []Option{WithBackend(o.backend)}
+	if o.framing {
+		opts = append(opts, WithFraming())
+	}
+	if o.alignment > 0 {
+		opts = append(opts, WithAlignment(o.alignment))
+	}
+	if o.readCacheEntries > 0 {
+		opts = append(opts, WithReadCache(o.readCacheEntries))
+	}
+
+	lfdb, err := Open(testDir, cSize, create, opts...)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,183 @@
+package logdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The "digests" file holds the checksums 'Manifest' has remembered, so they needn't be computed again after the
+// database is opened. It is replaced through this temporary file.
+const (
+	digestsFile    = "digests"
+	digestsTmpFile = digestsFile + sep + "new"
+)
+
+// A checksum in the "digests" file, with the extent of the chunk it is of. It only applies to a chunk which still
+// has the same extent.
+type digestRecord struct {
+	Oldest uint64
+	Next   uint64
+	End    int32
+	Digest [sha256.Size]byte
+}
+
+// A ChunkDigest describes one chunk of a database, in the list returned by 'Manifest'.
+type ChunkDigest struct {
+	// The path of the chunk data file.
+	Path string
+
+	// The ID of the first entry in the chunk, and one past the last. The chunk may hold entries before the oldest
+	// ID, which have been forgotten but not yet removed.
+	Oldest uint64
+	Next   uint64
+
+	// A SHA-256 checksum of the chunk data file, up to the end of the final entry.
+	Digest []byte
+}
+
+// Manifest lists the chunks with a checksum of each, atomically. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) Manifest() ([]ChunkDigest, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.Manifest()
+}
+
+// Manifest lists the chunks, oldest first, with a checksum of the data file of each, so that a tool keeping a copy
+// of the database up to date, like rsync, can compare the lists and copy only the chunks which differ. Entries
+// which haven't been synced are included, and so is the padding and framing between entries, but not the unused
+// space at the end of the final chunk.
+//
+// Only the final chunk is appended to, so the checksum of any other chunk is remembered once it has been synced,
+// and a manifest of a large database costs little more than checksumming its final chunk. A chunk which entries
+// are rolled back from, or which is compacted, is checksummed afresh. The remembered checksums are written to the
+// "digests" file, unless the database is read-only, so they survive the database being closed and opened again.
+//
+// Returns a 'ReadError' value if a chunk can't be read, and a 'WriteError' value if the "digests" file can't be
+// written.
+func (db *LockFreeChunkDB) Manifest() ([]ChunkDigest, error) {
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	// Syncing can happen under a read lock, and changes which chunks are dirty. Readers of a 'ChunkDB' also
+	// share the lock, so remembering a checksum needs a lock of its own.
+	db.slock.Lock()
+	defer db.slock.Unlock()
+	db.digestLock.Lock()
+	defer db.digestLock.Unlock()
+
+	manifest := make([]ChunkDigest, len(db.chunks))
+	remembered := false
+	for i, c := range db.chunks {
+		digest := c.digest
+		if digest == nil {
+			var err error
+			if digest, err = db.chunkDigest(c); err != nil {
+				return nil, err
+			}
+			if _, dirty := db.syncDirty[c]; !dirty && i < len(db.chunks)-1 {
+				c.digest = digest
+				remembered = true
+			}
+		}
+		manifest[i] = ChunkDigest{Path: c.path, Oldest: c.oldest, Next: c.next(), Digest: digest}
+	}
+	if remembered && !db.readOnly {
+		if err := db.writeDigests(); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// Compute the checksum of a chunk for 'Manifest'. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) chunkDigest(c *chunk) ([]byte, error) {
+	var sum [sha256.Size]byte
+	err := db.withChunkBytes(c, func(bytes []byte) error {
+		var end int32
+		if len(c.ends) > 0 {
+			end = c.ends[len(c.ends)-1]
+		}
+		sum = sha256.Sum256(bytes[:end])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sum[:], nil
+}
+
+// Forget the remembered checksums of the chunks holding entries from the given ID onwards, and rewrite the
+// "digests" file if there were any. This must be done before the bytes of the chunks change, so the file never
+// has a checksum which doesn't match. Assumes a write lock is held.
+func (db *LockFreeChunkDB) dropDigestsFrom(id uint64) error {
+	dropped := false
+	for _, c := range db.chunks {
+		if c.digest != nil && c.next() > id {
+			c.digest = nil
+			dropped = true
+		}
+	}
+	if !dropped {
+		return nil
+	}
+	return db.writeDigests()
+}
+
+// Replace the "digests" file with the remembered checksums. Assumes a write lock, or 'digestLock', is held.
+func (db *LockFreeChunkDB) writeDigests() error {
+	records := make([]digestRecord, 0, len(db.chunks))
+	for _, c := range db.chunks {
+		if c.digest != nil {
+			r := digestRecord{Oldest: c.oldest, Next: c.next(), End: c.ends[len(c.ends)-1]}
+			copy(r.Digest[:], c.digest)
+			records = append(records, r)
+		}
+	}
+	if err := replaceFile(db.fs, filepath.Join(db.path, digestsFile), digestsTmpFile, records); err != nil {
+		_ = db.fs.Remove(filepath.Join(db.path, digestsTmpFile))
+		return &WriteError{err}
+	}
+	return nil
+}
+
+// Remember the checksums in the "digests" file which still match a chunk other than the final one. The file is
+// only a cache, so if it can't be read, the checksums are computed again when needed. If the database is
+// writable, checksums of chunks which are gone are dropped from the file. Assumes a write lock is held.
+func (db *LockFreeChunkDB) loadDigests() {
+	file, err := db.fs.OpenFile(filepath.Join(db.path, digestsFile), os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	bs, err := ioutil.ReadAll(file)
+	_ = file.Close()
+	size := binary.Size(digestRecord{})
+	if err != nil || len(bs)%size != 0 {
+		return
+	}
+	records := make([]digestRecord, len(bs)/size)
+	if err := binary.Read(bytes.NewReader(bs), binary.LittleEndian, records); err != nil {
+		return
+	}
+
+	byOldest := make(map[uint64]digestRecord, len(records))
+	for _, r := range records {
+		byOldest[r.Oldest] = r
+	}
+	matched := 0
+	for i, c := range db.chunks {
+		r, ok := byOldest[c.oldest]
+		if ok && i < len(db.chunks)-1 && len(c.ends) > 0 && r.Next == c.next() && r.End == c.ends[len(c.ends)-1] {
+			c.digest = append([]byte(nil), r.Digest[:]...)
+			matched++
+		}
+	}
+	if matched < len(records) && !db.readOnly {
+		_ = db.writeDigests()
+	}
+}
@@ -0,0 +1,46 @@
+package logdb
+
+// Lock the newest chunks into memory, and unlock the others, if the 'WithMlockNewest' option was given. Chunks
+// which aren't mapped are skipped, and unmapping a chunk unlocks it, so this is called whenever the chunks, or
+// which of them are mapped, change. Assumes a write lock is held, or 'mapLock' if the number of mapped chunks is
+// limited.
+//
+// If locking a chunk fails, for example because it would go over the RLIMIT_MEMLOCK limit, a warning is logged,
+// the observer is told if it is a 'MlockObserver', and no more chunks are locked: the chunks already locked stay
+// locked until they are no longer among the newest.
+func (db *LockFreeChunkDB) lockNewest() {
+	if db.mlockNewest <= 0 {
+		return
+	}
+	if !isOSFileSystem(db.fs) {
+		return
+	}
+
+	for i, c := range db.chunks {
+		lock := i >= len(db.chunks)-db.mlockNewest
+		if c.bytes == nil || c.locked == lock || (lock && db.mlockFailed) {
+			continue
+		}
+		if lock {
+			if err := mlock(c.bytes); err != nil {
+				db.mlockFailed = true
+				if db.logger != nil {
+					db.log("warn", "couldn't lock chunk in memory, no more will be locked", "path", c.path, "error", err)
+				}
+				path := c.path
+				db.observe(func(o Observer) {
+					if mo, ok := o.(MlockObserver); ok {
+						mo.OnMlockFailed(path, err)
+					}
+				})
+				continue
+			}
+		} else if err := munlock(c.bytes); err != nil {
+			if db.logger != nil {
+				db.log("warn", "couldn't unlock chunk from memory", "path", c.path, "error", err)
+			}
+			continue
+		}
+		c.locked = lock
+	}
+}
@@ -0,0 +1,90 @@
+package logdb
+
+import "time"
+
+// An Observer is notified of changes to a 'LockFreeChunkDB', for example to gather metrics. Observers are
+// given with the 'WithObserver' option.
+//
+// For a 'LockFreeChunkDB', the methods are called synchronously, as the changes happen. For a 'ChunkDB', they
+// are called once the operation has released its lock, and may be called from a different goroutine to the one
+// which made the change (but not concurrently). In either case, they should return quickly.
+type Observer interface {
+	// OnAppend is called for each entry appended, with its ID and size in bytes.
+	OnAppend(id uint64, size int)
+
+	// OnSync is called after the database is synced to disk, with the number of chunks which needed syncing
+	// and how long it took.
+	OnSync(dirtyChunks int, dur time.Duration)
+
+	// OnForget is called after entries are forgotten, with the new oldest ID.
+	OnForget(newOldest uint64)
+
+	// OnRollback is called after entries are rolled back, with the ID the next appended entry will have.
+	OnRollback(newNext uint64)
+}
+
+// A CorruptTailObserver is an 'Observer' which is also told when opening a database discards damaged chunks. See
+// 'WithSkipCorruptTail' and 'WithCorruptionPolicy'.
+type CorruptTailObserver interface {
+	Observer
+
+	// OnCorruptTail is called for each chunk discarded when the database is opened, with the path of the chunk
+	// data file and the error opening it.
+	OnCorruptTail(chunkPath string, err error)
+}
+
+// A CorruptEntryObserver is an 'Observer' which is also told when the background scrubber finds a damaged entry.
+// See 'WithBackgroundScrub'.
+type CorruptEntryObserver interface {
+	Observer
+
+	// OnCorruptEntry is called with the ID of a damaged entry and the problem. An entry which stays damaged is
+	// reported each time it is checked.
+	OnCorruptEntry(id uint64, err error)
+}
+
+// A MlockObserver is an 'Observer' which is also told when a chunk can't be locked into memory. See
+// 'WithMlockNewest'.
+type MlockObserver interface {
+	Observer
+
+	// OnMlockFailed is called when locking a chunk into memory fails, with the path of the chunk data file and
+	// the error. No more chunks are locked after this, so it is called at most once.
+	OnMlockFailed(chunkPath string, err error)
+}
+
+// Notify the observer, if there is one. If the database is wrapped in a 'ChunkDB', the notification is queued
+// to be delivered by 'deliverEvents'.
+func (db *LockFreeChunkDB) observe(event func(Observer)) {
+	if db.observer == nil {
+		return
+	}
+	if db.wrapperLock == nil {
+		event(db.observer)
+		return
+	}
+
+	db.eventLock.Lock()
+	db.events = append(db.events, event)
+	db.eventLock.Unlock()
+}
+
+// Deliver any queued notifications to the observer. This must be called without holding the database lock.
+func (db *ChunkDB) deliverEvents() {
+	if db.observer == nil {
+		return
+	}
+
+	// Only one goroutine delivers at a time, so the observer sees events in order.
+	db.deliverLock.Lock()
+	defer db.deliverLock.Unlock()
+
+	db.eventLock.Lock()
+	events := db.events
+	db.events = nil
+	db.eventLock.Unlock()
+
+	for _, event := range events {
+		event(db.observer)
+	}
+}
@@ -0,0 +1,136 @@
+package logdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserver_Hooks(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		t.Logf("Concurrent: %v\n", concurrent)
+
+		obs := &recordingObserver{}
+		lfdb := assertOpenOptions(t, true, "observer_hooks", chunkSize, WithObserver(obs))
+		var db PersistDB = lfdb
+		if concurrent {
+			db = WrapForConcurrency(lfdb)
+		}
+		assertSetSync(t, db, -1)
+
+		assertAppend(t, db, []byte("a"))
+		assertAppendEntries(t, db, [][]byte{[]byte("bb"), []byte("ccc")})
+		assertSync(t, db)
+		assertForget(t, db, 2)
+		assertRollback(t, db, 2)
+
+		assert.Equal(t, []string{
+			"append 1 1",
+			"append 2 2",
+			"append 3 3",
+			"sync 1",
+			"forget 2",
+			"rollback 3",
+		}, obs.events)
+
+		assertClose(t, db.(CloseDB))
+	}
+}
+
+func TestObserver_Logger(t *testing.T) {
+	var messages []string
+	logger := func(level, msg string, kv ...interface{}) {
+		if msg == "new chunk" || msg == "chunk deleted" {
+			kv[1] = filepath.Base(kv[1].(string))
+		}
+		if msg == "sync" {
+			kv = kv[:2]
+		}
+		messages = append(messages, fmt.Sprintf("%s %s %v", level, msg, kv))
+	}
+
+	db := assertOpenOptions(t, true, "observer_logger", 100, WithLogger(logger))
+	assertSetSync(t, db, -1)
+
+	// 10-byte entries, so the eleventh starts a new chunk.
+	for i := 0; i < 11; i++ {
+		assertAppend(t, db, make([]byte, 10))
+	}
+	assert.Equal(t, []string{
+		"debug new chunk [path chunk_0_1 oldest 1]",
+		"debug new chunk [path chunk_1_11 oldest 11]",
+	}, messages)
+
+	messages = nil
+	// Forgetting a whole chunk syncs.
+	assertForget(t, db, 11)
+	assert.Equal(t, []string{
+		"debug chunk deleted [path chunk_0_1]",
+		"debug sync [dirty 2]",
+	}, messages)
+	assertClose(t, db)
+
+	// Opening a healthy database doesn't recover anything.
+	messages = nil
+	db = assertOpenOptions(t, false, "observer_logger", 100, WithLogger(logger))
+	defer assertClose(t, db)
+	assert.Equal(t, 0, len(messages), "expected no messages, got: %v", messages)
+}
+
+/// HELPERS
+
+// An 'Observer' which records the events it is notified of.
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) OnAppend(id uint64, size int) {
+	o.events = append(o.events, fmt.Sprintf("append %v %v", id, size))
+}
+
+func (o *recordingObserver) OnSync(dirtyChunks int, dur time.Duration) {
+	o.events = append(o.events, fmt.Sprintf("sync %v", dirtyChunks))
+}
+
+func (o *recordingObserver) OnForget(newOldest uint64) {
+	o.events = append(o.events, fmt.Sprintf("forget %v", newOldest))
+}
+
+func (o *recordingObserver) OnRollback(newNext uint64) {
+	o.events = append(o.events, fmt.Sprintf("rollback %v", newNext))
+}
+
+func (o *recordingObserver) OnCorruptTail(chunkPath string, err error) {
+	o.events = append(o.events, fmt.Sprintf("corrupt tail %v", filepath.Base(chunkPath)))
+}
+
+func (o *recordingObserver) OnCorruptEntry(id uint64, err error) {
+	o.events = append(o.events, fmt.Sprintf("corrupt entry %v", id))
+}
+
+func (o *recordingObserver) OnMlockFailed(chunkPath string, err error) {
+	o.events = append(o.events, fmt.Sprintf("mlock failed %v", filepath.Base(chunkPath)))
+}
+
+// An 'Observer' which sends the IDs of corrupt entries on a channel, and ignores everything else. Unlike a
+// 'recordingObserver', this can be used from the background goroutines of a 'ChunkDB'.
+type scrubObserver struct {
+	recordingObserver
+	ids chan uint64
+}
+
+func (o *scrubObserver) OnAppend(id uint64, size int)              {}
+func (o *scrubObserver) OnSync(dirtyChunks int, dur time.Duration) {}
+
+func (o *scrubObserver) OnCorruptEntry(id uint64, err error) {
+	if _, ok := err.(*FrameError); !ok {
+		return
+	}
+	select {
+	case o.ids <- id:
+	default:
+	}
+}
@@ -0,0 +1,49 @@
+package logdb
+
+import "path/filepath"
+
+// OpenAll opens every database in the subdirectories of a parent directory, such as one database per tenant, and
+// returns them keyed by the name of their subdirectory. The chunk size and options are as for 'Open', so a chunk
+// size of 0 opens each database with its own chunk size. Nothing is created.
+//
+// A subdirectory is taken to be a database if it has the "version", "chunk_size", and "oldest" files which every
+// database has, even before any entries are appended. Other subdirectories, and files, are skipped.
+//
+// Returns a 'ReadError' value if the parent directory can't be read, and a 'DatabaseError' value wrapping the
+// error from 'Open' if a database can't be opened. In either case the databases already opened are closed, and
+// no map is returned.
+func OpenAll(parent string, chunkSize uint32, opts ...Option) (map[string]*LockFreeChunkDB, error) {
+	fs := applyOptions(opts).fs
+
+	fis, err := fs.ReadDir(parent)
+	if err != nil {
+		return nil, &ReadError{err}
+	}
+
+	dbs := make(map[string]*LockFreeChunkDB)
+	for _, fi := range fis {
+		if !fi.IsDir() || !looksLikeDatabase(fs, filepath.Join(parent, fi.Name())) {
+			continue
+		}
+		db, err := Open(filepath.Join(parent, fi.Name()), chunkSize, false, opts...)
+		if err != nil {
+			for _, opened := range dbs {
+				_ = opened.Close()
+			}
+			return nil, &DatabaseError{Name: fi.Name(), Err: err}
+		}
+		dbs[fi.Name()] = db
+	}
+	return dbs, nil
+}
+
+// Check if a directory has the files which every database has.
+func looksLikeDatabase(fs FileSystem, path string) bool {
+	for _, name := range []string{"version", "chunk_size", "oldest"} {
+		fi, err := fs.Stat(filepath.Join(path, name))
+		if err != nil || !fi.Mode().IsRegular() {
+			return false
+		}
+	}
+	return true
+}
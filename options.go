@@ -0,0 +1,499 @@
+package logdb
+
+import (
+	"os"
+	"time"
+)
+
+// An Option configures a 'LockFreeChunkDB' when it is created or opened. Options are passed to 'Open'.
+type Option func(*options)
+
+// The configurable settings of a 'LockFreeChunkDB'.
+type options struct {
+	// The filesystem used for all file access.
+	fs FileSystem
+
+	// The source of entry timestamps. This is only overridden in tests.
+	now func() time.Time
+
+	// The maximum size of the database files, or 0 if there is no limit.
+	maxBytes uint64
+
+	// How chunk data files are flushed to disk, and how many may be flushed at once.
+	syncMode        SyncMode
+	syncParallelism int
+
+	// The live-byte fill ratio below which the oldest chunk is compacted after a forget, or 0 to never
+	// compact.
+	compactThreshold float64
+
+	// Notified of changes to the database, if not nil.
+	observer Observer
+
+	// The maximum number of chunks to keep memory-mapped at once, or 0 if there is no limit.
+	maxMappedChunks int
+
+	// The maximum number of entries to keep in the read cache, or 0 if there is no cache.
+	readCacheEntries int
+
+	// The number of bytes of entries a 'ChunkDB' checks each second in the background, or 0 if it doesn't.
+	scrubRate int
+
+	// The ID of the first entry of a new database, or 0 to start from 1.
+	startID uint64
+
+	// The number of the newest chunks to lock into memory, or 0 to lock none.
+	mlockNewest int
+
+	// Whether a final chunk which can't be opened is deleted, rather than making opening the database fail.
+	skipCorruptTail bool
+
+	// Whether an "oldest" file which refers to entries after the final chunk makes opening the database fail,
+	// rather than being corrected.
+	strictOldest bool
+
+	// Whether a chunk which can't be opened, or which doesn't follow on from the chunk before, cuts the log short
+	// there when the database is opened, rather than making opening fail.
+	truncateAtDamage bool
+
+	// The permissions of created files and directories.
+	fileMode os.FileMode
+	dirMode  os.FileMode
+
+	// The number of attempts made to open or memory-map a file, and the delay before the first retry.
+	openAttempts int
+	openBackoff  time.Duration
+
+	// Whether the final chunk data file is cut off after its final entry by 'Sync'.
+	trimTail bool
+
+	// How chunk data files are read and written.
+	backend Backend
+
+	// Whether databases are created with the disk format version which frames entries with their length.
+	framing bool
+
+	// Whether the database rejects changes once a write fails because the filesystem is read-only.
+	readOnlyOnError bool
+
+	// Given diagnostic messages, if not nil.
+	logger Logger
+
+	// Whether the database is opened only for reading, without taking the lock, so another process may be
+	// writing to it.
+	openReadOnly bool
+
+	// The offset within a chunk which entries start at a multiple of, or 0 or 1 if entries are not padded. Once
+	// a database is opened, this is the alignment it was created with.
+	alignment uint32
+}
+
+// The settings used if no options are given.
+func defaultOptions() options {
+	return options{
+		fs:       OSFileSystem{},
+		now:      time.Now,
+		fileMode: 0644,
+		dirMode:  0755,
+	}
+}
+
+// Apply options to the defaults. If the permissions of created files or directories have been changed, or
+// opening files is to be retried, the filesystem is wrapped to do so. Nothing is mapped by the file backend, so
+// the number of mapped chunks isn't limited.
+func applyOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	defaults := defaultOptions()
+	if o.fileMode != defaults.fileMode || o.dirMode != defaults.dirMode {
+		o.fs = &modeFileSystem{FileSystem: o.fs, fileMode: o.fileMode, dirMode: o.dirMode}
+	}
+	if o.openAttempts > 1 {
+		o.fs = &retryFileSystem{FileSystem: o.fs, attempts: o.openAttempts, backoff: o.openBackoff}
+	}
+	if o.backend == BackendFile {
+		o.maxMappedChunks = 0
+	}
+	return o
+}
+
+// The disk format version of a database created with these options.
+func (o options) createVersion() uint16 {
+	if o.framing {
+		return framedVersion
+	}
+	return latestVersion
+}
+
+// WithFileSystem makes the database access its files through the given 'FileSystem', rather than directly
+// through the operating system.
+func WithFileSystem(fs FileSystem) Option {
+	return func(o *options) {
+		o.fs = fs
+	}
+}
+
+// WithMaxBytes caps the total size of the database files. When the cap would be exceeded, whole chunks are
+// forgotten, oldest first, to bring the size back within it. This makes 'OldestID' advance automatically, as
+// in a ring buffer.
+//
+// The cap is enforced at chunk granularity: it is checked when a new chunk is needed, and after each periodic
+// sync. The final chunk is never forgotten, so a cap smaller than the size of two chunks cannot be honoured,
+// and an explicit 'Sync' may briefly take the size over the cap until the next append. If a single
+// 'AppendEntries' writes more than the cap, its own earliest entries will be forgotten. Spare files made by
+// 'Preallocate' don't count towards the cap until they are used. A cap of 0 means no limit, which is the default.
+func WithMaxBytes(maxBytes uint64) Option {
+	return func(o *options) {
+		o.maxBytes = maxBytes
+	}
+}
+
+// A SyncMode determines how chunk data is flushed to disk when the database is synced.
+type SyncMode int
+
+const (
+	// SyncFull flushes chunk data with 'fsync', which also flushes file metadata such as the modification
+	// time. This is the default.
+	SyncFull SyncMode = iota
+
+	// SyncData flushes chunk data with 'fdatasync' where the platform supports it, which skips file metadata
+	// that isn't needed to read the data back, and so is cheaper. On other platforms it is the same as
+	// 'SyncFull'.
+	SyncData
+)
+
+// WithSyncMode selects how chunk data files are flushed to disk. Chunk metadata files are always fully
+// synced, after the data, so the database stays consistent whichever mode is used.
+func WithSyncMode(mode SyncMode) Option {
+	return func(o *options) {
+		o.syncMode = mode
+	}
+}
+
+// WithSyncParallelism sets how many chunk data files may be flushed to disk at once when syncing. This cuts the
+// time a sync takes when many chunks have changed, particularly on network filesystems, where each flush has a
+// high latency. Chunk metadata files are still written one at a time, each after every data file has been
+// flushed, so the database stays consistent. The default is 1, flushing one data file at a time.
+func WithSyncParallelism(n int) Option {
+	return func(o *options) {
+		o.syncParallelism = n
+	}
+}
+
+// WithCompactThreshold makes the database compact its oldest chunk after entries are forgotten, if the
+// proportion of the bytes written to the chunk which belong to entries that have not been forgotten drops below
+// the given ratio. Compaction rewrites the remaining entries to the start of a new chunk file, so the space
+// used by the forgotten ones is returned to the filesystem. Without it, that space is only reclaimed when every
+// entry in the chunk has been forgotten, which may take a long time with a large chunk size.
+//
+// Chunk files keep their size: the space after the remaining entries is left as a hole, so this relies on the
+// filesystem supporting sparse files. The final chunk is never compacted.
+//
+// When a 'ChunkDB' is used, compaction happens in the background, holding the write lock only to swap the new
+// chunk in. Otherwise it happens synchronously, at the end of the call which forgot the entries. A ratio of 0
+// disables compaction, which is the default.
+func WithCompactThreshold(ratio float64) Option {
+	return func(o *options) {
+		o.compactThreshold = ratio
+	}
+}
+
+// WithObserver makes the database notify the given 'Observer' of appends, syncs, forgets, rollbacks, and
+// discarded chunks. This allows metrics to be gathered without this package depending on any particular metrics
+// system.
+func WithObserver(observer Observer) Option {
+	return func(o *options) {
+		o.observer = observer
+	}
+}
+
+// WithSkipCorruptTail makes opening a database which has a final chunk that can't be opened, for example
+// because it was only partly written when the program crashed, discard that chunk rather than fail. The entries
+// in the chunk are lost, and the database carries on from the end of the chunk before. If the 'Observer' is a
+// 'CorruptTailObserver', it is told of the discarded chunk. Only damage to the chunk files counts: an
+// I/O error, or running out of memory to map the chunk, still makes opening fail.
+//
+// A chunk before the final one which can't be opened is still an error. 'Repair' loses fewer entries, as it
+// keeps those in the final chunk which are intact.
+func WithSkipCorruptTail() Option {
+	return func(o *options) {
+		o.skipCorruptTail = true
+	}
+}
+
+// WithStrictOldest makes opening a database fail with a 'ChunkContinuityError' value if the "oldest" file, which
+// holds the oldest ID, refers to an entry after the end of the final chunk. This happens if the final chunk was
+// lost, or if the file was overwritten with a wrong ID which happens to have a valid checksum; without this
+// option the oldest ID is silently taken from the chunks instead, as the database can't tell the two apart.
+// An oldest ID before the first chunk is still corrected, as a crash between deleting a forgotten chunk and
+// rewriting the file leaves it that way.
+func WithStrictOldest() Option {
+	return func(o *options) {
+		o.strictOldest = true
+	}
+}
+
+// A CorruptionPolicy determines what opening a database does about damage to it. See 'WithCorruptionPolicy'.
+type CorruptionPolicy int
+
+const (
+	// CorruptionFailFast makes opening a database fail on any damage which would lose entries or leave the oldest
+	// ID in doubt, as 'WithStrictOldest' does. This suits a database which must not silently lose anything.
+	CorruptionFailFast CorruptionPolicy = iota
+
+	// CorruptionBestEffort opens as much of a damaged database as it can. A final chunk which can't be opened is
+	// discarded, as 'WithSkipCorruptTail' does, and the log is cut short before any other chunk which can't be
+	// opened or which doesn't follow on from the chunk before it: that chunk and every later one are discarded,
+	// so the entries before the damage are kept and the database carries on from them. This suits an audit log,
+	// where salvaging the older entries matters more than noticing the loss.
+	CorruptionBestEffort
+)
+
+// WithCorruptionPolicy sets what opening a database does about damage, replacing the 'WithSkipCorruptTail' and
+// 'WithStrictOldest' options (whichever of these is given last wins). Without it, a damaged final chunk or a
+// break in the chunks makes opening fail, but an "oldest" file beyond the final chunk is corrected.
+//
+// Discarded chunks are deleted, and an 'Observer' which is a 'CorruptTailObserver' is told of each. With
+// 'WithReadOnly' nothing is deleted: the discarded chunks are just left out. Damage which 'Open' can't work
+// around, such as an unreadable "chunk_size" file, is an error under either policy, as is an I/O error, or running
+// out of memory to map a chunk, as these may not happen again.
+func WithCorruptionPolicy(policy CorruptionPolicy) Option {
+	return func(o *options) {
+		o.skipCorruptTail = policy == CorruptionBestEffort
+		o.truncateAtDamage = policy == CorruptionBestEffort
+		o.strictOldest = policy == CorruptionFailFast
+	}
+}
+
+// WithMaxMappedChunks limits how many chunk files are memory-mapped at once, which bounds the address space used
+// by a large database. Chunks are mapped when they are read, and the least recently read are unmapped to stay
+// within the limit. The final chunk, which is appended to, is always mapped, so the limit is at least 2. A limit
+// of 0 keeps every chunk mapped, which is the default.
+//
+// With a limit, readers of a 'ChunkDB' take turns reading chunk data, as reading may change which chunks are
+// mapped.
+func WithMaxMappedChunks(n int) Option {
+	return func(o *options) {
+		if n > 0 && n < 2 {
+			n = 2
+		}
+		o.maxMappedChunks = n
+	}
+}
+
+// WithStartID makes a database which is created number its entries from 'base' rather than from 1, for example so
+// that the IDs of several databases don't overlap. The base is recorded in the "oldest" file, so the database
+// carries on from it when opened again: for an existing database this option does nothing. A base of 0 is the
+// same as 1.
+//
+// Until the first entry is appended, the database is empty in the same way as one whose entries have all been
+// forgotten: 'OldestID' and 'NextID' are the base, and 'NewestID' is one less.
+func WithStartID(base uint64) Option {
+	return func(o *options) {
+		o.startID = base
+	}
+}
+
+// WithMlockNewest locks the newest 'n' chunks into memory with 'mlock', so reading recent entries never has to
+// wait for the disk. As chunks are created, the chunk which is no longer among the newest is unlocked. Locking
+// needs the chunks to be memory-mapped, so chunks unmapped by 'WithMaxMappedChunks' are not locked until they are
+// read again. A limit of 0, the default, locks nothing.
+//
+// The memory which a process may lock is usually limited, by RLIMIT_MEMLOCK on Linux. If locking a chunk fails,
+// a warning is logged (see 'WithLogger'), an observer which is a 'MlockObserver' is told, and no more chunks are
+// locked, but the database works as usual.
+//
+// This only has an effect for an 'OSFileSystem' with the mmap backend, on Linux and macOS, the platforms for which
+// the syscall package has 'mlock'. Elsewhere it does nothing.
+func WithMlockNewest(n int) Option {
+	return func(o *options) {
+		o.mlockNewest = n
+	}
+}
+
+// WithReadCache keeps copies of up to 'maxEntries' recently-read entries in memory, so that an entry which is
+// read again is returned from the cache rather than from the chunk file. This trades memory for fewer reads of
+// the chunk files, which helps most with 'BackendFile' and with chunks unmapped by 'WithMaxMappedChunks'. The
+// least recently read entry is evicted when the cache is full. Entries which are forgotten, rolled back,
+// truncated, excised, or deleted are evicted too, so the cache never returns stale bytes. 'Stats' reports the
+// number of hits and misses. A limit of 0, the default, disables the cache.
+//
+// Only 'Get' and 'GetMany' use the cache. A cached entry is still copied, so the slice returned may be modified.
+func WithReadCache(maxEntries int) Option {
+	return func(o *options) {
+		o.readCacheEntries = maxEntries
+	}
+}
+
+// WithBackgroundScrub makes a 'ChunkDB' check its entries in a background goroutine, reading about
+// 'bytesPerSecond' bytes of entries a second, and reporting any which are damaged to the 'Observer', if it is a
+// 'CorruptEntryObserver'. When it reaches the newest entry, it starts again from the oldest, so every entry is
+// checked regularly, not only the ones which are read. A rate of 0, the default, checks nothing.
+//
+// Entries have no checksums of their own, so what is checked is that the frame header in the data file before
+// each entry gives its size, and that the metadata describes entries within the data file, in order. This needs
+// a disk format version which frames entries (see 'WithFraming'): 'Open' returns 'ErrScrubNeedsFraming' for any
+// other. An entry whose bytes have been overwritten in place is not noticed, but one whose frame has been
+// damaged, or which the metadata no longer lines up with, is. With the file backend, a chunk which can't be read
+// at all is reported at the first entry checked.
+//
+// The read lock is held while each chunk is checked, and released between chunks, so writers are delayed by at
+// most one chunk's worth of checking. A 'LockFreeChunkDB' is not checked, as there is no lock to share with it.
+func WithBackgroundScrub(bytesPerSecond int) Option {
+	return func(o *options) {
+		o.scrubRate = bytesPerSecond
+	}
+}
+
+// WithFileMode sets the permissions of files created in the database directory, including the chunk data and
+// metadata files. As with 'os.OpenFile', the process umask is applied. The default is 0644.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.fileMode = mode.Perm()
+	}
+}
+
+// WithDirMode sets the permissions of the database directory, if it is created. As with 'os.MkdirAll', the
+// process umask is applied. The default is 0755.
+func WithDirMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.dirMode = mode.Perm()
+	}
+}
+
+// WithOpenRetry makes opening or memory-mapping a file, such as a chunk file when the database is opened, try
+// again if it fails for want of resources: too many open files ('EMFILE' or 'ENFILE'), or not enough memory
+// ('ENOMEM' or 'EAGAIN'). These shortages are often brief on a busy system. Up to the given number of attempts
+// are made in total, waiting the given time before the first retry and twice as long before each one after.
+//
+// Other errors, such as a missing or corrupt file, are never retried. The default is a single attempt.
+func WithOpenRetry(attempts int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.openAttempts = attempts
+		o.openBackoff = backoff
+	}
+}
+
+// WithTrimTail makes 'Sync' cut the data file of the final chunk off after its final entry, so that the files
+// take up no more space than the entries do, rather than the full chunk size. This makes backups smaller, and
+// disk usage easier to understand. The file is grown back to the full chunk size when the next entry is
+// appended. Only an explicit 'Sync' trims the file, not the periodic syncs while appending.
+//
+// Unlike a newly-created chunk file, disk space is not reserved for a file which is grown back, so if the disk
+// fills up, writing an entry through the memory mapping may crash the program rather than return an error. A
+// database which has been synced with this option must be opened with it too, or else the final chunk has the
+// wrong size; 'Repair' can also fix that.
+func WithTrimTail() Option {
+	return func(o *options) {
+		o.trimTail = true
+	}
+}
+
+// A Backend determines how the data files of chunks are accessed.
+type Backend int
+
+const (
+	// BackendMmap memory-maps chunk data files, so entries are read and written as plain memory. This is the
+	// default.
+	BackendMmap Backend = iota
+
+	// BackendFile reads and writes chunk data files with 'ReadAt' and 'WriteAt' ('pread' and 'pwrite'), and
+	// never maps them. This is slower, as every read copies from the file, but it avoids the problems of
+	// memory-mapping on some network filesystems, such as NFS, and the program can't crash if a data file is
+	// truncated or the disk fills up. The files of the 'FileSystem' must implement 'io.ReaderAt' and
+	// 'io.WriterAt', as '*os.File' does.
+	BackendFile
+)
+
+// WithBackend selects how chunk data files are accessed. The files are the same whichever backend is used, so a
+// database can be opened with a different backend each time. The 'WithMaxMappedChunks' option and the 'Advise'
+// method have no effect with 'BackendFile'.
+func WithBackend(backend Backend) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
+// WithFraming makes 'Open' create databases with a disk format version which writes the length of each entry
+// before it in the chunk data file. This makes the data files self-describing, so the metadata files are only an
+// index: if one is lost or damaged, it is rebuilt from the data when the database is opened or repaired, rather
+// than the chunk being unreadable. Rebuilt metadata has no timestamps, so 'TimestampOf' gives the Unix epoch for
+// those entries.
+//
+// The length takes one byte for entries under 127 bytes, and a byte more for every seven bits after that, so the
+// largest entry is a few bytes smaller than the chunk size (see 'MaxEntrySize'). This option has no effect on
+// databases which already exist: their disk format version decides.
+func WithFraming() Option {
+	return func(o *options) {
+		o.framing = true
+	}
+}
+
+// WithReadOnlyOnError makes the database stop accepting changes once a write or sync fails because the
+// filesystem is read-only (EROFS), as happens when the operating system remounts it after an I/O error. The
+// failing operation returns its error as usual, and from then on every operation which would change the
+// database, including syncing, returns 'ErrReadOnly' without touching the disk. Reads keep working, so the
+// entries can still be served until the database is closed and the filesystem fixed. 'Close' returns
+// 'ErrReadOnly' too, as the changes since the last sync can't be written.
+//
+// Without this option, each later write fails with its own error, and may leave more partial files behind.
+func WithReadOnlyOnError() Option {
+	return func(o *options) {
+		o.readOnlyOnError = true
+	}
+}
+
+// WithAlignment makes 'Open' create databases whose entries start at a multiple of 'n' bytes within their chunk,
+// where 'n' is a power of two, so that reading an entry from a memory-mapped chunk doesn't start part-way
+// through a word or cache line. Each entry is padded to the next multiple, so this trades space for speed: with
+// entries of random size, each wastes 'n'/2 bytes on average. Entries are still returned without the padding.
+//
+// The alignment is stored with the database, so this option has no effect on databases which already exist. It
+// can't be combined with 'WithFraming'. Creating a database gives 'ErrAlignment' if 'n' is not a power of two.
+func WithAlignment(n uint32) Option {
+	return func(o *options) {
+		o.alignment = n
+	}
+}
+
+// WithReadOnly makes 'Open' open an existing database only for reading. The lock is not taken, so one process
+// can be writing to the database while others read it, and nothing on disk is changed: leftovers from an
+// interrupted operation are left for the writer to tidy up, and a database which needs repair can't be opened.
+// Every operation which would change the database returns 'ErrReadOnly', and 'Close' doesn't sync.
+//
+// The database is read as it was when opened: call 'Refresh' to see what has been synced since. A database
+// whose writer uses 'WithTrimTail' can't be read this way, as the final chunk is shorter than the chunk size.
+// Databases are never created with this option, even if 'create' is true.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.openReadOnly = true
+	}
+}
+
+// A Logger is given diagnostic messages about what a database is doing. The level is "debug" for routine events,
+// such as a chunk being created, synced, or deleted; and "warn" for problems found and fixed when a database is
+// opened, such as a damaged file being rebuilt or discarded. The message is a short fixed string, and 'kv' holds
+// alternating keys and values giving the details.
+//
+// A logger is called synchronously, with the database lock held, so it should return quickly.
+type Logger func(level, msg string, kv ...interface{})
+
+// WithLogger makes the database give diagnostic messages to the logger: when a chunk is created or deleted,
+// when the database is synced, and when opening it finds something to recover from. This is for debugging;
+// use 'WithObserver' to gather metrics. Without this option, no messages are made.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// Give a message to the logger, if there is one. Callers check for a logger first, as the arguments allocate even
+// when there isn't one.
+func (o *options) log(level, msg string, kv ...interface{}) {
+	if o.logger != nil {
+		o.logger(level, msg, kv...)
+	}
+}
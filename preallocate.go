@@ -0,0 +1,129 @@
+package logdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Spare chunk data files, made by 'Preallocate', are named "spare_<number>". These are not valid chunk filenames,
+// so they are ignored when the database is opened, other than to be used by new chunks.
+const sparePrefix = "spare"
+
+// Preallocate creates spare chunk files to hold the given number of bytes of new entries, atomically. See the
+// 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) Preallocate(totalBytes uint64) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.Preallocate(totalBytes)
+}
+
+// Preallocate creates enough spare chunk data files, each of the chunk size and with its disk space reserved, to
+// hold the given number of bytes of new entries on top of the space left in the final chunk. When an append
+// needs a new chunk it uses a spare, rather than creating a file and reserving space for it, so a bulk load of
+// that many bytes creates no data files. Spares which already exist count towards the total, so preallocating
+// the same size again does nothing.
+//
+// Entries are not split over chunks, so if they don't fill chunks exactly they take up more space than their
+// size, and files are created as usual once the spares run out. Spare files are kept when the database is
+// closed, for use after it is opened again. They count towards 'DiskUsage', but not towards the 'WithMaxBytes' cap
+// until a chunk uses them, so preallocating never makes entries be forgotten.
+//
+// Returns a 'WriteError' value if a file can't be created, and a 'SyncError' value if the directory can't be
+// synced. Spare files created before the error are kept.
+func (db *LockFreeChunkDB) Preallocate(totalBytes uint64) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// Space left in the final chunk doesn't need a spare.
+	free := uint64(0)
+	if len(db.chunks) > 0 {
+		c := db.chunks[len(db.chunks)-1]
+		free = uint64(c.size)
+		if len(c.ends) > 0 {
+			free -= uint64(c.ends[len(c.ends)-1])
+		}
+	}
+	if totalBytes <= free {
+		return nil
+	}
+	needed := (totalBytes - free + uint64(db.chunkSize) - 1) / uint64(db.chunkSize)
+
+	for uint64(len(db.spares)) < needed {
+		name := spareFileName(db.nextSpare)
+		if err := createFile(db.fs, filepath.Join(db.path, name), db.chunkSize); err != nil {
+			_ = db.fs.Remove(filepath.Join(db.path, name))
+			return &WriteError{err}
+		}
+		db.spares = append(db.spares, name)
+		db.nextSpare++
+	}
+
+	if err := dirSync(db.fs, db.path); err != nil {
+		return &SyncError{err}
+	}
+	return nil
+}
+
+// Create the files for a new chunk, using a spare data file if there is one. Assumes a write lock is held.
+func (db *LockFreeChunkDB) createChunkFiles(dataFilePath string) error {
+	if len(db.spares) == 0 {
+		return createChunkFiles(db.fs, dataFilePath, db.chunkSize, db.next())
+	}
+
+	spare := db.spares[len(db.spares)-1]
+	if err := db.fs.Rename(filepath.Join(db.path, spare), dataFilePath); err != nil {
+		return err
+	}
+	db.spares = db.spares[:len(db.spares)-1]
+	return createMetaFile(db.fs, dataFilePath)
+}
+
+// Get the filename of a spare chunk data file.
+func spareFileName(num uint64) string {
+	return fmt.Sprintf("%s%s%v", sparePrefix, sep, num)
+}
+
+// Find the spare chunk data files of a database, in order, and the number for the next one's name. Spare files
+// which aren't the chunk size were never fully created, so are deleted.
+func findSpareFiles(fs FileSystem, path string, chunkSize uint32) ([]string, uint64, error) {
+	fis, err := fs.ReadDir(path)
+	if err != nil {
+		return nil, 0, &ReadError{err}
+	}
+
+	var spareFiles []os.FileInfo
+	var next uint64
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), sparePrefix+sep) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimPrefix(fi.Name(), sparePrefix+sep), 10, 64)
+		if err != nil || fi.Name() != spareFileName(num) {
+			continue
+		}
+		if num >= next {
+			next = num + 1
+		}
+		if fi.Size() != int64(chunkSize) {
+			_ = fs.Remove(filepath.Join(path, fi.Name()))
+			continue
+		}
+		spareFiles = append(spareFiles, fi)
+	}
+
+	sort.Sort(fileInfoSlice(spareFiles))
+	spares := make([]string, len(spareFiles))
+	for i, fi := range spareFiles {
+		spares[i] = fi.Name()
+	}
+	return spares, next, nil
+}
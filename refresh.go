@@ -0,0 +1,64 @@
+package logdb
+
+// Refresh re-reads the database from disk, atomically. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) Refresh() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.Refresh()
+}
+
+// Refresh re-reads the chunks and the oldest ID of a database opened with 'WithReadOnly', so that what another
+// process has synced since it was opened, or last refreshed, is seen: new chunks are opened, chunks which have
+// grown are mapped again, forgotten chunks are closed, and deleted entries are hidden. Entries which have been
+// appended but not synced are not seen, and nor are entries which have been rolled back.
+//
+// An entry returned before the refresh must not be used afterwards, as the chunk it was read from is closed.
+//
+// If the files can't be read, which can happen if the writer is changing them at the same time, the error is
+// returned and the database is left as it was, so it is safe to try again. A database which wasn't opened with
+// 'WithReadOnly' is only changed through this handle, so there is nothing to re-read and this does nothing.
+func (db *LockFreeChunkDB) Refresh() error {
+	if db.closed {
+		return ErrClosed
+	}
+	if !db.openReadOnly {
+		return nil
+	}
+
+	o := db.options
+	chunkSize, chunks, oldest, err := loadChunks(db.path, 0, db.version, &o)
+	if err != nil {
+		return err
+	}
+	tombstones, err := readTombstones(db.fs, db.path)
+	if err != nil {
+		for _, c := range chunks {
+			_ = c.close()
+		}
+		return &ReadError{err}
+	}
+	if db.accessPattern != AccessNormal {
+		for _, c := range chunks {
+			if err := db.advise(c); err != nil {
+				for _, c := range chunks {
+					_ = c.close()
+				}
+				return err
+			}
+		}
+	}
+
+	for _, c := range db.chunks {
+		_ = c.close()
+	}
+	db.chunkSize = chunkSize
+	db.chunks = chunks
+	db.tombstones = tombstones
+	db.cache.clear()
+	db.setOldest(oldest)
+	db.updateNewest()
+	db.dropStaleTombstones()
+	db.lockNewest()
+	return nil
+}
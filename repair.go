@@ -0,0 +1,211 @@
+package logdb
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The temporary file used while rewriting the metadata of a chunk being repaired. This is not a valid chunk
+// filename, so it is ignored when the database is opened.
+const repairMetaFile = "repairing" + sep + metaSuffix
+
+// Repair salvages a database which can't be opened because its final chunk was left partially written, for
+// example by a crash or by the disk filling up. The final chunk is cut back to its last entry which has
+// consistent metadata and lies within the chunk data file, and any entries after that are lost. All the other
+// chunks must be intact: they are checked, but never modified. The chunk size and options are as for 'Open'.
+//
+// If the disk format version has framing (see 'WithFraming'), damaged or missing metadata is instead rebuilt from
+// the data files, for every chunk, so no entries which made it to disk are lost.
+//
+// Returns the ID that the next entry appended to the repaired database will have.
+//
+// Returns the same errors as 'Open' if the database can't be opened even after repairing the final chunk,
+// including if a chunk before the final one is damaged.
+func Repair(path string, chunkSize uint32, opts ...Option) (uint64, error) {
+	o := applyOptions(opts)
+	fs := o.fs
+
+	if err := checkDatabasePath(fs, path); err != nil {
+		return 0, err
+	}
+
+	if err := repairdb(path, chunkSize, o); err != nil {
+		return 0, err
+	}
+
+	db, err := Open(path, chunkSize, false, opts...)
+	if err != nil {
+		return 0, err
+	}
+	next := db.next()
+	return next, db.Close()
+}
+
+// Repair the final chunk of a database, after checking all the others.
+func repairdb(path string, chunkSize uint32, o options) error {
+	fs := o.fs
+
+	// Read and check the "version" file.
+	var version uint16
+	if err := readFile(fs, filepath.Join(path, "version"), &version); err != nil {
+		return &ReadError{err}
+	}
+	if !knownVersion(version) {
+		return ErrUnknownVersion
+	}
+
+	// Lock the "version" file.
+	lockfile, err := flock(fs, filepath.Join(path, "version"))
+	if err != nil {
+		return &LockError{err}
+	}
+	defer funlock(lockfile)
+
+	// Read and check the "chunk_size" file.
+	sizes, err := readChunkSizes(fs, path)
+	if err != nil {
+		return &ReadError{err}
+	}
+	storedChunkSize := sizes[0]
+	if chunkSize != 0 && chunkSize != storedChunkSize {
+		return &ChunkSizeError{
+			ChunkFilePath: filepath.Join(path, "chunk_size"),
+			Expected:      storedChunkSize,
+			Actual:        chunkSize,
+		}
+	}
+
+	chunkFiles, err := findChunkFiles(fs, path, version, true)
+	if err != nil {
+		return err
+	}
+	if len(chunkFiles) == 0 {
+		return nil
+	}
+
+	// Check every chunk before the final one, without changing anything.
+	var prior *chunk
+	for _, fi := range chunkFiles[:len(chunkFiles)-1] {
+		c, err := readChunkFile(fs, version, path, fi, prior, chunkSizeFor(fi.Size(), sizes), false)
+		if err != nil {
+			return err
+		}
+		if c.rebuilt {
+			if err := c.syncMeta(); err != nil {
+				return &WriteError{err}
+			}
+		}
+		if len(c.ends) == 0 {
+			return &FormatError{
+				FilePath: c.metaFilePath(),
+				Err:      ErrEmptyNonfinalChunk,
+			}
+		}
+		prior = &c
+	}
+
+	final := chunkFiles[len(chunkFiles)-1]
+	return repairFinalChunk(fs, version, path, final, prior, chunkSizeFor(final.Size(), sizes))
+}
+
+// Cut a final chunk back to its last good entry, deleting it entirely if there are none.
+func repairFinalChunk(fs FileSystem, version uint16, basedir string, fi os.FileInfo, priorChunk *chunk, chunkSize uint32) error {
+	dataPath := filepath.Join(basedir, fi.Name())
+	metaPath := metaFilePath(dataPath)
+
+	remove := func() error {
+		if err := fs.Remove(dataPath); err != nil {
+			return &DeleteError{err}
+		}
+		if err := fs.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+			return &DeleteError{err}
+		}
+		return nil
+	}
+
+	// A chunk which doesn't carry on from the prior one can't be trusted at all. This does no validation
+	// because isBasenameChunkDataFile took care of that.
+	nameBits := strings.Split(fi.Name(), sep)
+	oldest, _ := strconv.ParseUint(nameBits[2], 10, 0)
+	if priorChunk != nil && oldest != priorChunk.next() {
+		return remove()
+	}
+
+	// Keep the longest prefix of the metadata which is consistent, or with framing rebuild it if it is
+	// damaged...
+	var ends []int32
+	var stamps []uint64
+	damaged := false
+	mfile, err := fs.OpenFile(metaPath, os.O_RDONLY, 0)
+	if err != nil && !versionHasFraming(version) {
+		return &ReadError{err}
+	}
+	if err == nil {
+		ends, stamps, err = readMetadata(mfile, version)
+		_ = mfile.Close()
+	}
+	if err != nil {
+		damaged = true
+		if versionHasFraming(version) {
+			if ends, stamps, err = rebuildMetadata(fs, dataPath); err != nil {
+				return &ReadError{err}
+			}
+		}
+	}
+
+	// ...and which refers only to data that made it to disk.
+	limit := int64(chunkSize)
+	if fi.Size() < limit {
+		limit = fi.Size()
+	}
+	n := len(ends)
+	for n > 0 && int64(ends[n-1]) > limit {
+		n--
+	}
+	if n > 0 && ends[0] < 0 {
+		n = 0
+	}
+	if n < len(ends) {
+		damaged = true
+		ends = ends[:n]
+		if versionHasTimestamps(version) {
+			stamps = stamps[:n]
+		}
+	}
+
+	if n == 0 {
+		return remove()
+	}
+
+	// Restore the data file to the full chunk size, if it was cut short.
+	if fi.Size() != int64(chunkSize) {
+		file, err := fs.OpenFile(dataPath, os.O_RDWR, 0)
+		if err != nil {
+			return &WriteError{err}
+		}
+		err = file.Truncate(int64(chunkSize))
+		if err == nil {
+			err = fsync(file)
+		}
+		_ = file.Close()
+		if err != nil {
+			return &WriteError{err}
+		}
+	}
+
+	if !damaged {
+		return nil
+	}
+
+	// Rewrite the metadata without the bad records, replacing the old file atomically.
+	meta, err := encodeMetadataFile(version, ends, stamps)
+	if err != nil {
+		return &WriteError{err}
+	}
+	if err := replaceFile(fs, metaPath, repairMetaFile, meta); err != nil {
+		return &WriteError{err}
+	}
+	return nil
+}
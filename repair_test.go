@@ -0,0 +1,194 @@
+package logdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Metadata records are only appended, and so can be left partly written, in disk format versions without
+// checksummed metadata.
+func TestRepair_PartialMetaRecord(t *testing.T) {
+	vs, before := assertCorruptFinalChunk(t, "repair_partial_meta", 1, func(dataPath, metaPath string) {
+		meta := readTestFile(t, metaPath)
+		writeTestFile(t, metaPath, append(meta, 0xff, 0xff))
+	})
+
+	assertRepair(t, "repair_partial_meta", vs, before)
+}
+
+func TestRepair_MetaOutOfBounds(t *testing.T) {
+	vs, before := assertCorruptFinalChunk(t, "repair_meta_bounds", 1, func(dataPath, metaPath string) {
+		ends, stamps := readTestMetadata(t, metaPath, 1)
+		ends = append(ends, chunkSize+10)
+		stamps = append(stamps, 0)
+		record, err := encodeMetadata(1, len(ends)-1, ends, stamps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, metaPath, append(readTestFile(t, metaPath), record...))
+	})
+
+	assertRepair(t, "repair_meta_bounds", vs, before)
+}
+
+func TestRepair_TruncatedData(t *testing.T) {
+	var lost int
+	vs, before := assertCorruptFinalChunk(t, "repair_truncated_data", latestVersion, func(dataPath, metaPath string) {
+		ends, _ := readTestMetadata(t, metaPath, latestVersion)
+		for _, e := range ends {
+			if e > chunkSize/2 {
+				lost++
+			}
+		}
+		if err := os.Truncate(dataPath, chunkSize/2); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	assertRepair(t, "repair_truncated_data", vs[:len(vs)-lost], before)
+}
+
+func TestRepair_AllEntriesLost(t *testing.T) {
+	var lost int
+	vs, before := assertCorruptFinalChunk(t, "repair_all_lost", latestVersion, func(dataPath, metaPath string) {
+		ends, _ := readTestMetadata(t, metaPath, latestVersion)
+		lost = len(ends)
+		if err := os.Truncate(dataPath, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	assertRepair(t, "repair_all_lost", vs[:len(vs)-lost], before)
+}
+
+// Checksummed metadata can't be partly trusted, so if it is damaged then every entry in the chunk is lost.
+func TestRepair_MetaChecksum(t *testing.T) {
+	var lost int
+	vs, before := assertCorruptFinalChunk(t, "repair_meta_checksum", latestVersion, func(dataPath, metaPath string) {
+		ends, _ := readTestMetadata(t, metaPath, latestVersion)
+		lost = len(ends)
+		meta := readTestFile(t, metaPath)
+		meta[metaHeaderSize] ^= 0x01
+		writeTestFile(t, metaPath, meta)
+	})
+
+	assertRepair(t, "repair_meta_checksum", vs[:len(vs)-lost], before)
+}
+
+// With framing, damaged metadata is rebuilt from the data, so only the entries which didn't make it to disk are
+// lost.
+func TestRepair_FramedRebuildsMeta(t *testing.T) {
+	var lost int
+	vs, before := assertCorruptFinalChunk(t, "repair_framed", framedVersion, func(dataPath, metaPath string) {
+		ends, _ := readTestMetadata(t, metaPath, framedVersion)
+		for _, e := range ends {
+			if e > chunkSize/2 {
+				lost++
+			}
+		}
+		meta := readTestFile(t, metaPath)
+		meta[metaHeaderSize] ^= 0x01
+		writeTestFile(t, metaPath, meta)
+		if err := os.Truncate(dataPath, chunkSize/2); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	assertRepair(t, "repair_framed", vs[:len(vs)-lost], before)
+}
+
+func TestRepair_NoRepairNonfinalChunk(t *testing.T) {
+	db := assertOpenOptions(t, true, "repair_nonfinal", chunkSize)
+	filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	dir := "test_db/repair_nonfinal"
+	chunkFiles, err := findChunkFiles(OSFileSystem{}, dir, latestVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath := metaFilePath(filepath.Join(dir, chunkFiles[0].Name()))
+	meta := append(readTestFile(t, metaPath), 0xff, 0xff)
+	writeTestFile(t, metaPath, meta)
+
+	_, err = Repair(dir, chunkSize)
+	assert.NotNil(t, err, "expected repair to fail")
+	assert.True(t, bytes.Equal(meta, readTestFile(t, metaPath)), "expected non-final chunk to be untouched")
+}
+
+/// ASSERTIONS
+
+// Fill a database with the given disk format version, close it, and then damage its final chunk with the given
+// function. Returns the entries appended, and the contents of the files of the other chunks.
+func assertCorruptFinalChunk(t *testing.T, testName string, version uint16, corrupt func(dataPath, metaPath string)) ([][]byte, map[string][]byte) {
+	_ = os.RemoveAll("test_db/" + testName)
+	db, err := createdb("test_db/"+testName, chunkSize, version, applyOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs := filldb(t, db, numEntries)
+	assertClose(t, db)
+
+	dir := "test_db/" + testName
+	chunkFiles, err := findChunkFiles(OSFileSystem{}, dir, latestVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunkFiles) < 2 {
+		t.Fatal("expected more than one chunk")
+	}
+
+	// Keep a copy of the other chunks, to check they are not modified.
+	before := make(map[string][]byte)
+	for _, fi := range chunkFiles[:len(chunkFiles)-1] {
+		dataPath := filepath.Join(dir, fi.Name())
+		before[dataPath] = readTestFile(t, dataPath)
+		before[metaFilePath(dataPath)] = readTestFile(t, metaFilePath(dataPath))
+	}
+
+	dataPath := filepath.Join(dir, chunkFiles[len(chunkFiles)-1].Name())
+	corrupt(dataPath, metaFilePath(dataPath))
+
+	if _, err := Open(dir, chunkSize, false); err == nil {
+		t.Fatal("expected damaged database not to open")
+	}
+
+	return vs, before
+}
+
+// Repair a database, and check that exactly the given entries survive and that the other chunks are untouched.
+func assertRepair(t *testing.T, testName string, vs [][]byte, before map[string][]byte) {
+	next, err := Repair("test_db/"+testName, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, bs := range before {
+		assert.True(t, bytes.Equal(bs, readTestFile(t, path)), "expected %s to be untouched", path)
+	}
+	assert.Equal(t, uint64(len(vs))+1, next, "next ID")
+
+	db := assertOpenOptions(t, false, testName, chunkSize)
+	defer assertClose(t, db)
+
+	assert.Equal(t, uint64(len(vs)), db.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, db, uint64(i+1)))
+	}
+
+	// Appending carries on from the recovered entries.
+	assert.Equal(t, next, assertAppend(t, db, []byte("hello")))
+}
+
+/// HELPERS
+
+func readTestMetadata(t *testing.T, metaPath string, version uint16) ([]int32, []uint64) {
+	ends, stamps, err := readMetadata(bytes.NewReader(readTestFile(t, metaPath)), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ends, stamps
+}
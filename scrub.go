@@ -0,0 +1,131 @@
+package logdb
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// How long the scrubber waits before checking again when there was nothing to check.
+const scrubIdleDelay = time.Second
+
+// Start the background scrubber. See 'WithBackgroundScrub'.
+func (db *ChunkDB) startScrub() {
+	db.scrubStop = make(chan struct{})
+	db.scrubDone = make(chan struct{})
+	go db.scrub()
+}
+
+// Stop the background scrubber, if there is one, and wait for it to finish. This must be called without holding
+// the database lock.
+func (db *ChunkDB) stopScrub() {
+	if db.scrubStop == nil {
+		return
+	}
+	db.scrubStopOnce.Do(func() { close(db.scrubStop) })
+	<-db.scrubDone
+}
+
+// Check the entries a chunk at a time, from the oldest to the newest and then round again, until stopped. After
+// each chunk, wait for as long as checking its entries should take at the scrub rate.
+func (db *ChunkDB) scrub() {
+	defer close(db.scrubDone)
+
+	var from uint64
+	for {
+		var checked int
+		from, checked = db.scrubChunk(from)
+		db.deliverEvents()
+
+		delay := scrubIdleDelay
+		if checked > 0 {
+			delay = time.Duration(checked) * time.Second / time.Duration(db.scrubRate)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-db.scrubStop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Check the entries of the chunk holding the given ID, from that ID onwards, under the read lock. If the ID is no
+// longer in the log, the oldest chunk is checked instead. Returns the ID to check next, and the number of bytes of
+// entries checked.
+func (db *ChunkDB) scrubChunk(from uint64) (uint64, int) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	if db.closed {
+		return from, 0
+	}
+	if from < db.oldest || from >= db.next() {
+		from = db.oldest
+	}
+	c, err := db.chunkFor(from)
+	if err != nil {
+		return from, 0
+	}
+
+	first := from - c.oldest
+	start := int32(0)
+	if first > 0 {
+		start = alignUp(c.ends[first-1], c.align)
+	}
+	checked := int(c.ends[len(c.ends)-1] - start)
+
+	err = db.withChunkBytes(c, func(bytes []byte) error {
+		for off := first; off < uint64(len(c.ends)); off++ {
+			if err := checkEntry(c, bytes, off); err != nil {
+				id := c.oldest + off
+				db.observeCorruptEntry(id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.observeCorruptEntry(from, err)
+	}
+	return c.next(), checked
+}
+
+// Tell the observer of a damaged entry, if it is a 'CorruptEntryObserver'.
+func (db *ChunkDB) observeCorruptEntry(id uint64, err error) {
+	db.observe(func(o Observer) {
+		if co, ok := o.(CorruptEntryObserver); ok {
+			co.OnCorruptEntry(id, err)
+		}
+	})
+}
+
+// Check that an entry of a chunk, given its index, lies within the chunk bytes after the entry before it and, with
+// framing, that its frame header gives its size.
+func checkEntry(c *chunk, bytes []byte, off uint64) error {
+	prior := int32(0)
+	if off > 0 {
+		prior = alignUp(c.ends[off-1], c.align)
+	}
+	end := c.ends[off]
+	if end < prior {
+		return &MetaOffsetError{Expected: prior, Actual: end}
+	}
+	if limit := int32(len(bytes)); end > limit {
+		return &MetaBoundsError{Limit: limit, Actual: end}
+	}
+	if !versionHasFraming(c.version) {
+		return nil
+	}
+
+	start, _ := c.entryRange(off)
+	expected := int(end - start)
+	size, n := binary.Uvarint(bytes[prior:end])
+	if n > 0 && size == uint64(expected)+1 {
+		return nil
+	}
+	actual := -1
+	if n > 0 && size > 0 && size-1 <= uint64(len(bytes)) {
+		actual = int(size - 1)
+	}
+	return &FrameError{Expected: expected, Actual: actual}
+}
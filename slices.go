@@ -37,6 +37,39 @@ func (cs chunkSlice) Less(i, j int) bool {
 	return lessFileName(cs[i].path, cs[j].path)
 }
 
+// Numeric sorting of IDs.
+type idSlice []uint64
+
+func (ids idSlice) Len() int {
+	return len(ids)
+}
+
+func (ids idSlice) Swap(i, j int) {
+	ids[i], ids[j] = ids[j], ids[i]
+}
+
+func (ids idSlice) Less(i, j int) bool {
+	return ids[i] < ids[j]
+}
+
+// Sorting of the indices of a slice of IDs, by ID. The 'ids' are not changed.
+type idOrder struct {
+	ids   []uint64
+	order []int
+}
+
+func (o idOrder) Len() int {
+	return len(o.order)
+}
+
+func (o idOrder) Swap(i, j int) {
+	o.order[i], o.order[j] = o.order[j], o.order[i]
+}
+
+func (o idOrder) Less(i, j int) bool {
+	return o.ids[o.order[i]] < o.ids[o.order[j]]
+}
+
 // Compare two filenames with splitting.
 func lessFileName(a, b string) bool {
 	as := strings.Split(a, sep)
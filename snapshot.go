@@ -0,0 +1,199 @@
+package logdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Snapshot writes a consistent copy of the database to the writer as a tar archive, which can be unpacked by
+// 'RestoreSnapshot' or by any other tar tool.
+func (db *ChunkDB) Snapshot(w io.Writer) error {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.Snapshot(w)
+}
+
+// Snapshot writes a consistent copy of the database to the writer as a tar archive, which can be unpacked by
+// 'RestoreSnapshot' or by any other tar tool.
+//
+// The archive holds the "version", "chunk_size", "oldest", and (if entries are padded) "alignment" files, and
+// (if entries have been deleted) the "tombstones" file, followed by the data and metadata files of every chunk.
+// Entries which have not yet been synced are included, as the files are written from the in-memory state rather
+// than copied from disk. Chunk data files are cut off after their final entry, rather than holding the full
+// chunk size, to keep the archive small, and the bytes of deleted entries are zeroed.
+func (db *LockFreeChunkDB) Snapshot(w io.Writer) error {
+	if db.closed {
+		return ErrClosed
+	}
+
+	tw := tar.NewWriter(w)
+	now := db.now()
+	writeEntry := func(name string, bs []byte) error {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(bs)),
+			ModTime:  now,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(bs)
+		return err
+	}
+	writeValue := func(name string, data interface{}) error {
+		buf := new(bytes.Buffer)
+		if err := binary.Write(buf, binary.LittleEndian, data); err != nil {
+			return err
+		}
+		return writeEntry(name, buf.Bytes())
+	}
+
+	if err := writeValue("version", db.version); err != nil {
+		return err
+	}
+	if err := writeValue("chunk_size", db.chunkSizes(db.chunkSize)); err != nil {
+		return err
+	}
+	if err := writeValue("oldest", newOldestRecord(db.oldest)); err != nil {
+		return err
+	}
+	if db.alignment > 1 {
+		if err := writeValue("alignment", db.alignment); err != nil {
+			return err
+		}
+	}
+	if ids := db.tombstoneIDs(); len(ids) > 0 {
+		if err := writeValue(tombstonesFile, ids); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range db.chunks {
+		var used int32
+		if len(c.ends) > 0 {
+			used = c.ends[len(c.ends)-1]
+		}
+		err := db.withChunkBytes(c, func(bytes []byte) error {
+			return writeEntry(filepath.Base(c.path), db.blankDeleted(c, bytes[:used]))
+		})
+		if err != nil {
+			return err
+		}
+
+		meta, err := encodeMetadataFile(c.version, c.ends, c.stamps)
+		if err != nil {
+			return err
+		}
+		if err := writeEntry(filepath.Base(c.metaFilePath()), meta); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// RestoreSnapshot unpacks an archive produced by 'Snapshot' into a new database directory, and checks that the
+// result can be opened. The options are as for 'Open'. The restored database is not left open.
+//
+// Returns 'ErrCorrupt' if the archive is malformed or holds files which don't belong in a database, a
+// 'PathError' value if the path already exists, and the same errors as 'HealthCheck' if the restored database
+// is not consistent. If an error is returned after the directory has been created, it is deleted.
+func RestoreSnapshot(path string, r io.Reader, opts ...Option) error {
+	o := applyOptions(opts)
+	fs := o.fs
+
+	if _, err := fs.Stat(path); err == nil {
+		return &PathError{&os.PathError{Op: "create", Path: path, Err: os.ErrExist}}
+	}
+	if err := fs.MkdirAll(path, os.ModeDir|0755); err != nil {
+		return &PathError{err}
+	}
+
+	err := unpackSnapshot(fs, path, tar.NewReader(r))
+	if err == nil {
+		err = HealthCheck(path, opts...)
+	}
+	if err != nil {
+		_ = removeDatabase(fs, path)
+	}
+	return err
+}
+
+// Write the files in a snapshot archive to a database directory, restoring chunk data files to the full chunk
+// size. If the chunk size has been changed, a chunk whose entries fit in the current size is restored to that
+// size, whatever size it had before.
+func unpackSnapshot(fs FileSystem, path string, tr *tar.Reader) error {
+	var sizes []uint32
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return ErrCorrupt
+		}
+
+		// Only accept the files a database is made of, so that a hostile archive can't write elsewhere.
+		name := hdr.Name
+		isData := isBasenameChunkDataFile(name)
+		switch {
+		case hdr.Typeflag != tar.TypeReg:
+			return ErrCorrupt
+		case name == "version" || name == "oldest" || name == "alignment" || name == tombstonesFile || isBasenameChunkMetaFile(name):
+		case name == "chunk_size":
+			bs, err := ioutil.ReadAll(io.LimitReader(tr, hdr.Size))
+			if err != nil {
+				return ErrCorrupt
+			}
+			if sizes, err = decodeChunkSizes(bs); err != nil {
+				return ErrCorrupt
+			}
+			if err := writeFile(fs, filepath.Join(path, name), sizes); err != nil {
+				return &WriteError{err}
+			}
+			continue
+		case isData:
+			// The chunk size comes first, so data files can be restored to their full size.
+			if sizes == nil {
+				return ErrCorrupt
+			}
+			chunkSize := chunkSizeFor(hdr.Size, sizes)
+			if chunkSize == 0 || hdr.Size > int64(chunkSize) {
+				return ErrCorrupt
+			}
+			if err := createFile(fs, filepath.Join(path, name), chunkSize); err != nil {
+				return &WriteError{err}
+			}
+		default:
+			return ErrCorrupt
+		}
+
+		flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+		if isData {
+			flags = os.O_RDWR
+		}
+		file, err := fs.OpenFile(filepath.Join(path, name), flags, 0644)
+		if err != nil {
+			return &WriteError{err}
+		}
+		n, err := io.Copy(file, tr)
+		if err == nil && n != hdr.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = fsync(file)
+		}
+		_ = file.Close()
+		if err != nil {
+			return &WriteError{err}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package logdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	db := assertOpenOptions(t, true, "snapshot_round_trip", chunkSize)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+
+	// Entries which haven't been synced are included too.
+	assertSetSync(t, db, -1)
+	vs = append(vs, []byte("unsynced"))
+	assertAppend(t, db, []byte("unsynced"))
+
+	buf := new(bytes.Buffer)
+	if err := db.Snapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunk data files only hold their used bytes.
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	var files []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, hdr.Name)
+		if isBasenameChunkDataFile(hdr.Name) {
+			assert.True(t, hdr.Size < chunkSize, "expected %s to be cut short", hdr.Name)
+		}
+	}
+	assert.Equal(t, []string{"version", "chunk_size", "oldest"}, files[:3])
+	assert.Equal(t, 3+2*len(db.chunks), len(files), "expected a data and metadata file per chunk")
+
+	path := "test_db/snapshot_round_trip_restored"
+	_ = os.RemoveAll(path)
+	if err := RestoreSnapshot(path, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := assertOpenOptions(t, false, "snapshot_round_trip_restored", chunkSize)
+	defer assertClose(t, db2)
+
+	assert.Equal(t, uint64(20), db2.OldestID())
+	assert.Equal(t, uint64(len(vs)), db2.NewestID())
+	for id := db2.OldestID(); id <= db2.NewestID(); id++ {
+		assert.Equal(t, vs[id-1], assertGet(t, db2, id))
+	}
+
+	// Restoring over an existing database is refused.
+	err := RestoreSnapshot(path, bytes.NewReader(buf.Bytes()))
+	_, ok := err.(*PathError)
+	assert.True(t, ok, "expected path error, got: %s", err)
+}
+
+func TestSnapshot_RestoreBadArchive(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	bs := []byte("hello")
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0644, Size: int64(len(bs))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(bs); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := "test_db/snapshot_bad_archive"
+	_ = os.RemoveAll(path)
+	assert.Equal(t, ErrCorrupt, RestoreSnapshot(path, buf))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "expected failed restore to be deleted")
+}
@@ -0,0 +1,349 @@
+package logdb
+
+import (
+	"path/filepath"
+	"strconv"
+)
+
+// The smallest batch, in bytes, which 'ChunkDB.AppendEntries' stages rather than appending under the write lock.
+// Smaller batches don't hold the lock for long enough to be worth it.
+const stagedBatchBytes = 4 * 1024 * 1024
+
+// Staged chunk files are named with this prefix and a number. These are not valid chunk filenames, so if the
+// program dies before a staged append is committed they are ignored, and deleted, when the database is next
+// opened.
+const stagedFilePrefix = "staged" + sep
+
+// A stage is a batch of entries on its way to being appended, in new chunks of their own.
+type stage struct {
+	// The state of the database when the stage was planned, to check that it hasn't changed by the time the
+	// stage is committed: the final chunk (nil if there are no chunks) and its number of entries, the next ID,
+	// the rollback count, and the chunk size. The alignment doesn't change.
+	last      *chunk
+	entries   int
+	next      uint64
+	rollbacks uint64
+	chunkSize uint32
+	align     int32
+
+	// The batch, and the earliest timestamp its entries can have.
+	batch [][]byte
+	floor uint64
+
+	// The staged chunks, once written: the number of entries in each, and the total size of the entries.
+	counts []int
+	size   uint64
+}
+
+// Append a large batch of entries by writing them to new chunks without holding the lock, and then taking the
+// write lock only to move the chunks into place, so readers of the existing entries are not blocked while the
+// batch is written. The new entries are not visible until they are all in place. Returns false if the batch was
+// not appended, and should be appended as usual.
+//
+// A batch is staged if it is at least 'stagedBatchBytes' and doesn't fit in the final chunk, which must not be
+// empty or trimmed. The staged chunks start after the final chunk, rather than filling it first, so whatever
+// space is left in it goes unused. If the database changes while the batch is staged, the staged chunks are
+// thrown away and the batch is appended as usual.
+func (db *ChunkDB) appendStaged(entries [][]byte) (uint64, bool, error) {
+	// Most batches are small, so check that before taking any locks.
+	var size int
+	for _, entry := range entries {
+		size += len(entry)
+	}
+	if size < stagedBatchBytes {
+		return 0, false, nil
+	}
+
+	db.stageLock.Lock()
+	defer db.stageLock.Unlock()
+
+	// Plan the stage under the read lock.
+	db.rwlock.RLock()
+	st := db.prepareStage(entries)
+	db.rwlock.RUnlock()
+	if st == nil {
+		return 0, false, nil
+	}
+
+	// Write the staged chunks without holding any lock at all: this is the slow part.
+	err := st.write(db.fs, db.path, db.version, db.now().UnixNano())
+
+	// Move them into place under the write lock.
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if err != nil {
+		removeStagedFiles(db.fs, db.path, len(st.counts))
+		db.noteReadOnly(err)
+		return 0, true, err
+	}
+	if !db.stageValid(st) {
+		removeStagedFiles(db.fs, db.path, len(st.counts))
+		id, err := db.LockFreeChunkDB.AppendEntries(entries)
+		return id, true, err
+	}
+	id, err := db.commitStage(st)
+	return id, true, err
+}
+
+// Plan a stage for a batch of entries. Assumes a lock (read or write) is held.
+//
+// Returns nil if the batch should be appended as usual, which includes when appending it will fail.
+func (db *LockFreeChunkDB) prepareStage(entries [][]byte) *stage {
+	if db.closed || db.readOnly {
+		return nil
+	}
+
+	var size uint64
+	for _, entry := range entries {
+		n := len(entry) + frameHeaderSize(db.version, len(entry))
+		if uint64(n) > uint64(db.chunkSize) {
+			return nil
+		}
+		size += uint64(n)
+	}
+	if size < stagedBatchBytes {
+		return nil
+	}
+
+	st := &stage{
+		next:      db.next(),
+		rollbacks: db.rollbacks,
+		chunkSize: db.chunkSize,
+		align:     int32(db.alignment),
+		batch:     entries,
+		floor:     db.timestamp(),
+	}
+	if len(db.chunks) > 0 {
+		st.last = db.chunks[len(db.chunks)-1]
+		st.entries = len(st.last.ends)
+		if st.entries == 0 || st.last.trimmed {
+			return nil
+		}
+		if uint64(st.last.size)-uint64(st.last.ends[st.entries-1]) >= size {
+			return nil
+		}
+	}
+	return st
+}
+
+// Write the staged chunk files, and sync them to disk. The entries are given the timestamp 'now', or the floor
+// if that is later.
+func (st *stage) write(fs FileSystem, path string, version uint16, now int64) error {
+	stamp := uint64(now)
+	if stamp < st.floor {
+		stamp = st.floor
+	}
+
+	w := &stageWriter{st: st, fs: fs, path: path, version: version}
+	for _, entry := range st.batch {
+		if err := w.add(entry, stamp); err != nil {
+			return err
+		}
+	}
+	return w.flush()
+}
+
+// A stageWriter writes entries to the staged chunk files of a stage, one chunk at a time, so only the chunk
+// being filled is held in memory.
+type stageWriter struct {
+	st      *stage
+	fs      FileSystem
+	path    string
+	version uint16
+
+	// The chunk being filled.
+	bytes  []byte
+	ends   []int32
+	stamps []uint64
+}
+
+// Add an entry, with the given timestamp, writing out the chunk being filled first if the entry doesn't fit in
+// it. The entry must fit in an empty chunk.
+func (w *stageWriter) add(entry []byte, stamp uint64) error {
+	hdrSize := frameHeaderSize(w.version, len(entry))
+	start := int(alignUp(int32(len(w.bytes)), w.st.align))
+	if uint64(start+hdrSize+len(entry)) > uint64(w.st.chunkSize) {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		start = 0
+	}
+	w.bytes = append(w.bytes, make([]byte, start-len(w.bytes))...)
+	if hdrSize > 0 {
+		w.bytes = append(w.bytes, frameHeader(len(entry))...)
+	}
+	w.bytes = append(w.bytes, entry...)
+	w.ends = append(w.ends, int32(len(w.bytes)))
+	if versionHasTimestamps(w.version) {
+		w.stamps = append(w.stamps, stamp)
+	}
+	w.st.size += uint64(len(entry))
+	return nil
+}
+
+// Write out the chunk being filled, if it has any entries, as the next staged chunk, and sync it to disk.
+func (w *stageWriter) flush() error {
+	if len(w.ends) == 0 {
+		return nil
+	}
+	dataPath := filepath.Join(w.path, stagedFileName(len(w.st.counts)))
+	w.st.counts = append(w.st.counts, len(w.ends))
+	if err := writeChunkFiles(w.fs, dataPath, w.version, w.st.chunkSize, w.bytes, w.ends, w.stamps); err != nil {
+		return err
+	}
+	w.bytes, w.ends, w.stamps = w.bytes[:0], w.ends[:0], w.stamps[:0]
+	return nil
+}
+
+// Check that the database hasn't changed in a way which stops a stage being committed since it was planned.
+// Assumes a write lock is held.
+func (db *LockFreeChunkDB) stageValid(st *stage) bool {
+	if db.closed || db.readOnly || db.next() != st.next || db.rollbacks != st.rollbacks || db.chunkSize != st.chunkSize {
+		return false
+	}
+	if len(db.chunks) == 0 {
+		return st.last == nil
+	}
+	last := db.chunks[len(db.chunks)-1]
+	return last == st.last && len(last.ends) == st.entries && !last.trimmed
+}
+
+// Move the staged chunk files into place after the final chunk, and open them, and then account for the new
+// entries. Assumes a write lock is held.
+//
+// If a chunk can't be moved into place or opened, the chunks of the stage which already have been are deleted, so
+// none of the batch is appended.
+func (db *LockFreeChunkDB) commitStage(st *stage) (uint64, error) {
+	defer db.updateNewest()
+
+	if err := db.moveStagedChunks(st); err != nil {
+		return 0, err
+	}
+
+	if db.oldest == 0 {
+		db.setOldest(1)
+	}
+	db.sinceLastSync += uint64(len(st.batch))
+	db.bytesSinceLastSync += st.size
+
+	if db.observer != nil {
+		for i, entry := range st.batch {
+			id, size := st.next+uint64(i), len(entry)
+			db.observe(func(o Observer) { o.OnAppend(id, size) })
+		}
+	}
+
+	// The staged chunks are mapped, but only the newest need to stay that way.
+	if err := db.trimStagedMappings(); err != nil {
+		return st.next, err
+	}
+
+	if err := db.periodicSync(); err != nil {
+		return st.next, err
+	}
+	return st.next, db.enforceMaxBytes(0)
+}
+
+// Move the staged chunk files into place after 'st.last', which must be the final chunk, and open them. Assumes
+// a write lock is held.
+//
+// If a chunk can't be moved into place or opened, the chunks of the stage which already have been are deleted,
+// as are the staged files.
+func (db *LockFreeChunkDB) moveStagedChunks(st *stage) error {
+	// As with a new chunk, the final chunk must be synced before any chunk after it is created.
+	if st.last != nil {
+		if err := db.syncOne(st.last); err != nil {
+			removeStagedFiles(db.fs, db.path, len(st.counts))
+			return err
+		}
+	}
+
+	numChunks := len(db.chunks)
+	abort := func(err error) error {
+		for _, c := range db.chunks[numChunks:] {
+			_ = c.closeAndRemove()
+		}
+		db.chunks = db.chunks[:numChunks]
+		removeStagedFiles(db.fs, db.path, len(st.counts))
+		db.noteReadOnly(err)
+		return err
+	}
+
+	next := st.next
+	for i, count := range st.counts {
+		chunkFile := filepath.Join(db.path, initialDataFileName(next))
+		if len(db.chunks) > 0 {
+			chunkFile = filepath.Join(db.path, db.chunks[len(db.chunks)-1].nextDataFileName(next))
+		}
+
+		// As when compacting, first the metadata, as metadata without a data file is ignored; then the data.
+		stagedFile := filepath.Join(db.path, stagedFileName(i))
+		if err := db.fs.Rename(metaFilePath(stagedFile), metaFilePath(chunkFile)); err != nil {
+			return abort(&WriteError{err})
+		}
+		if err := db.fs.Rename(stagedFile, chunkFile); err != nil {
+			_ = db.fs.Remove(metaFilePath(chunkFile))
+			return abort(&WriteError{err})
+		}
+
+		fi, err := db.fs.Stat(chunkFile)
+		if err != nil {
+			_ = db.fs.Remove(chunkFile)
+			_ = db.fs.Remove(metaFilePath(chunkFile))
+			return abort(&ReadError{err})
+		}
+		var prior *chunk
+		if len(db.chunks) > 0 {
+			prior = db.chunks[len(db.chunks)-1]
+		}
+		c, err := openChunkFile(db.fs, db.backend, db.version, db.path, fi, prior, st.chunkSize)
+		if err != nil {
+			_ = db.fs.Remove(chunkFile)
+			_ = db.fs.Remove(metaFilePath(chunkFile))
+			return abort(err)
+		}
+		c.align = int32(db.alignment)
+		db.chunks = append(db.chunks, &c)
+		if db.logger != nil {
+			db.log("debug", "new chunk", "path", c.path, "oldest", c.oldest)
+		}
+		if db.accessPattern != AccessNormal {
+			if err := db.advise(&c); err != nil {
+				return abort(err)
+			}
+		}
+		next += uint64(count)
+	}
+	if err := dirSync(db.fs, db.path); err != nil {
+		return abort(&SyncError{err})
+	}
+	db.lockNewest()
+	return nil
+}
+
+// Unmap the chunks beyond the mapping limit, if there is one, after staged chunks have been moved into place.
+// Assumes a write lock is held.
+func (db *LockFreeChunkDB) trimStagedMappings() error {
+	if db.maxMappedChunks == 0 {
+		return nil
+	}
+	db.mapLock.Lock()
+	defer db.mapLock.Unlock()
+	return db.trimMappings(nil)
+}
+
+// Get the name of a staged chunk data file.
+func stagedFileName(i int) string {
+	return stagedFilePrefix + strconv.Itoa(i)
+}
+
+// Delete the files of the given number of staged chunks, if they exist.
+func removeStagedFiles(fs FileSystem, path string, count int) {
+	for i := 0; i < count; i++ {
+		stagedFile := filepath.Join(path, stagedFileName(i))
+		_ = fs.Remove(stagedFile)
+		_ = fs.Remove(metaFilePath(stagedFile))
+	}
+}
@@ -0,0 +1,322 @@
+package logdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Stats are statistics about a 'LockFreeChunkDB', for monitoring.
+type Stats struct {
+	// The number of chunks.
+	Chunks int
+
+	// The number of chunks which are currently memory-mapped. This is the same as 'Chunks' unless the
+	// 'WithMaxMappedChunks' option is used.
+	MappedChunks int
+
+	// The number of entries in the read cache, and the number of reads which found the entry there and which
+	// didn't, since the database was opened. These are all 0 unless the 'WithReadCache' option is used.
+	CachedEntries int
+	CacheHits     uint64
+	CacheMisses   uint64
+}
+
+// Stats gets statistics about the database, atomically.
+func (db *ChunkDB) Stats() Stats {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.Stats()
+}
+
+// Stats gets statistics about the database.
+func (db *LockFreeChunkDB) Stats() Stats {
+	if db.maxMappedChunks > 0 {
+		db.mapLock.Lock()
+		defer db.mapLock.Unlock()
+	}
+
+	stats := Stats{Chunks: len(db.chunks)}
+	for _, c := range db.chunks {
+		if c.bytes != nil {
+			stats.MappedChunks++
+		}
+	}
+	stats.CacheHits, stats.CacheMisses, stats.CachedEntries = db.cache.stats()
+	return stats
+}
+
+// DataBytes gets the number of bytes the entries take up in the chunk data files, atomically. See the
+// 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) DataBytes() uint64 {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.DataBytes()
+}
+
+// DataBytes gets the number of bytes the entries take up in the chunk data files. This is worked out from the
+// chunk metadata alone, so it takes time proportional to the number of chunks, not the number of entries, and
+// touches no files: unlike 'DiskUsage', it doesn't count the unused space at the end of chunks, or the metadata.
+//
+// Unless the database has framing or alignment (see 'WithFraming' and 'WithAlignment'), this is the total size of
+// the entries, as found by getting every one. With them, it also counts the frame headers and the padding between
+// entries. Deleted entries are counted until their chunk is compacted or forgotten.
+func (db *LockFreeChunkDB) DataBytes() uint64 {
+	var total uint64
+	for _, c := range db.chunks {
+		if len(c.ends) == 0 || c.next() <= db.oldest {
+			continue
+		}
+		var start int32
+		if db.oldest > c.oldest {
+			start = alignUp(c.ends[db.oldest-c.oldest-1], c.align)
+		}
+		total += uint64(c.ends[len(c.ends)-1] - start)
+	}
+	return total
+}
+
+// WriteMetrics writes metrics about the database to a writer, atomically. See the 'LockFreeChunkDB' method for
+// details.
+func (db *ChunkDB) WriteMetrics(w io.Writer) error {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.WriteMetrics(w)
+}
+
+// WriteMetrics writes metrics about the database to a writer, in the Prometheus text exposition format, so that
+// it can be scraped without a client library. The metrics, all gauges, are:
+//
+//  - logdb_entries: the number of entries, as 'Len'.
+//  - logdb_chunks: the number of chunks.
+//  - logdb_disk_bytes: the total size of the files in the database directory, as 'DiskUsage'.
+//  - logdb_oldest_id: the ID of the oldest entry, as 'OldestID'.
+//  - logdb_next_id: the ID the next appended entry will have.
+//  - logdb_bytes_since_sync: the number of bytes appended since the last sync.
+//
+// Every value is found before anything is written. Returns a 'ReadError' value if the disk usage can't be
+// found, in which case nothing is written, and the error of the writer if writing fails.
+func (db *LockFreeChunkDB) WriteMetrics(w io.Writer) error {
+	if db.closed {
+		return ErrClosed
+	}
+
+	usage, err := db.diskUsage()
+	if err != nil {
+		return &ReadError{err}
+	}
+
+	// Syncing can happen under a read lock, and resets the byte count.
+	db.slock.Lock()
+	sinceSync := db.bytesSinceLastSync
+	db.slock.Unlock()
+
+	metrics := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"logdb_entries", "Number of entries in the log.", db.Len()},
+		{"logdb_chunks", "Number of chunks.", uint64(len(db.chunks))},
+		{"logdb_disk_bytes", "Total size of the files in the database directory, in bytes.", usage},
+		{"logdb_oldest_id", "ID of the oldest entry.", db.oldest},
+		{"logdb_next_id", "ID the next appended entry will have.", db.next()},
+		{"logdb_bytes_since_sync", "Bytes appended since the last sync.", sinceSync},
+	}
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// ChunkInfo describes one chunk of a 'LockFreeChunkDB', for debugging.
+type ChunkInfo struct {
+	// The path of the chunk data file.
+	Path string
+
+	// The ID of the oldest entry in the chunk, which may have been forgotten, and one past the newest.
+	OldestID uint64
+	NextID   uint64
+
+	// The number of entries in the chunk, including any which have been forgotten, and the number of bytes of
+	// the chunk data file they take up.
+	Entries   int
+	UsedBytes uint32
+
+	// The chunk size the chunk was created with. This is the chunk size of the database, unless that has been
+	// changed with 'SetChunkSize' since.
+	Size uint32
+
+	// Whether the chunk has changes which have not yet been synced to disk.
+	Dirty bool
+}
+
+// Chunks describes the chunks of the database, oldest first, atomically.
+func (db *ChunkDB) Chunks() []ChunkInfo {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.Chunks()
+}
+
+// Chunks describes the chunks of the database, oldest first. This shows how entries are laid out on disk, for
+// example to see why forgetting entries hasn't freed any space: a chunk is only deleted once every entry in it
+// has been forgotten.
+func (db *LockFreeChunkDB) Chunks() []ChunkInfo {
+	// Syncing can happen under a read lock, and changes which chunks are dirty.
+	db.slock.Lock()
+	defer db.slock.Unlock()
+
+	infos := make([]ChunkInfo, len(db.chunks))
+	for i, c := range db.chunks {
+		_, dirty := db.syncDirty[c]
+		infos[i] = ChunkInfo{
+			Path:     c.path,
+			OldestID: c.oldest,
+			NextID:   c.next(),
+			Entries:  len(c.ends),
+			Size:     c.size,
+			Dirty:    dirty,
+		}
+		if len(c.ends) > 0 {
+			infos[i].UsedBytes = uint32(c.ends[len(c.ends)-1])
+		}
+	}
+	return infos
+}
+
+// LocateID finds where an entry is stored on disk, atomically. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) LocateID(id uint64) (string, int32, int32, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.LocateID(id)
+}
+
+// LocateID finds where an entry is stored on disk, for debugging. Returns the path of the chunk data file which
+// holds the entry, and the offsets in that file of the first byte of the entry and one past the last. The entry
+// itself is not read.
+//
+// Returns 'ErrIDOutOfRange' if the requested ID is not present in the log.
+func (db *LockFreeChunkDB) LocateID(id uint64) (string, int32, int32, error) {
+	if db.closed {
+		return "", 0, 0, ErrClosed
+	}
+
+	c, err := db.chunkFor(id)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	start, end := c.entryRange(id - c.oldest)
+	return c.path, start, end, nil
+}
+
+// ChunkReader gives the entries of one chunk as a single block of bytes. See the 'LockFreeChunkDB' method for
+// details. The bytes are copied, so the reader can be used after the database has changed.
+func (db *ChunkDB) ChunkReader(index int) (io.Reader, []int32, uint64, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	if db.closed {
+		return nil, nil, 0, ErrClosed
+	}
+	bs, ends, oldest, err := db.chunkBytes(index, true)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return bytes.NewReader(bs), ends, oldest, nil
+}
+
+// ChunkReader gives the entries of one chunk as a single block of bytes, so that they can be copied in bulk, for
+// example to a replica, rather than one at a time. The index is as for 'Chunks'. Returns a reader over the bytes
+// of the entries, one past their ending offsets in those bytes, and the ID of the first. Entries which have been
+// forgotten are left out.
+//
+// Unless the number of memory-mapped chunks is limited, the reader reads straight from the chunk file, and must
+// not be used after the database has changed.
+//
+// Returns 'ErrIDOutOfRange' if there is no chunk with that index, or all of its entries have been forgotten.
+func (db *LockFreeChunkDB) ChunkReader(index int) (io.Reader, []int32, uint64, error) {
+	if db.closed {
+		return nil, nil, 0, ErrClosed
+	}
+
+	// The chunk may be unmapped as soon as another is read, if the number of mapped chunks is limited.
+	bs, ends, oldest, err := db.chunkBytes(index, db.maxMappedChunks > 0)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return bytes.NewReader(bs), ends, oldest, nil
+}
+
+// Get the bytes of the entries in a chunk which haven't been forgotten, copying them if asked to, along with
+// their ends relative to the first and the first ID. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) chunkBytes(index int, copyBytes bool) ([]byte, []int32, uint64, error) {
+	if index < 0 || index >= len(db.chunks) {
+		return nil, nil, 0, ErrIDOutOfRange
+	}
+
+	c := db.chunks[index]
+	oldest := c.oldest
+	if oldest < db.oldest {
+		oldest = db.oldest
+	}
+	if oldest >= c.next() {
+		return nil, nil, 0, ErrIDOutOfRange
+	}
+
+	// Offsets are relative to the start of the first entry which hasn't been forgotten.
+	off := oldest - c.oldest
+	if versionHasFraming(c.version) || c.align > 1 {
+		return db.unframedChunkBytes(c, off, oldest)
+	}
+	start := int32(0)
+	if off > 0 {
+		start = c.ends[off-1]
+	}
+	ends := make([]int32, len(c.ends)-int(off))
+	for i := range ends {
+		ends[i] = c.ends[int(off)+i] - start
+	}
+	end := c.ends[len(c.ends)-1]
+
+	var out []byte
+	err := db.withChunkBytes(c, func(bs []byte) error {
+		if copyBytes {
+			out = append([]byte(nil), bs[start:end]...)
+		} else {
+			out = bs[start:end:end]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return out, ends, oldest, nil
+}
+
+// Get the bytes of the entries in a chunk with framing or alignment from index 'off' onwards, as 'chunkBytes'
+// does. The frame headers and padding are left out, so the bytes are always copied. Assumes a lock (read or
+// write) is held.
+func (db *LockFreeChunkDB) unframedChunkBytes(c *chunk, off uint64, oldest uint64) ([]byte, []int32, uint64, error) {
+	var out []byte
+	ends := make([]int32, 0, len(c.ends)-int(off))
+	err := db.withChunkBytes(c, func(bs []byte) error {
+		for i := off; i < uint64(len(c.ends)); i++ {
+			start, end := c.entryRange(i)
+			out = append(out, bs[start:end]...)
+			ends = append(ends, int32(len(out)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return out, ends, oldest, nil
+}
@@ -0,0 +1,357 @@
+package logdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// The magic number at the start of a serialised database stream.
+var streamMagic = [8]byte{'l', 'o', 'g', 'd', 'b', 's', 't', 'r'}
+
+// The header of a serialised database stream. This is followed by 'Count' records, each of the form [id
+// uint64][length uint32][bytes], with the IDs contiguous and starting from 'Oldest'.
+type streamHeader struct {
+	Magic  [8]byte
+	Oldest uint64
+	Count  uint64
+}
+
+// WriteTo implements the 'io.WriterTo' interface, writing every entry in the database to the writer, in a
+// format which records the entry IDs.
+func (db *ChunkDB) WriteTo(w io.Writer) (int64, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.WriteTo(w)
+}
+
+// WriteTo implements the 'io.WriterTo' interface, writing every entry in the database to the writer, in a
+// format which records the entry IDs. Deleted entries are written as empty entries, so the IDs stay contiguous.
+//
+// Entries are written straight from the chunk files, so the whole database is never held in memory at once.
+func (db *LockFreeChunkDB) WriteTo(w io.Writer) (int64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+	return db.writeStream(w, db.oldest)
+}
+
+// BackupSince writes the entries with IDs greater than the given one to the writer, in the same format as
+// 'WriteTo'. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) BackupSince(sinceID uint64, w io.Writer) (uint64, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.BackupSince(sinceID, w)
+}
+
+// BackupSince writes the entries with IDs greater than the given one to the writer, in the same format as
+// 'WriteTo', and returns the newest ID written. This is an incremental backup: passing the returned ID to the
+// next call writes only the entries appended in between. The stream can be applied to a copy of the database
+// with 'ReadFrom'. If the given ID is older than the oldest entry, the stream starts from the oldest entry, and
+// if there are no newer entries, the stream is empty and the given ID is returned.
+//
+// Returns 'ErrIDOutOfRange' if the given ID is newer than the newest entry.
+func (db *LockFreeChunkDB) BackupSince(sinceID uint64, w io.Writer) (uint64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if sinceID >= db.next() {
+		return 0, ErrIDOutOfRange
+	}
+
+	fromID := sinceID + 1
+	if fromID < db.oldest {
+		fromID = db.oldest
+	}
+	if _, err := db.writeStream(w, fromID); err != nil {
+		return 0, err
+	}
+	if fromID == db.next() {
+		return sinceID, nil
+	}
+	return db.next() - 1, nil
+}
+
+// Write the entries from the given ID onwards as a stream. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) writeStream(w io.Writer, fromID uint64) (int64, error) {
+	cw := &countingWriter{w: w}
+
+	header := streamHeader{Magic: streamMagic, Oldest: fromID}
+	if fromID > 0 {
+		header.Count = db.next() - fromID
+	}
+	if err := binary.Write(cw, binary.LittleEndian, header); err != nil {
+		return cw.n, err
+	}
+
+	for _, c := range db.chunks {
+		if c.next() <= fromID {
+			continue
+		}
+		err := db.withChunkBytes(c, func(bytes []byte) error {
+			for id := c.oldest; id < c.next(); id++ {
+				if id < fromID {
+					continue
+				}
+				start, end := c.entryRange(id - c.oldest)
+				if db.isDeleted(id) {
+					start = end
+				}
+
+				if err := binary.Write(cw, binary.LittleEndian, id); err != nil {
+					return err
+				}
+				if err := binary.Write(cw, binary.LittleEndian, uint32(end-start)); err != nil {
+					return err
+				}
+				if _, err := cw.Write(bytes[start:end]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return cw.n, err
+		}
+	}
+
+	return cw.n, nil
+}
+
+// A line of JSON Lines output. Exactly one of 'Data' and 'Text' is set.
+type jsonlEntry struct {
+	ID   uint64  `json:"id"`
+	Data *[]byte `json:"data,omitempty"`
+	Text *string `json:"text,omitempty"`
+}
+
+// ExportJSONL writes every entry in the database to the writer as JSON Lines (newline-delimited JSON objects).
+// See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) ExportJSONL(w io.Writer, asText bool) error {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.LockFreeChunkDB.ExportJSONL(w, asText)
+}
+
+// ExportJSONL writes every entry in the database to the writer as JSON Lines (newline-delimited JSON objects),
+// one entry per line, in ID order, skipping deleted entries. Each object has an "id" field, and a "data" field
+// holding the base64-encoded entry. If 'asText' is true then entries which are valid UTF-8 instead have a "text"
+// field holding the entry as a string.
+//
+// This is intended for debugging and ad-hoc analysis: use 'WriteTo' for backups.
+func (db *LockFreeChunkDB) ExportJSONL(w io.Writer, asText bool) error {
+	if db.closed {
+		return ErrClosed
+	}
+
+	enc := json.NewEncoder(w)
+	for _, c := range db.chunks {
+		err := db.withChunkBytes(c, func(bytes []byte) error {
+			for id := c.oldest; id < c.next(); id++ {
+				if id < db.oldest || db.isDeleted(id) {
+					continue
+				}
+				start, end := c.entryRange(id - c.oldest)
+				entry := bytes[start:end]
+
+				line := jsonlEntry{ID: id}
+				if asText && utf8.Valid(entry) {
+					text := string(entry)
+					line.Text = &text
+				} else {
+					line.Data = &entry
+				}
+				if err := enc.Encode(line); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OpenFromStream creates a new 'LockFreeChunkDB' containing the entries read from a stream produced by 'WriteTo'.
+// The entries keep their original IDs. The chunk size and options are as for 'Open'.
+//
+// Returns 'ErrCorrupt' if the stream is malformed or truncated, a 'PathError' value if the path already
+// exists, and the same errors as 'Open' and 'Append'. If an error is returned after the database has been
+// created, it is closed and deleted.
+func OpenFromStream(path string, chunkSize uint32, r io.Reader, opts ...Option) (*LockFreeChunkDB, error) {
+	o := applyOptions(opts)
+
+	if _, err := o.fs.Stat(path); err == nil {
+		return nil, &PathError{&os.PathError{Op: "create", Path: path, Err: os.ErrExist}}
+	}
+
+	db, err := createdb(path, chunkSize, o.createVersion(), o)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.readFrom(bufio.NewReader(r)); err != nil {
+		_ = db.Close()
+		_ = removeDatabase(o.fs, path)
+		return nil, err
+	}
+	return db, nil
+}
+
+// ReadFrom implements the 'io.ReaderFrom' interface, appending the entries from a stream produced by 'WriteTo'
+// or 'BackupSince'. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) ReadFrom(r io.Reader) (int64, error) {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.ReadFrom(r)
+}
+
+// ReadFrom implements the 'io.ReaderFrom' interface, appending the entries from a stream produced by 'WriteTo'
+// or 'BackupSince', and then syncing. The entries keep their IDs, so a database which has never had any entries
+// takes on the IDs of the stream, and otherwise the stream must carry on from the newest entry. This applies
+// incremental backups to a copy of the database.
+//
+// If an error is returned, the entries read are rolled back, or forgotten if the database had no entries before.
+//
+// Returns 'ErrCorrupt' if the stream is malformed or truncated, 'ErrConflict' if the stream doesn't carry on
+// from the newest entry, and the same errors as 'Append'.
+func (db *LockFreeChunkDB) ReadFrom(r io.Reader) (int64, error) {
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	cr := &countingReader{r: r}
+	originalNext := db.next()
+	err := db.readFrom(cr)
+	if err != nil && db.next() > originalNext {
+		var rerr error
+		if originalNext > db.oldest {
+			rerr = db.Rollback(originalNext - 1)
+		} else {
+			rerr = db.forgetUpTo(db.next())
+		}
+		if rerr == nil {
+			rerr = db.sync()
+		}
+		if rerr != nil {
+			return cr.n, &AtomicityError{AppendErr: err, RollbackErr: rerr}
+		}
+	}
+	db.noteReadOnly(err)
+	return cr.n, err
+}
+
+// Append all the entries from a stream produced by 'WriteTo' or 'BackupSince', preserving their IDs. If the
+// database has never had any entries, the IDs start from the oldest in the stream.
+func (db *LockFreeChunkDB) readFrom(r io.Reader) error {
+	var header streamHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return ErrCorrupt
+	}
+	if header.Magic != streamMagic {
+		return ErrCorrupt
+	}
+
+	if len(db.chunks) > 0 || db.oldest > 0 {
+		if header.Count > 0 && header.Oldest != db.next() {
+			return ErrConflict
+		}
+	} else if header.Oldest > 0 {
+		// Entries start from the oldest ID in the stream.
+		db.setOldest(header.Oldest)
+		db.updateNewest()
+		if err := writeOldestFile(db.fs, db.path, db.oldest); err != nil {
+			return &WriteError{err}
+		}
+	}
+
+	// Only sync once all the entries are in.
+	syncEvery, syncBytes := db.syncEvery, db.syncBytes
+	db.syncEvery, db.syncBytes = -1, 0
+	defer func() { db.syncEvery, db.syncBytes = syncEvery, syncBytes }()
+
+	var entry []byte
+	for i := uint64(0); i < header.Count; i++ {
+		var id uint64
+		var length uint32
+		if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+			return ErrCorrupt
+		}
+		if id != header.Oldest+i {
+			return ErrCorrupt
+		}
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return ErrCorrupt
+		}
+		if length > db.chunkSize {
+			return ErrTooBig
+		}
+
+		if uint32(cap(entry)) < length {
+			entry = make([]byte, length)
+		}
+		entry = entry[:length]
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return ErrCorrupt
+		}
+
+		if _, err := db.Append(entry); err != nil {
+			return err
+		}
+	}
+
+	return db.Sync()
+}
+
+// Delete all the files in a database directory, and then the directory itself.
+func removeDatabase(fs FileSystem, path string) error {
+	fis, err := fs.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err := fs.Remove(filepath.Join(path, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return fs.Remove(path)
+}
+
+// A reader which keeps track of how many bytes have been read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// A writer which keeps track of how many bytes have been written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
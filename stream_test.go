@@ -0,0 +1,226 @@
+package logdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStream_WriteTo(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "stream_write_to", chunkSize).(*LockFreeChunkDB)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+
+	buf := new(bytes.Buffer)
+	n, err := db.WriteTo(buf)
+	assert.Nil(t, err, "failed to write stream: %s", err)
+	assert.Equal(t, int64(buf.Len()), n, "reported length")
+
+	var header streamHeader
+	if err := binary.Read(buf, binary.LittleEndian, &header); err != nil {
+		t.Fatal("could not read header:", err)
+	}
+	assert.Equal(t, streamMagic, header.Magic)
+	assert.Equal(t, db.OldestID(), header.Oldest)
+	assert.Equal(t, db.NewestID()+1-db.OldestID(), header.Count)
+
+	var records uint64
+	for {
+		var id uint64
+		var length uint32
+		if err := binary.Read(buf, binary.LittleEndian, &id); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("could not read record ID:", err)
+		}
+		if err := binary.Read(buf, binary.LittleEndian, &length); err != nil {
+			t.Fatal("could not read record length:", err)
+		}
+		entry := make([]byte, length)
+		if _, err := io.ReadFull(buf, entry); err != nil {
+			t.Fatal("could not read record bytes:", err)
+		}
+
+		assert.Equal(t, header.Oldest+records, id)
+		assert.Equal(t, vs[id-1], entry)
+		records++
+	}
+	assert.Equal(t, header.Count, records)
+}
+
+func TestStream_RoundTrip(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "stream_round_trip", chunkSize).(*LockFreeChunkDB)
+	vs := filldb(t, db, numEntries)
+	assertForget(t, db, 20)
+	buf := assertWriteTo(t, db)
+	assertClose(t, db)
+
+	_ = os.RemoveAll("test_db/stream_round_trip_restored")
+	restored, err := OpenFromStream("test_db/stream_round_trip_restored", chunkSize, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, uint64(20), restored.OldestID())
+	assert.Equal(t, uint64(len(vs)), restored.NewestID())
+	for i := restored.OldestID(); i <= restored.NewestID(); i++ {
+		assert.Equal(t, vs[i-1], assertGet(t, restored, i))
+	}
+
+	// The restored IDs persist.
+	assertClose(t, restored)
+	reopened := assertOpen(t, dbTypes["lock free chunkdb"], false, "stream_round_trip_restored", chunkSize)
+	defer assertClose(t, reopened)
+	assert.Equal(t, uint64(20), reopened.OldestID())
+	assert.Equal(t, uint64(len(vs)), reopened.NewestID())
+}
+
+func TestStream_BackupSince(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "stream_backup_since", chunkSize).(*LockFreeChunkDB)
+	defer assertClose(t, db)
+	vs := filldb(t, db, 100)
+
+	full := new(bytes.Buffer)
+	newest, err := db.BackupSince(0, full)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), newest)
+
+	_ = os.RemoveAll("test_db/stream_backup_since_restored")
+	restored, err := OpenFromStream("test_db/stream_backup_since_restored", chunkSize, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer assertClose(t, restored)
+
+	// The incremental backup holds only the new entries.
+	for i := 100; i < 150; i++ {
+		vs = append(vs, []byte(fmt.Sprintf("new entry %v", i)))
+		assertAppend(t, db, vs[i])
+	}
+	incremental := new(bytes.Buffer)
+	newest, err = db.BackupSince(newest, incremental)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(150), newest)
+
+	var header streamHeader
+	if err := binary.Read(bytes.NewReader(incremental.Bytes()), binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(101), header.Oldest)
+	assert.Equal(t, uint64(50), header.Count)
+
+	n, err := restored.ReadFrom(bytes.NewReader(incremental.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(incremental.Len()), n, "bytes read")
+	assert.Equal(t, uint64(150), restored.NewestID())
+	for i, v := range vs {
+		assert.Equal(t, v, assertGet(t, restored, uint64(i+1)))
+	}
+
+	// With nothing new, the backup is empty.
+	empty := new(bytes.Buffer)
+	newest, err = db.BackupSince(newest, empty)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(150), newest)
+	_, err = restored.ReadFrom(empty)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(150), restored.NewestID())
+
+	// A backup which doesn't carry on from the newest entry is refused, and nothing is appended.
+	_, err = restored.ReadFrom(bytes.NewReader(incremental.Bytes()))
+	assert.Equal(t, ErrConflict, err)
+	assert.Equal(t, uint64(150), restored.NewestID())
+
+	_, err = db.BackupSince(151, new(bytes.Buffer))
+	assert.Equal(t, ErrIDOutOfRange, err)
+}
+
+func TestStream_ReadFromTruncatedRollsBack(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "stream_read_from_truncated", chunkSize).(*LockFreeChunkDB)
+	defer assertClose(t, db)
+	filldb(t, db, 100)
+	for i := 100; i < 150; i++ {
+		assertAppend(t, db, []byte(fmt.Sprintf("new entry %v", i)))
+	}
+	buf := new(bytes.Buffer)
+	if _, err := db.BackupSince(100, buf); err != nil {
+		t.Fatal(err)
+	}
+	assertRollback(t, db, 100)
+
+	_, err := db.ReadFrom(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	assert.Equal(t, ErrCorrupt, err)
+	assert.Equal(t, uint64(100), db.NewestID(), "expected partial read to be rolled back")
+}
+
+func TestStream_NoReadTruncated(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "stream_truncated", chunkSize).(*LockFreeChunkDB)
+	filldb(t, db, numEntries)
+	buf := assertWriteTo(t, db)
+	assertClose(t, db)
+
+	for _, length := range []int{0, 10, buf.Len() / 2, buf.Len() - 1} {
+		_ = os.RemoveAll("test_db/stream_truncated_restored")
+		_, err := OpenFromStream("test_db/stream_truncated_restored", chunkSize, bytes.NewReader(buf.Bytes()[:length]))
+		assert.Equal(t, ErrCorrupt, err, "length %v", length)
+
+		_, err = os.Stat("test_db/stream_truncated_restored")
+		assert.True(t, os.IsNotExist(err), "expected partially restored database to be deleted")
+	}
+}
+
+func TestStream_ExportJSONL(t *testing.T) {
+	db := assertOpen(t, dbTypes["lock free chunkdb"], true, "stream_export_jsonl", chunkSize).(*LockFreeChunkDB)
+	defer assertClose(t, db)
+
+	vs := filldb(t, db, numEntries)
+	binaryEntry := []byte{0xff, 0xfe, 0x00, 0x01}
+	vs = append(vs, binaryEntry)
+	assertAppend(t, db, binaryEntry)
+
+	for _, asText := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		if err := db.ExportJSONL(buf, asText); err != nil {
+			t.Fatal(err)
+		}
+
+		var lines int
+		scanner := bufio.NewScanner(buf)
+		for scanner.Scan() {
+			var line jsonlEntry
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatal("could not decode line:", err)
+			}
+			lines++
+
+			assert.Equal(t, uint64(lines), line.ID)
+			if asText && line.ID <= numEntries {
+				assert.Nil(t, line.Data, "expected text for entry %v", line.ID)
+				assert.Equal(t, string(vs[line.ID-1]), *line.Text)
+			} else {
+				assert.Nil(t, line.Text, "expected data for entry %v", line.ID)
+				assert.Equal(t, vs[line.ID-1], *line.Data)
+			}
+		}
+		assert.Equal(t, len(vs), lines, "line count")
+	}
+}
+
+/// ASSERTIONS
+
+func assertWriteTo(t *testing.T, db *LockFreeChunkDB) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	if _, err := db.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
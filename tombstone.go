@@ -0,0 +1,179 @@
+package logdb
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The "tombstones" file holds the IDs of deleted entries, in order. It only exists once an entry has been
+// deleted, and is replaced through this temporary file.
+const (
+	tombstonesFile    = "tombstones"
+	tombstonesTmpFile = tombstonesFile + sep + "new"
+)
+
+// Delete marks an entry as deleted, atomically. See the 'LockFreeChunkDB' method for details.
+func (db *ChunkDB) Delete(id uint64) error {
+	defer db.deliverEvents()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	return db.LockFreeChunkDB.Delete(id)
+}
+
+// Delete marks an entry as deleted, without renumbering any entries: unlike 'Excise', every other ID keeps
+// referring to the same entry. Getting a deleted entry returns 'ErrDeleted', and 'Iterator', 'Scan', and the
+// other ways of visiting every entry skip it. This is for erasing a single record, such as to comply with a
+// request to remove personal data, without breaking references to the others.
+//
+// The deletion is durable once this returns, but the bytes of the entry stay in the chunk file until the chunk
+// is forgotten or compacted: compaction (see 'WithCompactThreshold') drops them, and counts them as free space
+// when deciding whether a chunk is worth compacting. Backups made by 'WriteTo' and 'BackupSince' hold an empty
+// entry in place of a deleted one, and 'Snapshot' and 'CloneVersion' keep the entry deleted. Rolling back past
+// a deleted entry undoes the deletion, as the ID is then reused.
+//
+// The chunk holding the entry is synced first, if it needs it, so that the entry is never lost while its deletion
+// survives. Deleting an entry which is already deleted does nothing. Returns 'ErrIDOutOfRange' if the ID is not in
+// the log, a 'SyncError' value if the chunk can't be synced, and a 'WriteError' value if the "tombstones" file
+// can't be written, in which case the entry is not deleted.
+func (db *LockFreeChunkDB) Delete(id uint64) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	c, err := db.chunkFor(id)
+	if err != nil {
+		return err
+	}
+	if db.isDeleted(id) {
+		return nil
+	}
+
+	// The entry must be durable before its tombstone is, or a crash could lose the entry but keep the
+	// tombstone, which would then apply to whatever entry is next given the ID.
+	if err := db.syncOne(c); err != nil {
+		db.noteReadOnly(err)
+		return err
+	}
+
+	if db.tombstones == nil {
+		db.tombstones = make(map[uint64]struct{})
+	}
+	db.tombstones[id] = struct{}{}
+	if err := db.writeTombstones(); err != nil {
+		delete(db.tombstones, id)
+		db.noteReadOnly(err)
+		return err
+	}
+	db.cache.remove(id, id+1)
+	return nil
+}
+
+// Check if an entry has been deleted. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) isDeleted(id uint64) bool {
+	_, ok := db.tombstones[id]
+	return ok
+}
+
+// Undo the deletion of the entries from the given ID onwards, as they are being rolled back. The "tombstones"
+// file is rewritten by the next sync, along with the chunk metadata. Assumes a write lock is held.
+func (db *LockFreeChunkDB) dropTombstonesFrom(id uint64) {
+	for tid := range db.tombstones {
+		if tid >= id {
+			delete(db.tombstones, tid)
+			db.tombstonesDirty = true
+		}
+	}
+}
+
+// Forget the tombstones of IDs which aren't in the log, such as those of entries which were never synced and so
+// were lost when the database was closed without syncing. Otherwise, an entry appended later with one of those IDs
+// would be deleted from the start. Assumes a write lock is held.
+func (db *LockFreeChunkDB) dropStaleTombstones() {
+	for id := range db.tombstones {
+		if id < db.oldest || id >= db.next() {
+			delete(db.tombstones, id)
+		}
+	}
+}
+
+// Replace the "tombstones" file with the IDs of the deleted entries which are still in the log. Assumes a write
+// lock is held.
+func (db *LockFreeChunkDB) writeTombstones() error {
+	ids := db.tombstoneIDs()
+	if err := replaceFile(db.fs, filepath.Join(db.path, tombstonesFile), tombstonesTmpFile, ids); err != nil {
+		_ = db.fs.Remove(filepath.Join(db.path, tombstonesTmpFile))
+		return &WriteError{err}
+	}
+	db.tombstonesDirty = false
+	return nil
+}
+
+// Get the IDs of the deleted entries which are still in the log, in order. Assumes a lock (read or write) is
+// held.
+func (db *LockFreeChunkDB) tombstoneIDs() []uint64 {
+	ids := make([]uint64, 0, len(db.tombstones))
+	for id := range db.tombstones {
+		if id >= db.oldest && id < db.next() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(idSlice(ids))
+	return ids
+}
+
+// Get a copy of the bytes of a chunk with the deleted entries zeroed, or the bytes themselves if none of its
+// entries are deleted. Assumes a lock (read or write) is held.
+func (db *LockFreeChunkDB) blankDeleted(c *chunk, bytes []byte) []byte {
+	copied := false
+	for id := range db.tombstones {
+		if id < c.oldest || id >= c.next() {
+			continue
+		}
+		if !copied {
+			bytes = append([]byte(nil), bytes...)
+			copied = true
+		}
+		start, end := c.entryRange(id - c.oldest)
+		for i := start; i < end; i++ {
+			bytes[i] = 0
+		}
+	}
+	return bytes
+}
+
+// Read the "tombstones" file of the database at the given path. Returns an empty set if there is no such file,
+// and 'ErrCorrupt' if it holds a partial ID.
+func readTombstones(fs FileSystem, path string) (map[uint64]struct{}, error) {
+	file, err := fs.OpenFile(filepath.Join(path, tombstonesFile), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bs, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTombstones(bs)
+}
+
+// Decode the contents of a "tombstones" file. Returns 'ErrCorrupt' if it holds a partial ID.
+func decodeTombstones(bs []byte) (map[uint64]struct{}, error) {
+	if len(bs)%8 != 0 {
+		return nil, ErrCorrupt
+	}
+	tombstones := make(map[uint64]struct{}, len(bs)/8)
+	for i := 0; i < len(bs); i += 8 {
+		tombstones[binary.LittleEndian.Uint64(bs[i:])] = struct{}{}
+	}
+	return tombstones, nil
+}